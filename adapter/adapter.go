@@ -11,6 +11,8 @@ type HttpClient interface {
 }
 
 type Adapter interface {
+	// Name is kept in the catalog, e.g. "reddit"
+	Name() string
 	Match(link *opb.Link) bool
 	Get(link *opb.Link) ([]*opb.Object, error)
 }
@@ -49,6 +49,10 @@ func NewAdapter(client adapter.HttpClient) adapter.Adapter {
 	}
 }
 
+func (fca *fourchanAdapter) Name() string {
+	return "fourchan"
+}
+
 func (fca *fourchanAdapter) Match(link *opb.Link) bool {
 	u, err := url.Parse(link.Href)
 	if err != nil {
@@ -41,6 +41,10 @@ func (pa *pikabuAdapter) getPostId(link *opb.Link) string {
 	return maybeId[0][1]
 }
 
+func (pa *pikabuAdapter) Name() string {
+	return "pikabu"
+}
+
 func (pa *pikabuAdapter) Match(link *opb.Link) bool {
 	_, err := url.Parse(link.Href)
 	if err != nil {
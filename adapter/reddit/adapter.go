@@ -30,6 +30,10 @@ func NewAdapter(client adapter.HttpClient, auth *RedditAuth) adapter.Adapter {
 	}
 }
 
+func (ta *redditAdapter) Name() string {
+	return "reddit"
+}
+
 func (ta *redditAdapter) Match(link *opb.Link) bool {
 	postDef := ParseLink(link.Href)
 	return postDef.PostId != "" && postDef.Subreddit != ""
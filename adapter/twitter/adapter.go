@@ -79,6 +79,10 @@ func NewAdapter(client Client) adapter.Adapter {
 	}
 }
 
+func (ta *twitterAdapter) Name() string {
+	return "twitter"
+}
+
 func (ta *twitterAdapter) Match(link *opb.Link) bool {
 	return extractId(link.Href) != ""
 }
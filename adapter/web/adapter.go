@@ -48,6 +48,10 @@ func NewAdapter(client adapter.HttpClient) adapter.Adapter {
 	}
 }
 
+func (wa *webAdapter) Name() string {
+	return "web"
+}
+
 func (wa *webAdapter) Match(link *opb.Link) bool {
 	u, err := url.Parse(link.Href)
 	if err != nil {
@@ -0,0 +1,373 @@
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"chronicler/common"
+	"chronicler/storage"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	bundleVersion  = 1
+	bundleManifest = "manifest.json"
+	bundleBlobs    = "blobs"
+)
+
+// BundleManifest is the first file of the bundle, it describes every item
+// and version, the contents are stored once per sha256 in blobs/{sha256}.
+type BundleManifest struct {
+	Version  int              `json:"version"`
+	Created  int64            `json:"created"`
+	Storages []*BundleStorage `json:"storages"`
+}
+
+type BundleStorage struct {
+	Id    string        `json:"id"`
+	Items []*BundleItem `json:"items"`
+}
+
+type BundleItem struct {
+	Url string `json:"url"`
+	// Oldest version first, the latest content last
+	History []*BundleFile `json:"history"`
+}
+
+type BundleFile struct {
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+
+	version string
+}
+
+var (
+	sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// validate checks the ids and hashes of the manifest, they become paths of
+// the storages and the extracted blobs.
+func (bm *BundleManifest) validate() error {
+	for _, bundled := range bm.Storages {
+		if !common.IsUUID(bundled.Id) {
+			return fmt.Errorf("bundle has invalid storage id %q", bundled.Id)
+		}
+		for _, item := range bundled.Items {
+			for _, file := range item.History {
+				if !sha256Pattern.MatchString(file.Sha256) {
+					return fmt.Errorf("bundle has invalid sha256 %q for %q", file.Sha256, item.Url)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type Bundler struct {
+	storages storage.Provider
+	logger   *common.Logger
+}
+
+func NewBundler(storages storage.Provider) *Bundler {
+	return &Bundler{
+		storages: storages,
+		logger:   common.NewLogger("Bundler"),
+	}
+}
+
+func (b *Bundler) manifest(ids []string) (*BundleManifest, error) {
+	manifest := &BundleManifest{Version: bundleVersion, Created: time.Now().Unix()}
+	for _, id := range ids {
+		s, err := b.storages.Open(id)
+		if err != nil {
+			return nil, err
+		}
+		list, err := s.List(&storage.ListRequest{WithSnapshots: true})
+		if err != nil {
+			return nil, err
+		}
+		bundled := &BundleStorage{Id: id}
+		for _, item := range list.Items {
+			bundledItem := &BundleItem{Url: item.Url}
+			for _, version := range history(item) {
+				hash, size, err := readHash(s, item.Url, version)
+				if err != nil {
+					b.logger.Warningf("Skipping %s %q %s: %s", id, item.Url, version, err)
+					continue
+				}
+				bundledItem.History = append(bundledItem.History, &BundleFile{Sha256: hash, Size: size, version: version})
+			}
+			if len(bundledItem.History) > 0 {
+				bundled.Items = append(bundled.Items, bundledItem)
+			}
+		}
+		manifest.Storages = append(manifest.Storages, bundled)
+	}
+	return manifest, nil
+}
+
+// Write packs the storages with the given ids, all of them if ids is empty.
+func (b *Bundler) Write(target io.Writer, ids []string) (*BundleManifest, error) {
+	if len(ids) == 0 {
+		all, err := b.storages.List()
+		if err != nil {
+			return nil, err
+		}
+		ids = all
+	}
+	manifest, err := b.manifest(ids)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	tw := tar.NewWriter(target)
+	if err := tw.WriteHeader(&tar.Header{Name: bundleManifest, Mode: 0644, Size: int64(len(data))}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return nil, err
+	}
+	written := map[string]bool{}
+	for _, bundled := range manifest.Storages {
+		s, err := b.storages.Open(bundled.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range bundled.Items {
+			for _, file := range item.History {
+				if written[file.Sha256] {
+					continue
+				}
+				if err := b.writeBlob(tw, s, item.Url, file); err != nil {
+					return nil, err
+				}
+				written[file.Sha256] = true
+			}
+		}
+	}
+	return manifest, tw.Close()
+}
+
+func (b *Bundler) writeBlob(tw *tar.Writer, s storage.Storage, url string, file *BundleFile) error {
+	reader, err := s.Get(&storage.GetRequest{Url: url, Version: file.version})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	header := &tar.Header{Name: path.Join(bundleBlobs, file.Sha256), Mode: 0644, Size: file.Size}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	digest := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, digest), reader); err != nil {
+		return fmt.Errorf("cannot pack %q: %w", url, err)
+	}
+	if hex.EncodeToString(digest.Sum(nil)) != file.Sha256 {
+		return fmt.Errorf("%q changed while packing", url)
+	}
+	return nil
+}
+
+// Read merges the bundle into the storages: histories of the same snapshot
+// are kept both and the identical contents are stored once.
+func (b *Bundler) Read(source io.Reader) (*MergeStats, error) {
+	tmpDir, err := os.MkdirTemp("", "chronicler-bundle")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tr := tar.NewReader(source)
+	header, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read bundle: %w", err)
+	}
+	if header.Name != bundleManifest {
+		return nil, fmt.Errorf("bundle should start with %s, but starts with %s", bundleManifest, header.Name)
+	}
+	manifest := &BundleManifest{}
+	if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("cannot read bundle manifest: %w", err)
+	}
+	if manifest.Version > bundleVersion {
+		return nil, fmt.Errorf("bundle version %d is newer than supported %d", manifest.Version, bundleVersion)
+	}
+	if err := manifest.validate(); err != nil {
+		return nil, err
+	}
+	sizes := map[string]int64{}
+	for _, bundled := range manifest.Storages {
+		for _, item := range bundled.Items {
+			for _, file := range item.History {
+				sizes[file.Sha256] = file.Size
+			}
+		}
+	}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read bundle: %w", err)
+		}
+		hash, ok := strings.CutPrefix(header.Name, bundleBlobs+"/")
+		size, known := sizes[hash]
+		if !ok || !known {
+			b.logger.Warningf("Skipping unknown file %q", header.Name)
+			continue
+		}
+		if err := extractBlob(tr, filepath.Join(tmpDir, hash), hash, size); err != nil {
+			return nil, err
+		}
+	}
+
+	stats := &MergeStats{}
+	for _, bundled := range manifest.Storages {
+		s, err := b.storages.Open(bundled.Id)
+		if err != nil {
+			return stats, err
+		}
+		for _, item := range bundled.Items {
+			incoming := []string{}
+			for _, file := range item.History {
+				incoming = append(incoming, file.Sha256)
+			}
+			err := mergeHistory(s, item.Url, incoming, func(i int) (io.ReadCloser, error) {
+				return os.Open(filepath.Join(tmpDir, incoming[i]))
+			}, stats)
+			if err != nil {
+				return stats, fmt.Errorf("cannot merge %s %q: %w", bundled.Id, item.Url, err)
+			}
+			stats.Items++
+		}
+		stats.Storages++
+	}
+	return stats, nil
+}
+
+// extractBlob writes the blob only if it matches the hash and the size from
+// the manifest, so damaged content never reaches the storages.
+func extractBlob(reader io.Reader, target string, hash string, size int64) error {
+	file, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	digest := sha256.New()
+	written, err := io.Copy(io.MultiWriter(file, digest), reader)
+	if err == nil {
+		if got := hex.EncodeToString(digest.Sum(nil)); got != hash || written != size {
+			err = fmt.Errorf("bundled blob %s is damaged: sha256 %s and size %d, want size %d", hash, got, written, size)
+		}
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(target)
+		return err
+	}
+	return file.Close()
+}
+
+type multiCloser struct {
+	io.WriteCloser
+
+	writer  io.Writer
+	closers []io.Closer
+}
+
+func (mc *multiCloser) Write(data []byte) (int, error) {
+	return mc.writer.Write(data)
+}
+
+func (mc *multiCloser) Close() error {
+	var result error
+	for _, c := range mc.closers {
+		if err := c.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// CreateBundleFile compresses the bundle by the file extension: .tar.zst,
+// .tar.gz (.tgz) or plain .tar.
+func CreateBundleFile(name string) (io.WriteCloser, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasSuffix(name, ".zst"):
+		zw, err := zstd.NewWriter(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &multiCloser{writer: zw, closers: []io.Closer{zw, file}}, nil
+	case strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz"):
+		gw := gzip.NewWriter(file)
+		return &multiCloser{writer: gw, closers: []io.Closer{gw, file}}, nil
+	}
+	return file, nil
+}
+
+type readCloser struct {
+	io.ReadCloser
+
+	reader io.Reader
+	close  func() error
+}
+
+func (rc *readCloser) Read(data []byte) (int, error) {
+	return rc.reader.Read(data)
+}
+
+func (rc *readCloser) Close() error {
+	return rc.close()
+}
+
+func OpenBundleFile(name string) (io.ReadCloser, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasSuffix(name, ".zst"):
+		zr, err := zstd.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &readCloser{reader: zr, close: func() error {
+			zr.Close()
+			return file.Close()
+		}}, nil
+	case strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz"):
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &readCloser{reader: gr, close: func() error {
+			gr.Close()
+			return file.Close()
+		}}, nil
+	}
+	return file, nil
+}
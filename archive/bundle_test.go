@@ -0,0 +1,212 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"chronicler/storage"
+)
+
+func TestBundle(t *testing.T) {
+	from := storage.NewMemoryProvider(nil)
+	s, _ := from.Open("00000000-0000-4000-8000-000000000001")
+	putAll(t, s, "snapshot.json", "first", "second")
+	putAll(t, s, "http://some/image.jpg", "image")
+	putAll(t, s, "http://some/copy.jpg", "image")
+	other, _ := from.Open("00000000-0000-4000-8000-000000000002")
+	putAll(t, other, "snapshot.json", "other")
+
+	buffer := &bytes.Buffer{}
+	manifest, err := NewBundler(from).Write(buffer, []string{"00000000-0000-4000-8000-000000000001"})
+	if err != nil {
+		t.Fatalf("Cannot write bundle: %s", err)
+	}
+	if len(manifest.Storages) != 1 || len(manifest.Storages[0].Items) != 3 {
+		t.Errorf("Expected one storage with 3 items, but got %v", manifest.Storages)
+	}
+
+	t.Run("into empty", func(t *testing.T) {
+		to := storage.NewMemoryProvider(nil)
+		stats, err := NewBundler(to).Read(bytes.NewReader(buffer.Bytes()))
+		if err != nil {
+			t.Fatalf("Cannot read bundle: %s", err)
+		}
+		if want := (&MergeStats{Storages: 1, Items: 3, Added: 4, Bytes: 21}); !reflect.DeepEqual(stats, want) {
+			t.Errorf("Expected stats %v, but got %v", want, stats)
+		}
+		s, _ := to.Open("00000000-0000-4000-8000-000000000001")
+		want := map[string][]string{
+			"snapshot.json":         {"first", "second"},
+			"http://some/image.jpg": {"image"},
+			"http://some/copy.jpg":  {"image"},
+		}
+		if got := readAll(t, s); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v, but got %v", want, got)
+		}
+	})
+
+	t.Run("merge with existing", func(t *testing.T) {
+		to := storage.NewMemoryProvider(nil)
+		s, _ := to.Open("00000000-0000-4000-8000-000000000001")
+		putAll(t, s, "snapshot.json", "first", "local")
+		putAll(t, s, "http://some/image.jpg", "image")
+
+		stats, err := NewBundler(to).Read(bytes.NewReader(buffer.Bytes()))
+		if err != nil {
+			t.Fatalf("Cannot read bundle: %s", err)
+		}
+		if stats.Added != 2 || stats.Skipped != 2 {
+			t.Errorf("Expected 2 added and 2 skipped, but got %v", stats)
+		}
+		want := map[string][]string{
+			"snapshot.json":         {"first", "local", "second"},
+			"http://some/image.jpg": {"image"},
+			"http://some/copy.jpg":  {"image"},
+		}
+		if got := readAll(t, s); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v, but got %v", want, got)
+		}
+	})
+}
+
+func TestBundleOldSnapshot(t *testing.T) {
+	from := storage.NewMemoryProvider(nil)
+	s, _ := from.Open("00000000-0000-4000-8000-000000000001")
+	putAll(t, s, "snapshot.json", firstSnapshot)
+	buffer := &bytes.Buffer{}
+	if _, err := NewBundler(from).Write(buffer, nil); err != nil {
+		t.Fatalf("Cannot write bundle: %s", err)
+	}
+
+	to := storage.NewMemoryProvider(nil)
+	s, _ = to.Open("00000000-0000-4000-8000-000000000001")
+	putAll(t, s, "snapshot.json", nasSnapshot)
+	if _, err := NewBundler(to).Read(bytes.NewReader(buffer.Bytes())); err != nil {
+		t.Fatalf("Cannot read bundle: %s", err)
+	}
+	if got, want := readAll(t, s)["snapshot.json"], []string{nasSnapshot, firstSnapshot, nasSnapshot}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the imported snapshot before the newer one %q, but got %q", want, got)
+	}
+}
+
+func TestBundleInvalidManifest(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		manifest *BundleManifest
+	}{
+		{
+			name:     "id outside of the root",
+			manifest: &BundleManifest{Storages: []*BundleStorage{{Id: "../escaped"}}},
+		},
+		{
+			name: "blob outside of the bundle",
+			manifest: &BundleManifest{Storages: []*BundleStorage{{
+				Id:    "00000000-0000-4000-8000-000000000001",
+				Items: []*BundleItem{{Url: "snapshot.json", History: []*BundleFile{{Sha256: "../../etc/passwd"}}}},
+			}}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, _ := json.Marshal(tc.manifest)
+			buffer := &bytes.Buffer{}
+			tw := tar.NewWriter(buffer)
+			tw.WriteHeader(&tar.Header{Name: bundleManifest, Mode: 0644, Size: int64(len(data))})
+			tw.Write(data)
+			tw.Close()
+
+			root := t.TempDir()
+			if _, err := NewBundler(storage.NewLocalProvider(filepath.Join(root, "data"))).Read(buffer); err == nil {
+				t.Errorf("Expected invalid manifest to be rejected")
+			}
+			if _, err := os.Stat(filepath.Join(root, "escaped")); err == nil {
+				t.Errorf("Expected no storage outside of the root")
+			}
+		})
+	}
+}
+
+func TestBundleDamagedBlob(t *testing.T) {
+	sum := sha256.Sum256([]byte("good"))
+	hash := hex.EncodeToString(sum[:])
+
+	t.Run("bundle", func(t *testing.T) {
+		data, _ := json.Marshal(&BundleManifest{Storages: []*BundleStorage{{
+			Id:    "00000000-0000-4000-8000-000000000001",
+			Items: []*BundleItem{{Url: "snapshot.json", History: []*BundleFile{{Sha256: hash, Size: 4}}}},
+		}}})
+		buffer := &bytes.Buffer{}
+		tw := tar.NewWriter(buffer)
+		tw.WriteHeader(&tar.Header{Name: bundleManifest, Mode: 0644, Size: int64(len(data))})
+		tw.Write(data)
+		tw.WriteHeader(&tar.Header{Name: bundleBlobs + "/" + hash, Mode: 0644, Size: 4})
+		tw.Write([]byte("evil"))
+		tw.Close()
+
+		to := storage.NewMemoryProvider(nil)
+		if _, err := NewBundler(to).Read(buffer); err == nil {
+			t.Errorf("Expected damaged blob to be rejected")
+		}
+		s, _ := to.Open("00000000-0000-4000-8000-000000000001")
+		if got := readAll(t, s); len(got) != 0 {
+			t.Errorf("Expected nothing to be imported, but got %v", got)
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		s, _ := storage.NewMemoryProvider(nil).Open("00000000-0000-4000-8000-000000000001")
+		putAll(t, s, "http://some/image.jpg", "image")
+		err := mergeHistory(s, "http://some/image.jpg", []string{hash}, func(i int) (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader("evil")), nil
+		}, &MergeStats{})
+		if err == nil {
+			t.Errorf("Expected different content to be rejected")
+		}
+		want := map[string][]string{"http://some/image.jpg": {"image"}}
+		if got := readAll(t, s); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v, but got %v", want, got)
+		}
+	})
+}
+
+func TestBundleFile(t *testing.T) {
+	from := storage.NewMemoryProvider(nil)
+	s, _ := from.Open("00000000-0000-4000-8000-000000000001")
+	putAll(t, s, "snapshot.json", "first", "second")
+
+	for _, name := range []string{"bundle.tar.zst", "bundle.tar.gz", "bundle.tar"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			writer, err := CreateBundleFile(path)
+			if err != nil {
+				t.Fatalf("Cannot create bundle: %s", err)
+			}
+			if _, err := NewBundler(from).Write(writer, nil); err != nil {
+				t.Errorf("Cannot write bundle: %s", err)
+			}
+			writer.Close()
+
+			reader, err := OpenBundleFile(path)
+			if err != nil {
+				t.Fatalf("Cannot open bundle: %s", err)
+			}
+			defer reader.Close()
+			to := storage.NewMemoryProvider(nil)
+			if _, err := NewBundler(to).Read(reader); err != nil {
+				t.Errorf("Cannot read bundle: %s", err)
+			}
+			s, _ := to.Open("00000000-0000-4000-8000-000000000001")
+			if got, want := readAll(t, s), map[string][]string{"snapshot.json": {"first", "second"}}; !reflect.DeepEqual(got, want) {
+				t.Errorf("Expected %v, but got %v", want, got)
+			}
+		})
+	}
+}
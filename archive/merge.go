@@ -0,0 +1,181 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"chronicler/storage"
+)
+
+const (
+	snapshotObject = "snapshot.json"
+)
+
+type MergeStats struct {
+	Storages int
+	Items    int
+	Added    int
+	Skipped  int
+	Bytes    int64
+}
+
+// history returns versions of the item oldest first, "" is the latest content.
+func history(item storage.StorageItem) []string {
+	result := append([]string{}, item.Versions...)
+	sort.Strings(result)
+	return append(result, "")
+}
+
+// historyHashes reads sha256 of every version of the url, oldest first.
+func historyHashes(s storage.Storage, url string) ([]string, error) {
+	list, err := s.List(&storage.ListRequest{Url: []string{url}, WithSnapshots: true})
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Items) == 0 {
+		return []string{}, nil
+	}
+	result := []string{}
+	for _, version := range history(list.Items[0]) {
+		hash, _, err := readHash(s, url, version)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, hash)
+	}
+	return result, nil
+}
+
+// fetchTime returns the fetch time of the snapshot in nanoseconds, other
+// files and unreadable snapshots have no time and keep the merge order.
+func fetchTime(url string, open func() (io.ReadCloser, error)) (int64, error) {
+	if url != snapshotObject {
+		return 0, nil
+	}
+	reader, err := open()
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return 0, err
+	}
+	snapshot, err := storage.UnmarshalSnapshot(data)
+	if err != nil || snapshot.FetchTime == nil {
+		return 0, nil
+	}
+	return snapshot.FetchTime.Seconds*int64(time.Second) + int64(snapshot.FetchTime.Nanos), nil
+}
+
+// mergeHistory appends incoming versions which are not in the target yet,
+// so both histories are kept and identical contents are stored once. The
+// added versions are ordered by the fetch time and the newest snapshot stays
+// the latest content. The open function returns the content of incoming[i].
+func mergeHistory(to storage.Storage, url string, incoming []string, open func(i int) (io.ReadCloser, error), stats *MergeStats) error {
+	existing, err := historyHashes(to, url)
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, hash := range existing {
+		known[hash] = true
+	}
+	missing := []int{}
+	times := map[int]int64{}
+	for i, hash := range incoming {
+		if known[hash] {
+			stats.Skipped++
+			continue
+		}
+		known[hash] = true
+		if times[i], err = fetchTime(url, func() (io.ReadCloser, error) { return open(i) }); err != nil {
+			return err
+		}
+		missing = append(missing, i)
+	}
+	sort.SliceStable(missing, func(a, b int) bool {
+		return times[missing[a]] < times[missing[b]]
+	})
+
+	// Versions older than the latest content of the target are written after
+	// it is saved as a version, then the content is written again to stay the
+	// latest one.
+	older := 0
+	var current []byte
+	if len(existing) > 0 && len(missing) > 0 {
+		currentTime, err := fetchTime(url, func() (io.ReadCloser, error) {
+			return to.Get(&storage.GetRequest{Url: url})
+		})
+		if err != nil {
+			return err
+		}
+		for older < len(missing) && times[missing[older]] < currentTime {
+			older++
+		}
+		if older > 0 {
+			if current, err = (&storage.BlockStorage{Storage: to}).GetBytes(&storage.GetRequest{Url: url}); err != nil {
+				return err
+			}
+		}
+	}
+	restore := func() error {
+		_, err := (&storage.BlockStorage{Storage: to}).PutBytes(&storage.PutRequest{Url: url, SaveOnOverwrite: true}, current)
+		return err
+	}
+	save := len(existing) > 0
+	for n, i := range missing {
+		if err := writeVersion(to, url, incoming[i], save, func() (io.ReadCloser, error) { return open(i) }, stats); err != nil {
+			// The failed version is dropped, but an older one may be the
+			// latest content by now
+			if n > 0 && n < older {
+				if restoreErr := restore(); restoreErr != nil {
+					return errors.Join(err, restoreErr)
+				}
+			}
+			return err
+		}
+		save = true
+		if n == older-1 {
+			if err := restore(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeVersion(to storage.Storage, url string, hash string, save bool, open func() (io.ReadCloser, error), stats *MergeStats) error {
+	reader, err := open()
+	if err != nil {
+		return err
+	}
+	writer, err := to.Put(&storage.PutRequest{Url: url, SaveOnOverwrite: save})
+	if err != nil {
+		reader.Close()
+		return err
+	}
+	digest := sha256.New()
+	size, err := io.Copy(io.MultiWriter(writer, digest), reader)
+	reader.Close()
+	if err == nil {
+		if got := hex.EncodeToString(digest.Sum(nil)); got != hash {
+			err = fmt.Errorf("content of %q is different: sha256 %s, want %s", url, got, hash)
+		}
+	}
+	if err != nil {
+		storage.CloseWithError(writer, err)
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	stats.Added++
+	stats.Bytes += size
+	return nil
+}
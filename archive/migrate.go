@@ -0,0 +1,236 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"chronicler/common"
+	"chronicler/storage"
+)
+
+type MigrateStats struct {
+	Storages int
+	Items    int
+	Versions int
+	Skipped  int
+	Bytes    int64
+}
+
+// migrationState is saved after every copied item, so the interrupted
+// migration can continue from where it stopped. It is only valid for the
+// same storages.
+type migrationState struct {
+	From string                     `json:"from"`
+	To   string                     `json:"to"`
+	Done map[string]map[string]bool `json:"done"`
+}
+
+// Migrator copies every item with all its versions from one storage provider
+// to another, checking that the copy reads back with the same sha256.
+type Migrator struct {
+	from      storage.Provider
+	to        storage.Provider
+	statePath string
+	state     *migrationState
+	logger    *common.Logger
+}
+
+// NewMigrator resumes the migration from the state file, the specs describe
+// both storages and the state of other storages is refused.
+func NewMigrator(from storage.Provider, to storage.Provider, statePath string, fromSpec string, toSpec string) (*Migrator, error) {
+	m := &Migrator{
+		from:      from,
+		to:        to,
+		statePath: statePath,
+		state:     &migrationState{From: fromSpec, To: toSpec, Done: map[string]map[string]bool{}},
+		logger:    common.NewLogger("Migrator"),
+	}
+	if statePath == "" {
+		return m, nil
+	}
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, err
+	}
+	state := &migrationState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("cannot read migration state %q: %w", statePath, err)
+	}
+	if state.From != fromSpec || state.To != toSpec {
+		return nil, fmt.Errorf("migration state %q is for %q to %q, remove it to migrate %q to %q",
+			statePath, state.From, state.To, fromSpec, toSpec)
+	}
+	if state.Done != nil {
+		m.state.Done = state.Done
+	}
+	return m, nil
+}
+
+func (m *Migrator) saveState() error {
+	if m.statePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(m.state)
+	if err != nil {
+		return err
+	}
+	tmpPath := m.statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, m.statePath)
+}
+
+func readHash(s storage.Storage, url string, version string) (string, int64, error) {
+	reader, err := s.Get(&storage.GetRequest{Url: url, Version: version})
+	if err != nil {
+		return "", -1, err
+	}
+	defer reader.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, reader)
+	if err != nil {
+		return "", -1, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+func copyEntry(from storage.Storage, to storage.Storage, url string, version string, saveOnOverwrite bool) (int64, error) {
+	reader, err := from.Get(&storage.GetRequest{Url: url, Version: version})
+	if err != nil {
+		return -1, err
+	}
+	defer reader.Close()
+	writer, err := to.Put(&storage.PutRequest{Url: url, SaveOnOverwrite: saveOnOverwrite})
+	if err != nil {
+		return -1, err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(writer, hash), reader)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return -1, err
+	}
+	copied, copiedSize, err := readHash(to, url, "")
+	if err != nil {
+		return -1, fmt.Errorf("cannot read back %q: %w", url, err)
+	}
+	if want := hex.EncodeToString(hash.Sum(nil)); copied != want || copiedSize != size {
+		return -1, fmt.Errorf("copy of %q is different: sha256 %s, want %s", url, copied, want)
+	}
+	return size, nil
+}
+
+// migrateItem copies versions in order and the latest content last, so the
+// target storage rotates them into the same history. Entries already copied
+// by an interrupted migration are checked and skipped.
+func (m *Migrator) migrateItem(from storage.Storage, to storage.Storage, item storage.StorageItem, existing *storage.StorageItem, stats *MigrateStats) error {
+	entries := history(item)
+
+	copied := 0
+	if existing != nil {
+		copied = len(existing.Versions) + 1
+		if copied > len(entries) {
+			return fmt.Errorf("target has more versions of %q than the source", item.Url)
+		}
+		for i, version := range history(*existing) {
+			want, _, err := readHash(from, item.Url, entries[i])
+			if err != nil {
+				return err
+			}
+			got, _, err := readHash(to, item.Url, version)
+			if err != nil {
+				return err
+			}
+			if got != want {
+				return fmt.Errorf("target already has different content for %q", item.Url)
+			}
+		}
+	}
+	for i := copied; i < len(entries); i++ {
+		size, err := copyEntry(from, to, item.Url, entries[i], i > 0)
+		if err != nil {
+			return err
+		}
+		stats.Bytes += size
+		if entries[i] != "" {
+			stats.Versions++
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) migrateStorage(id string, stats *MigrateStats) error {
+	from, err := m.from.Open(id)
+	if err != nil {
+		return err
+	}
+	to, err := m.to.Open(id)
+	if err != nil {
+		return err
+	}
+	list, err := from.List(&storage.ListRequest{WithSnapshots: true})
+	if err != nil {
+		return err
+	}
+	existingList, err := to.List(&storage.ListRequest{WithSnapshots: true})
+	if err != nil {
+		return err
+	}
+	existing := map[string]*storage.StorageItem{}
+	for i, item := range existingList.Items {
+		existing[item.Url] = &existingList.Items[i]
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].Url < list.Items[j].Url
+	})
+	if m.state.Done[id] == nil {
+		m.state.Done[id] = map[string]bool{}
+	}
+	for _, item := range list.Items {
+		if m.state.Done[id][item.Url] {
+			stats.Skipped++
+			continue
+		}
+		m.logger.Debugf("Copying %s %q with %d versions", id, item.Url, len(item.Versions))
+		if err := m.migrateItem(from, to, item, existing[item.Url], stats); err != nil {
+			return fmt.Errorf("cannot migrate %q: %w", item.Url, err)
+		}
+		stats.Items++
+		m.state.Done[id][item.Url] = true
+		if err := m.saveState(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Migrate copies the storages with the given ids, all of them if ids is empty.
+func (m *Migrator) Migrate(ids []string) (*MigrateStats, error) {
+	if len(ids) == 0 {
+		all, err := m.from.List()
+		if err != nil {
+			return nil, err
+		}
+		ids = all
+	}
+	stats := &MigrateStats{}
+	for _, id := range ids {
+		m.logger.Infof("Migrating %s", id)
+		if err := m.migrateStorage(id, stats); err != nil {
+			return stats, fmt.Errorf("cannot migrate %s: %w", id, err)
+		}
+		stats.Storages++
+	}
+	return stats, nil
+}
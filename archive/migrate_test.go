@@ -0,0 +1,117 @@
+package archive
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"chronicler/storage"
+)
+
+func putAll(t *testing.T, s storage.Storage, url string, contents ...string) {
+	bs := &storage.BlockStorage{Storage: s}
+	for _, content := range contents {
+		if _, err := bs.PutBytes(&storage.PutRequest{Url: url, SaveOnOverwrite: true}, []byte(content)); err != nil {
+			t.Fatalf("Cannot write %q: %s", url, err)
+		}
+	}
+}
+
+// readAll returns the contents of every item, versions first
+func readAll(t *testing.T, s storage.Storage) map[string][]string {
+	list, err := s.List(&storage.ListRequest{WithSnapshots: true})
+	if err != nil {
+		t.Fatalf("Cannot list storage: %s", err)
+	}
+	bs := &storage.BlockStorage{Storage: s}
+	result := map[string][]string{}
+	for _, item := range list.Items {
+		sort.Strings(item.Versions)
+		for _, version := range append(item.Versions, "") {
+			data, err := bs.GetBytes(&storage.GetRequest{Url: item.Url, Version: version})
+			if err != nil {
+				t.Fatalf("Cannot read %q %q: %s", item.Url, version, err)
+			}
+			result[item.Url] = append(result[item.Url], string(data))
+		}
+	}
+	return result
+}
+
+func newSource(t *testing.T) storage.Provider {
+	from := storage.NewLocalProvider(t.TempDir())
+	s, err := from.Open("00000000-0000-4000-8000-000000000001")
+	if err != nil {
+		t.Fatalf("Cannot open storage: %s", err)
+	}
+	putAll(t, s, "snapshot.json", "first", "second", "third")
+	putAll(t, s, "http://some/image.jpg", "image")
+	return from
+}
+
+func TestMigrate(t *testing.T) {
+	want := map[string][]string{
+		"snapshot.json":         {"first", "second", "third"},
+		"http://some/image.jpg": {"image"},
+	}
+
+	t.Run("local to compressed", func(t *testing.T) {
+		from := newSource(t)
+		to := storage.NewCompressedProvider(storage.NewLocalProvider(t.TempDir()), storage.DefaultSkipMime)
+		m, err := NewMigrator(from, to, "", "local:from", "local+compress:to")
+		if err != nil {
+			t.Fatalf("Cannot create migrator: %s", err)
+		}
+		stats, err := m.Migrate(nil)
+		if err != nil {
+			t.Errorf("Cannot migrate: %s", err)
+		}
+		if wantStats := (&MigrateStats{Storages: 1, Items: 2, Versions: 2, Bytes: 21}); !reflect.DeepEqual(stats, wantStats) {
+			t.Errorf("Expected stats %v, but got %v", wantStats, stats)
+		}
+		s, _ := to.Open("00000000-0000-4000-8000-000000000001")
+		if got := readAll(t, s); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected migrated storage %v, but got %v", want, got)
+		}
+	})
+
+	t.Run("resume interrupted", func(t *testing.T) {
+		from := newSource(t)
+		to := storage.NewLocalProvider(t.TempDir())
+		s, _ := to.Open("00000000-0000-4000-8000-000000000001")
+		putAll(t, s, "snapshot.json", "first", "second")
+
+		statePath := filepath.Join(t.TempDir(), "state.json")
+		m, _ := NewMigrator(from, to, statePath, "local:from", "local:to")
+		if _, err := m.Migrate(nil); err != nil {
+			t.Errorf("Cannot migrate: %s", err)
+		}
+		s, _ = to.Open("00000000-0000-4000-8000-000000000001")
+		if got := readAll(t, s); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected migrated storage %v, but got %v", want, got)
+		}
+
+		m, _ = NewMigrator(from, to, statePath, "local:from", "local:to")
+		stats, err := m.Migrate([]string{"00000000-0000-4000-8000-000000000001"})
+		if err != nil || stats.Skipped != 2 || stats.Items != 0 {
+			t.Errorf("Expected everything to be skipped, but got %v (%v)", stats, err)
+		}
+
+		if _, err := NewMigrator(from, to, statePath, "local:from", "local:other"); err == nil {
+			t.Errorf("Expected the state of another migration to be refused")
+		}
+	})
+
+	t.Run("different target", func(t *testing.T) {
+		from := newSource(t)
+		to := storage.NewLocalProvider(t.TempDir())
+		s, _ := to.Open("00000000-0000-4000-8000-000000000001")
+		putAll(t, s, "snapshot.json", "other")
+
+		m, _ := NewMigrator(from, to, "", "local:from", "local:to")
+		if _, err := m.Migrate(nil); err == nil {
+			t.Errorf("Expected error when the target has different content")
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+
+	"chronicler/storage"
+)
+
+type SyncStats struct {
+	ToA *MergeStats
+	ToB *MergeStats
+}
+
+// mergeFrom adds versions of the url missing in the target, nothing in the
+// target is overwritten: the latest content is saved as a version first.
+func mergeFrom(from storage.Storage, to storage.Storage, url string, stats *MergeStats) error {
+	list, err := from.List(&storage.ListRequest{Url: []string{url}, WithSnapshots: true})
+	if err != nil {
+		return err
+	}
+	if len(list.Items) == 0 {
+		return nil
+	}
+	versions := history(list.Items[0])
+	incoming := []string{}
+	for _, version := range versions {
+		hash, _, err := readHash(from, url, version)
+		if err != nil {
+			return err
+		}
+		incoming = append(incoming, hash)
+	}
+	return mergeHistory(to, url, incoming, func(i int) (io.ReadCloser, error) {
+		return from.Get(&storage.GetRequest{Url: url, Version: versions[i]})
+	}, stats)
+}
+
+func listUrls(s storage.Storage) ([]string, error) {
+	list, err := s.List(&storage.ListRequest{})
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, item := range list.Items {
+		result = append(result, item.Url)
+	}
+	return result, nil
+}
+
+func union(a []string, b []string) []string {
+	result := append([]string{}, a...)
+	for _, value := range b {
+		if !slices.Contains(result, value) {
+			result = append(result, value)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Sync copies the versions missing in either of the providers, when both
+// have different versions of the same url, both histories are kept.
+func Sync(a storage.Provider, b storage.Provider, ids []string) (*SyncStats, error) {
+	if len(ids) == 0 {
+		idsA, err := a.List()
+		if err != nil {
+			return nil, err
+		}
+		idsB, err := b.List()
+		if err != nil {
+			return nil, err
+		}
+		ids = union(idsA, idsB)
+	}
+	stats := &SyncStats{ToA: &MergeStats{}, ToB: &MergeStats{}}
+	for _, id := range ids {
+		sa, err := a.Open(id)
+		if err != nil {
+			return stats, err
+		}
+		sb, err := b.Open(id)
+		if err != nil {
+			return stats, err
+		}
+		urlsA, err := listUrls(sa)
+		if err != nil {
+			return stats, err
+		}
+		urlsB, err := listUrls(sb)
+		if err != nil {
+			return stats, err
+		}
+		addedA, addedB := stats.ToA.Added, stats.ToB.Added
+		for _, url := range union(urlsA, urlsB) {
+			for _, direction := range []struct {
+				from  storage.Storage
+				to    storage.Storage
+				stats *MergeStats
+			}{{sb, sa, stats.ToA}, {sa, sb, stats.ToB}} {
+				added := direction.stats.Added
+				if err := mergeFrom(direction.from, direction.to, url, direction.stats); err != nil {
+					return stats, fmt.Errorf("cannot sync %s %q: %w", id, url, err)
+				}
+				if direction.stats.Added > added {
+					direction.stats.Items++
+				}
+			}
+		}
+		if stats.ToA.Added > addedA {
+			stats.ToA.Storages++
+		}
+		if stats.ToB.Added > addedB {
+			stats.ToB.Storages++
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,148 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"chronicler/storage"
+)
+
+// Snapshots fetched on the laptop and the nas after the first one
+const (
+	firstSnapshot  = `{"fetchTime":{"seconds":"100"}}`
+	laptopSnapshot = `{"fetchTime":{"seconds":"200"}}`
+	nasSnapshot    = `{"fetchTime":{"seconds":"300"}}`
+)
+
+func TestSync(t *testing.T) {
+	a := storage.NewMemoryProvider(nil)
+	b := storage.NewMemoryProvider(nil)
+	sa, _ := a.Open("00000000-0000-4000-8000-000000000003")
+	putAll(t, sa, "snapshot.json", firstSnapshot, laptopSnapshot)
+	putAll(t, sa, "http://some/image.jpg", "image")
+	sb, _ := b.Open("00000000-0000-4000-8000-000000000003")
+	putAll(t, sb, "snapshot.json", firstSnapshot, nasSnapshot)
+	putAll(t, sb, "http://some/image.jpg", "image")
+	putAll(t, sb, "http://some/video.mp4", "video")
+	onlyA, _ := a.Open("00000000-0000-4000-8000-000000000004")
+	putAll(t, onlyA, "snapshot.json", "a")
+
+	stats, err := Sync(a, b, nil)
+	if err != nil {
+		t.Fatalf("Cannot sync: %s", err)
+	}
+	if stats.ToA.Added != 2 || stats.ToA.Storages != 1 || stats.ToB.Added != 2 || stats.ToB.Storages != 2 {
+		t.Errorf("Unexpected stats %v %v", stats.ToA, stats.ToB)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		provider storage.Provider
+		id       string
+		want     map[string][]string
+	}{
+		{
+			name:     "laptop",
+			provider: a,
+			id:       "00000000-0000-4000-8000-000000000003",
+			want: map[string][]string{
+				"snapshot.json":         {firstSnapshot, laptopSnapshot, nasSnapshot},
+				"http://some/image.jpg": {"image"},
+				"http://some/video.mp4": {"video"},
+			},
+		},
+		{
+			name:     "nas",
+			provider: b,
+			id:       "00000000-0000-4000-8000-000000000003",
+			// The latest snapshot is saved before the older one is added
+			want: map[string][]string{
+				"snapshot.json":         {firstSnapshot, nasSnapshot, laptopSnapshot, nasSnapshot},
+				"http://some/image.jpg": {"image"},
+				"http://some/video.mp4": {"video"},
+			},
+		},
+		{
+			name:     "only on laptop",
+			provider: b,
+			id:       "00000000-0000-4000-8000-000000000004",
+			want:     map[string][]string{"snapshot.json": {"a"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := tc.provider.Open(tc.id)
+			if got := readAll(t, s); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected %v, but got %v", tc.want, got)
+			}
+		})
+	}
+
+	t.Run("same latest snapshot", func(t *testing.T) {
+		for _, p := range []storage.Provider{a, b} {
+			s, _ := p.Open("00000000-0000-4000-8000-000000000003")
+			data, err := (&storage.BlockStorage{Storage: s}).GetBytes(&storage.GetRequest{Url: "snapshot.json"})
+			if err != nil || string(data) != nasSnapshot {
+				t.Errorf("Expected the newest snapshot to be the latest, but got %q (%v)", data, err)
+			}
+		}
+	})
+
+	t.Run("nothing to do", func(t *testing.T) {
+		stats, err := Sync(a, b, nil)
+		if err != nil || stats.ToA.Added != 0 || stats.ToB.Added != 0 {
+			t.Errorf("Expected nothing to sync, but got %v %v (%v)", stats.ToA, stats.ToB, err)
+		}
+	})
+}
+
+func TestSyncLocalRoots(t *testing.T) {
+	roots := []string{t.TempDir(), t.TempDir()}
+	a := storage.NewLocalProvider(roots[0])
+	b := storage.NewLocalProvider(roots[1])
+	sa, _ := a.Open("00000000-0000-4000-8000-000000000003")
+	putAll(t, sa, "snapshot.json", nasSnapshot)
+	sb, _ := b.Open("00000000-0000-4000-8000-000000000003")
+	putAll(t, sb, "snapshot.json", firstSnapshot, laptopSnapshot)
+
+	if _, err := Sync(a, b, nil); err != nil {
+		t.Fatalf("Cannot sync: %s", err)
+	}
+	for i, want := range [][]string{
+		{nasSnapshot, firstSnapshot, laptopSnapshot, nasSnapshot},
+		{firstSnapshot, laptopSnapshot, nasSnapshot},
+	} {
+		s, _ := storage.NewLocalProvider(roots[i]).Open("00000000-0000-4000-8000-000000000003")
+		if got := readAll(t, s)["snapshot.json"]; !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected history %q in %s, but got %q", want, roots[i], got)
+		}
+	}
+}
+
+func TestMergeFailedOlderVersion(t *testing.T) {
+	s, _ := storage.NewMemoryProvider(nil).Open("00000000-0000-4000-8000-000000000003")
+	putAll(t, s, "snapshot.json", nasSnapshot)
+	incoming := []string{}
+	for _, content := range []string{firstSnapshot, laptopSnapshot} {
+		sum := sha256.Sum256([]byte(content))
+		incoming = append(incoming, hex.EncodeToString(sum[:]))
+	}
+	// The laptop snapshot is damaged after its fetch time is read
+	opened := 0
+	err := mergeHistory(s, "snapshot.json", incoming, func(i int) (io.ReadCloser, error) {
+		opened++
+		if i == 1 && opened > 2 {
+			return io.NopCloser(strings.NewReader(laptopSnapshot + " ")), nil
+		}
+		return io.NopCloser(strings.NewReader([]string{firstSnapshot, laptopSnapshot}[i])), nil
+	}, &MergeStats{})
+	if err == nil {
+		t.Errorf("Expected the damaged version to fail the merge")
+	}
+	if got, want := readAll(t, s)["snapshot.json"], []string{nasSnapshot, firstSnapshot, nasSnapshot}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected history %q with the newest snapshot kept, but got %q", want, got)
+	}
+}
@@ -0,0 +1,275 @@
+package catalog
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chronicler/common"
+	opb "chronicler/proto"
+	"chronicler/storage"
+)
+
+const (
+	defaultPerms   = 0777
+	catalogDir     = ".catalog"
+	catalogFile    = "catalog.json"
+	snapshotObject = "snapshot.json"
+)
+
+// Entry is a short description of a saved snapshot, enough to list and
+// filter snapshots without reading them.
+type Entry struct {
+	Id        string `json:"id"`
+	Link      string `json:"link"`
+	FetchTime int64  `json:"fetch_time"`
+	Adapter   string `json:"adapter"`
+	Objects   int    `json:"objects"`
+	Size      int64  `json:"size"`
+	Versions  int    `json:"versions"`
+}
+
+func (e *Entry) Host() string {
+	if u, err := url.Parse(e.Link); err == nil {
+		return u.Hostname()
+	}
+	return ""
+}
+
+func NewEntry(id string, snapshot *opb.Snapshot, adapter string, size int64) *Entry {
+	entry := &Entry{
+		Id:      id,
+		Adapter: adapter,
+		Objects: len(snapshot.Objects),
+		Size:    size,
+	}
+	if snapshot.Link != nil {
+		entry.Link = snapshot.Link.Href
+	}
+	if snapshot.FetchTime != nil {
+		entry.FetchTime = snapshot.FetchTime.Seconds
+	}
+	return entry
+}
+
+type Query struct {
+	Host    string
+	Adapter string
+	Since   time.Time
+	Until   time.Time
+	SortBy  string
+	Reverse bool
+}
+
+func (q *Query) matches(e *Entry) bool {
+	if q.Host != "" {
+		host := e.Host()
+		if host != q.Host && !strings.HasSuffix(host, "."+q.Host) {
+			return false
+		}
+	}
+	if q.Adapter != "" && e.Adapter != q.Adapter {
+		return false
+	}
+	fetchTime := time.Unix(e.FetchTime, 0)
+	if !q.Since.IsZero() && fetchTime.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !fetchTime.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+func (q *Query) less(a *Entry, b *Entry) bool {
+	switch q.SortBy {
+	case "link":
+		return a.Link < b.Link
+	case "size":
+		return a.Size < b.Size
+	case "objects":
+		return a.Objects < b.Objects
+	case "adapter":
+		return a.Adapter < b.Adapter
+	}
+	return a.FetchTime < b.FetchTime
+}
+
+// Catalog keeps entries for all snapshots under the data root in
+// {root}/.catalog/catalog.json, or only in memory for storages without a root.
+type Catalog struct {
+	mux     sync.Mutex
+	path    string
+	entries map[string]*Entry
+	logger  *common.Logger
+}
+
+func Open(root string) (*Catalog, error) {
+	if err := os.MkdirAll(filepath.Join(root, catalogDir), defaultPerms); err != nil {
+		return nil, err
+	}
+	c := &Catalog{
+		path:    filepath.Join(root, catalogDir, catalogFile),
+		entries: map[string]*Entry{},
+		logger:  common.NewLogger("Catalog"),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// New returns a catalog kept in memory, for storages which are not under a
+// local root, so the catalog is rebuilt from them instead.
+func New() *Catalog {
+	return &Catalog{
+		entries: map[string]*Entry{},
+		logger:  common.NewLogger("Catalog"),
+	}
+}
+
+func (c *Catalog) Exists() bool {
+	if c.path == "" {
+		return false
+	}
+	_, err := os.Stat(c.path)
+	return err == nil
+}
+
+func (c *Catalog) load() error {
+	if c.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	entries := map[string]*Entry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	c.entries = entries
+	return nil
+}
+
+func (c *Catalog) save() error {
+	if c.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	tmpPath := c.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, defaultPerms); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, c.path)
+}
+
+// Put adds or replaces the entry, an already known snapshot gets one more version.
+func (c *Catalog) Put(entry *Entry) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	// Other processes could have updated the catalog
+	if err := c.load(); err != nil {
+		return err
+	}
+	if old, ok := c.entries[entry.Id]; ok {
+		entry.Versions = old.Versions + 1
+	}
+	c.entries[entry.Id] = entry
+	return c.save()
+}
+
+func (c *Catalog) Get(id string) (*Entry, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	entry, ok := c.entries[id]
+	return entry, ok
+}
+
+func (c *Catalog) Query(query *Query) []*Entry {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	result := []*Entry{}
+	for _, e := range c.entries {
+		if query.matches(e) {
+			result = append(result, e)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if query.Reverse {
+			a, b = b, a
+		}
+		if query.less(a, b) == query.less(b, a) {
+			return a.Id < b.Id
+		}
+		return query.less(a, b)
+	})
+	return result
+}
+
+// Rebuild replaces the catalog with entries read from all the storages,
+// adapter names cannot be recovered, so they are kept from the old entries.
+func (c *Catalog) Rebuild(storages storage.Provider) error {
+	ids, err := storages.List()
+	if err != nil {
+		return err
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	entries := map[string]*Entry{}
+	for _, id := range ids {
+		entry, err := readEntry(storages, id)
+		if err != nil {
+			c.logger.Warningf("Cannot read snapshot %q: %s", id, err)
+			continue
+		}
+		if old, ok := c.entries[id]; ok {
+			entry.Adapter = old.Adapter
+		}
+		entries[id] = entry
+	}
+	c.entries = entries
+	return c.save()
+}
+
+func readEntry(storages storage.Provider, id string) (*Entry, error) {
+	s, err := storages.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	bs := &storage.BlockStorage{Storage: s}
+	snapshot, err := bs.GetSnapshot(&storage.GetRequest{Url: snapshotObject})
+	if err != nil {
+		return nil, err
+	}
+	// Sizes of the stored files, so nothing but the snapshot is read
+	list, err := s.List(&storage.ListRequest{WithSnapshots: true, WithFiles: true})
+	if err != nil {
+		return nil, err
+	}
+	size := int64(0)
+	versions := 0
+	for _, item := range list.Items {
+		if item.Url == snapshotObject {
+			versions = len(item.Versions)
+		}
+		size += item.Size
+	}
+	entry := NewEntry(id, snapshot, "", size)
+	entry.Versions = versions
+	return entry, nil
+}
@@ -0,0 +1,140 @@
+package catalog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"chronicler/common"
+	opb "chronicler/proto"
+	"chronicler/storage"
+)
+
+func entryIds(entries []*Entry) []string {
+	result := []string{}
+	for _, e := range entries {
+		result = append(result, e.Id)
+	}
+	return result
+}
+
+func TestCatalogQuery(t *testing.T) {
+	c, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Cannot open catalog: %s", err)
+	}
+	for _, e := range []*Entry{
+		{Id: "1", Link: "https://www.reddit.com/r/golang/1", FetchTime: 300, Adapter: "reddit", Objects: 10, Size: 100},
+		{Id: "2", Link: "https://pikabu.ru/story/2", FetchTime: 100, Adapter: "pikabu", Objects: 30, Size: 50},
+		{Id: "3", Link: "https://reddit.com/r/golang/3", FetchTime: 200, Adapter: "reddit", Objects: 20, Size: 200},
+		{Id: "4", Link: "https://boards.4chan.org/g/4", FetchTime: 400, Adapter: "fourchan", Objects: 5, Size: 10},
+	} {
+		if err := c.Put(e); err != nil {
+			t.Errorf("Cannot put entry: %s", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		query *Query
+		want  []string
+	}{
+		{name: "all by time", query: &Query{}, want: []string{"2", "3", "1", "4"}},
+		{name: "all by time reverse", query: &Query{Reverse: true}, want: []string{"4", "1", "3", "2"}},
+		{name: "by host with subdomains", query: &Query{Host: "reddit.com"}, want: []string{"3", "1"}},
+		{name: "by adapter", query: &Query{Adapter: "pikabu"}, want: []string{"2"}},
+		{name: "by size", query: &Query{SortBy: "size"}, want: []string{"4", "2", "1", "3"}},
+		{name: "by objects", query: &Query{SortBy: "objects"}, want: []string{"4", "1", "3", "2"}},
+		{name: "by link", query: &Query{SortBy: "link"}, want: []string{"4", "2", "3", "1"}},
+		{
+			name:  "date range",
+			query: &Query{Since: time.Unix(200, 0), Until: time.Unix(400, 0)},
+			want:  []string{"3", "1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := entryIds(c.Query(tc.query)); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected query %v to return %q, but got %q", tc.query, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCatalogPersistence(t *testing.T) {
+	root := t.TempDir()
+	c, err := Open(root)
+	if err != nil {
+		t.Fatalf("Cannot open catalog: %s", err)
+	}
+	if c.Exists() {
+		t.Errorf("Expected new catalog to not exist before the first put")
+	}
+	c.Put(&Entry{Id: "1", Link: "http://some/url", Adapter: "web"})
+	c.Put(&Entry{Id: "1", Link: "http://some/url", Adapter: "web", Objects: 2})
+
+	reopened, err := Open(root)
+	if err != nil {
+		t.Fatalf("Cannot reopen catalog: %s", err)
+	}
+	got, ok := reopened.Get("1")
+	want := &Entry{Id: "1", Link: "http://some/url", Adapter: "web", Objects: 2, Versions: 1}
+	if !ok || !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected entry %v, but got %v", want, got)
+	}
+}
+
+func TestCatalogRebuild(t *testing.T) {
+	root := t.TempDir()
+	storages := storage.NewLocalProvider(root)
+	someId := common.UUID4For(&opb.Link{Href: "http://some/url"})
+	otherId := common.UUID4For(&opb.Link{Href: "http://other/url"})
+	for i, href := range []string{"http://some/url", "http://other/url"} {
+		s, err := storages.Open(common.UUID4For(&opb.Link{Href: href}))
+		if err != nil {
+			t.Fatalf("Cannot open storage: %s", err)
+		}
+		bs := &storage.BlockStorage{Storage: s}
+		for range i + 1 {
+			bs.PutSnapshot(&storage.PutRequest{Url: "snapshot.json", SaveOnOverwrite: true}, &opb.Snapshot{
+				Link:      &opb.Link{Href: href},
+				FetchTime: &opb.Timestamp{Seconds: int64(i)},
+				Objects:   []*opb.Object{{Id: "1"}, {Id: "2"}},
+			}, storage.FormatProtoJson)
+		}
+		bs.PutBytes(&storage.PutRequest{Url: "http://some/file"}, []byte("12345"))
+	}
+
+	c, err := Open(root)
+	if err != nil {
+		t.Fatalf("Cannot open catalog: %s", err)
+	}
+	c.Put(&Entry{Id: someId, Adapter: "web"})
+	c.Put(&Entry{Id: "removed", Adapter: "web"})
+	if err := c.Rebuild(storages); err != nil {
+		t.Errorf("Cannot rebuild catalog: %s", err)
+	}
+
+	got := c.Query(&Query{})
+	if ids := entryIds(got); !reflect.DeepEqual(ids, []string{someId, otherId}) {
+		t.Fatalf("Expected rebuilt catalog to contain %q and %q, but got %q", someId, otherId, ids)
+	}
+	if got[0].Adapter != "web" || got[0].Objects != 2 || got[0].Versions != 0 || got[0].Size <= 5 {
+		t.Errorf("Unexpected entry %v", got[0])
+	}
+	if got[1].Link != "http://other/url" || got[1].Versions != 1 {
+		t.Errorf("Unexpected entry %v", got[1])
+	}
+}
+
+func TestCatalogInMemory(t *testing.T) {
+	c := New()
+	if err := c.Put(&Entry{Id: "1", Link: "http://some/url"}); err != nil {
+		t.Fatalf("Cannot put entry: %s", err)
+	}
+	if c.Exists() {
+		t.Errorf("Expected catalog in memory not to exist on disk")
+	}
+	if entry, ok := c.Get("1"); !ok || entry.Link != "http://some/url" {
+		t.Errorf("Expected entry to be kept in memory, but got %v", entry)
+	}
+}
@@ -2,14 +2,43 @@ package common
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sync"
 )
 
 const (
 	logFormat = log.Ldate | log.Ltime | log.Lmsgprefix | log.Lshortfile
 )
 
+// logOutput lets the output of the existing loggers be changed, e.g. while
+// the terminal is used for something else.
+type logOutput struct {
+	mux    sync.Mutex
+	writer io.Writer
+}
+
+func (lo *logOutput) Write(data []byte) (int, error) {
+	lo.mux.Lock()
+	defer lo.mux.Unlock()
+	return lo.writer.Write(data)
+}
+
+var (
+	output = &logOutput{writer: os.Stdout}
+)
+
+// SetLogOutput sends the output of all loggers to the writer and returns the
+// previous one.
+func SetLogOutput(writer io.Writer) io.Writer {
+	output.mux.Lock()
+	defer output.mux.Unlock()
+	previous := output.writer
+	output.writer = writer
+	return previous
+}
+
 type Logger struct {
 	debug *log.Logger
 	info  *log.Logger
@@ -19,10 +48,10 @@ type Logger struct {
 
 func NewLogger(name string) *Logger {
 	return &Logger{
-		debug: log.New(os.Stdout, fmt.Sprintf("DEBUG: %s: ", name), logFormat),
-		info:  log.New(os.Stdout, fmt.Sprintf("INFO: %s: ", name), logFormat),
-		warn:  log.New(os.Stdout, fmt.Sprintf("WARNING: %s: ", name), logFormat),
-		err:   log.New(os.Stdout, fmt.Sprintf("ERROR: %s: ", name), logFormat),
+		debug: log.New(output, fmt.Sprintf("DEBUG: %s: ", name), logFormat),
+		info:  log.New(output, fmt.Sprintf("INFO: %s: ", name), logFormat),
+		warn:  log.New(output, fmt.Sprintf("WARNING: %s: ", name), logFormat),
+		err:   log.New(output, fmt.Sprintf("ERROR: %s: ", name), logFormat),
 	}
 }
 
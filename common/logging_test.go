@@ -1,6 +1,8 @@
 package common
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 )
 
@@ -16,4 +18,17 @@ func TestLogging(t *testing.T) {
 		log.Warningf(format, args...)
 		log.Errorf(format, args...)
 	})
+
+	t.Run("Output", func(t *testing.T) {
+		log := NewLogger("a logger")
+		buffer := &bytes.Buffer{}
+		previous := SetLogOutput(buffer)
+		log.Infof("captured")
+		SetLogOutput(previous)
+		log.Infof("not captured")
+
+		if got := buffer.String(); !strings.Contains(got, "INFO: a logger: captured") || strings.Contains(got, "not captured") {
+			t.Errorf("Unexpected output %q", got)
+		}
+	})
 }
@@ -6,6 +6,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"hash/fnv"
+	"regexp"
+)
+
+var (
+	uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
 )
 
 func uuid4ForBytes(bytes []byte) string {
@@ -34,3 +39,8 @@ func UUID4() string {
 	rand.Read(bytes)
 	return uuid4ForBytes(bytes)
 }
+
+// IsUUID is true for the ids made by UUID4 and UUID4For.
+func IsUUID(id string) bool {
+	return uuidPattern.MatchString(id)
+}
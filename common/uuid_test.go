@@ -40,9 +40,34 @@ func TestUUID4For(t *testing.T) {
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			result := UUID4For(tc.item)
+			if !IsUUID(result) {
+				t.Errorf("Expected %s to be an UUID", result)
+			}
 			if result != tc.want {
 				t.Errorf("Expected UUID4For(%v) = %s, but got %s", tc.item, tc.want, result)
 			}
 		})
 	}
 }
+
+func TestIsUUID(t *testing.T) {
+	for _, tc := range []struct {
+		id   string
+		want bool
+	}{
+		{id: UUID4(), want: true},
+		{id: "b9d1969b-af0c-4f63-9dbe-cb02cf64ee57", want: true},
+		{id: "B9D1969B-AF0C-4F63-9DBE-CB02CF64EE57"},
+		{id: ""},
+		{id: ".."},
+		{id: "x/../../escaped"},
+		{id: "b9d1969b-af0c-4f63-9dbe-cb02cf64ee57/.."},
+		{id: "b9d1969b\\af0c-4f63-9dbe-cb02cf64ee57"},
+	} {
+		t.Run(tc.id, func(t *testing.T) {
+			if got := IsUUID(tc.id); got != tc.want {
+				t.Errorf("Expected IsUUID(%q) = %v, but got %v", tc.id, tc.want, got)
+			}
+		})
+	}
+}
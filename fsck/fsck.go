@@ -0,0 +1,155 @@
+package fsck
+
+import (
+	"fmt"
+	"slices"
+
+	"chronicler/common"
+	"chronicler/storage"
+)
+
+const (
+	snapshotObject = "snapshot.json"
+)
+
+type Report struct {
+	Id            string
+	Problems      []*storage.Problem
+	NotDownloaded []string
+}
+
+func (r *Report) Ok() bool {
+	return len(r.Problems) == 0 && len(r.NotDownloaded) == 0
+}
+
+// Checker verifies snapshot storages which implement storage.Verifier, the
+// local ones, compressed or encrypted archives can be checked too.
+type Checker struct {
+	storages storage.Provider
+	loader   common.Downloader
+	logger   *common.Logger
+}
+
+func NewChecker(storages storage.Provider, loader common.Downloader) *Checker {
+	return &Checker{
+		storages: storages,
+		loader:   loader,
+		logger:   common.NewLogger("Fsck"),
+	}
+}
+
+func (c *Checker) attachments(s storage.Storage) ([]string, error) {
+	snapshot, err := (&storage.BlockStorage{Storage: s}).GetSnapshot(&storage.GetRequest{Url: snapshotObject})
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, obj := range snapshot.Objects {
+		for _, attachment := range obj.Attachment {
+			if attachment.Mime == "" || slices.Contains(result, attachment.Url) {
+				continue
+			}
+			result = append(result, attachment.Url)
+		}
+	}
+	return result, nil
+}
+
+func (c *Checker) open(id string) (storage.Storage, storage.Verifier, error) {
+	s, err := c.storages.Open(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	v, ok := s.(storage.Verifier)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %T", storage.ErrNotVerifiable, s)
+	}
+	return s, v, nil
+}
+
+func (c *Checker) Check(id string) (*Report, error) {
+	s, v, err := c.open(id)
+	if err != nil {
+		return nil, err
+	}
+	problems, err := v.Verify()
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{Id: id, Problems: problems, NotDownloaded: []string{}}
+
+	attachments, err := c.attachments(s)
+	if err != nil {
+		report.Problems = append(report.Problems, &storage.Problem{
+			Kind:    storage.ProblemCorrupted,
+			Url:     snapshotObject,
+			Details: err.Error(),
+		})
+		return report, nil
+	}
+	list, err := s.List(&storage.ListRequest{})
+	if err != nil {
+		return nil, err
+	}
+	saved := map[string]bool{}
+	for _, item := range list.Items {
+		saved[item.Url] = true
+	}
+	for _, url := range attachments {
+		if !saved[url] {
+			report.NotDownloaded = append(report.NotDownloaded, url)
+		}
+	}
+	return report, nil
+}
+
+// Repair fixes the mapping and the manifest, then downloads again the
+// attachments which are missing, truncated or corrupted.
+func (c *Checker) Repair(report *Report) ([]string, error) {
+	s, v, err := c.open(report.Id)
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := c.attachments(s)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read snapshot, nothing to repair against: %w", err)
+	}
+	changes, err := v.Repair(attachments)
+	if err != nil {
+		return changes, err
+	}
+
+	refetch := append([]string{}, report.NotDownloaded...)
+	for _, p := range report.Problems {
+		switch p.Kind {
+		case storage.ProblemMissing, storage.ProblemTruncated, storage.ProblemCorrupted:
+			if slices.Contains(attachments, p.Url) && !slices.Contains(refetch, p.Url) {
+				refetch = append(refetch, p.Url)
+			}
+		}
+	}
+	// The storage could have changed after the local repair
+	s, err = c.storages.Open(report.Id)
+	if err != nil {
+		return changes, err
+	}
+	for _, url := range refetch {
+		c.logger.Infof("Downloading %s", url)
+		writer, err := s.Put(&storage.PutRequest{Url: url})
+		if err != nil {
+			c.logger.Warningf("Cannot create writer for %q: %s", url, err)
+			continue
+		}
+		if _, err := c.loader.Download(url, writer); err != nil {
+			c.logger.Warningf("Failed to download %s: %s", url, err)
+			storage.CloseWithError(writer, err)
+			continue
+		}
+		if err := writer.Close(); err != nil {
+			c.logger.Warningf("Failed to save %s: %s", url, err)
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("downloaded %q", url))
+	}
+	return changes, nil
+}
@@ -0,0 +1,188 @@
+package fsck
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"chronicler/common"
+	opb "chronicler/proto"
+	"chronicler/storage"
+)
+
+const (
+	testId = "00000000-0000-4000-8000-000000000001"
+)
+
+type fakeDownloader struct {
+	common.Downloader
+
+	urls []string
+	// Downloads write a part of the file and fail
+	fail bool
+}
+
+func (fd *fakeDownloader) Download(url string, target io.Writer) (int64, error) {
+	fd.urls = append(fd.urls, url)
+	written, err := target.Write([]byte("content of " + url))
+	if fd.fail {
+		return int64(written), errors.New("connection reset")
+	}
+	return int64(written), err
+}
+
+func newTestStorage(t *testing.T, storages storage.Provider) {
+	s, err := storages.Open(testId)
+	if err != nil {
+		t.Fatalf("Cannot open storage: %s", err)
+	}
+	bs := &storage.BlockStorage{Storage: s}
+	bs.PutSnapshot(&storage.PutRequest{Url: snapshotObject}, &opb.Snapshot{
+		Link: &opb.Link{Href: "http://some/url"},
+		Objects: []*opb.Object{
+			{
+				Id: "1",
+				Attachment: []*opb.Attachment{
+					{Url: "http://some/image.jpg", Mime: "image/jpeg"},
+					{Url: "http://some/link"},
+				},
+			},
+			{
+				Id: "2",
+				Attachment: []*opb.Attachment{
+					{Url: "http://some/video.mp4", Mime: "video/mp4"},
+					{Url: "http://some/never.png", Mime: "image/png"},
+				},
+			},
+		},
+	}, storage.FormatProtoJson)
+	bs.PutBytes(&storage.PutRequest{Url: "http://some/image.jpg"}, []byte("image"))
+	bs.PutBytes(&storage.PutRequest{Url: "http://some/video.mp4"}, []byte("video"))
+}
+
+func damage(t *testing.T, root string, pattern string, truncate bool) {
+	files, _ := filepath.Glob(filepath.Join(root, testId, pattern))
+	if len(files) != 1 {
+		t.Fatalf("Expected one file matching %q, but got %q", pattern, files)
+	}
+	if truncate {
+		os.Truncate(files[0], 1)
+	} else {
+		os.Remove(files[0])
+	}
+}
+
+func TestCheck(t *testing.T) {
+	root := t.TempDir()
+	newTestStorage(t, storage.NewLocalProvider(root))
+	damage(t, root, "http___some_video*", true)
+
+	checker := NewChecker(storage.NewLocalProvider(root), &fakeDownloader{})
+	report, err := checker.Check(testId)
+	if err != nil {
+		t.Fatalf("Cannot check storage: %s", err)
+	}
+	if want := []string{"http://some/never.png"}; !reflect.DeepEqual(report.NotDownloaded, want) {
+		t.Errorf("Expected not downloaded %q, but got %q", want, report.NotDownloaded)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != storage.ProblemTruncated {
+		t.Errorf("Expected truncated video, but got %v", report.Problems)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	root := t.TempDir()
+	newTestStorage(t, storage.NewLocalProvider(root))
+	damage(t, root, "http___some_video*", true)
+	damage(t, root, "http___some_image*", false)
+
+	loader := &fakeDownloader{}
+	checker := NewChecker(storage.NewLocalProvider(root), loader)
+	report, err := checker.Check(testId)
+	if err != nil {
+		t.Fatalf("Cannot check storage: %s", err)
+	}
+	if _, err := checker.Repair(report); err != nil {
+		t.Errorf("Cannot repair storage: %s", err)
+	}
+	want := []string{"http://some/never.png", "http://some/image.jpg", "http://some/video.mp4"}
+	if !reflect.DeepEqual(loader.urls, want) {
+		t.Errorf("Expected to download %q, but got %q", want, loader.urls)
+	}
+
+	report, err = checker.Check(testId)
+	if err != nil {
+		t.Fatalf("Cannot check storage: %s", err)
+	}
+	if !report.Ok() {
+		t.Errorf("Expected storage to be intact after repair, but got %v %q", report.Problems, report.NotDownloaded)
+	}
+}
+
+func TestRepairFailedDownload(t *testing.T) {
+	root := t.TempDir()
+	newTestStorage(t, storage.NewLocalProvider(root))
+	damage(t, root, "http___some_video*", true)
+
+	checker := NewChecker(storage.NewLocalProvider(root), &fakeDownloader{fail: true})
+	report, err := checker.Check(testId)
+	if err != nil {
+		t.Fatalf("Cannot check storage: %s", err)
+	}
+	if _, err := checker.Repair(report); err != nil {
+		t.Errorf("Cannot repair storage: %s", err)
+	}
+
+	report, err = checker.Check(testId)
+	if err != nil {
+		t.Fatalf("Cannot check storage: %s", err)
+	}
+	if len(report.Problems) != 0 {
+		t.Errorf("Expected failed downloads not to be kept, but got %v", report.Problems)
+	}
+	want := []string{"http://some/video.mp4", "http://some/never.png"}
+	if !reflect.DeepEqual(report.NotDownloaded, want) {
+		t.Errorf("Expected not downloaded %q, but got %q", want, report.NotDownloaded)
+	}
+}
+
+func TestRepairEncrypted(t *testing.T) {
+	root := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(keyFile, []byte(strings.Repeat("0f", 32)), 0600)
+	key, err := storage.KeyFromFile(keyFile)
+	if err != nil {
+		t.Fatalf("Cannot read key: %s", err)
+	}
+	storages := storage.NewEncryptedProvider(storage.NewLocalProvider(root), key)
+	newTestStorage(t, storages)
+	s, _ := storages.Open(testId)
+	list, err := s.List(&storage.ListRequest{Url: []string{"http://some/video.mp4"}, WithFiles: true})
+	if err != nil || len(list.Items) != 1 {
+		t.Fatalf("Cannot find the video file: %v", err)
+	}
+	os.Truncate(filepath.Join(root, testId, list.Items[0].Name), 1)
+
+	loader := &fakeDownloader{}
+	checker := NewChecker(storages, loader)
+	report, err := checker.Check(testId)
+	if err != nil {
+		t.Fatalf("Cannot check storage: %s", err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Url != "http://some/video.mp4" {
+		t.Fatalf("Expected truncated video with the real url, but got %v", report.Problems)
+	}
+	if _, err := checker.Repair(report); err != nil {
+		t.Errorf("Cannot repair storage: %s", err)
+	}
+	if want := []string{"http://some/never.png", "http://some/video.mp4"}; !reflect.DeepEqual(loader.urls, want) {
+		t.Errorf("Expected to download %q, but got %q", want, loader.urls)
+	}
+	if report, err = checker.Check(testId); err != nil || !report.Ok() {
+		t.Errorf("Expected storage to be intact after repair, but got %v", report)
+	}
+}
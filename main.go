@@ -1,13 +1,15 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/cookiejar"
 	"os"
 	"path/filepath"
-	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"chronicler/adapter"
@@ -16,15 +18,23 @@ import (
 	"chronicler/adapter/reddit"
 	"chronicler/adapter/twitter"
 	"chronicler/adapter/web"
+	"chronicler/archive"
+	"chronicler/catalog"
 	"chronicler/common"
+	"chronicler/fsck"
+	"chronicler/iferr"
 	opb "chronicler/proto"
 	"chronicler/resolver"
+	"chronicler/server"
 	"chronicler/storage"
 	"chronicler/viewer"
 )
 
 const (
-	root = "data"
+	root          = "data"
+	passphraseEnv = "CHRONICLER_PASSPHRASE"
+	tokenEnv      = "CHRONICLER_STORAGE_TOKEN"
+	snapshotFile  = "snapshot.json"
 )
 
 func main() {
@@ -35,57 +45,601 @@ func main() {
 		save(os.Args[2:])
 	case "view":
 		view(os.Args[2:])
+	case "browse":
+		browse(os.Args[2:])
 	case "export":
 		export(os.Args[2:])
+	case "import":
+		importSnapshots(os.Args[2:])
+	case "feed":
+		feed(os.Args[2:])
+	case "serve":
+		serve(os.Args[2:])
+	case "serve-storage":
+		serveStorage(os.Args[2:])
+	case "fsck":
+		check(os.Args[2:])
+	case "migrate-names":
+		migrateNames(os.Args[2:])
+	case "migrate":
+		migrate(os.Args[2:])
+	case "bundle":
+		bundle(os.Args[2:])
+	case "unbundle":
+		unbundle(os.Args[2:])
+	case "sync":
+		syncRoots(os.Args[2:])
 	}
 }
 
-func list(_ []string) {
-	dir, err := os.ReadDir(root)
-	if err != nil {
-		return
+type storageFlags struct {
+	compress  *bool
+	keyFile   *string
+	s3Url     *string
+	remoteUrl *string
+}
+
+func addStorageFlags(flags *flag.FlagSet) *storageFlags {
+	return &storageFlags{
+		keyFile:   flags.String("key-file", "", "encryption key file, the passphrase can be set with "+passphraseEnv),
+		s3Url:     flags.String("s3", "", "use S3-compatible storage at https://host/bucket/prefix instead of the local one"),
+		remoteUrl: flags.String("remote", "", "use storage served by serve-storage at http://host:port, the token is read from "+tokenEnv),
+	}
+}
+
+func (sf *storageFlags) backend() storage.Provider {
+	if *sf.s3Url != "" {
+		return storage.NewS3Provider(&http.Client{Timeout: 10 * time.Minute}, iferr.Exit(storage.ParseS3Url(*sf.s3Url)))
+	} else if *sf.remoteUrl != "" {
+		return storage.NewRemoteProvider(&http.Client{}, *sf.remoteUrl, os.Getenv(tokenEnv))
+	}
+	return storage.NewLocalProvider(root)
+}
+
+func (sf *storageFlags) local() bool {
+	return *sf.s3Url == "" && *sf.remoteUrl == ""
+}
+
+func (sf *storageFlags) encrypted() bool {
+	return *sf.keyFile != "" || os.Getenv(passphraseEnv) != ""
+}
+
+// keepsCatalog is true when the catalog can be saved in the root, it lists
+// every link in plain text, so encrypted archives never save it.
+func (sf *storageFlags) keepsCatalog() bool {
+	return sf.local() && !sf.encrypted()
+}
+
+// catalog opens the catalog in the root, other storages have no place for it
+// there, so their catalog is read from the snapshots and kept in memory.
+func (sf *storageFlags) catalog(storages storage.Provider, rebuild bool) *catalog.Catalog {
+	c := catalog.New()
+	if sf.keepsCatalog() {
+		c = iferr.Exit(catalog.Open(root))
+	}
+	if rebuild || !c.Exists() {
+		if err := c.Rebuild(storages); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return c
+}
+
+func (sf *storageFlags) storages() storage.Provider {
+	result := sf.backend()
+	if *sf.keyFile != "" {
+		result = storage.NewEncryptedProvider(result, iferr.Exit(storage.KeyFromFile(*sf.keyFile)))
+	} else if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		result = storage.NewEncryptedProvider(result, storage.KeyFromPassphrase(passphrase))
 	}
-	snapshots := []*opb.Snapshot{}
-	for _, d := range dir {
-		ls, err := storage.NewLocalStorage(filepath.Join(root, d.Name()))
+	skip := storage.DefaultSkipMime
+	if sf.compress == nil || !*sf.compress {
+		// Nothing new is compressed, but the compressed data is still readable
+		skip = []string{""}
+	}
+	return storage.NewCompressedProvider(result, skip)
+}
+
+// parseStorageSpec reads "backend[+compress][+encrypt]:location", e.g.
+// "local:data", "local+compress:archive" or "s3+encrypt:https://host/bucket/prefix".
+func parseStorageSpec(spec string, keyFile string) (storage.Provider, error) {
+	kind, location, ok := strings.Cut(spec, ":")
+	if !ok || location == "" {
+		return nil, fmt.Errorf("storage spec %q should look like backend:location", spec)
+	}
+	options := strings.Split(kind, "+")
+	var result storage.Provider
+	switch options[0] {
+	case "local":
+		result = storage.NewLocalProvider(location)
+	case "s3":
+		config, err := storage.ParseS3Url(location)
 		if err != nil {
-			continue
+			return nil, err
 		}
-		bs := storage.BlockStorage{Storage: ls}
-		snapshot := &opb.Snapshot{}
-		if err = bs.GetObject(&storage.GetRequest{Url: "snapshot.json"}, snapshot); err != nil {
-			continue
+		result = storage.NewS3Provider(&http.Client{Timeout: 10 * time.Minute}, config)
+	case "remote":
+		result = storage.NewRemoteProvider(&http.Client{}, location, os.Getenv(tokenEnv))
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q, supported are local, s3 and remote", options[0])
+	}
+	skip := []string{""}
+	for _, option := range options[1:] {
+		switch option {
+		case "compress":
+			skip = storage.DefaultSkipMime
+		case "encrypt":
+			if keyFile != "" {
+				key, err := storage.KeyFromFile(keyFile)
+				if err != nil {
+					return nil, err
+				}
+				result = storage.NewEncryptedProvider(result, key)
+			} else if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+				result = storage.NewEncryptedProvider(result, storage.KeyFromPassphrase(passphrase))
+			} else {
+				return nil, fmt.Errorf("%q needs a key file or %s", spec, passphraseEnv)
+			}
+		default:
+			return nil, fmt.Errorf("unknown storage option %q", option)
 		}
-		snapshots = append(snapshots, snapshot)
 	}
-	sort.Slice(snapshots, func(i, j int) bool {
-		sa := snapshots[i]
-		sb := snapshots[j]
-		if sb.FetchTime == nil {
-			return false
-		} else if sa.FetchTime == nil {
-			return true
+	return storage.NewCompressedProvider(result, skip), nil
+}
+
+// parseArgs allows flags after the positional arguments: "bundle url -o file"
+func parseArgs(flags *flag.FlagSet, args []string) []string {
+	positional := []string{}
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
 		}
-		return sa.FetchTime.Seconds < sb.FetchTime.Seconds
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func parseDate(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	return iferr.Exit(time.ParseInLocation(time.DateOnly, value, time.Local))
+}
+
+type threadFlags struct {
+	root     *string
+	depth    *int
+	author   *string
+	since    *string
+	until    *string
+	minScore *string
+	sortBy   *string
+}
+
+func addThreadFlags(flags *flag.FlagSet) *threadFlags {
+	return &threadFlags{
+		root:     flags.String("root", "", "only the object with the id and its replies"),
+		depth:    flags.Int("depth", 0, "number of shown reply levels, 1 shows only the top-level objects, 0 all"),
+		author:   flags.String("author", "", "only objects of the author with the id or name"),
+		since:    flags.String("since", "", "only objects created on or after the date, YYYY-MM-DD"),
+		until:    flags.String("until", "", "only objects created before the date, YYYY-MM-DD"),
+		minScore: flags.String("min-score", "", "hide objects with lower rating or upvotes minus downvotes"),
+		sortBy:   flags.String("sort", "", "sort replies by time, score or replies, top-level objects keep the snapshot order if empty"),
+	}
+}
+
+func (tf *threadFlags) query() viewer.ThreadQuery {
+	query := viewer.ThreadQuery{
+		Root:     *tf.root,
+		MaxDepth: *tf.depth,
+		Author:   *tf.author,
+		Since:    parseDate(*tf.since),
+		Until:    parseDate(*tf.until),
+		SortBy:   *tf.sortBy,
+	}
+	if *tf.minScore != "" {
+		minScore := iferr.Exit(strconv.ParseInt(*tf.minScore, 10, 64))
+		query.MinScore = &minScore
+	}
+	switch query.SortBy {
+	case "", "time", "score", "replies":
+	default:
+		log.Fatalf("Unknown sort order %q, supported are time, score and replies", query.SortBy)
+	}
+	return query
+}
+
+func list(args []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	storageFlags := addStorageFlags(flags)
+	host := flags.String("host", "", "only snapshots from the host or its subdomains")
+	adapterName := flags.String("adapter", "", "only snapshots saved by the adapter, e.g. reddit")
+	since := flags.String("since", "", "only snapshots fetched on or after the date, YYYY-MM-DD")
+	until := flags.String("until", "", "only snapshots fetched before the date, YYYY-MM-DD")
+	sortBy := flags.String("sort", "time", "sort by time, link, size, objects or adapter")
+	reverse := flags.Bool("reverse", false, "reverse the sort order")
+	rebuild := flags.Bool("rebuild", false, "rebuild the catalog from the saved snapshots")
+	flags.Parse(args)
+
+	c := storageFlags.catalog(storageFlags.storages(), *rebuild)
+	entries := c.Query(&catalog.Query{
+		Host:    *host,
+		Adapter: *adapterName,
+		Since:   parseDate(*since),
+		Until:   parseDate(*until),
+		SortBy:  *sortBy,
+		Reverse: *reverse,
 	})
-	for i, snapshot := range snapshots {
+	for i, e := range entries {
 		fetchTime := "?"
-		if snapshot.FetchTime != nil {
-			fetchTime = time.Unix(snapshot.FetchTime.Seconds, 0).Format(time.DateTime)
+		if e.FetchTime != 0 {
+			fetchTime = time.Unix(e.FetchTime, 0).Format(time.DateTime)
 		}
-		fmt.Printf("%03d [%s] %s\n", i, fetchTime, snapshot.Link)
+		fmt.Printf("%03d [%s] %-8s %5d objects %10d bytes %s\n", i, fetchTime, e.Adapter, e.Objects, e.Size, e.Link)
+	}
+}
+
+func feed(args []string) {
+	flags := flag.NewFlagSet("feed", flag.ExitOnError)
+	storageFlags := addStorageFlags(flags)
+	host := flags.String("host", "", "only snapshots from the host or its subdomains")
+	adapterName := flags.String("adapter", "", "only snapshots saved by the adapter, e.g. reddit")
+	since := flags.String("since", "", "only snapshots fetched on or after the date, YYYY-MM-DD")
+	title := flags.String("title", "Chronicler archive", "feed title")
+	limit := flags.Int("n", 50, "number of entries, all if 0")
+	objects := flags.Int("objects", 5, "number of objects in the entry summary")
+	versions := flags.Bool("versions", false, "an entry for every saved version, not only the latest one")
+	output := flags.String("o", "", "output file, stdout if empty")
+	flags.Parse(args)
+
+	storages := storageFlags.storages()
+	c := storageFlags.catalog(storages, false)
+	entries := c.Query(&catalog.Query{
+		Host:    *host,
+		Adapter: *adapterName,
+		Since:   parseDate(*since),
+	})
+	writer := os.Stdout
+	if *output != "" {
+		writer = iferr.Exit(os.Create(*output))
+	}
+	err := viewer.NewFeed(storages, &viewer.FeedOptions{
+		Title:    *title,
+		Limit:    *limit,
+		Objects:  *objects,
+		Versions: *versions,
+	}).Write(writer, entries)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
 }
 
 func view(args []string) {
-	viewer.NewViewer(root).View(common.UUID4For(&opb.Link{Href: args[0]}))
+	flags := flag.NewFlagSet("view", flag.ExitOnError)
+	storageFlags := addStorageFlags(flags)
+	threadFlags := addThreadFlags(flags)
+	urls := parseArgs(flags, args)
+	if len(urls) == 0 {
+		log.Fatal("view needs an url")
+	}
+
+	v := viewer.NewViewer(storageFlags.storages())
+	v.Query = threadFlags.query()
+	if err := v.View(common.UUID4For(&opb.Link{Href: urls[0]})); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func browse(args []string) {
+	flags := flag.NewFlagSet("browse", flag.ExitOnError)
+	storageFlags := addStorageFlags(flags)
+	host := flags.String("host", "", "only snapshots from the host or its subdomains")
+	adapterName := flags.String("adapter", "", "only snapshots saved by the adapter, e.g. reddit")
+	flags.Parse(args)
+
+	storages := storageFlags.storages()
+	c := storageFlags.catalog(storages, false)
+	entries := c.Query(&catalog.Query{Host: *host, Adapter: *adapterName, Reverse: true})
+	if err := viewer.NewBrowser(storages, entries).Run(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func export(args []string) {
-	viewer.NewExporter(root, args[1]).Export(common.UUID4For(&opb.Link{Href: args[0]}))
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	storageFlags := addStorageFlags(flags)
+	format := flags.String("format", "html", fmt.Sprintf("output format: %s", strings.Join(viewer.Formats(), ", ")))
+	output := flags.String("o", "export", "output directory")
+	threadFlags := addThreadFlags(flags)
+	urls := parseArgs(flags, args)
+
+	ids := []string{}
+	for _, href := range urls {
+		ids = append(ids, common.UUID4For(&opb.Link{Href: href}))
+	}
+	exporter := viewer.NewExporter(storageFlags.storages(), *output)
+	exporter.Format = *format
+	exporter.Query = threadFlags.query()
+	if err := exporter.Export(ids...); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Exported %d snapshots to %s\n", len(ids), *output)
+}
+
+// importSnapshots saves snapshots from ActivityStreams collections written by
+// "export -format activitystreams".
+func importSnapshots(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	storageFlags := addStorageFlags(flags)
+	files := parseArgs(flags, args)
+
+	storages := storageFlags.storages()
+	cat := catalog.New()
+	if storageFlags.keepsCatalog() {
+		cat = iferr.Exit(catalog.Open(root))
+	}
+	for _, name := range files {
+		file := iferr.Exit(os.Open(name))
+		snapshot, err := viewer.ReadActivityStreams(file)
+		file.Close()
+		if err != nil {
+			log.Fatalf("Cannot read %s: %s", name, err)
+		}
+		if snapshot.Link == nil {
+			log.Fatalf("Snapshot in %s has no url", name)
+		}
+		id := common.UUID4For(snapshot.Link)
+		s := &storage.BlockStorage{Storage: iferr.Exit(storages.Open(id))}
+		size, err := s.PutSnapshot(&storage.PutRequest{Url: snapshotFile, SaveOnOverwrite: true}, snapshot, storage.FormatProtoJson)
+		if err != nil {
+			log.Fatalf("Cannot save %s: %s", name, err)
+		}
+		if err := cat.Put(catalog.NewEntry(id, snapshot, "import", size)); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s: %d objects of %s\n", name, len(snapshot.Objects), snapshot.Link.Href)
+	}
+}
+
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	storageFlags := addStorageFlags(flags)
+	address := flags.String("address", "localhost:8080", "address to listen on")
+	rebuild := flags.Bool("rebuild", false, "rebuild the catalog from the saved snapshots")
+	flags.Parse(args)
+
+	storages := storageFlags.storages()
+	c := storageFlags.catalog(storages, *rebuild)
+	log.Printf("Serving the archive on http://%s", *address)
+	log.Fatal(http.ListenAndServe(*address, server.NewServer(storages, c)))
+}
+
+func serveStorage(args []string) {
+	flags := flag.NewFlagSet("serve-storage", flag.ExitOnError)
+	storageFlags := addStorageFlags(flags)
+	address := flags.String("address", "localhost:8081", "address to listen on")
+	noAuth := flags.Bool("no-auth", false, "serve the storage without authorization when "+tokenEnv+" is not set")
+	flags.Parse(args)
+
+	if *storageFlags.keyFile != "" {
+		log.Fatalf("serve-storage keeps the data as it is sent, encryption happens on the client side, pass -key-file to the clients")
+	}
+
+	token := os.Getenv(tokenEnv)
+	if token == "" && !*noAuth {
+		log.Fatalf("%s is not set, pass -no-auth to serve the storage without authorization", tokenEnv)
+	}
+	if token == "" {
+		log.Printf("%s is not set, storage is available without authorization", tokenEnv)
+	}
+	log.Printf("Serving storage on %s", *address)
+	log.Fatal(http.ListenAndServe(*address, storage.NewRemoteServer(storageFlags.backend(), token)))
+}
+
+func check(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	storageFlags := addStorageFlags(flags)
+	repair := flags.Bool("repair", false, "fix the mapping and download again missing or damaged attachments")
+	verbose := flags.Bool("v", false, "print intact snapshots too")
+	flags.Parse(args)
+
+	if *storageFlags.s3Url != "" || *storageFlags.remoteUrl != "" {
+		log.Fatalf("fsck checks files against the local manifest, -s3 and -remote storages cannot be checked")
+	}
+	storages := storageFlags.storages()
+	ids := []string{}
+	for _, href := range flags.Args() {
+		ids = append(ids, common.UUID4For(&opb.Link{Href: href}))
+	}
+	if len(ids) == 0 {
+		ids = iferr.Exit(storages.List())
+	}
+
+	checker := fsck.NewChecker(storages, common.NewHttpDownloader(&http.Client{Timeout: 10 * time.Minute}))
+	damaged := 0
+	for _, id := range ids {
+		report, err := checker.Check(id)
+		if err != nil {
+			log.Printf("Cannot check %s: %s", id, err)
+			damaged++
+			continue
+		}
+		if report.Ok() {
+			if *verbose {
+				fmt.Printf("%s: ok\n", id)
+			}
+			continue
+		}
+		damaged++
+		fmt.Printf("%s:\n", id)
+		for _, p := range report.Problems {
+			fmt.Printf("  %s\n", p)
+		}
+		for _, url := range report.NotDownloaded {
+			fmt.Printf("  not downloaded: %s\n", url)
+		}
+		if *repair {
+			changes, err := checker.Repair(report)
+			for _, change := range changes {
+				fmt.Printf("  repaired: %s\n", change)
+			}
+			if err != nil {
+				log.Printf("Cannot repair %s: %s", id, err)
+			}
+		}
+	}
+	if damaged > 0 && !*repair {
+		os.Exit(1)
+	}
+}
+
+func migrateNames(args []string) {
+	flags := flag.NewFlagSet("migrate-names", flag.ExitOnError)
+	flags.Parse(args)
+
+	for _, id := range iferr.Exit(storage.NewLocalProvider(root).List()) {
+		changes, err := storage.MigrateLocalNames(filepath.Join(root, id))
+		for _, change := range changes {
+			fmt.Printf("%s: %s\n", id, change)
+		}
+		if err != nil {
+			log.Fatalf("Cannot migrate %s: %s", id, err)
+		}
+	}
+}
+
+func migrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "local:"+root, "source storage: backend[+compress][+encrypt]:location, backend is local, s3 or remote")
+	to := flags.String("to", "", "target storage, same format as -from")
+	fromKeyFile := flags.String("from-key-file", "", "key file for the encrypted source, "+passphraseEnv+" is used otherwise")
+	toKeyFile := flags.String("to-key-file", "", "key file for the encrypted target, "+passphraseEnv+" is used otherwise")
+	statePath := flags.String("state", "migrate-state.json", "progress file to resume interrupted migration")
+	flags.Parse(args)
+
+	ids := []string{}
+	for _, href := range flags.Args() {
+		ids = append(ids, common.UUID4For(&opb.Link{Href: href}))
+	}
+	m := iferr.Exit(archive.NewMigrator(
+		iferr.Exit(parseStorageSpec(*from, *fromKeyFile)),
+		iferr.Exit(parseStorageSpec(*to, *toKeyFile)),
+		*statePath, *from, *to,
+	))
+	stats, err := m.Migrate(ids)
+	if stats != nil {
+		fmt.Printf("Copied %d items and %d versions (%d bytes) in %d storages, skipped %d already copied items\n",
+			stats.Items, stats.Versions, stats.Bytes, stats.Storages, stats.Skipped)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Remove(*statePath)
+}
+
+func bundle(args []string) {
+	flags := flag.NewFlagSet("bundle", flag.ExitOnError)
+	storageFlags := addStorageFlags(flags)
+	output := flags.String("o", "chronicler.tar.zst", "bundle file: .tar.zst, .tar.gz or .tar")
+	urls := parseArgs(flags, args)
+
+	ids := []string{}
+	for _, href := range urls {
+		ids = append(ids, common.UUID4For(&opb.Link{Href: href}))
+	}
+	writer := iferr.Exit(archive.CreateBundleFile(*output))
+	manifest, err := archive.NewBundler(storageFlags.storages()).Write(writer, ids)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*output)
+		log.Fatal(err)
+	}
+	fmt.Printf("Packed %d snapshots into %s\n", len(manifest.Storages), *output)
+}
+
+func unbundle(args []string) {
+	flags := flag.NewFlagSet("unbundle", flag.ExitOnError)
+	storageFlags := addStorageFlags(flags)
+	files := parseArgs(flags, args)
+
+	storages := storageFlags.storages()
+	for _, file := range files {
+		reader := iferr.Exit(archive.OpenBundleFile(file))
+		stats, err := archive.NewBundler(storages).Read(reader)
+		reader.Close()
+		if err != nil {
+			log.Fatalf("Cannot unbundle %s: %s", file, err)
+		}
+		fmt.Printf("%s: %d snapshots, %d items, %d files added (%d bytes), %d already present\n",
+			file, stats.Storages, stats.Items, stats.Added, stats.Bytes, stats.Skipped)
+	}
+	if storageFlags.keepsCatalog() {
+		if err := iferr.Exit(catalog.Open(root)).Rebuild(storages); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func syncRoots(args []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	keyFile := flags.String("key-file", "", "key file for the encrypted roots, "+passphraseEnv+" is used otherwise")
+	roots := parseArgs(flags, args)
+	if len(roots) != 2 {
+		log.Fatal("sync needs two roots, local paths or backend[+compress][+encrypt]:location")
+	}
+
+	providers := []storage.Provider{}
+	for _, r := range roots {
+		spec := r
+		if !strings.Contains(spec, ":") {
+			spec = "local:" + spec
+		}
+		providers = append(providers, iferr.Exit(parseStorageSpec(spec, *keyFile)))
+	}
+	stats, err := archive.Sync(providers[0], providers[1], nil)
+	if stats != nil {
+		for i, s := range []*archive.MergeStats{stats.ToA, stats.ToB} {
+			fmt.Printf("%s: %d files added (%d bytes) to %d items in %d snapshots\n",
+				roots[i], s.Added, s.Bytes, s.Items, s.Storages)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i, r := range roots {
+		if strings.Contains(r, ":") {
+			continue
+		}
+		if err := iferr.Exit(catalog.Open(r)).Rebuild(providers[i]); err != nil {
+			log.Printf("Cannot rebuild catalog in %s: %s", r, err)
+		}
+	}
 }
 
 func save(args []string) {
+	flags := flag.NewFlagSet("save", flag.ExitOnError)
+	storageFlags := addStorageFlags(flags)
+	storageFlags.compress = flags.Bool("compress", false, "compress saved objects, except already compressed media")
+	format := flags.String("format", storage.FormatProtoJson.String(), "snapshot format: protojson or binary")
+	dryRun := flags.Bool("dry-run", false, "fetch everything, but keep it in memory and only print what would be saved")
+	flags.Parse(args)
+	snapshotFormat := iferr.Exit(storage.ParseSnapshotFormat(*format))
+
+	storages := storageFlags.storages()
+	options := &resolver.Options{SnapshotFormat: snapshotFormat}
+	if *dryRun {
+		storages = storage.NewMemoryProvider(nil)
+	} else if storageFlags.keepsCatalog() {
+		options.Catalog = iferr.Exit(catalog.Open(root))
+	}
+
 	jar, err := cookiejar.New(&cookiejar.Options{})
 	if err != nil {
 		log.Fatal(err)
@@ -100,7 +654,7 @@ func save(args []string) {
 	redditToken := os.Getenv("REDDIT_TOKEN")
 
 	r := resolver.NewResolver(
-		root,
+		storages,
 		common.NewHttpDownloader(httpClient),
 		[]adapter.Adapter{
 			twitter.NewAdapter(twitter.NewClient(httpClient, twitterToken)),
@@ -109,9 +663,21 @@ func save(args []string) {
 			reddit.NewAdapter(httpClient, &reddit.RedditAuth{AccessToken: redditToken}),
 			web.NewAdapter(httpClient),
 		},
+		options,
 	)
 	r.Start()
-	r.Resolve(&opb.Link{Href: args[0]})
+	r.Resolve(&opb.Link{Href: flags.Arg(0)})
 	r.Wait()
 	r.Stop()
+
+	if *dryRun {
+		for _, id := range iferr.Exit(storages.List()) {
+			s := iferr.Exit(storages.Open(id))
+			list := iferr.Exit(s.List(&storage.ListRequest{}))
+			for _, item := range list.Items {
+				data := iferr.Exit((&storage.BlockStorage{Storage: s}).GetBytes(&storage.GetRequest{Url: item.Url}))
+				fmt.Printf("%s %10d bytes %s\n", id, len(data), item.Url)
+			}
+		}
+	}
 }
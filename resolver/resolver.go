@@ -2,11 +2,11 @@ package resolver
 
 import (
 	"chronicler/adapter"
+	"chronicler/catalog"
 	"chronicler/common"
 	opb "chronicler/proto"
 	"chronicler/storage"
 	"net/url"
-	"path/filepath"
 	"sync"
 	"time"
 )
@@ -20,6 +20,11 @@ type resolverTask struct {
 	adapter int
 }
 
+type Options struct {
+	SnapshotFormat storage.SnapshotFormat
+	Catalog        *catalog.Catalog
+}
+
 type Resolver interface {
 	Resolve(link *opb.Link) error
 	Start()
@@ -35,12 +40,16 @@ type resolver struct {
 	done     chan bool
 	tasks    chan resolverTask
 	loader   common.Downloader
-	root     string
+	storages storage.Provider
+	options  *Options
 	adapters []adapter.Adapter
 	logger   *common.Logger
 }
 
-func NewResolver(root string, loader common.Downloader, adapters []adapter.Adapter) Resolver {
+func NewResolver(storages storage.Provider, loader common.Downloader, adapters []adapter.Adapter, options *Options) Resolver {
+	if options == nil {
+		options = &Options{}
+	}
 	r := &resolver{
 		taskWaiter: sync.WaitGroup{},
 
@@ -48,7 +57,8 @@ func NewResolver(root string, loader common.Downloader, adapters []adapter.Adapt
 		tasks:    make(chan resolverTask, 10),
 		adapters: adapters,
 		loader:   loader,
-		root:     root,
+		storages: storages,
+		options:  options,
 		logger:   common.NewLogger("Resolver"),
 	}
 	r.logger.Infof("Initialized resolver with %d adapters", len(adapters))
@@ -97,7 +107,7 @@ func (r *resolver) Resolve(link *opb.Link) error {
 }
 
 func (r *resolver) getStorage(link *opb.Link) (*storage.BlockStorage, error) {
-	ls, err := storage.NewLocalStorage(filepath.Join(r.root, common.UUID4For(link)))
+	ls, err := r.storages.Open(common.UUID4For(link))
 	if err != nil {
 		return nil, err
 	}
@@ -126,10 +136,10 @@ func (r *resolver) resolveTask(task resolverTask) error {
 		Link:    link,
 		Objects: objs,
 	}
-	bytesWritten, err := s.PutObject(&storage.PutRequest{
+	bytesWritten, err := s.PutSnapshot(&storage.PutRequest{
 		Url:             objectFileName,
 		SaveOnOverwrite: true,
-	}, snapshot)
+	}, snapshot, r.options.SnapshotFormat)
 	if err != nil {
 		return err
 	}
@@ -161,12 +171,24 @@ func (r *resolver) resolveTask(task resolverTask) error {
 			r.logger.Warningf("Cannot create writer for %q: %s", k.String(), err)
 			continue
 		}
-		_, err = r.loader.Download(k.String(), writer)
+		downloaded, err := r.loader.Download(k.String(), writer)
 		if err != nil {
 			r.logger.Warningf("Failed to download %s: %s", k, err)
+			storage.CloseWithError(writer, err)
+			continue
 		}
-		writer.Close()
+		if err := writer.Close(); err != nil {
+			r.logger.Warningf("Failed to save %s: %s", k, err)
+			continue
+		}
+		bytesWritten += downloaded
 	}
 	r.logger.Infof("Saved objects: %d, files: %d", len(objs), len(filesToLoad))
+	if r.options.Catalog != nil {
+		entry := catalog.NewEntry(common.UUID4For(link), snapshot, ad.Name(), bytesWritten)
+		if err := r.options.Catalog.Put(entry); err != nil {
+			r.logger.Warningf("Cannot update catalog: %s", err)
+		}
+	}
 	return nil
 }
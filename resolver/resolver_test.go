@@ -3,11 +3,14 @@ package resolver
 import (
 	"io"
 	"reflect"
+	"strings"
 	"testing"
 
 	"chronicler/adapter"
+	"chronicler/catalog"
 	"chronicler/common"
 	opb "chronicler/proto"
+	"chronicler/storage"
 )
 
 type fakeDownloader struct {
@@ -27,6 +30,10 @@ type fakeAdapter struct {
 	objects []*opb.Object
 }
 
+func (fa *fakeAdapter) Name() string {
+	return "fake"
+}
+
 func (fa *fakeAdapter) Match(link *opb.Link) bool {
 	return true
 }
@@ -43,7 +50,6 @@ func newFakeAdapter(o ...*opb.Object) adapter.Adapter {
 
 func TestResolver(t *testing.T) {
 	t.Run("resolver start stop", func(t *testing.T) {
-		root := t.TempDir()
 		loader := &fakeDownloader{
 			urls: []string{},
 		}
@@ -55,7 +61,7 @@ func TestResolver(t *testing.T) {
 				},
 			}),
 		}
-		r := NewResolver(root, loader, adapters)
+		r := NewResolver(storage.NewMemoryProvider(nil), loader, adapters, nil)
 		r.Start()
 		if err := r.Resolve(&opb.Link{Href: "http://some/url"}); err != nil {
 			t.Errorf("Failed while resolving: %q", err)
@@ -68,3 +74,100 @@ func TestResolver(t *testing.T) {
 		}
 	})
 }
+
+func TestResolverSnapshotFormat(t *testing.T) {
+	for _, format := range []storage.SnapshotFormat{storage.FormatProtoJson, storage.FormatProtoBinary} {
+		t.Run(format.String(), func(t *testing.T) {
+			storages := storage.NewMemoryProvider(nil)
+			link := &opb.Link{Href: "http://some/url"}
+			r := NewResolver(storages, &fakeDownloader{}, []adapter.Adapter{
+				newFakeAdapter(&opb.Object{Id: "123"}),
+			}, &Options{SnapshotFormat: format})
+			r.Start()
+			r.Resolve(link)
+			r.Wait()
+			r.Stop()
+
+			s, err := storages.Open(common.UUID4For(link))
+			if err != nil {
+				t.Fatalf("Cannot open storage: %s", err)
+			}
+			bs := &storage.BlockStorage{Storage: s}
+			data, err := bs.GetBytes(&storage.GetRequest{Url: objectFileName})
+			if err != nil {
+				t.Errorf("Cannot read snapshot: %s", err)
+			}
+			wantHeader := "#chronicler-snapshot 1 " + format.String() + "\n"
+			if !strings.HasPrefix(string(data), wantHeader) {
+				t.Errorf("Expected snapshot to start with %q, but got %q", wantHeader, data)
+			}
+			snapshot, err := bs.GetSnapshot(&storage.GetRequest{Url: objectFileName})
+			if err != nil || len(snapshot.Objects) != 1 || snapshot.Objects[0].Id != "123" {
+				t.Errorf("Expected snapshot with one object, but got %v (%v)", snapshot, err)
+			}
+		})
+	}
+}
+
+func TestResolverCatalog(t *testing.T) {
+	c := catalog.New()
+	link := &opb.Link{Href: "http://some/url"}
+	r := NewResolver(storage.NewMemoryProvider(nil), &fakeDownloader{}, []adapter.Adapter{
+		newFakeAdapter(&opb.Object{Id: "1"}, &opb.Object{Id: "2", Parent: "1"}),
+	}, &Options{Catalog: c})
+	r.Start()
+	r.Resolve(link)
+	r.Resolve(link)
+	r.Wait()
+	r.Stop()
+
+	entry, ok := c.Get(common.UUID4For(link))
+	if !ok {
+		t.Fatalf("Expected catalog entry for %q", link.Href)
+	}
+	if entry.Link != link.Href || entry.Adapter != "fake" || entry.Objects != 2 ||
+		entry.Versions != 1 || entry.Size == 0 || entry.FetchTime == 0 {
+		t.Errorf("Unexpected catalog entry %v", entry)
+	}
+}
+
+func TestResolverStorageErrors(t *testing.T) {
+	objects := []*opb.Object{{
+		Id: "1",
+		Attachment: []*opb.Attachment{
+			{Url: "http://some/1.jpg", Mime: "image/jpeg"},
+			{Url: "http://some/2.jpg", Mime: "image/jpeg"},
+			{Url: "http://some/3.jpg", Mime: "image/jpeg"},
+		},
+	}}
+	for _, tc := range []struct {
+		name          string
+		options       *storage.MemoryOptions
+		wantDownloads int
+		wantSnapshot  bool
+	}{
+		{name: "no errors", options: nil, wantDownloads: 3, wantSnapshot: true},
+		{name: "snapshot not written", options: &storage.MemoryOptions{FailPut: 1}, wantDownloads: 0},
+		{name: "attachment not written", options: &storage.MemoryOptions{FailPut: 3}, wantDownloads: 2, wantSnapshot: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			storages := storage.NewMemoryProvider(tc.options)
+			loader := &fakeDownloader{}
+			link := &opb.Link{Href: "http://some/url"}
+			r := NewResolver(storages, loader, []adapter.Adapter{newFakeAdapter(objects...)}, nil)
+			r.Start()
+			r.Resolve(link)
+			r.Wait()
+			r.Stop()
+
+			if len(loader.urls) != tc.wantDownloads {
+				t.Errorf("Expected %d downloads, but got %q", tc.wantDownloads, loader.urls)
+			}
+			s, _ := storages.Open(common.UUID4For(link))
+			_, err := (&storage.BlockStorage{Storage: s}).GetSnapshot(&storage.GetRequest{Url: objectFileName})
+			if (err == nil) != tc.wantSnapshot {
+				t.Errorf("Expected snapshot to be saved: %v, but got error %v", tc.wantSnapshot, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,555 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chronicler/catalog"
+	"chronicler/common"
+	opb "chronicler/proto"
+	"chronicler/storage"
+	"chronicler/viewer"
+
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	snapshotObject = "snapshot.json"
+	// Pages show the saved html, which is cleaned, but the browser should not
+	// run scripts or load anything from other sites even if something slips.
+	pagePolicy = "default-src 'self'; script-src 'none'; object-src 'none'; style-src 'self' 'unsafe-inline'; " +
+		"base-uri 'none'; form-action 'self'; frame-ancestors 'none'"
+)
+
+var (
+	catalogTemplate = template.Must(template.New("catalog").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Chronicler</title>
+<style>
+body { font-family: sans-serif; max-width: 70em; margin: 0 auto; padding: 1em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 0.2em 0.5em; border-bottom: 1px solid #eee; }
+form input { margin-right: 0.5em; }
+</style>
+</head>
+<body>
+<h1>Snapshots</h1>
+<form method="get" action="/">
+<input name="q" placeholder="url contains" value="{{.Query.Text}}">
+<input name="host" placeholder="host" value="{{.Query.Host}}">
+<input name="adapter" placeholder="adapter" value="{{.Query.Adapter}}">
+<button type="submit">Search</button>
+</form>
+<p>{{len .Entries}} snapshots</p>
+<table>{{range .Entries}}
+<tr><td>{{.Time}}</td><td>{{.Adapter}}</td><td>{{.Objects}} objects</td><td>{{.Versions}} versions</td><td><a href="/snapshot/{{.Id}}/">{{.Link}}</a></td></tr>{{end}}
+</table>
+</body>
+</html>
+`))
+)
+
+type catalogPage struct {
+	Query struct {
+		Text    string
+		Host    string
+		Adapter string
+	}
+	Entries []*catalogRow
+}
+
+type catalogRow struct {
+	*catalog.Entry
+	Time string
+}
+
+// Version is a saved version of the snapshot, the latest one has an empty id.
+type Version struct {
+	Version   string `json:"version"`
+	FetchTime int64  `json:"fetch_time"`
+	Objects   int    `json:"objects"`
+}
+
+// threadNode is an object with its replies in the json api.
+type threadNode struct {
+	Object  json.RawMessage `json:"object"`
+	Depth   int             `json:"depth"`
+	Replies []*threadNode   `json:"replies"`
+}
+
+type snapshotResponse struct {
+	Id        string        `json:"id"`
+	Link      string        `json:"link"`
+	FetchTime int64         `json:"fetch_time"`
+	Version   string        `json:"version"`
+	Versions  []*Version    `json:"versions"`
+	Files     []string      `json:"files"`
+	Thread    []*threadNode `json:"thread"`
+}
+
+// openedSnapshot keeps what file requests and version lists need, so they do
+// not read the snapshots on every request.
+type openedSnapshot struct {
+	storage.Storage
+
+	mux sync.Mutex
+	// Mime types of the attachments in the latest snapshot fetched at mimeTime
+	mimes    map[string]string
+	mimeTime int64
+	// Sizes of the files which cannot seek by version and url
+	sizes map[[2]string]int64
+	// Saved versions never change, the latest one comes from the catalog
+	versions map[string]*Version
+}
+
+type archiveServer struct {
+	http.Handler
+
+	mux      sync.Mutex
+	storages storage.Provider
+	catalog  *catalog.Catalog
+	opened   map[string]*openedSnapshot
+	serveMux *http.ServeMux
+	logger   *common.Logger
+}
+
+// NewServer serves pages and the json api to browse the saved snapshots.
+func NewServer(storages storage.Provider, c *catalog.Catalog) http.Handler {
+	as := &archiveServer{
+		storages: storages,
+		catalog:  c,
+		opened:   map[string]*openedSnapshot{},
+		serveMux: http.NewServeMux(),
+		logger:   common.NewLogger("Server"),
+	}
+	as.serveMux.HandleFunc("GET /{$}", as.catalogPage)
+	as.serveMux.HandleFunc("GET /snapshot/{id}/{$}", as.snapshotPage)
+	as.serveMux.HandleFunc("GET /snapshot/{id}/file", as.file)
+	as.serveMux.HandleFunc("GET /api/snapshots", as.catalogApi)
+	as.serveMux.HandleFunc("GET /api/snapshot/{id}", as.snapshotApi)
+	as.serveMux.HandleFunc("GET /api/snapshot/{id}/versions", as.versionsApi)
+	return as
+}
+
+func (as *archiveServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	as.serveMux.ServeHTTP(w, r)
+}
+
+func (as *archiveServer) writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, os.ErrNotExist) {
+		status = http.StatusNotFound
+	}
+	as.logger.Warningf("Request failed: %s", err)
+	http.Error(w, err.Error(), status)
+}
+
+func setPageHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", pagePolicy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+}
+
+func (as *archiveServer) writeJson(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		as.logger.Warningf("Failed to send response: %s", err)
+	}
+}
+
+// open returns the storage of a snapshot in the catalog, so request cannot
+// create new storages.
+func (as *archiveServer) open(r *http.Request) (*catalog.Entry, *openedSnapshot, error) {
+	id := r.PathValue("id")
+	entry, ok := as.catalog.Get(id)
+	if !ok {
+		return nil, nil, fmt.Errorf("no snapshot %q: %w", id, os.ErrNotExist)
+	}
+	as.mux.Lock()
+	defer as.mux.Unlock()
+	if s, ok := as.opened[id]; ok {
+		return entry, s, nil
+	}
+	s, err := as.storages.Open(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	opened := &openedSnapshot{
+		Storage:  s,
+		sizes:    map[[2]string]int64{},
+		versions: map[string]*Version{},
+	}
+	as.opened[id] = opened
+	return entry, opened, nil
+}
+
+func (as *archiveServer) query(r *http.Request) []*catalog.Entry {
+	values := r.URL.Query()
+	entries := as.catalog.Query(&catalog.Query{
+		Host:    values.Get("host"),
+		Adapter: values.Get("adapter"),
+		SortBy:  values.Get("sort"),
+		Reverse: values.Get("sort") == "",
+	})
+	text := strings.ToLower(values.Get("q"))
+	result := []*catalog.Entry{}
+	for _, e := range entries {
+		if strings.Contains(strings.ToLower(e.Link), text) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func (as *archiveServer) catalogPage(w http.ResponseWriter, r *http.Request) {
+	page := &catalogPage{}
+	page.Query.Text = r.URL.Query().Get("q")
+	page.Query.Host = r.URL.Query().Get("host")
+	page.Query.Adapter = r.URL.Query().Get("adapter")
+	for _, e := range as.query(r) {
+		row := &catalogRow{Entry: e, Time: "?"}
+		if e.FetchTime != 0 {
+			row.Time = time.Unix(e.FetchTime, 0).Format(time.DateTime)
+		}
+		page.Entries = append(page.Entries, row)
+	}
+	setPageHeaders(w)
+	if err := catalogTemplate.Execute(w, page); err != nil {
+		as.logger.Warningf("Failed to send catalog: %s", err)
+	}
+}
+
+func (as *archiveServer) catalogApi(w http.ResponseWriter, r *http.Request) {
+	as.writeJson(w, as.query(r))
+}
+
+func readSnapshot(s storage.Storage, version string) (*opb.Snapshot, error) {
+	return (&storage.BlockStorage{Storage: s}).GetSnapshot(&storage.GetRequest{Url: snapshotObject, Version: version})
+}
+
+// versions returns the saved versions from the oldest to the latest one, only
+// versions which were not listed before are read.
+func (o *openedSnapshot) history(latest *catalog.Entry) ([]*Version, error) {
+	list, err := o.List(&storage.ListRequest{Url: []string{snapshotObject}, WithSnapshots: true})
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	if len(list.Items) > 0 {
+		ids = append(ids, list.Items[0].Versions...)
+	}
+	sort.Strings(ids)
+	result := []*Version{}
+	for _, id := range ids {
+		version, err := o.version(id)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, version)
+	}
+	return append(result, &Version{FetchTime: latest.FetchTime, Objects: latest.Objects}), nil
+}
+
+func (o *openedSnapshot) version(id string) (*Version, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if version, ok := o.versions[id]; ok {
+		return version, nil
+	}
+	snapshot, err := readSnapshot(o, id)
+	if err != nil {
+		return nil, err
+	}
+	version := &Version{Version: id, Objects: len(snapshot.Objects)}
+	if snapshot.FetchTime != nil {
+		version.FetchTime = snapshot.FetchTime.Seconds
+	}
+	o.versions[id] = version
+	return version, nil
+}
+
+// savedFiles returns urls of the saved attachments.
+func savedFiles(s storage.Storage, snapshot *opb.Snapshot) ([]string, error) {
+	list, err := s.List(&storage.ListRequest{})
+	if err != nil {
+		return nil, err
+	}
+	saved := map[string]bool{}
+	for _, item := range list.Items {
+		saved[item.Url] = true
+	}
+	result := []string{}
+	for _, obj := range snapshot.Objects {
+		for _, a := range obj.Attachment {
+			if saved[a.Url] {
+				result = append(result, a.Url)
+				saved[a.Url] = false
+			}
+		}
+	}
+	return result, nil
+}
+
+func fileUrl(id string, fileUrl string) string {
+	return fmt.Sprintf("/snapshot/%s/file?url=%s", id, url.QueryEscape(fileUrl))
+}
+
+func (as *archiveServer) snapshotPage(w http.ResponseWriter, r *http.Request) {
+	entry, s, err := as.open(r)
+	if err != nil {
+		as.writeError(w, err)
+		return
+	}
+	version := r.URL.Query().Get("version")
+	snapshot, err := readSnapshot(s, version)
+	if err != nil {
+		as.writeError(w, err)
+		return
+	}
+	saved, err := savedFiles(s, snapshot)
+	if err != nil {
+		as.writeError(w, err)
+		return
+	}
+	history, err := s.history(entry)
+	if err != nil {
+		as.writeError(w, err)
+		return
+	}
+	id := entry.Id
+	page := &viewer.HtmlPage{Id: id, Snapshot: snapshot, Files: map[string]string{}, Index: "/"}
+	for _, u := range saved {
+		page.Files[u] = fileUrl(id, u)
+	}
+	if len(history) > 1 {
+		for _, v := range history {
+			name := time.Unix(v.FetchTime, 0).Format(time.DateTime)
+			if v.Version == "" {
+				name += " (latest)"
+			}
+			href := "?version=" + url.QueryEscape(v.Version)
+			if v.Version == "" {
+				href = "./"
+			}
+			page.Versions = append(page.Versions, &viewer.HtmlLink{Name: name, Href: href})
+		}
+	}
+	setPageHeaders(w)
+	if err := page.Write(w); err != nil {
+		as.logger.Warningf("Failed to send %s: %s", id, err)
+	}
+}
+
+func toThread(nodes []*viewer.Node) ([]*threadNode, error) {
+	result := []*threadNode{}
+	for _, node := range nodes {
+		data, err := protojson.Marshal(node.Object)
+		if err != nil {
+			return nil, err
+		}
+		replies, err := toThread(node.Children)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &threadNode{Object: data, Depth: node.Depth, Replies: replies})
+	}
+	return result, nil
+}
+
+func (as *archiveServer) snapshotApi(w http.ResponseWriter, r *http.Request) {
+	entry, s, err := as.open(r)
+	if err != nil {
+		as.writeError(w, err)
+		return
+	}
+	response := &snapshotResponse{Id: entry.Id, Version: r.URL.Query().Get("version")}
+	snapshot, err := readSnapshot(s, response.Version)
+	if err != nil {
+		as.writeError(w, err)
+		return
+	}
+	if snapshot.Link != nil {
+		response.Link = snapshot.Link.Href
+	}
+	if snapshot.FetchTime != nil {
+		response.FetchTime = snapshot.FetchTime.Seconds
+	}
+	if response.Versions, err = s.history(entry); err != nil {
+		as.writeError(w, err)
+		return
+	}
+	if response.Files, err = savedFiles(s, snapshot); err != nil {
+		as.writeError(w, err)
+		return
+	}
+	if response.Thread, err = toThread(viewer.BuildThread(snapshot.Objects)); err != nil {
+		as.writeError(w, err)
+		return
+	}
+	as.writeJson(w, response)
+}
+
+func (as *archiveServer) versionsApi(w http.ResponseWriter, r *http.Request) {
+	entry, s, err := as.open(r)
+	if err != nil {
+		as.writeError(w, err)
+		return
+	}
+	result, err := s.history(entry)
+	if err != nil {
+		as.writeError(w, err)
+		return
+	}
+	as.writeJson(w, result)
+}
+
+// reopeningReader serves ranges of files which cannot seek, the file is
+// opened again and skipped to the position when a read follows a seek.
+type reopeningReader struct {
+	io.ReadSeeker
+
+	open     func() (io.ReadCloser, error)
+	size     int64
+	position int64
+	reader   io.ReadCloser
+}
+
+func (rr *reopeningReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += rr.position
+	case io.SeekEnd:
+		offset += rr.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("cannot seek to negative position %d", offset)
+	}
+	if offset != rr.position {
+		rr.Close()
+	}
+	rr.position = offset
+	return offset, nil
+}
+
+func (rr *reopeningReader) Read(data []byte) (int, error) {
+	if rr.reader == nil {
+		reader, err := rr.open()
+		if err != nil {
+			return 0, err
+		}
+		rr.reader = reader
+		if _, err := io.CopyN(io.Discard, reader, rr.position); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rr.reader.Read(data)
+	rr.position += int64(n)
+	return n, err
+}
+
+func (rr *reopeningReader) Close() error {
+	if rr.reader == nil {
+		return nil
+	}
+	err := rr.reader.Close()
+	rr.reader = nil
+	return err
+}
+
+// content returns a seekable reader of the file, files which cannot seek are
+// read through once to know their size.
+func (o *openedSnapshot) content(get *storage.GetRequest) (io.ReadSeeker, func(), error) {
+	reader, err := o.Get(get)
+	if err != nil {
+		return nil, nil, err
+	}
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		return seeker, func() { reader.Close() }, nil
+	}
+	key := [2]string{get.Version, get.Url}
+	o.mux.Lock()
+	size, ok := o.sizes[key]
+	o.mux.Unlock()
+	if !ok {
+		size, err = io.Copy(io.Discard, reader)
+		reader.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		o.mux.Lock()
+		o.sizes[key] = size
+		o.mux.Unlock()
+		reader = nil
+	}
+	rr := &reopeningReader{
+		open:   func() (io.ReadCloser, error) { return o.Get(get) },
+		size:   size,
+		reader: reader,
+	}
+	return rr, func() { rr.Close() }, nil
+}
+
+// mimeType of the attachment from the latest snapshot, guessed from the url
+// if the snapshot has none.
+func (o *openedSnapshot) mimeType(latest *catalog.Entry, fileUrl string) (string, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if o.mimes == nil || o.mimeTime != latest.FetchTime {
+		snapshot, err := readSnapshot(o, "")
+		if err != nil {
+			return "", err
+		}
+		o.mimes = map[string]string{}
+		o.mimeTime = latest.FetchTime
+		for _, obj := range snapshot.Objects {
+			for _, a := range obj.Attachment {
+				if _, ok := o.mimes[a.Url]; !ok && a.Mime != "" {
+					o.mimes[a.Url] = a.Mime
+				}
+			}
+		}
+	}
+	if mime, ok := o.mimes[fileUrl]; ok {
+		return mime, nil
+	}
+	return common.GuessMimeType(fileUrl), nil
+}
+
+func (as *archiveServer) file(w http.ResponseWriter, r *http.Request) {
+	entry, s, err := as.open(r)
+	if err != nil {
+		as.writeError(w, err)
+		return
+	}
+	fileUrl := r.URL.Query().Get("url")
+	contentType, err := s.mimeType(entry, fileUrl)
+	if err != nil {
+		as.writeError(w, err)
+		return
+	}
+	content, cleanup, err := s.content(&storage.GetRequest{Url: fileUrl, Version: r.URL.Query().Get("version")})
+	if err != nil {
+		as.writeError(w, err)
+		return
+	}
+	defer cleanup()
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	// Saved pages and images must not run scripts on the archive pages
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"chronicler/catalog"
+	"chronicler/common"
+	opb "chronicler/proto"
+	"chronicler/storage"
+)
+
+var (
+	testLink = &opb.Link{Href: "http://some/url"}
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	storages := storage.NewMemoryProvider(nil)
+	id := common.UUID4For(testLink)
+	s, _ := storages.Open(id)
+	bs := &storage.BlockStorage{Storage: s}
+	first := &opb.Snapshot{
+		Link:      testLink,
+		FetchTime: &opb.Timestamp{Seconds: 1700000000},
+		Objects:   []*opb.Object{{Id: "1", Content: []*opb.Content{{Text: "First version"}}}},
+	}
+	latest := &opb.Snapshot{
+		Link:      testLink,
+		FetchTime: &opb.Timestamp{Seconds: 1700000100},
+		Objects: []*opb.Object{
+			{
+				Id:         "1",
+				Content:    []*opb.Content{{Text: "Latest version"}},
+				Attachment: []*opb.Attachment{{Url: "http://some/video.mp4", Mime: "video/mp4"}},
+			},
+			{Id: "2", Parent: "1", Content: []*opb.Content{{Text: "Reply"}}},
+		},
+	}
+	for _, snapshot := range []*opb.Snapshot{first, latest} {
+		bs.PutSnapshot(&storage.PutRequest{Url: snapshotObject, SaveOnOverwrite: true}, snapshot, storage.FormatProtoJson)
+	}
+	bs.PutBytes(&storage.PutRequest{Url: "http://some/video.mp4"}, []byte("0123456789"))
+
+	c, err := catalog.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Cannot open catalog: %s", err)
+	}
+	c.Put(catalog.NewEntry(id, latest, "web", 100))
+	c.Put(&catalog.Entry{Id: "other", Link: "http://other/url"})
+	server := httptest.NewServer(NewServer(storages, c))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(t *testing.T, url string, header map[string]string) (*http.Response, string) {
+	request, _ := http.NewRequest("GET", url, nil)
+	for k, v := range header {
+		request.Header.Set(k, v)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	return response, string(body)
+}
+
+func TestServerPages(t *testing.T) {
+	server := newTestServer(t)
+	id := common.UUID4For(testLink)
+	for _, tc := range []struct {
+		name    string
+		path    string
+		status  int
+		want    []string
+		notWant []string
+	}{
+		{
+			name:   "catalog",
+			path:   "/",
+			status: http.StatusOK,
+			want:   []string{`<a href="/snapshot/` + id + `/">http://some/url</a>`, "http://other/url", "2 snapshots"},
+		},
+		{
+			name:    "catalog search",
+			path:    "/?q=SOME",
+			status:  http.StatusOK,
+			want:    []string{"http://some/url", "1 snapshots"},
+			notWant: []string{"http://other/url"},
+		},
+		{
+			name:   "snapshot",
+			path:   "/snapshot/" + id + "/",
+			status: http.StatusOK,
+			want: []string{
+				"Latest version",
+				`<div class="children">`,
+				`<video src="/snapshot/` + id + `/file?url=http%3a%2f%2fsome%2fvideo.mp4"`,
+				`<a href="?version=0000">`,
+				"(latest)",
+			},
+		},
+		{
+			name:    "old version",
+			path:    "/snapshot/" + id + "/?version=0000",
+			status:  http.StatusOK,
+			want:    []string{"First version"},
+			notWant: []string{"Latest version"},
+		},
+		{
+			name:   "unknown snapshot",
+			path:   "/snapshot/unknown/",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "unknown version",
+			path:   "/snapshot/" + id + "/?version=0005",
+			status: http.StatusNotFound,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			response, body := get(t, server.URL+tc.path, nil)
+			if response.StatusCode != tc.status {
+				t.Fatalf("Expected status %d, but got %d: %s", tc.status, response.StatusCode, body)
+			}
+			if policy := response.Header.Get("Content-Security-Policy"); tc.status == http.StatusOK && !strings.Contains(policy, "script-src 'none'") {
+				t.Errorf("Expected a policy without scripts, but got %q", policy)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(strings.ToLower(body), strings.ToLower(want)) {
+					t.Errorf("Expected page to contain %q, but got %s", want, body)
+				}
+			}
+			for _, notWant := range tc.notWant {
+				if strings.Contains(body, notWant) {
+					t.Errorf("Expected page not to contain %q", notWant)
+				}
+			}
+		})
+	}
+}
+
+func TestServerFiles(t *testing.T) {
+	server := newTestServer(t)
+	path := server.URL + "/snapshot/" + common.UUID4For(testLink) + "/file?url=http%3A%2F%2Fsome%2Fvideo.mp4"
+	for _, tc := range []struct {
+		name   string
+		header map[string]string
+		status int
+		body   string
+	}{
+		{name: "whole file", status: http.StatusOK, body: "0123456789"},
+		{name: "range", header: map[string]string{"Range": "bytes=2-5"}, status: http.StatusPartialContent, body: "2345"},
+		{name: "suffix range", header: map[string]string{"Range": "bytes=-3"}, status: http.StatusPartialContent, body: "789"},
+		{name: "multiple ranges", header: map[string]string{"Range": "bytes=6-7,1-2"}, status: http.StatusPartialContent},
+		{name: "range again", header: map[string]string{"Range": "bytes=8-"}, status: http.StatusPartialContent, body: "89"},
+		{name: "bad range", header: map[string]string{"Range": "bytes=20-30"}, status: http.StatusRequestedRangeNotSatisfiable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			response, body := get(t, path, tc.header)
+			if response.StatusCode != tc.status {
+				t.Fatalf("Expected status %d, but got %d", tc.status, response.StatusCode)
+			}
+			if tc.body != "" && body != tc.body {
+				t.Errorf("Expected %q, but got %q", tc.body, body)
+			}
+			if got := response.Header.Get("Content-Type"); tc.body != "" && got != "video/mp4" {
+				t.Errorf("Expected video/mp4, but got %q", got)
+			}
+		})
+	}
+
+	t.Run("not saved", func(t *testing.T) {
+		if response, _ := get(t, path+"x", nil); response.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected not found, but got %d", response.StatusCode)
+		}
+	})
+}
+
+func TestServerApi(t *testing.T) {
+	server := newTestServer(t)
+	id := common.UUID4For(testLink)
+
+	t.Run("snapshots", func(t *testing.T) {
+		_, body := get(t, server.URL+"/api/snapshots?host=some", nil)
+		entries := []*catalog.Entry{}
+		if err := json.Unmarshal([]byte(body), &entries); err != nil {
+			t.Fatalf("Cannot parse %q: %s", body, err)
+		}
+		if len(entries) != 1 || entries[0].Id != id || entries[0].Objects != 2 {
+			t.Errorf("Unexpected entries %s", body)
+		}
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		response, body := get(t, server.URL+"/api/snapshot/"+id, nil)
+		if got := response.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("Expected json, but got %q", got)
+		}
+		result := &snapshotResponse{}
+		if err := json.Unmarshal([]byte(body), result); err != nil {
+			t.Fatalf("Cannot parse %q: %s", body, err)
+		}
+		if result.Link != testLink.Href || result.FetchTime != 1700000100 || len(result.Versions) != 2 {
+			t.Errorf("Unexpected snapshot %s", body)
+		}
+		if len(result.Files) != 1 || result.Files[0] != "http://some/video.mp4" {
+			t.Errorf("Unexpected files %q", result.Files)
+		}
+		if len(result.Thread) != 1 || len(result.Thread[0].Replies) != 1 || result.Thread[0].Replies[0].Depth != 1 {
+			t.Fatalf("Unexpected thread %s", body)
+		}
+		reply := &opb.Object{}
+		json.Unmarshal(result.Thread[0].Replies[0].Object, reply)
+		if reply.Id != "2" || reply.Content[0].Text != "Reply" {
+			t.Errorf("Unexpected reply %v", reply)
+		}
+	})
+
+	t.Run("versions", func(t *testing.T) {
+		_, body := get(t, server.URL+"/api/snapshot/"+id+"/versions", nil)
+		versions := []*Version{}
+		json.Unmarshal([]byte(body), &versions)
+		want := []Version{{Version: "0000", FetchTime: 1700000000, Objects: 1}, {Version: "", FetchTime: 1700000100, Objects: 2}}
+		if len(versions) != 2 || *versions[0] != want[0] || *versions[1] != want[1] {
+			t.Errorf("Expected versions %v, but got %s", want, body)
+		}
+	})
+}
@@ -15,8 +15,12 @@ func (bs *BlockStorage) PutBytes(put *PutRequest, data []byte) (int64, error) {
 	if err != nil {
 		return -1, err
 	}
-	defer writer.Close()
-	return io.Copy(writer, bytes.NewReader(data))
+	written, err := io.Copy(writer, bytes.NewReader(data))
+	if err != nil {
+		CloseWithError(writer, err)
+		return written, err
+	}
+	return written, writer.Close()
 }
 
 func (bs *BlockStorage) GetBytes(get *GetRequest) ([]byte, error) {
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"chronicler/common"
+)
+
+var (
+	// Written before the gzip stream, so the data saved without compression
+	// can be told apart and returned as is.
+	compressionMagic = []byte{0x89, 'C', 'H', 'Z', '\r', '\n', 0x1a, '\n'}
+
+	// Mime type prefixes for the data which is compressed already.
+	DefaultSkipMime = []string{
+		"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif",
+		"video/", "audio/", "font/woff",
+		"application/zip", "application/gzip", "application/x-gzip",
+		"application/zstd", "application/x-bzip2", "application/x-xz",
+		"application/x-7z-compressed", "application/vnd.rar",
+	}
+)
+
+type compressedWriter struct {
+	io.WriteCloser
+
+	gz     *gzip.Writer
+	target io.WriteCloser
+}
+
+func (cw *compressedWriter) Write(data []byte) (int, error) {
+	return cw.gz.Write(data)
+}
+
+func (cw *compressedWriter) Close() error {
+	gzErr := cw.gz.Close()
+	if err := cw.target.Close(); err != nil {
+		return err
+	}
+	return gzErr
+}
+
+func (cw *compressedWriter) CloseWithError(err error) error {
+	cw.gz.Close()
+	return CloseWithError(cw.target, err)
+}
+
+type compressedReader struct {
+	io.ReadCloser
+
+	reader io.Reader
+	source io.ReadCloser
+}
+
+func (cr *compressedReader) Read(data []byte) (int, error) {
+	return cr.reader.Read(data)
+}
+
+func (cr *compressedReader) Close() error {
+	return cr.source.Close()
+}
+
+type compressedStorage struct {
+	Storage
+
+	storage Storage
+	skip    []string
+}
+
+// NewCompressedStorage gzips everything written to the storage, except for
+// the urls with mime type starting with one of the skip prefixes.
+func NewCompressedStorage(storage Storage, skip []string) Storage {
+	return &compressedStorage{
+		storage: storage,
+		skip:    skip,
+	}
+}
+
+func (cs *compressedStorage) shouldCompress(url string) bool {
+	mime := common.GuessMimeType(url)
+	for _, prefix := range cs.skip {
+		if strings.HasPrefix(mime, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cs *compressedStorage) Put(put *PutRequest) (io.WriteCloser, error) {
+	writer, err := cs.storage.Put(put)
+	if err != nil || !cs.shouldCompress(put.Url) {
+		return writer, err
+	}
+	if _, err := writer.Write(compressionMagic); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	return &compressedWriter{
+		gz:     gzip.NewWriter(writer),
+		target: writer,
+	}, nil
+}
+
+func (cs *compressedStorage) Get(get *GetRequest) (io.ReadCloser, error) {
+	reader, err := cs.storage.Get(get)
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReader(reader)
+	header, _ := buffered.Peek(len(compressionMagic))
+	if !bytes.Equal(header, compressionMagic) {
+		// Files can be served with ranges if they are not compressed
+		if seeker, ok := reader.(io.Seeker); ok {
+			if _, err := seeker.Seek(0, io.SeekStart); err == nil {
+				return reader, nil
+			}
+		}
+		return &compressedReader{reader: buffered, source: reader}, nil
+	}
+	buffered.Discard(len(compressionMagic))
+	gz, err := gzip.NewReader(buffered)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return &compressedReader{reader: gz, source: reader}, nil
+}
+
+func (cs *compressedStorage) List(list *ListRequest) (*ListResponse, error) {
+	return cs.storage.List(list)
+}
+
+func (cs *compressedStorage) Verify() ([]*Problem, error) {
+	v, err := verifier(cs.storage)
+	if err != nil {
+		return nil, err
+	}
+	return v.Verify()
+}
+
+func (cs *compressedStorage) Repair(urls []string) ([]string, error) {
+	v, err := verifier(cs.storage)
+	if err != nil {
+		return nil, err
+	}
+	return v.Repair(urls)
+}
+
+type compressedProvider struct {
+	Provider
+
+	provider Provider
+	skip     []string
+}
+
+func NewCompressedProvider(provider Provider, skip []string) Provider {
+	return &compressedProvider{
+		provider: provider,
+		skip:     skip,
+	}
+}
+
+func (cp *compressedProvider) Open(id string) (Storage, error) {
+	s, err := cp.provider.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	return NewCompressedStorage(s, cp.skip), nil
+}
+
+func (cp *compressedProvider) List() ([]string, error) {
+	return cp.provider.List()
+}
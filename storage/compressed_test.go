@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompressedStorage(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		url          string
+		data         []byte
+		wantCompress bool
+	}{
+		{
+			name:         "json compressed",
+			url:          "snapshot.json",
+			data:         []byte(strings.Repeat("{\"some\": \"data\"}", 100)),
+			wantCompress: true,
+		},
+		{
+			name:         "unknown type compressed",
+			url:          "http://some/page",
+			data:         []byte(strings.Repeat("<html></html>", 100)),
+			wantCompress: true,
+		},
+		{
+			name:         "empty payload",
+			url:          "http://some/page.html",
+			data:         []byte{},
+			wantCompress: true,
+		},
+		{
+			name: "image skipped",
+			url:  "http://some/image.jpg",
+			data: []byte{0xff, 0xd8, 0xff, 1, 2, 3},
+		},
+		{
+			name: "video skipped",
+			url:  "http://some/video.mp4?query=1",
+			data: []byte{1, 2, 3},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			local, err := NewLocalStorage(t.TempDir())
+			if err != nil {
+				t.Fatalf("Cannot create temporary storage: %s", err)
+			}
+			s := NewCompressedStorage(local, DefaultSkipMime)
+			if err := write(s, tc.url, tc.data); err != nil {
+				t.Errorf("Cannot write to storage: %s", err)
+			}
+
+			raw := &BlockStorage{Storage: local}
+			rawBytes, err := raw.GetBytes(&GetRequest{Url: tc.url})
+			if err != nil {
+				t.Errorf("Cannot read raw bytes: %s", err)
+			}
+			if compressed := bytes.HasPrefix(rawBytes, compressionMagic); compressed != tc.wantCompress {
+				t.Errorf("Expected %q to be compressed: %v, but got %v", tc.url, tc.wantCompress, compressed)
+			}
+
+			rc, err := s.Get(&GetRequest{Url: tc.url})
+			if err != nil {
+				t.Errorf("Cannot open reader for %q: %s", tc.url, err)
+			}
+			got, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Errorf("Error while reading %q: %s", tc.url, err)
+			}
+			if !reflect.DeepEqual(got, tc.data) {
+				t.Errorf("Expected to read %v, but got %v", tc.data, got)
+			}
+		})
+	}
+
+	t.Run("reads uncompressed data", func(t *testing.T) {
+		local, err := NewLocalStorage(t.TempDir())
+		if err != nil {
+			t.Fatalf("Cannot create temporary storage: %s", err)
+		}
+		want := []byte("{\"written\": \"before compression\"}")
+		if err := write(local, "snapshot.json", want); err != nil {
+			t.Errorf("Cannot write to storage: %s", err)
+		}
+
+		bs := &BlockStorage{Storage: NewCompressedStorage(local, DefaultSkipMime)}
+		got, err := bs.GetBytes(&GetRequest{Url: "snapshot.json"})
+		if err != nil {
+			t.Errorf("Cannot read old data: %s", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected to read %q, but got %q", want, got)
+		}
+
+		reader, err := bs.Get(&GetRequest{Url: "snapshot.json"})
+		if err != nil {
+			t.Fatalf("Cannot read old data: %s", err)
+		}
+		defer reader.Close()
+		if _, ok := reader.(io.Seeker); !ok {
+			t.Errorf("Expected uncompressed local file to be seekable")
+		}
+	})
+}
+
+func TestCompressedProvider(t *testing.T) {
+	root := t.TempDir()
+	p := NewCompressedProvider(NewLocalProvider(root), DefaultSkipMime)
+	for _, id := range []string{"00000000-0000-4000-8000-000000000012", "00000000-0000-4000-8000-000000000011"} {
+		s, err := p.Open(id)
+		if err != nil {
+			t.Fatalf("Cannot open storage %q: %s", id, err)
+		}
+		if err := write(s, "snapshot.json", []byte(id)); err != nil {
+			t.Errorf("Cannot write to storage %q: %s", id, err)
+		}
+	}
+
+	ids, err := p.List()
+	if err != nil {
+		t.Errorf("Cannot list storages: %s", err)
+	}
+	if want := []string{"00000000-0000-4000-8000-000000000011", "00000000-0000-4000-8000-000000000012"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("Expected ids to be %q, but got %q", want, ids)
+	}
+}
@@ -0,0 +1,626 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// Version 2 adds the archive salt, version 1 archives are still readable
+	encryptionVersion    = 2
+	encryptionHeaderUrl  = "encryption.json"
+	encryptionIndexUrl   = "\x00index"
+	encryptionChunkSize  = 64 * 1024
+	encryptionKeySize    = 32
+	encryptionSaltSize   = 16
+	encryptionNonceSize  = 8
+	encryptionLastChunk  = 1 << 31
+	defaultKdfIterations = 600000
+)
+
+var (
+	ErrWrongKey     = errors.New("wrong encryption key")
+	ErrNotEncrypted = errors.New("storage is not encrypted")
+	ErrTruncated    = errors.New("encrypted data is truncated")
+)
+
+// EncryptionKey is either a raw key or a passphrase, keys derived from the
+// passphrase are cached, so the same salt is used for all new storages and
+// the archive salt of each storage separates their keys.
+type EncryptionKey struct {
+	mux        sync.Mutex
+	passphrase string
+	raw        []byte
+	salt       []byte
+	derived    map[string][]byte
+}
+
+func KeyFromPassphrase(passphrase string) *EncryptionKey {
+	return &EncryptionKey{
+		passphrase: passphrase,
+		derived:    map[string][]byte{},
+	}
+}
+
+// KeyFromFile reads a 32 bytes key, either raw or hex encoded.
+func KeyFromFile(path string) (*EncryptionKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if decoded, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		data = decoded
+	}
+	if len(data) != encryptionKeySize {
+		return nil, fmt.Errorf("key file %q should contain %d bytes, but got %d", path, encryptionKeySize, len(data))
+	}
+	return &EncryptionKey{raw: data}, nil
+}
+
+type encryptionHeader struct {
+	Version    int    `json:"version"`
+	Kdf        string `json:"kdf"`
+	Iterations int    `json:"iterations,omitempty"`
+	Salt       []byte `json:"salt"`
+	// Random for every archive, so archives sharing the cached salt of the
+	// passphrase still get their own keys and url hashes.
+	Archive []byte `json:"archive,omitempty"`
+	Check   []byte `json:"check"`
+}
+
+func (ek *EncryptionKey) newHeader() (*encryptionHeader, error) {
+	ek.mux.Lock()
+	defer ek.mux.Unlock()
+	if ek.salt == nil {
+		ek.salt = make([]byte, encryptionSaltSize)
+		if _, err := rand.Read(ek.salt); err != nil {
+			return nil, err
+		}
+	}
+	archive := make([]byte, encryptionSaltSize)
+	if _, err := rand.Read(archive); err != nil {
+		return nil, err
+	}
+	if ek.raw != nil {
+		return &encryptionHeader{Version: encryptionVersion, Kdf: "none", Salt: ek.salt, Archive: archive}, nil
+	}
+	return &encryptionHeader{
+		Version:    encryptionVersion,
+		Kdf:        "pbkdf2-sha256",
+		Iterations: defaultKdfIterations,
+		Salt:       ek.salt,
+		Archive:    archive,
+	}, nil
+}
+
+func (ek *EncryptionKey) master(header *encryptionHeader) ([]byte, error) {
+	ek.mux.Lock()
+	defer ek.mux.Unlock()
+	switch header.Kdf {
+	case "none":
+		if ek.raw == nil {
+			return nil, fmt.Errorf("%w: storage needs a key file, not a passphrase", ErrWrongKey)
+		}
+		return ek.raw, nil
+	case "pbkdf2-sha256":
+		if ek.raw != nil {
+			return nil, fmt.Errorf("%w: storage needs a passphrase, not a key file", ErrWrongKey)
+		}
+		cacheKey := fmt.Sprintf("%x_%d", header.Salt, header.Iterations)
+		if key, ok := ek.derived[cacheKey]; ok {
+			return key, nil
+		}
+		key, err := pbkdf2.Key(sha256.New, ek.passphrase, header.Salt, header.Iterations, encryptionKeySize)
+		if err != nil {
+			return nil, err
+		}
+		if ek.salt == nil {
+			ek.salt = header.Salt
+		}
+		ek.derived[cacheKey] = key
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key derivation function %q", header.Kdf)
+}
+
+type encryptedWriter struct {
+	io.WriteCloser
+
+	aead    cipher.AEAD
+	name    string
+	nonce   []byte
+	counter uint32
+	buffer  []byte
+	target  io.WriteCloser
+}
+
+func (ew *encryptedWriter) sealChunk(last bool) error {
+	header := uint32(len(ew.buffer))
+	if last {
+		header |= encryptionLastChunk
+	}
+	chunk := binary.BigEndian.AppendUint32(nil, header)
+	chunk = ew.aead.Seal(chunk, chunkNonce(ew.nonce, ew.counter), ew.buffer, chunkData(ew.name, ew.counter, last))
+	ew.counter++
+	ew.buffer = ew.buffer[:0]
+	_, err := ew.target.Write(chunk)
+	return err
+}
+
+func (ew *encryptedWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		toCopy := min(encryptionChunkSize-len(ew.buffer), len(data))
+		ew.buffer = append(ew.buffer, data[:toCopy]...)
+		data = data[toCopy:]
+		written += toCopy
+		if len(ew.buffer) == encryptionChunkSize {
+			if err := ew.sealChunk(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (ew *encryptedWriter) Close() error {
+	sealErr := ew.sealChunk(true)
+	if err := ew.target.Close(); err != nil {
+		return err
+	}
+	return sealErr
+}
+
+func (ew *encryptedWriter) CloseWithError(err error) error {
+	return CloseWithError(ew.target, err)
+}
+
+type encryptedReader struct {
+	io.ReadCloser
+
+	aead    cipher.AEAD
+	name    string
+	nonce   []byte
+	counter uint32
+	last    bool
+	buffer  []byte
+	source  io.ReadCloser
+}
+
+func (er *encryptedReader) openChunk() error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(er.source, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrTruncated
+		}
+		return err
+	}
+	size := binary.BigEndian.Uint32(header)
+	last := size&encryptionLastChunk != 0
+	size &^= encryptionLastChunk
+	if size > encryptionChunkSize {
+		return fmt.Errorf("encrypted chunk is too big: %d", size)
+	}
+	sealed := make([]byte, int(size)+er.aead.Overhead())
+	if _, err := io.ReadFull(er.source, sealed); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrTruncated
+		}
+		return err
+	}
+	data, err := er.aead.Open(sealed[:0], chunkNonce(er.nonce, er.counter), sealed, chunkData(er.name, er.counter, last))
+	if err != nil {
+		return fmt.Errorf("cannot decrypt chunk %d of %q: %w", er.counter, er.name, err)
+	}
+	er.counter++
+	er.last = last
+	er.buffer = data
+	return nil
+}
+
+func (er *encryptedReader) Read(data []byte) (int, error) {
+	for len(er.buffer) == 0 {
+		if er.last {
+			return 0, io.EOF
+		}
+		if err := er.openChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(data, er.buffer)
+	er.buffer = er.buffer[n:]
+	return n, nil
+}
+
+func (er *encryptedReader) Close() error {
+	return er.source.Close()
+}
+
+// seekableEncryptedReader seeks in the encrypted file chunk by chunk, all
+// chunks but the last one have encryptionChunkSize bytes of data.
+type seekableEncryptedReader struct {
+	*encryptedReader
+
+	seeker   io.Seeker
+	position int64
+	// Bytes of the chunk to drop after it is decrypted
+	skip int64
+}
+
+func (sr *seekableEncryptedReader) sealedChunkSize() int64 {
+	return int64(4 + encryptionChunkSize + sr.aead.Overhead())
+}
+
+// size of the decrypted data, computed from the size of the file.
+func (sr *seekableEncryptedReader) size() (int64, error) {
+	total, err := sr.seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	rest := total - encryptionNonceSize - int64(4+sr.aead.Overhead())
+	if rest < 0 {
+		return 0, ErrTruncated
+	}
+	chunks := rest / sr.sealedChunkSize()
+	return chunks*encryptionChunkSize + rest%sr.sealedChunkSize(), nil
+}
+
+func (sr *seekableEncryptedReader) Seek(offset int64, whence int) (int64, error) {
+	size, err := sr.size()
+	if err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += sr.position
+	case io.SeekEnd:
+		offset += size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("cannot seek to negative position %d", offset)
+	}
+	sr.position = offset
+	sr.buffer = nil
+	if offset >= size {
+		// Reads after the end return io.EOF
+		sr.last = true
+		sr.skip = 0
+		return offset, nil
+	}
+	chunk := offset / encryptionChunkSize
+	if _, err := sr.seeker.Seek(encryptionNonceSize+chunk*sr.sealedChunkSize(), io.SeekStart); err != nil {
+		return 0, err
+	}
+	sr.counter = uint32(chunk)
+	sr.last = false
+	sr.skip = offset % encryptionChunkSize
+	return offset, nil
+}
+
+func (sr *seekableEncryptedReader) Read(data []byte) (int, error) {
+	for sr.skip > 0 {
+		if sr.last && len(sr.buffer) == 0 {
+			return 0, io.EOF
+		}
+		if len(sr.buffer) == 0 {
+			if err := sr.openChunk(); err != nil {
+				return 0, err
+			}
+		}
+		dropped := min(sr.skip, int64(len(sr.buffer)))
+		sr.buffer = sr.buffer[dropped:]
+		sr.skip -= dropped
+	}
+	n, err := sr.encryptedReader.Read(data)
+	sr.position += int64(n)
+	return n, err
+}
+
+func chunkNonce(prefix []byte, counter uint32) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte{}, prefix...), counter)
+}
+
+func chunkData(name string, counter uint32, last bool) []byte {
+	result := binary.BigEndian.AppendUint32([]byte(name), counter)
+	if last {
+		return append(result, 1)
+	}
+	return append(result, 0)
+}
+
+type encryptedStorage struct {
+	Storage
+
+	mux      sync.Mutex
+	storage  Storage
+	aead     cipher.AEAD
+	nameKey  []byte
+	urls     map[string]string
+	indexUrl string
+}
+
+// NewEncryptedStorage encrypts both the data and the urls with AES-GCM, the
+// real urls are kept in the encrypted index, so the underlying storage only
+// sees hashes.
+func NewEncryptedStorage(storage Storage, key *EncryptionKey) (Storage, error) {
+	bs := &BlockStorage{Storage: storage}
+	header := &encryptionHeader{}
+	if err := bs.GetObject(&GetRequest{Url: encryptionHeaderUrl}, header); err != nil {
+		list, listErr := storage.List(&ListRequest{})
+		if listErr != nil {
+			return nil, listErr
+		}
+		if len(list.Items) > 0 {
+			return nil, ErrNotEncrypted
+		}
+		if header, err = key.newHeader(); err != nil {
+			return nil, err
+		}
+	}
+	if header.Version < 1 || header.Version > encryptionVersion {
+		return nil, fmt.Errorf("unsupported encryption version %d", header.Version)
+	}
+	if header.Version > 1 && header.Archive == nil {
+		return nil, fmt.Errorf("encryption header version %d has no archive salt", header.Version)
+	}
+
+	master, err := key.master(header)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(append([]byte{}, header.Salt...), header.Archive...)
+	contentKey, err := hkdf.Key(sha256.New, master, salt, "chronicler content", encryptionKeySize)
+	if err != nil {
+		return nil, err
+	}
+	nameKey, err := hkdf.Key(sha256.New, master, salt, "chronicler names", encryptionKeySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	es := &encryptedStorage{
+		storage: storage,
+		aead:    aead,
+		nameKey: nameKey,
+		urls:    map[string]string{},
+	}
+	es.indexUrl = es.localName(encryptionIndexUrl)
+
+	check := es.hmac("chronicler key check")
+	if header.Check == nil {
+		header.Check = check
+		if _, err := bs.PutObject(&PutRequest{Url: encryptionHeaderUrl}, header); err != nil {
+			return nil, err
+		}
+	} else if !hmac.Equal(header.Check, check) {
+		return nil, ErrWrongKey
+	}
+	if err := es.readIndex(); err != nil {
+		return nil, err
+	}
+	return es, nil
+}
+
+func (es *encryptedStorage) hmac(value string) []byte {
+	mac := hmac.New(sha256.New, es.nameKey)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+func (es *encryptedStorage) localName(url string) string {
+	return hex.EncodeToString(es.hmac(url)[:16])
+}
+
+func (es *encryptedStorage) readIndex() error {
+	reader, err := es.open(es.indexUrl, &GetRequest{Url: es.indexUrl})
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer reader.Close()
+	urls := []string{}
+	if err := json.NewDecoder(reader).Decode(&urls); err != nil {
+		return err
+	}
+	for _, url := range urls {
+		es.urls[es.localName(url)] = url
+	}
+	return nil
+}
+
+func (es *encryptedStorage) saveIndex() error {
+	urls := []string{}
+	for _, url := range es.urls {
+		urls = append(urls, url)
+	}
+	data, err := json.Marshal(urls)
+	if err != nil {
+		return err
+	}
+	writer, err := es.create(&PutRequest{Url: es.indexUrl})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, bytes.NewReader(data)); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+func (es *encryptedStorage) create(put *PutRequest) (io.WriteCloser, error) {
+	nonce := make([]byte, encryptionNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	writer, err := es.storage.Put(put)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(nonce); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	return &encryptedWriter{
+		aead:   es.aead,
+		name:   put.Url,
+		nonce:  nonce,
+		target: writer,
+	}, nil
+}
+
+func (es *encryptedStorage) open(name string, get *GetRequest) (io.ReadCloser, error) {
+	reader, err := es.storage.Get(get)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, encryptionNonceSize)
+	if _, err := io.ReadFull(reader, nonce); err != nil {
+		reader.Close()
+		return nil, ErrTruncated
+	}
+	result := &encryptedReader{
+		aead:   es.aead,
+		name:   name,
+		nonce:  nonce,
+		source: reader,
+	}
+	if seeker, ok := reader.(io.Seeker); ok {
+		return &seekableEncryptedReader{encryptedReader: result, seeker: seeker}, nil
+	}
+	return result, nil
+}
+
+func (es *encryptedStorage) Put(put *PutRequest) (io.WriteCloser, error) {
+	es.mux.Lock()
+	defer es.mux.Unlock()
+
+	name := es.localName(put.Url)
+	if _, ok := es.urls[name]; !ok {
+		es.urls[name] = put.Url
+		if err := es.saveIndex(); err != nil {
+			return nil, err
+		}
+	}
+	return es.create(&PutRequest{Url: name, SaveOnOverwrite: put.SaveOnOverwrite})
+}
+
+func (es *encryptedStorage) Get(get *GetRequest) (io.ReadCloser, error) {
+	name := es.localName(get.Url)
+	return es.open(name, &GetRequest{Url: name, Version: get.Version})
+}
+
+func (es *encryptedStorage) List(list *ListRequest) (*ListResponse, error) {
+	es.mux.Lock()
+	defer es.mux.Unlock()
+
+	request := &ListRequest{WithSnapshots: list.WithSnapshots, WithFiles: list.WithFiles}
+	for _, url := range list.Url {
+		request.Url = append(request.Url, es.localName(url))
+	}
+	if len(list.Url) == 0 {
+		for name := range es.urls {
+			request.Url = append(request.Url, name)
+		}
+		if len(request.Url) == 0 {
+			return &ListResponse{}, nil
+		}
+	}
+	response, err := es.storage.List(request)
+	if err != nil {
+		return nil, err
+	}
+	result := &ListResponse{}
+	for _, item := range response.Items {
+		url, ok := es.urls[item.Url]
+		if !ok {
+			continue
+		}
+		item.Url = url
+		result.Items = append(result.Items, item)
+	}
+	return result, nil
+}
+
+// Verify reports problems of the underlying storage with the real urls.
+func (es *encryptedStorage) Verify() ([]*Problem, error) {
+	v, err := verifier(es.storage)
+	if err != nil {
+		return nil, err
+	}
+	problems, err := v.Verify()
+	if err != nil {
+		return nil, err
+	}
+	es.mux.Lock()
+	defer es.mux.Unlock()
+	for _, p := range problems {
+		if url, ok := es.urls[p.Url]; ok {
+			p.Url = url
+		}
+	}
+	return problems, nil
+}
+
+// Repair maps the orphan files back by the hashed names of the urls.
+func (es *encryptedStorage) Repair(urls []string) ([]string, error) {
+	v, err := verifier(es.storage)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, url := range urls {
+		names = append(names, es.localName(url))
+	}
+	return v.Repair(names)
+}
+
+type encryptedProvider struct {
+	Provider
+
+	provider Provider
+	key      *EncryptionKey
+}
+
+func NewEncryptedProvider(provider Provider, key *EncryptionKey) Provider {
+	return &encryptedProvider{
+		provider: provider,
+		key:      key,
+	}
+}
+
+func (ep *encryptedProvider) Open(id string) (Storage, error) {
+	s, err := ep.provider.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptedStorage(s, ep.key)
+}
+
+func (ep *encryptedProvider) List() ([]string, error) {
+	return ep.provider.List()
+}
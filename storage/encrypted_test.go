@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func writeKeyFile(t *testing.T, content string) *EncryptionKey {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte(content), 0600); err != nil {
+		t.Fatalf("Cannot write key file: %s", err)
+	}
+	key, err := KeyFromFile(keyFile)
+	if err != nil {
+		t.Fatalf("Cannot read key file: %s", err)
+	}
+	return key
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	key := writeKeyFile(t, strings.Repeat("0f", 32)+"\n")
+	for _, tc := range []struct {
+		name string
+		url  string
+		data []byte
+	}{
+		{name: "empty payload", url: "empty", data: []byte{}},
+		{name: "small payload", url: "http://some/url?a=b", data: []byte("Hello There")},
+		{name: "exactly one chunk", url: "one", data: bytes.Repeat([]byte{1}, encryptionChunkSize)},
+		{name: "multiple chunks", url: "many", data: bytes.Repeat([]byte{1, 2, 3}, encryptionChunkSize)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			local, err := NewLocalStorage(root)
+			if err != nil {
+				t.Fatalf("Cannot create temporary storage: %s", err)
+			}
+			s, err := NewEncryptedStorage(local, key)
+			if err != nil {
+				t.Fatalf("Cannot create encrypted storage: %s", err)
+			}
+			bs := &BlockStorage{Storage: s}
+			if _, err := bs.PutBytes(&PutRequest{Url: tc.url}, tc.data); err != nil {
+				t.Errorf("Cannot write to storage: %s", err)
+			}
+			got, err := bs.GetBytes(&GetRequest{Url: tc.url})
+			if err != nil {
+				t.Errorf("Cannot read from storage: %s", err)
+			}
+			if !bytes.Equal(got, tc.data) {
+				t.Errorf("Expected to read %d bytes, but got %d", len(tc.data), len(got))
+			}
+
+			mapping, err := os.ReadFile(filepath.Join(root, defaultMapping))
+			if err != nil {
+				t.Errorf("Cannot read mapping: %s", err)
+			}
+			if strings.Contains(string(mapping), tc.url) {
+				t.Errorf("Expected mapping %q to contain no plain urls", mapping)
+			}
+		})
+	}
+}
+
+func TestEncryptedStorageReopen(t *testing.T) {
+	key := KeyFromPassphrase("correct horse battery staple")
+	root := t.TempDir()
+	local, err := NewLocalStorage(root)
+	if err != nil {
+		t.Fatalf("Cannot create temporary storage: %s", err)
+	}
+	s, err := NewEncryptedStorage(local, key)
+	if err != nil {
+		t.Fatalf("Cannot create encrypted storage: %s", err)
+	}
+	for _, content := range []string{"first", "second", "third"} {
+		if err := write(s, "snapshot.json", []byte(content)); err != nil {
+			t.Errorf("Cannot write to storage: %s", err)
+		}
+		if err := write(s, "http://some/file.jpg", []byte(content)); err != nil {
+			t.Errorf("Cannot write to storage: %s", err)
+		}
+	}
+	w, err := s.Put(&PutRequest{Url: "snapshot.json", SaveOnOverwrite: true})
+	if err != nil {
+		t.Fatalf("Cannot write to storage: %s", err)
+	}
+	w.Write([]byte("fourth"))
+	w.Close()
+
+	t.Run("same passphrase", func(t *testing.T) {
+		local, _ := NewLocalStorage(root)
+		reopened, err := NewEncryptedStorage(local, KeyFromPassphrase("correct horse battery staple"))
+		if err != nil {
+			t.Fatalf("Cannot reopen encrypted storage: %s", err)
+		}
+		list, err := reopened.List(&ListRequest{WithSnapshots: true})
+		if err != nil {
+			t.Errorf("Cannot list storage: %s", err)
+		}
+		sort.Slice(list.Items, func(i, j int) bool {
+			return list.Items[i].Url < list.Items[j].Url
+		})
+		want := &ListResponse{Items: []StorageItem{
+			{Url: "http://some/file.jpg"},
+			{Url: "snapshot.json", Versions: []string{"0000"}},
+		}}
+		if !reflect.DeepEqual(list, want) {
+			t.Errorf("Expected list to be %v, but got %v", want, list)
+		}
+		got, err := (&BlockStorage{Storage: reopened}).GetBytes(&GetRequest{Url: "snapshot.json"})
+		if err != nil || string(got) != "fourth" {
+			t.Errorf("Expected to read \"fourth\", but got %q (%v)", got, err)
+		}
+	})
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		local, _ := NewLocalStorage(root)
+		if _, err := NewEncryptedStorage(local, KeyFromPassphrase("wrong")); !errors.Is(err, ErrWrongKey) {
+			t.Errorf("Expected error %q, but got %v", ErrWrongKey, err)
+		}
+	})
+
+	t.Run("key file instead of passphrase", func(t *testing.T) {
+		local, _ := NewLocalStorage(root)
+		key := writeKeyFile(t, strings.Repeat("z", 32))
+		if _, err := NewEncryptedStorage(local, key); !errors.Is(err, ErrWrongKey) {
+			t.Errorf("Expected error %q, but got %v", ErrWrongKey, err)
+		}
+	})
+}
+
+func TestEncryptedStorageErrors(t *testing.T) {
+	key := writeKeyFile(t, strings.Repeat("k", 32))
+
+	t.Run("not encrypted", func(t *testing.T) {
+		local, err := NewLocalStorage(t.TempDir())
+		if err != nil {
+			t.Fatalf("Cannot create temporary storage: %s", err)
+		}
+		write(local, "snapshot.json", []byte("{}"))
+		if _, err := NewEncryptedStorage(local, key); !errors.Is(err, ErrNotEncrypted) {
+			t.Errorf("Expected error %q, but got %v", ErrNotEncrypted, err)
+		}
+	})
+
+	t.Run("truncated data", func(t *testing.T) {
+		root := t.TempDir()
+		local, err := NewLocalStorage(root)
+		if err != nil {
+			t.Fatalf("Cannot create temporary storage: %s", err)
+		}
+		s, err := NewEncryptedStorage(local, key)
+		if err != nil {
+			t.Fatalf("Cannot create encrypted storage: %s", err)
+		}
+		bs := &BlockStorage{Storage: s}
+		bs.PutBytes(&PutRequest{Url: "file"}, bytes.Repeat([]byte{1}, encryptionChunkSize+10))
+
+		es := s.(*encryptedStorage)
+		localFile := filepath.Join(root, es.localName("file"))
+		data, _ := os.ReadFile(localFile)
+		os.WriteFile(localFile, data[:len(data)-40], 0600)
+
+		if _, err := bs.GetBytes(&GetRequest{Url: "file"}); !errors.Is(err, ErrTruncated) {
+			t.Errorf("Expected error %q, but got %v", ErrTruncated, err)
+		}
+	})
+}
+
+func TestEncryptedStorageSeek(t *testing.T) {
+	key := writeKeyFile(t, strings.Repeat("0f", 32))
+	local, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Cannot create temporary storage: %s", err)
+	}
+	s, err := NewEncryptedStorage(local, key)
+	if err != nil {
+		t.Fatalf("Cannot create encrypted storage: %s", err)
+	}
+	data := make([]byte, 2*encryptionChunkSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	bs := &BlockStorage{Storage: s}
+	if _, err := bs.PutBytes(&PutRequest{Url: "file"}, data); err != nil {
+		t.Fatalf("Cannot write to storage: %s", err)
+	}
+	reader, err := s.Get(&GetRequest{Url: "file"})
+	if err != nil {
+		t.Fatalf("Cannot read from storage: %s", err)
+	}
+	defer reader.Close()
+	seeker, ok := reader.(io.ReadSeeker)
+	if !ok {
+		t.Fatalf("Expected reader of a local file to be seekable")
+	}
+	if size, err := seeker.Seek(0, io.SeekEnd); err != nil || size != int64(len(data)) {
+		t.Errorf("Expected size %d, but got %d (%v)", len(data), size, err)
+	}
+	for _, tc := range []struct {
+		offset int64
+		length int
+	}{
+		{offset: 10, length: 20},
+		{offset: encryptionChunkSize - 5, length: 10},
+		{offset: 2 * encryptionChunkSize, length: 100},
+		{offset: 0, length: 5},
+	} {
+		if _, err := seeker.Seek(tc.offset, io.SeekStart); err != nil {
+			t.Fatalf("Cannot seek to %d: %s", tc.offset, err)
+		}
+		got := make([]byte, tc.length)
+		if _, err := io.ReadFull(seeker, got); err != nil {
+			t.Errorf("Cannot read at %d: %s", tc.offset, err)
+		}
+		if want := data[tc.offset : tc.offset+int64(tc.length)]; !bytes.Equal(got, want) {
+			t.Errorf("Expected %v at %d, but got %v", want, tc.offset, got)
+		}
+	}
+	if _, err := seeker.Seek(int64(len(data))+10, io.SeekStart); err != nil {
+		t.Fatalf("Cannot seek after the end: %s", err)
+	}
+	if n, err := seeker.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Errorf("Expected io.EOF after the end, but got %d, %v", n, err)
+	}
+}
+
+func TestEncryptedStorageArchiveKeys(t *testing.T) {
+	key := KeyFromPassphrase("correct horse battery staple")
+	names := []string{}
+	for range 2 {
+		local, err := NewLocalStorage(t.TempDir())
+		if err != nil {
+			t.Fatalf("Cannot create temporary storage: %s", err)
+		}
+		s, err := NewEncryptedStorage(local, key)
+		if err != nil {
+			t.Fatalf("Cannot create encrypted storage: %s", err)
+		}
+		names = append(names, s.(*encryptedStorage).localName("http://some/url"))
+	}
+	if names[0] == names[1] {
+		t.Errorf("Expected archives with the same passphrase to hash urls differently, but both got %q", names[0])
+	}
+
+	t.Run("version 1", func(t *testing.T) {
+		local, err := NewLocalStorage(t.TempDir())
+		if err != nil {
+			t.Fatalf("Cannot create temporary storage: %s", err)
+		}
+		header := &encryptionHeader{Version: 1, Kdf: "none", Salt: bytes.Repeat([]byte{1}, encryptionSaltSize)}
+		(&BlockStorage{Storage: local}).PutObject(&PutRequest{Url: encryptionHeaderUrl}, header)
+		s, err := NewEncryptedStorage(local, writeKeyFile(t, strings.Repeat("0f", 32)))
+		if err != nil {
+			t.Fatalf("Cannot open version 1 storage: %s", err)
+		}
+		bs := &BlockStorage{Storage: s}
+		bs.PutBytes(&PutRequest{Url: "file"}, []byte("data"))
+		if got, err := bs.GetBytes(&GetRequest{Url: "file"}); err != nil || string(got) != "data" {
+			t.Errorf("Expected to read \"data\", but got %q (%v)", got, err)
+		}
+	})
+}
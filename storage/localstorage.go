@@ -2,9 +2,12 @@ package storage
 
 import (
 	"chronicler/common"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
@@ -18,14 +21,56 @@ const (
 	defaultMetadata = ".metadata"
 	defaultSnapshot = ".snapshot"
 	defaultMapping  = defaultMetadata + "/mapping.json"
+	defaultManifest = defaultMetadata + "/manifest.json"
 )
 
+// fileInfo is recorded in the manifest when the file is closed, so it is
+// possible to check later if the file is intact.
+type fileInfo struct {
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+type localWriter struct {
+	io.WriteCloser
+
+	file    *os.File
+	hash    hash.Hash
+	size    int64
+	onClose func(info *fileInfo) error
+	onAbort func() error
+}
+
+func (lw *localWriter) Write(data []byte) (int, error) {
+	n, err := lw.file.Write(data)
+	lw.hash.Write(data[:n])
+	lw.size += int64(n)
+	return n, err
+}
+
+func (lw *localWriter) Close() error {
+	if err := lw.file.Close(); err != nil {
+		return err
+	}
+	return lw.onClose(&fileInfo{
+		Size:   lw.size,
+		Sha256: hex.EncodeToString(lw.hash.Sum(nil)),
+	})
+}
+
+func (lw *localWriter) CloseWithError(err error) error {
+	lw.file.Close()
+	return lw.onAbort()
+}
+
 type localStorage struct {
 	Storage
 
-	writeMux   sync.Mutex
+	writeMux   sync.RWMutex
 	root       string
 	localNames map[string]string
+	usedNames  usedNames
+	manifest   map[string]*fileInfo
 	logger     *common.Logger
 }
 
@@ -36,11 +81,16 @@ func NewLocalStorage(root string) (Storage, error) {
 	storage := &localStorage{
 		root:       root,
 		localNames: map[string]string{},
+		usedNames:  usedNames{},
+		manifest:   map[string]*fileInfo{},
 		logger:     common.NewLogger("LocalStorage"),
 	}
 	if err := storage.readMapping(); err != nil {
 		return nil, err
 	}
+	if err := storage.readManifest(); err != nil {
+		return nil, err
+	}
 	return storage, nil
 }
 
@@ -67,34 +117,62 @@ func (ls *localStorage) readMapping() error {
 	}
 
 	ls.localNames = mapping
+	ls.usedNames = newUsedNames(mapping)
 	return nil
 }
 
-func (ls *localStorage) snapshotFile(localName string) error {
+func (ls *localStorage) saveManifest() error {
+	bytes, err := json.Marshal(ls.manifest)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(ls.root, defaultManifest), bytes, defaultPerms)
+}
+
+func (ls *localStorage) readManifest() error {
+	bytes, err := os.ReadFile(filepath.Join(ls.root, defaultManifest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(bytes, &ls.manifest)
+}
+
+// snapshotFile moves the file to the versions and returns its new name.
+func (ls *localStorage) snapshotFile(localName string) (string, error) {
 	snapshotRoot := filepath.Join(ls.root, defaultSnapshot)
 	if err := os.MkdirAll(snapshotRoot, defaultPerms); err != nil {
-		return err
+		return "", err
 	}
 	i := 0
 	for ; i < maxBackups; i++ {
 		backupName := filepath.Join(snapshotRoot, fmt.Sprintf("%s_%04d", localName, i))
 		if _, err := os.Stat(backupName); errors.Is(err, os.ErrNotExist) {
-			return os.Rename(filepath.Join(ls.root, localName), backupName)
+			if err := os.Rename(filepath.Join(ls.root, localName), backupName); err != nil {
+				return "", err
+			}
+			if info, ok := ls.manifest[localName]; ok {
+				ls.manifest[filepath.ToSlash(filepath.Join(defaultSnapshot, filepath.Base(backupName)))] = info
+			}
+			return backupName, nil
 		}
 	}
-	return fmt.Errorf("too many backups already")
+	return "", fmt.Errorf("too many backups already")
 }
 
 func (ls *localStorage) Put(put *PutRequest) (io.WriteCloser, error) {
 	ls.writeMux.Lock()
 	defer ls.writeMux.Unlock()
 
-	localName := common.SanitizeUrl(put.Url, maxNameLen)
+	localName := uniqueName(ls.localNames, ls.usedNames, put.Url)
 	localPath := filepath.Join(ls.root, localName)
+	backupName := ""
 	if _, err := os.Stat(localPath); err == nil {
 		if put.SaveOnOverwrite {
 			ls.logger.Debugf("File %q will be saved on overwrite", put.Url)
-			if err = ls.snapshotFile(localName); err != nil {
+			if backupName, err = ls.snapshotFile(localName); err != nil {
 				return nil, err
 			}
 		}
@@ -103,24 +181,73 @@ func (ls *localStorage) Put(put *PutRequest) (io.WriteCloser, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot open for writing %s/%s: %s", ls.root, put.Url, err)
 	}
+	if _, ok := ls.localNames[put.Url]; !ok {
+		ls.usedNames.add(localName)
+	}
 	ls.localNames[put.Url] = localName
 	ls.saveMapping()
-	return file, nil
+	// Until the file is closed there is nothing to check it against
+	delete(ls.manifest, localName)
+	ls.saveManifest()
+	return &localWriter{
+		file: file,
+		hash: sha256.New(),
+		onClose: func(info *fileInfo) error {
+			ls.writeMux.Lock()
+			defer ls.writeMux.Unlock()
+			ls.manifest[localName] = info
+			return ls.saveManifest()
+		},
+		// Failed writes are dropped and the saved version becomes the latest
+		// one again, so the file is never listed as complete.
+		onAbort: func() error {
+			ls.writeMux.Lock()
+			defer ls.writeMux.Unlock()
+			if backupName == "" {
+				delete(ls.localNames, put.Url)
+				ls.usedNames.remove(localName)
+				if err := os.Remove(localPath); err != nil {
+					return err
+				}
+				return ls.saveMapping()
+			}
+			versionName := filepath.ToSlash(filepath.Join(defaultSnapshot, filepath.Base(backupName)))
+			if info, ok := ls.manifest[versionName]; ok {
+				ls.manifest[localName] = info
+				delete(ls.manifest, versionName)
+			}
+			if err := os.Rename(backupName, localPath); err != nil {
+				return err
+			}
+			return ls.saveManifest()
+		},
+	}, nil
 }
 
 func (ls *localStorage) Get(get *GetRequest) (io.ReadCloser, error) {
+	ls.writeMux.RLock()
 	localName, ok := ls.localNames[get.Url]
+	ls.writeMux.RUnlock()
 	if !ok {
-		return nil, fmt.Errorf("cannot open %s/%s: %s", ls.root, get.Url, os.ErrNotExist)
+		return nil, fmt.Errorf("cannot open %s/%s: %w", ls.root, get.Url, os.ErrNotExist)
+	}
+	if get.Version != "" {
+		if !validVersion(get.Version) {
+			return nil, fmt.Errorf("cannot open %s/%s version %q: %w", ls.root, get.Url, get.Version, os.ErrNotExist)
+		}
+		localName = filepath.Join(defaultSnapshot, fmt.Sprintf("%s_%s", localName, get.Version))
 	}
 	file, err := os.Open(filepath.Join(ls.root, localName))
 	if err != nil {
-		return nil, fmt.Errorf("cannot open %s/%s: %s", ls.root, get.Url, err)
+		return nil, fmt.Errorf("cannot open %s/%s: %w", ls.root, get.Url, err)
 	}
 	return file, nil
 }
 
 func (ls *localStorage) List(list *ListRequest) (*ListResponse, error) {
+	ls.writeMux.RLock()
+	defer ls.writeMux.RUnlock()
+
 	result := &ListResponse{}
 	snapshotRoot := filepath.Join(ls.root, defaultSnapshot)
 	for actual, local := range ls.localNames {
@@ -139,6 +266,14 @@ func (ls *localStorage) List(list *ListRequest) (*ListResponse, error) {
 		item := StorageItem{
 			Url: actual,
 		}
+		if list.WithFiles {
+			item.Name = local
+			if info, ok := ls.manifest[local]; ok {
+				item.Size = info.Size
+			} else if stat, err := os.Stat(filepath.Join(ls.root, local)); err == nil {
+				item.Size = stat.Size()
+			}
+		}
 		if list.WithSnapshots {
 			for i := 0; i < maxBackups; i++ {
 				backupName := filepath.Join(snapshotRoot, fmt.Sprintf("%s_%04d", local, i))
@@ -1,10 +1,15 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -62,7 +67,111 @@ func TestLocalStorageMapping(t *testing.T) {
 	})
 
 	if !reflect.DeepEqual(list, wantList) {
-		t.Errorf("Expected list to be %q, but got %q", wantList, list)
+		t.Errorf("Expected list to be %v, but got %v", wantList, list)
+	}
+}
+
+func TestLocalStorageListFiles(t *testing.T) {
+	s, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Cannot initialize storage: %s", err)
+	}
+	if err := write(s, "http://some/image.jpg", []byte{1, 2, 3}); err != nil {
+		t.Errorf("Cannot write to storage: %s", err)
+	}
+
+	list, err := s.List(&ListRequest{WithFiles: true})
+	if err != nil {
+		t.Fatalf("Error while listing files: %s", err)
+	}
+	want := &ListResponse{Items: []StorageItem{{
+		Url:  "http://some/image.jpg",
+		Name: localName("http://some/image.jpg"),
+		Size: 3,
+	}}}
+	if !reflect.DeepEqual(list, want) {
+		t.Errorf("Expected list to be %v, but got %v", want, list)
+	}
+}
+
+func TestLocalStorageConcurrent(t *testing.T) {
+	s, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Cannot initialize storage: %s", err)
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		url := fmt.Sprintf("http://some/image%d.jpg", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := write(s, url, []byte{1, 2, 3}); err != nil {
+				t.Errorf("Cannot write to storage: %s", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := s.List(&ListRequest{WithFiles: true, WithSnapshots: true}); err != nil {
+				t.Errorf("Error while listing files: %s", err)
+			}
+			if reader, err := s.Get(&GetRequest{Url: url}); err == nil {
+				reader.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	list, err := s.List(&ListRequest{})
+	if err != nil {
+		t.Fatalf("Error while listing files: %s", err)
+	}
+	if len(list.Items) != 10 {
+		t.Errorf("Expected 10 files, but got %d", len(list.Items))
+	}
+}
+
+func TestLocalProviderIds(t *testing.T) {
+	root := t.TempDir()
+	p := NewLocalProvider(filepath.Join(root, "data"))
+	for _, id := range []string{"", ".", "..", "../escaped", "x/../../escaped", `x\..\escaped`, ".catalog"} {
+		t.Run(id, func(t *testing.T) {
+			if _, err := p.Open(id); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Expected id %q to be rejected, but got %v", id, err)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected nothing to be created outside of the root")
+	}
+	if _, err := p.Open("00000000-0000-4000-8000-000000000001"); err != nil {
+		t.Errorf("Cannot open storage with a valid id: %s", err)
+	}
+}
+
+func TestLocalStorageVersionTraversal(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0666); err != nil {
+		t.Fatalf("Cannot write secret: %s", err)
+	}
+	s, err := NewLocalStorage(filepath.Join(root, "archive"))
+	if err != nil {
+		t.Fatalf("Cannot initialize storage: %s", err)
+	}
+	bs := &BlockStorage{Storage: s}
+	bs.PutBytes(&PutRequest{Url: "file"}, []byte("old"))
+	bs.PutBytes(&PutRequest{Url: "file", SaveOnOverwrite: true}, []byte("new"))
+
+	for _, version := range []string{
+		"/../../../secret.txt", "0000/../../../secret.txt", "../secret.txt", "0000 ", "00000", "-001",
+	} {
+		t.Run(version, func(t *testing.T) {
+			got, err := bs.GetBytes(&GetRequest{Url: "file", Version: version})
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Expected version %q to not exist, but got %q (%v)", version, got, err)
+			}
+		})
+	}
+	if got, err := bs.GetBytes(&GetRequest{Url: "file", Version: "0000"}); err != nil || string(got) != "old" {
+		t.Errorf("Expected to read the saved version, but got %q (%v)", got, err)
 	}
 }
 
@@ -239,9 +348,40 @@ func TestLocalStoragePutFile(t *testing.T) {
 					return list.Items[i].Url < list.Items[j].Url
 				})
 				if !reflect.DeepEqual(list, tc.wantList[i]) {
-					t.Errorf("Expected list to be %q, but got %q", tc.wantList[i], list)
+					t.Errorf("Expected list to be %v, but got %v", tc.wantList[i], list)
 				}
 			}
 		})
 	}
 }
+
+func TestLocalStorageCloseWithError(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewLocalStorage(root)
+	if err != nil {
+		t.Fatalf("Cannot create storage: %s", err)
+	}
+	bs := &BlockStorage{Storage: s}
+	bs.PutBytes(&PutRequest{Url: "saved"}, []byte("old"))
+	for _, put := range []*PutRequest{{Url: "new"}, {Url: "saved", SaveOnOverwrite: true}} {
+		writer, err := s.Put(put)
+		if err != nil {
+			t.Fatalf("Cannot write %q: %s", put.Url, err)
+		}
+		writer.Write([]byte("partial"))
+		if err := CloseWithError(writer, errors.New("failed")); err != nil {
+			t.Errorf("Cannot drop %q: %s", put.Url, err)
+		}
+	}
+
+	list, _ := s.List(&ListRequest{WithSnapshots: true})
+	if len(list.Items) != 1 || list.Items[0].Url != "saved" || len(list.Items[0].Versions) != 0 {
+		t.Errorf("Expected only the saved file without versions, but got %v", list.Items)
+	}
+	if got, err := bs.GetBytes(&GetRequest{Url: "saved"}); err != nil || string(got) != "old" {
+		t.Errorf("Expected the saved file to be restored, but got %q (%v)", got, err)
+	}
+	if problems, err := verifyRoot(root); err != nil || len(problems) != 0 {
+		t.Errorf("Expected storage to be intact, but got %v (%v)", problems, err)
+	}
+}
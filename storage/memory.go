@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInjected = errors.New("injected storage failure")
+)
+
+// MemoryOptions make the memory storage misbehave, zero values disable the faults.
+type MemoryOptions struct {
+	// Put number FailPut (1-based) returns ErrInjected
+	FailPut int
+	// Write number FailWrite (1-based, counted over all writers) returns ErrInjected
+	FailWrite int
+	// Get returns ErrInjected for these urls
+	FailGet []string
+	// Every Read call on the returned readers sleeps this long
+	ReadDelay time.Duration
+}
+
+type memoryItem struct {
+	data     []byte
+	versions [][]byte
+}
+
+type memoryWriter struct {
+	io.WriteCloser
+
+	buffer  bytes.Buffer
+	storage *memoryStorage
+	url     string
+	closed  bool
+	// Previous data was saved as a version by the Put
+	saved bool
+}
+
+func (mw *memoryWriter) Write(data []byte) (int, error) {
+	if mw.closed {
+		return 0, os.ErrClosed
+	}
+	if err := mw.storage.countWrite(); err != nil {
+		return 0, err
+	}
+	return mw.buffer.Write(data)
+}
+
+func (mw *memoryWriter) Close() error {
+	if mw.closed {
+		return os.ErrClosed
+	}
+	mw.closed = true
+	mw.storage.mux.Lock()
+	defer mw.storage.mux.Unlock()
+	mw.storage.items[mw.url].data = mw.buffer.Bytes()
+	return nil
+}
+
+func (mw *memoryWriter) CloseWithError(err error) error {
+	if mw.closed {
+		return os.ErrClosed
+	}
+	mw.closed = true
+	mw.storage.mux.Lock()
+	defer mw.storage.mux.Unlock()
+	item := mw.storage.items[mw.url]
+	switch {
+	case mw.saved:
+		item.data = item.versions[len(item.versions)-1]
+		item.versions = item.versions[:len(item.versions)-1]
+	case len(item.versions) == 0:
+		delete(mw.storage.items, mw.url)
+	}
+	return nil
+}
+
+type slowReader struct {
+	io.Reader
+
+	reader io.Reader
+	delay  time.Duration
+}
+
+func (sr *slowReader) Read(data []byte) (int, error) {
+	time.Sleep(sr.delay)
+	return sr.reader.Read(data)
+}
+
+type memoryStorage struct {
+	Storage
+
+	mux     sync.Mutex
+	items   map[string]*memoryItem
+	options MemoryOptions
+	puts    int
+	writes  int
+}
+
+// NewMemoryStorage keeps everything in memory, it behaves like the local
+// storage: versions are kept on overwrite and the written data is stored
+// when the writer is closed.
+func NewMemoryStorage(options *MemoryOptions) Storage {
+	ms := &memoryStorage{items: map[string]*memoryItem{}}
+	if options != nil {
+		ms.options = *options
+	}
+	return ms
+}
+
+func (ms *memoryStorage) countWrite() error {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	ms.writes++
+	if ms.writes == ms.options.FailWrite {
+		return ErrInjected
+	}
+	return nil
+}
+
+func (ms *memoryStorage) Put(put *PutRequest) (io.WriteCloser, error) {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+
+	ms.puts++
+	if ms.puts == ms.options.FailPut {
+		return nil, fmt.Errorf("cannot open for writing %s: %w", put.Url, ErrInjected)
+	}
+	item, ok := ms.items[put.Url]
+	saved := false
+	if !ok {
+		item = &memoryItem{}
+		ms.items[put.Url] = item
+	} else if put.SaveOnOverwrite {
+		if len(item.versions) >= maxBackups {
+			return nil, fmt.Errorf("too many backups already")
+		}
+		item.versions = append(item.versions, item.data)
+		saved = true
+	}
+	item.data = []byte{}
+	return &memoryWriter{storage: ms, url: put.Url, saved: saved}, nil
+}
+
+func (ms *memoryStorage) Get(get *GetRequest) (io.ReadCloser, error) {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+
+	if slices.Contains(ms.options.FailGet, get.Url) {
+		return nil, fmt.Errorf("cannot open %s: %w", get.Url, ErrInjected)
+	}
+	item, ok := ms.items[get.Url]
+	if !ok {
+		return nil, fmt.Errorf("cannot open %s: %w", get.Url, os.ErrNotExist)
+	}
+	data := item.data
+	if get.Version != "" {
+		i := 0
+		if _, err := fmt.Sscanf(get.Version, "%04d", &i); err != nil || !validVersion(get.Version) || i >= len(item.versions) {
+			return nil, fmt.Errorf("cannot open %s version %s: %w", get.Url, get.Version, os.ErrNotExist)
+		}
+		data = item.versions[i]
+	}
+	var reader io.Reader = bytes.NewReader(data)
+	if ms.options.ReadDelay > 0 {
+		reader = &slowReader{reader: reader, delay: ms.options.ReadDelay}
+	}
+	return io.NopCloser(reader), nil
+}
+
+func (ms *memoryStorage) List(list *ListRequest) (*ListResponse, error) {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+
+	result := &ListResponse{}
+	for url, item := range ms.items {
+		if len(list.Url) > 0 && !slices.Contains(list.Url, url) {
+			continue
+		}
+		storageItem := StorageItem{Url: url}
+		if list.WithFiles {
+			storageItem.Size = int64(len(item.data))
+		}
+		if list.WithSnapshots {
+			for i := range item.versions {
+				storageItem.Versions = append(storageItem.Versions, fmt.Sprintf("%04d", i))
+			}
+		}
+		result.Items = append(result.Items, storageItem)
+	}
+	return result, nil
+}
+
+type memoryProvider struct {
+	Provider
+
+	mux      sync.Mutex
+	options  *MemoryOptions
+	storages map[string]Storage
+}
+
+// NewMemoryProvider returns the same memory storage for the same id, every
+// storage gets its own copy of the options.
+func NewMemoryProvider(options *MemoryOptions) Provider {
+	return &memoryProvider{
+		options:  options,
+		storages: map[string]Storage{},
+	}
+}
+
+func (mp *memoryProvider) Open(id string) (Storage, error) {
+	mp.mux.Lock()
+	defer mp.mux.Unlock()
+	s, ok := mp.storages[id]
+	if !ok {
+		s = NewMemoryStorage(mp.options)
+		mp.storages[id] = s
+	}
+	return s, nil
+}
+
+func (mp *memoryProvider) List() ([]string, error) {
+	mp.mux.Lock()
+	defer mp.mux.Unlock()
+	result := []string{}
+	for id := range mp.storages {
+		result = append(result, id)
+	}
+	sort.Strings(result)
+	return result, nil
+}
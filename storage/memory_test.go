@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	s := NewMemoryStorage(nil)
+	bs := &BlockStorage{Storage: s}
+	for _, content := range []string{"first", "second", "third"} {
+		if _, err := bs.PutBytes(&PutRequest{Url: "snapshot.json", SaveOnOverwrite: true}, []byte(content)); err != nil {
+			t.Errorf("Cannot write: %s", err)
+		}
+	}
+	bs.PutBytes(&PutRequest{Url: "file"}, []byte("old"))
+	bs.PutBytes(&PutRequest{Url: "file"}, []byte("new"))
+
+	for _, tc := range []struct {
+		name    string
+		get     *GetRequest
+		want    string
+		wantErr bool
+	}{
+		{name: "latest", get: &GetRequest{Url: "snapshot.json"}, want: "third"},
+		{name: "first version", get: &GetRequest{Url: "snapshot.json", Version: "0000"}, want: "first"},
+		{name: "second version", get: &GetRequest{Url: "snapshot.json", Version: "0001"}, want: "second"},
+		{name: "overwritten", get: &GetRequest{Url: "file"}, want: "new"},
+		{name: "no such version", get: &GetRequest{Url: "snapshot.json", Version: "0002"}, wantErr: true},
+		{name: "no such url", get: &GetRequest{Url: "other"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := bs.GetBytes(tc.get)
+			if (err != nil) != tc.wantErr || string(got) != tc.want {
+				t.Errorf("Expected %q (error %v), but got %q (%v)", tc.want, tc.wantErr, got, err)
+			}
+		})
+	}
+
+	t.Run("list", func(t *testing.T) {
+		list, err := s.List(&ListRequest{WithSnapshots: true, Url: []string{"snapshot.json"}})
+		want := &ListResponse{Items: []StorageItem{{Url: "snapshot.json", Versions: []string{"0000", "0001"}}}}
+		if err != nil || !reflect.DeepEqual(list, want) {
+			t.Errorf("Expected list %v, but got %v (%v)", want, list, err)
+		}
+	})
+
+	t.Run("list files", func(t *testing.T) {
+		list, err := s.List(&ListRequest{WithFiles: true, Url: []string{"file"}})
+		want := &ListResponse{Items: []StorageItem{{Url: "file", Size: 3}}}
+		if err != nil || !reflect.DeepEqual(list, want) {
+			t.Errorf("Expected list %v, but got %v (%v)", want, list, err)
+		}
+	})
+}
+
+func TestMemoryStorageFaults(t *testing.T) {
+	t.Run("fail put", func(t *testing.T) {
+		s := NewMemoryStorage(&MemoryOptions{FailPut: 2})
+		for i, wantErr := range []bool{false, true, false} {
+			if _, err := s.Put(&PutRequest{Url: "file"}); (err != nil) != wantErr || (err != nil && !errors.Is(err, ErrInjected)) {
+				t.Errorf("Put %d: expected error %v, but got %v", i+1, wantErr, err)
+			}
+		}
+	})
+
+	t.Run("fail write", func(t *testing.T) {
+		s := NewMemoryStorage(&MemoryOptions{FailWrite: 3})
+		w, _ := s.Put(&PutRequest{Url: "file"})
+		for i, wantErr := range []bool{false, false, true, false} {
+			if _, err := w.Write([]byte{1}); (err != nil) != wantErr {
+				t.Errorf("Write %d: expected error %v, but got %v", i+1, wantErr, err)
+			}
+		}
+	})
+
+	t.Run("fail get", func(t *testing.T) {
+		s := NewMemoryStorage(&MemoryOptions{FailGet: []string{"file"}})
+		(&BlockStorage{Storage: s}).PutBytes(&PutRequest{Url: "file"}, []byte{1})
+		if _, err := s.Get(&GetRequest{Url: "file"}); !errors.Is(err, ErrInjected) {
+			t.Errorf("Expected injected error, but got %v", err)
+		}
+	})
+
+	t.Run("slow read", func(t *testing.T) {
+		s := NewMemoryStorage(&MemoryOptions{ReadDelay: 10 * time.Millisecond})
+		bs := &BlockStorage{Storage: s}
+		bs.PutBytes(&PutRequest{Url: "file"}, []byte{1})
+		start := time.Now()
+		if _, err := bs.GetBytes(&GetRequest{Url: "file"}); err != nil {
+			t.Errorf("Cannot read: %s", err)
+		}
+		if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+			t.Errorf("Expected read to take at least 10ms, but took %s", elapsed)
+		}
+	})
+}
+
+func TestMemoryProvider(t *testing.T) {
+	p := NewMemoryProvider(nil)
+	a, _ := p.Open("b")
+	(&BlockStorage{Storage: a}).PutBytes(&PutRequest{Url: "file"}, []byte("data"))
+	p.Open("a")
+	again, _ := p.Open("b")
+	if got, err := (&BlockStorage{Storage: again}).GetBytes(&GetRequest{Url: "file"}); err != nil || string(got) != "data" {
+		t.Errorf("Expected the same storage for the same id, but got %q (%v)", got, err)
+	}
+	if ids, _ := p.List(); !reflect.DeepEqual(ids, []string{"a", "b"}) {
+		t.Errorf("Expected ids [a b], but got %q", ids)
+	}
+}
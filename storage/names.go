@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"chronicler/common"
+)
+
+const (
+	nameHashLen   = 16
+	maxExtLen     = 10
+	collisionsDir = defaultMetadata + "/collisions"
+)
+
+func urlExt(remoteUrl string) string {
+	u, err := url.Parse(remoteUrl)
+	if err != nil {
+		return ""
+	}
+	ext := path.Ext(u.Path)
+	if len(ext) < 2 || len(ext) > maxExtLen || common.SanitizeUrl(ext, 0) != ext || strings.Count(ext, ".") > 1 {
+		return ""
+	}
+	return ext
+}
+
+// localName keeps urls made only of the safe characters as they are, the
+// others get a readable prefix, a hash of the whole url and the extension:
+// "http://some/image.jpg?size=1" -> "http___some_image.jpg_size_1_9f1c3e8a0b2d4c6e.jpg"
+func localName(url string) string {
+	sanitized := common.SanitizeUrl(url, 0)
+	if sanitized == url && len(url) <= maxNameLen && !strings.HasPrefix(url, ".") {
+		return url
+	}
+	sum := sha256.Sum256([]byte(url))
+	suffix := "_" + hex.EncodeToString(sum[:])[:nameHashLen] + urlExt(url)
+	return sanitized[:min(len(sanitized), maxNameLen-len(suffix))] + suffix
+}
+
+// legacyName is the name files had before localName started adding hashes.
+func legacyName(url string) string {
+	return common.SanitizeUrl(url, maxNameLen)
+}
+
+func withCounter(name string, i int) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), i, ext)
+}
+
+// usedNames counts the urls mapped to every name, it is updated along with
+// the mapping, so new names are picked without going over all of it.
+type usedNames map[string]int
+
+func newUsedNames(names map[string]string) usedNames {
+	result := usedNames{}
+	for _, name := range names {
+		result.add(name)
+	}
+	return result
+}
+
+func (un usedNames) add(name string) {
+	un[name]++
+}
+
+func (un usedNames) remove(name string) {
+	if un[name]--; un[name] <= 0 {
+		delete(un, name)
+	}
+}
+
+// uniqueName returns the name already mapped to the url or a new name not
+// used by any other url, so different urls never share a file.
+func uniqueName(names map[string]string, used usedNames, url string) string {
+	if name, ok := names[url]; ok {
+		return name
+	}
+	name := localName(url)
+	for i := 1; used[name] > 0; i++ {
+		name = withCounter(localName(url), i)
+	}
+	return name
+}
+
+func (ls *localStorage) versionFiles(name string) []string {
+	result := []string{}
+	for i := 0; i < maxBackups; i++ {
+		version := path.Join(defaultSnapshot, fmt.Sprintf("%s_%04d", name, i))
+		if _, err := os.Stat(filepath.Join(ls.root, filepath.FromSlash(version))); err != nil {
+			break
+		}
+		result = append(result, version)
+	}
+	return result
+}
+
+func (ls *localStorage) rename(from string, to string) error {
+	err := os.Rename(filepath.Join(ls.root, filepath.FromSlash(from)), filepath.Join(ls.root, filepath.FromSlash(to)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if info, ok := ls.manifest[from]; ok {
+		delete(ls.manifest, from)
+		ls.manifest[to] = info
+	}
+	return nil
+}
+
+// MigrateLocalNames renames files of the local storage at root to the
+// collision-proof names. Urls which already shared a file cannot be told
+// apart, so the file is moved to .metadata/collisions and the urls are
+// removed from the mapping to be downloaded again. Returns the list of changes.
+func MigrateLocalNames(root string) ([]string, error) {
+	s, err := NewLocalStorage(root)
+	if err != nil {
+		return nil, err
+	}
+	ls := s.(*localStorage)
+	ls.writeMux.Lock()
+	defer ls.writeMux.Unlock()
+
+	byName := map[string][]string{}
+	for url, name := range ls.localNames {
+		byName[name] = append(byName[name], url)
+	}
+	urls := []string{}
+	for url := range ls.localNames {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+
+	changes := []string{}
+	for _, url := range urls {
+		oldName := ls.localNames[url]
+		if len(byName[oldName]) == 1 {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("removed %q, it shared %q with other urls", url, oldName))
+		if err := os.MkdirAll(filepath.Join(ls.root, collisionsDir), defaultPerms); err != nil {
+			return changes, err
+		}
+		for _, file := range append(ls.versionFiles(oldName), oldName) {
+			if err := ls.rename(file, path.Join(collisionsDir, path.Base(file))); err != nil {
+				return changes, err
+			}
+		}
+	}
+
+	// Old names stay taken until the files are moved away from them
+	used := map[string]string{}
+	for url, name := range ls.localNames {
+		if len(byName[name]) == 1 {
+			used[url] = name
+		}
+	}
+	taken := newUsedNames(used)
+	for _, url := range urls {
+		oldName := ls.localNames[url]
+		if len(byName[oldName]) != 1 {
+			continue
+		}
+		delete(used, url)
+		taken.remove(oldName)
+		newName := uniqueName(used, taken, url)
+		used[url] = newName
+		taken.add(newName)
+		if newName == oldName {
+			continue
+		}
+		for _, version := range ls.versionFiles(oldName) {
+			if err := ls.rename(version, path.Join(defaultSnapshot, newName+strings.TrimPrefix(path.Base(version), oldName))); err != nil {
+				return changes, err
+			}
+		}
+		if err := ls.rename(oldName, newName); err != nil {
+			return changes, err
+		}
+		changes = append(changes, fmt.Sprintf("renamed %q to %q", oldName, newName))
+	}
+	ls.localNames = used
+	ls.usedNames = taken
+	if err := ls.saveMapping(); err != nil {
+		return changes, err
+	}
+	return changes, ls.saveManifest()
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLocalName(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		url        string
+		wantPrefix string
+		wantSuffix string
+	}{
+		{name: "safe name", url: "snapshot.json", wantPrefix: "snapshot.json", wantSuffix: "snapshot.json"},
+		{name: "url", url: "http://some/image.jpg?size=1", wantPrefix: "http___some_image.jpg_size_1_", wantSuffix: ".jpg"},
+		{name: "no extension", url: "http://some/page", wantPrefix: "http___some_page_"},
+		{name: "strange extension", url: "http://some/page.a b", wantPrefix: "http___some_page.a_b_"},
+		{name: "hidden", url: ".metadata", wantPrefix: ".metadata_"},
+		{name: "long", url: "http://some/" + strings.Repeat("a", 500) + ".png", wantPrefix: "http___some_aaa", wantSuffix: ".png"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := localName(tc.url)
+			if !strings.HasPrefix(got, tc.wantPrefix) || !strings.HasSuffix(got, tc.wantSuffix) || len(got) > maxNameLen {
+				t.Errorf("Expected localName(%q) to be %q...%q, but got %q", tc.url, tc.wantPrefix, tc.wantSuffix, got)
+			}
+		})
+	}
+
+	t.Run("no collisions", func(t *testing.T) {
+		long := "http://some/" + strings.Repeat("a", 300)
+		for _, pair := range [][]string{
+			{"a?b=1", "a_b=1"},
+			{"a?b=1", "a_b_1"},
+			{long + "1", long + "2"},
+		} {
+			if localName(pair[0]) == localName(pair[1]) {
+				t.Errorf("Expected different names for %q and %q, but got %q", pair[0], pair[1], localName(pair[0]))
+			}
+		}
+	})
+}
+
+func TestUniqueName(t *testing.T) {
+	names := map[string]string{
+		"known":      "some_name",
+		"collision":  localName("new url"),
+		"collision2": withCounter(localName("new url"), 1),
+	}
+	used := newUsedNames(names)
+	if got := uniqueName(names, used, "known"); got != "some_name" {
+		t.Errorf("Expected known url to keep its name, but got %q", got)
+	}
+	if got, want := uniqueName(names, used, "new url"), withCounter(localName("new url"), 2); got != want {
+		t.Errorf("Expected name %q, but got %q", want, got)
+	}
+	used.remove(localName("new url"))
+	if got, want := uniqueName(names, used, "new url"), localName("new url"); got != want {
+		t.Errorf("Expected freed name %q, but got %q", want, got)
+	}
+}
+
+func TestMigrateLocalNames(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, defaultSnapshot), defaultPerms)
+	os.MkdirAll(filepath.Join(root, defaultMetadata), defaultPerms)
+	for name, content := range map[string]string{
+		"snapshot.json":                "snapshot",
+		defaultSnapshot + "/a_b_0000":  "old a?b",
+		"a_b":                          "a?b or a_b",
+		"http___some_image.jpg":        "image",
+		defaultSnapshot + "/unrelated": "?",
+	} {
+		os.WriteFile(filepath.Join(root, name), []byte(content), defaultPerms)
+	}
+	os.WriteFile(filepath.Join(root, defaultMapping), []byte(`{
+		"snapshot.json": "snapshot.json",
+		"a?b": "a_b",
+		"a b": "a_b",
+		"http://some/image.jpg": "http___some_image.jpg"
+	}`), defaultPerms)
+
+	changes, err := MigrateLocalNames(root)
+	if err != nil {
+		t.Errorf("Cannot migrate: %s", err)
+	}
+	if len(changes) != 3 {
+		t.Errorf("Expected 3 changes, but got %q", changes)
+	}
+
+	s, err := NewLocalStorage(root)
+	if err != nil {
+		t.Fatalf("Cannot open storage: %s", err)
+	}
+	bs := &BlockStorage{Storage: s}
+	for url, want := range map[string]string{
+		"snapshot.json":         "snapshot",
+		"http://some/image.jpg": "image",
+	} {
+		if got, err := bs.GetBytes(&GetRequest{Url: url}); err != nil || string(got) != want {
+			t.Errorf("Expected %q to contain %q, but got %q (%v)", url, want, got, err)
+		}
+	}
+	list, _ := s.List(&ListRequest{})
+	if len(list.Items) != 2 {
+		t.Errorf("Expected collided urls to be removed, but got %v", list.Items)
+	}
+	for _, name := range []string{collisionsDir + "/a_b", collisionsDir + "/a_b_0000", localName("http://some/image.jpg")} {
+		if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+			t.Errorf("Expected %q to exist: %s", name, err)
+		}
+	}
+	problems, _ := verifyRoot(root)
+	want := map[string]ProblemKind{
+		"snapshot.json":                    ProblemUnverified,
+		localName("http://some/image.jpg"): ProblemUnverified,
+		defaultSnapshot + "/unrelated":     ProblemOrphan,
+	}
+	if got := problemKinds(problems); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected problems %v, but got %v", want, got)
+	}
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"chronicler/common"
+)
+
+// Provider opens a separate storage for every snapshot, identified by an id.
+type Provider interface {
+	Open(id string) (Storage, error)
+	List() ([]string, error)
+}
+
+type localProvider struct {
+	Provider
+
+	root string
+}
+
+func NewLocalProvider(root string) Provider {
+	return &localProvider{
+		root: root,
+	}
+}
+
+// checkId allows only ids made by common.UUID4For, so the id cannot point
+// outside of the root.
+func checkId(id string) error {
+	if !common.IsUUID(id) {
+		return fmt.Errorf("invalid storage id %q: %w", id, os.ErrNotExist)
+	}
+	return nil
+}
+
+func (lp *localProvider) Open(id string) (Storage, error) {
+	if err := checkId(id); err != nil {
+		return nil, err
+	}
+	return NewLocalStorage(filepath.Join(lp.root, id))
+}
+
+func (lp *localProvider) List() ([]string, error) {
+	dir, err := os.ReadDir(lp.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	result := []string{}
+	for _, d := range dir {
+		if !d.IsDir() || checkId(d.Name()) != nil {
+			continue
+		}
+		result = append(result, d.Name())
+	}
+	sort.Strings(result)
+	return result, nil
+}
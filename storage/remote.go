@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"chronicler/common"
+)
+
+const (
+	remotePrefix = "/storage"
+)
+
+type remoteServer struct {
+	http.Handler
+
+	mux      sync.Mutex
+	storages Provider
+	token    string
+	opened   map[string]Storage
+	serveMux *http.ServeMux
+	logger   *common.Logger
+}
+
+// NewRemoteServer exposes the storages over http, requests should have
+// an "Authorization: Bearer {token}" header, unless the token is empty.
+func NewRemoteServer(storages Provider, token string) http.Handler {
+	rs := &remoteServer{
+		storages: storages,
+		token:    token,
+		opened:   map[string]Storage{},
+		serveMux: http.NewServeMux(),
+		logger:   common.NewLogger("RemoteServer"),
+	}
+	rs.serveMux.HandleFunc("GET "+remotePrefix, rs.listStorages)
+	rs.serveMux.HandleFunc("GET "+remotePrefix+"/{id}/list", rs.list)
+	rs.serveMux.HandleFunc("GET "+remotePrefix+"/{id}/object", rs.get)
+	rs.serveMux.HandleFunc("PUT "+remotePrefix+"/{id}/object", rs.put)
+	return rs
+}
+
+func (rs *remoteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if rs.token != "" && subtle.ConstantTimeCompare([]byte(auth), []byte(rs.token)) != 1 {
+		http.Error(w, "wrong or missing token", http.StatusUnauthorized)
+		return
+	}
+	rs.serveMux.ServeHTTP(w, r)
+}
+
+func (rs *remoteServer) writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, os.ErrNotExist) {
+		status = http.StatusNotFound
+	}
+	rs.logger.Warningf("Request failed: %s", err)
+	http.Error(w, err.Error(), status)
+}
+
+func (rs *remoteServer) open(r *http.Request) (Storage, error) {
+	id := r.PathValue("id")
+	if err := checkId(id); err != nil {
+		return nil, err
+	}
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+	if s, ok := rs.opened[id]; ok {
+		return s, nil
+	}
+	s, err := rs.storages.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	rs.opened[id] = s
+	return s, nil
+}
+
+func (rs *remoteServer) listStorages(w http.ResponseWriter, r *http.Request) {
+	ids, err := rs.storages.List()
+	if err != nil {
+		rs.writeError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(ids)
+}
+
+func (rs *remoteServer) list(w http.ResponseWriter, r *http.Request) {
+	s, err := rs.open(r)
+	if err != nil {
+		rs.writeError(w, err)
+		return
+	}
+	result, err := s.List(&ListRequest{
+		WithSnapshots: r.URL.Query().Get("snapshots") == "true",
+		WithFiles:     r.URL.Query().Get("files") == "true",
+		Url:           r.URL.Query()["url"],
+	})
+	if err != nil {
+		rs.writeError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (rs *remoteServer) get(w http.ResponseWriter, r *http.Request) {
+	s, err := rs.open(r)
+	if err != nil {
+		rs.writeError(w, err)
+		return
+	}
+	reader, err := s.Get(&GetRequest{Url: r.URL.Query().Get("url"), Version: r.URL.Query().Get("version")})
+	if err != nil {
+		rs.writeError(w, err)
+		return
+	}
+	defer reader.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(w, reader); err != nil {
+		rs.logger.Warningf("Failed to send %q: %s", r.URL.Query().Get("url"), err)
+	}
+}
+
+func (rs *remoteServer) put(w http.ResponseWriter, r *http.Request) {
+	s, err := rs.open(r)
+	if err != nil {
+		rs.writeError(w, err)
+		return
+	}
+	writer, err := s.Put(&PutRequest{
+		Url:             r.URL.Query().Get("url"),
+		SaveOnOverwrite: r.URL.Query().Get("overwrite") == "true",
+	})
+	if err != nil {
+		rs.writeError(w, err)
+		return
+	}
+	if _, err := io.Copy(writer, r.Body); err != nil {
+		rs.writeError(w, errors.Join(err, CloseWithError(writer, err)))
+		return
+	}
+	if err := writer.Close(); err != nil {
+		rs.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+type remoteWriter struct {
+	io.WriteCloser
+
+	pipe *io.PipeWriter
+	done chan error
+}
+
+func (rw *remoteWriter) Write(data []byte) (int, error) {
+	return rw.pipe.Write(data)
+}
+
+func (rw *remoteWriter) Close() error {
+	rw.pipe.Close()
+	return <-rw.done
+}
+
+func (rw *remoteWriter) CloseWithError(err error) error {
+	rw.pipe.CloseWithError(err)
+	<-rw.done
+	return nil
+}
+
+type remoteStorage struct {
+	Storage
+
+	client *http.Client
+	base   string
+	token  string
+}
+
+func (rs *remoteStorage) request(method string, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(method, rs.base+path+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	if rs.token != "" {
+		request.Header.Set("Authorization", "Bearer "+rs.token)
+	}
+	response, err := rs.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		message, _ := io.ReadAll(response.Body)
+		err = fmt.Errorf("remote storage %s %s: %s", method, path, strings.TrimSpace(string(message)))
+		if response.StatusCode == http.StatusNotFound {
+			err = fmt.Errorf("%w: %w", err, os.ErrNotExist)
+		}
+		return nil, err
+	}
+	return response, nil
+}
+
+func (rs *remoteStorage) Put(put *PutRequest) (io.WriteCloser, error) {
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	query := url.Values{"url": {put.Url}}
+	if put.SaveOnOverwrite {
+		query.Set("overwrite", "true")
+	}
+	go func() {
+		response, err := rs.request(http.MethodPut, "/object", query, reader)
+		if err == nil {
+			response.Body.Close()
+		}
+		reader.CloseWithError(err)
+		done <- err
+	}()
+	return &remoteWriter{pipe: writer, done: done}, nil
+}
+
+func (rs *remoteStorage) Get(get *GetRequest) (io.ReadCloser, error) {
+	query := url.Values{"url": {get.Url}}
+	if get.Version != "" {
+		query.Set("version", get.Version)
+	}
+	response, err := rs.request(http.MethodGet, "/object", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (rs *remoteStorage) List(list *ListRequest) (*ListResponse, error) {
+	query := url.Values{"url": list.Url}
+	if list.WithSnapshots {
+		query.Set("snapshots", "true")
+	}
+	if list.WithFiles {
+		query.Set("files", "true")
+	}
+	response, err := rs.request(http.MethodGet, "/list", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	result := &ListResponse{}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type remoteProvider struct {
+	Provider
+
+	client *http.Client
+	base   string
+	token  string
+}
+
+// NewRemoteProvider connects to the storages served by the NewRemoteServer at
+// the base url, e.g. "http://somehost:8081".
+func NewRemoteProvider(client *http.Client, base string, token string) Provider {
+	return &remoteProvider{
+		client: client,
+		base:   strings.TrimSuffix(base, "/") + remotePrefix,
+		token:  token,
+	}
+}
+
+func (rp *remoteProvider) Open(id string) (Storage, error) {
+	return &remoteStorage{
+		client: rp.client,
+		base:   rp.base + "/" + url.PathEscape(id),
+		token:  rp.token,
+	}, nil
+}
+
+func (rp *remoteProvider) List() ([]string, error) {
+	s := &remoteStorage{client: rp.client, base: rp.base, token: rp.token}
+	response, err := s.request(http.MethodGet, "", url.Values{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	result := []string{}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
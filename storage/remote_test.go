@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newRemoteProvider(t *testing.T, token string) (string, Provider) {
+	root := t.TempDir()
+	server := httptest.NewServer(NewRemoteServer(NewLocalProvider(root), "token"))
+	t.Cleanup(server.Close)
+	return root, NewRemoteProvider(server.Client(), server.URL, token)
+}
+
+func TestRemoteStorage(t *testing.T) {
+	root, provider := newRemoteProvider(t, "token")
+	s, err := provider.Open("00000000-0000-4000-8000-000000000001")
+	if err != nil {
+		t.Fatalf("Cannot open remote storage: %s", err)
+	}
+	big := bytes.Repeat([]byte{1, 2, 3, 4}, 1024*1024)
+	bs := &BlockStorage{Storage: s}
+	for _, content := range [][]byte{[]byte("first"), []byte("second")} {
+		w, err := s.Put(&PutRequest{Url: "snapshot.json", SaveOnOverwrite: true})
+		if err != nil {
+			t.Fatalf("Cannot write to storage: %s", err)
+		}
+		w.Write(content)
+		if err := w.Close(); err != nil {
+			t.Errorf("Cannot finish writing: %s", err)
+		}
+	}
+	if _, err := bs.PutBytes(&PutRequest{Url: "http://some/big/file.mp4"}, big); err != nil {
+		t.Errorf("Cannot write to storage: %s", err)
+	}
+
+	t.Run("read remote", func(t *testing.T) {
+		got, err := bs.GetBytes(&GetRequest{Url: "http://some/big/file.mp4"})
+		if err != nil {
+			t.Errorf("Cannot read from storage: %s", err)
+		}
+		if !bytes.Equal(got, big) {
+			t.Errorf("Expected to read %d bytes, but got %d", len(big), len(got))
+		}
+	})
+
+	t.Run("read version", func(t *testing.T) {
+		got, err := bs.GetBytes(&GetRequest{Url: "snapshot.json", Version: "0000"})
+		if err != nil || string(got) != "first" {
+			t.Errorf("Expected to read \"first\", but got %q (%v)", got, err)
+		}
+		if _, err := bs.GetBytes(&GetRequest{Url: "snapshot.json", Version: "0001"}); err == nil {
+			t.Errorf("Expected error for the non existing version")
+		}
+		os.WriteFile(root+"/secret.txt", []byte("secret"), 0666)
+		if got, err := bs.GetBytes(&GetRequest{Url: "snapshot.json", Version: "/../../../secret.txt"}); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected the version outside of the storage to not exist, but got %q (%v)", got, err)
+		}
+	})
+
+	t.Run("read local", func(t *testing.T) {
+		local, err := NewLocalStorage(root + "/00000000-0000-4000-8000-000000000001")
+		if err != nil {
+			t.Fatalf("Cannot open local storage: %s", err)
+		}
+		got, err := (&BlockStorage{Storage: local}).GetBytes(&GetRequest{Url: "snapshot.json"})
+		if err != nil || string(got) != "second" {
+			t.Errorf("Expected to read \"second\", but got %q (%v)", got, err)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		list, err := s.List(&ListRequest{WithSnapshots: true})
+		if err != nil {
+			t.Errorf("Cannot list storage: %s", err)
+		}
+		sort.Slice(list.Items, func(i, j int) bool {
+			return list.Items[i].Url < list.Items[j].Url
+		})
+		want := &ListResponse{Items: []StorageItem{
+			{Url: "http://some/big/file.mp4"},
+			{Url: "snapshot.json", Versions: []string{"0000"}},
+		}}
+		if !reflect.DeepEqual(list, want) {
+			t.Errorf("Expected list to be %v, but got %v", want, list)
+		}
+
+		filtered, err := s.List(&ListRequest{Url: []string{"snapshot.json"}})
+		if err != nil {
+			t.Errorf("Cannot list storage: %s", err)
+		}
+		if want := listResponseUrls("snapshot.json"); !reflect.DeepEqual(filtered, want) {
+			t.Errorf("Expected list to be %v, but got %v", want, filtered)
+		}
+	})
+
+	t.Run("list storages", func(t *testing.T) {
+		ids, err := provider.List()
+		if err != nil {
+			t.Errorf("Cannot list storages: %s", err)
+		}
+		if want := []string{"00000000-0000-4000-8000-000000000001"}; !reflect.DeepEqual(ids, want) {
+			t.Errorf("Expected ids to be %q, but got %q", want, ids)
+		}
+	})
+
+	t.Run("non existing get", func(t *testing.T) {
+		if _, err := s.Get(&GetRequest{Url: "someurl"}); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected %q error, but got %v", os.ErrNotExist, err)
+		}
+	})
+}
+
+func TestRemoteStorageErrors(t *testing.T) {
+	t.Run("wrong token", func(t *testing.T) {
+		_, provider := newRemoteProvider(t, "wrong token")
+		s, _ := provider.Open("00000000-0000-4000-8000-000000000001")
+		w, _ := s.Put(&PutRequest{Url: "snapshot.json"})
+		w.Write([]byte("data"))
+		if err := w.Close(); err == nil {
+			t.Errorf("Expected put to fail with the wrong token")
+		}
+		if _, err := provider.List(); err == nil {
+			t.Errorf("Expected list to fail with the wrong token")
+		}
+	})
+
+	t.Run("invalid id", func(t *testing.T) {
+		_, provider := newRemoteProvider(t, "token")
+		s, _ := provider.Open("..")
+		if _, err := s.List(&ListRequest{}); err == nil {
+			t.Errorf("Expected list to fail for the invalid id")
+		}
+	})
+
+	t.Run("encoded slash in id", func(t *testing.T) {
+		root := t.TempDir()
+		data := filepath.Join(root, "data")
+		server := httptest.NewServer(NewRemoteServer(NewLocalProvider(data), ""))
+		defer server.Close()
+		request, _ := http.NewRequest(http.MethodPut, server.URL+"/storage/x%2F..%2F..%2Fescaped/object?url=file", strings.NewReader("data"))
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Request failed: %s", err)
+		}
+		response.Body.Close()
+		if response.StatusCode < 400 {
+			t.Errorf("Expected the request to fail, but got %d", response.StatusCode)
+		}
+		for _, name := range []string{filepath.Join(root, "escaped"), filepath.Join(data, "escaped")} {
+			if _, err := os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Expected %s to not be created", name)
+			}
+		}
+	})
+
+	t.Run("no token", func(t *testing.T) {
+		server := httptest.NewServer(NewRemoteServer(NewLocalProvider(t.TempDir()), ""))
+		defer server.Close()
+		s, _ := NewRemoteProvider(http.DefaultClient, server.URL, "").Open("00000000-0000-4000-8000-000000000001")
+		if err := write(s, "file", []byte("data")); err != nil {
+			t.Errorf("Cannot write without token: %s", err)
+		}
+	})
+}
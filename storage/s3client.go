@@ -0,0 +1,346 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3Service         = "s3"
+	s3DefaultRegion   = "us-east-1"
+	s3DefaultPartSize = 16 * 1024 * 1024
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "20060102T150405Z"
+)
+
+// S3Config points to the bucket and prefix of some S3-compatible storage,
+// objects are addressed path style: {Endpoint}/{Bucket}/{Prefix}/{key}.
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	PartSize  int
+}
+
+// ParseS3Url reads the config from an url like "https://host:port/bucket/some/prefix",
+// the credentials are taken from the standard AWS_* environment variables.
+func ParseS3Url(s3Url string) (*S3Config, error) {
+	u, err := url.Parse(s3Url)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("s3 url %q should start with http:// or https://", s3Url)
+	}
+	bucket, prefix, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("no bucket in s3 url %q", s3Url)
+	}
+	return &S3Config{
+		Endpoint:  u.Scheme + "://" + u.Host,
+		Bucket:    bucket,
+		Prefix:    prefix,
+		Region:    os.Getenv("AWS_REGION"),
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}, nil
+}
+
+type s3Object struct {
+	Key  string `xml:"Key"`
+	Size int64  `xml:"Size"`
+	ETag string `xml:"ETag"`
+}
+
+type s3Prefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListResult struct {
+	XMLName               xml.Name   `xml:"ListBucketResult"`
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []s3Prefix `xml:"CommonPrefixes"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+type s3InitiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	UploadId string   `xml:"UploadId"`
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteRequest struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3 error %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (e *s3Error) Unwrap() error {
+	if e.Status == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// s3Client is a minimal client for the S3 REST API with AWS signature v4.
+type s3Client struct {
+	client *http.Client
+	config *S3Config
+	now    func() time.Time
+}
+
+func newS3Client(client *http.Client, config *S3Config) *s3Client {
+	return &s3Client{
+		client: client,
+		config: config,
+		now:    time.Now,
+	}
+}
+
+func s3Escape(value string, keepSlash bool) string {
+	result := strings.Builder{}
+	for _, b := range []byte(value) {
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (keepSlash && b == '/') {
+			result.WriteByte(b)
+		} else {
+			result.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+	return result.String()
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (c *s3Client) sign(request *http.Request, query url.Values) {
+	if c.config.AccessKey == "" {
+		return
+	}
+	region := c.config.Region
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	now := c.now().UTC()
+	amzDate := now.Format(s3TimeFormat)
+	day := amzDate[:8]
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	headerNames := []string{"host"}
+	for name := range request.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headerNames = append(headerNames, lower)
+		}
+	}
+	sort.Strings(headerNames)
+	canonicalHeaders := strings.Builder{}
+	for _, name := range headerNames {
+		value := request.Host
+		if name != "host" {
+			value = strings.TrimSpace(request.Header.Get(name))
+		}
+		canonicalHeaders.WriteString(name + ":" + value + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	queryKeys := []string{}
+	for k := range query {
+		queryKeys = append(queryKeys, k)
+	}
+	sort.Strings(queryKeys)
+	canonicalQuery := []string{}
+	for _, k := range queryKeys {
+		canonicalQuery = append(canonicalQuery, s3Escape(k, false)+"="+s3Escape(query.Get(k), false))
+	}
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := strings.Join([]string{day, region, s3Service, "aws4_request"}, "/")
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+c.config.SecretKey), day)
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, s3Service)
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, toSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func (c *s3Client) do(method string, key string, query url.Values, headers map[string]string, body []byte) (*http.Response, error) {
+	path := "/" + c.config.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+	u, err := url.Parse(c.config.Endpoint + s3Escape(path, true))
+	if err != nil {
+		return nil, err
+	}
+	if query == nil {
+		query = url.Values{}
+	}
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	request, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.ContentLength = int64(len(body))
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+	c.sign(request, query)
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		s3Err := &s3Error{Status: response.StatusCode}
+		data, _ := io.ReadAll(response.Body)
+		xml.Unmarshal(data, s3Err)
+		return nil, s3Err
+	}
+	return response, nil
+}
+
+func (c *s3Client) doXml(method string, key string, query url.Values, body []byte, result interface{}) error {
+	response, err := c.do(method, key, query, nil, body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if result == nil {
+		_, err = io.Copy(io.Discard, response.Body)
+		return err
+	}
+	return xml.NewDecoder(response.Body).Decode(result)
+}
+
+func (c *s3Client) putObject(key string, data []byte) error {
+	return c.doXml(http.MethodPut, key, nil, data, nil)
+}
+
+func (c *s3Client) copyObject(from string, to string) error {
+	response, err := c.do(http.MethodPut, to, nil, map[string]string{
+		"X-Amz-Copy-Source": s3Escape("/"+c.config.Bucket+"/"+from, true),
+	}, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(io.Discard, response.Body)
+	return err
+}
+
+func (c *s3Client) getObject(key string) (io.ReadCloser, error) {
+	response, err := c.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+// listObjects returns all keys with the given prefix and the common prefixes
+// when the delimiter is not empty, following the continuation tokens.
+func (c *s3Client) listObjects(prefix string, delimiter string) ([]s3Object, []string, error) {
+	objects := []s3Object{}
+	prefixes := []string{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		result := &s3ListResult{}
+		if err := c.doXml(http.MethodGet, "", query, nil, result); err != nil {
+			return nil, nil, err
+		}
+		objects = append(objects, result.Contents...)
+		for _, p := range result.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return objects, prefixes, nil
+}
+
+func (c *s3Client) createUpload(key string) (string, error) {
+	result := &s3InitiateResult{}
+	if err := c.doXml(http.MethodPost, key, url.Values{"uploads": {""}}, nil, result); err != nil {
+		return "", err
+	}
+	return result.UploadId, nil
+}
+
+func (c *s3Client) uploadPart(key string, uploadId string, number int, data []byte) (string, error) {
+	response, err := c.do(http.MethodPut, key, url.Values{
+		"partNumber": {fmt.Sprintf("%d", number)},
+		"uploadId":   {uploadId},
+	}, nil, data)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	return response.Header.Get("ETag"), nil
+}
+
+func (c *s3Client) completeUpload(key string, uploadId string, parts []s3Part) error {
+	body, err := xml.Marshal(&s3CompleteRequest{Parts: parts})
+	if err != nil {
+		return err
+	}
+	return c.doXml(http.MethodPost, key, url.Values{"uploadId": {uploadId}}, body, nil)
+}
+
+func (c *s3Client) abortUpload(key string, uploadId string) error {
+	return c.doXml(http.MethodDelete, key, url.Values{"uploadId": {uploadId}}, nil, nil)
+}
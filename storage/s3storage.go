@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"chronicler/common"
+)
+
+type s3Writer struct {
+	io.WriteCloser
+
+	client   *s3Client
+	key      string
+	partSize int
+	buffer   []byte
+	uploadId string
+	parts    []s3Part
+	// err is kept after a failed part, the upload is aborted by then
+	err     error
+	onClose func() error
+	onAbort func()
+}
+
+func (sw *s3Writer) flushPart() error {
+	if sw.uploadId == "" {
+		uploadId, err := sw.client.createUpload(sw.key)
+		if err != nil {
+			sw.abort(err)
+			return err
+		}
+		sw.uploadId = uploadId
+	}
+	number := len(sw.parts) + 1
+	etag, err := sw.client.uploadPart(sw.key, sw.uploadId, number, sw.buffer)
+	if err != nil {
+		sw.abort(err)
+		return err
+	}
+	sw.parts = append(sw.parts, s3Part{PartNumber: number, ETag: etag})
+	sw.buffer = sw.buffer[:0]
+	return nil
+}
+
+// abort drops the uploaded parts, so they are not kept in the bucket.
+func (sw *s3Writer) abort(err error) error {
+	if sw.err == nil {
+		sw.onAbort()
+	}
+	sw.err = err
+	if sw.uploadId == "" {
+		return nil
+	}
+	uploadId := sw.uploadId
+	sw.uploadId = ""
+	return sw.client.abortUpload(sw.key, uploadId)
+}
+
+func (sw *s3Writer) Write(data []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	written := 0
+	for len(data) > 0 {
+		toCopy := min(sw.partSize-len(sw.buffer), len(data))
+		sw.buffer = append(sw.buffer, data[:toCopy]...)
+		data = data[toCopy:]
+		written += toCopy
+		if len(sw.buffer) == sw.partSize {
+			if err := sw.flushPart(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (sw *s3Writer) Close() error {
+	if sw.err != nil {
+		return sw.err
+	}
+	if sw.uploadId == "" {
+		if err := sw.client.putObject(sw.key, sw.buffer); err != nil {
+			sw.abort(err)
+			return err
+		}
+		return sw.onClose()
+	}
+	if len(sw.buffer) > 0 {
+		if err := sw.flushPart(); err != nil {
+			return err
+		}
+	}
+	if err := sw.client.completeUpload(sw.key, sw.uploadId, sw.parts); err != nil {
+		sw.abort(err)
+		return err
+	}
+	return sw.onClose()
+}
+
+func (sw *s3Writer) CloseWithError(err error) error {
+	return sw.abort(err)
+}
+
+// s3Storage keeps the same layout as the localStorage, just with the
+// object keys under the {prefix}/{id}/ instead of the directory.
+type s3Storage struct {
+	Storage
+
+	writeMux   sync.RWMutex
+	client     *s3Client
+	root       string
+	localNames map[string]string
+	usedNames  usedNames
+	logger     *common.Logger
+}
+
+func newS3Storage(client *s3Client, root string) (Storage, error) {
+	storage := &s3Storage{
+		client:     client,
+		root:       root,
+		localNames: map[string]string{},
+		usedNames:  usedNames{},
+		logger:     common.NewLogger("S3Storage"),
+	}
+	if err := storage.readMapping(); err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+func (ss *s3Storage) key(name string) string {
+	return path.Join(ss.root, name)
+}
+
+func (ss *s3Storage) saveMapping() error {
+	bytes, err := json.Marshal(ss.localNames)
+	if err != nil {
+		return err
+	}
+	return ss.client.putObject(ss.key(defaultMapping), bytes)
+}
+
+func (ss *s3Storage) readMapping() error {
+	reader, err := ss.client.getObject(ss.key(defaultMapping))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer reader.Close()
+	mapping := map[string]string{}
+	if err := json.NewDecoder(reader).Decode(&mapping); err != nil {
+		return err
+	}
+	ss.localNames = mapping
+	ss.usedNames = newUsedNames(mapping)
+	return nil
+}
+
+func (ss *s3Storage) versions(localName string) ([]string, error) {
+	prefix := ss.key(path.Join(defaultSnapshot, localName+"_"))
+	objects, _, err := ss.client.listObjects(prefix, "")
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, obj := range objects {
+		version := strings.TrimPrefix(obj.Key, prefix)
+		if len(version) == 4 {
+			result = append(result, version)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (ss *s3Storage) snapshotFile(localName string) error {
+	versions, err := ss.versions(localName)
+	if err != nil {
+		return err
+	}
+	if len(versions) >= maxBackups {
+		return fmt.Errorf("too many backups already")
+	}
+	backupName := path.Join(defaultSnapshot, fmt.Sprintf("%s_%04d", localName, len(versions)))
+	return ss.client.copyObject(ss.key(localName), ss.key(backupName))
+}
+
+func (ss *s3Storage) Put(put *PutRequest) (io.WriteCloser, error) {
+	ss.writeMux.Lock()
+	defer ss.writeMux.Unlock()
+
+	name := uniqueName(ss.localNames, ss.usedNames, put.Url)
+	_, mapped := ss.localNames[put.Url]
+	if mapped && put.SaveOnOverwrite {
+		ss.logger.Debugf("File %q will be saved on overwrite", put.Url)
+		if err := ss.snapshotFile(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	// The name is taken until the upload fails, but the url is mapped to it
+	// only after the object is uploaded
+	if !mapped {
+		ss.usedNames.add(name)
+	}
+	partSize := ss.client.config.PartSize
+	if partSize <= 0 {
+		partSize = s3DefaultPartSize
+	}
+	return &s3Writer{
+		client:   ss.client,
+		key:      ss.key(name),
+		partSize: partSize,
+		onClose: func() error {
+			ss.writeMux.Lock()
+			defer ss.writeMux.Unlock()
+			ss.localNames[put.Url] = name
+			return ss.saveMapping()
+		},
+		onAbort: func() {
+			ss.writeMux.Lock()
+			defer ss.writeMux.Unlock()
+			if _, ok := ss.localNames[put.Url]; !ok {
+				ss.usedNames.remove(name)
+			}
+		},
+	}, nil
+}
+
+func (ss *s3Storage) Get(get *GetRequest) (io.ReadCloser, error) {
+	ss.writeMux.RLock()
+	name, ok := ss.localNames[get.Url]
+	ss.writeMux.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("cannot open %s/%s: %w", ss.root, get.Url, os.ErrNotExist)
+	}
+	if get.Version != "" {
+		if !validVersion(get.Version) {
+			return nil, fmt.Errorf("cannot open %s/%s version %q: %w", ss.root, get.Url, get.Version, os.ErrNotExist)
+		}
+		name = path.Join(defaultSnapshot, fmt.Sprintf("%s_%s", name, get.Version))
+	}
+	reader, err := ss.client.getObject(ss.key(name))
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s/%s: %w", ss.root, get.Url, err)
+	}
+	return reader, nil
+}
+
+func (ss *s3Storage) List(list *ListRequest) (*ListResponse, error) {
+	// The versions are listed without the lock, it is held only to copy the
+	// mapping
+	names := map[string]string{}
+	ss.writeMux.RLock()
+	for actual, local := range ss.localNames {
+		if len(list.Url) == 0 || slices.Contains(list.Url, actual) {
+			names[actual] = local
+		}
+	}
+	ss.writeMux.RUnlock()
+
+	result := &ListResponse{}
+	for actual, local := range names {
+		item := StorageItem{
+			Url: actual,
+		}
+		if list.WithFiles {
+			item.Name = local
+		}
+		if list.WithSnapshots {
+			versions, err := ss.versions(local)
+			if err != nil {
+				return nil, err
+			}
+			if len(versions) > 0 {
+				item.Versions = versions
+			}
+		}
+		result.Items = append(result.Items, item)
+	}
+	return result, nil
+}
+
+type s3Provider struct {
+	Provider
+
+	client *s3Client
+}
+
+func NewS3Provider(client *http.Client, config *S3Config) Provider {
+	return &s3Provider{
+		client: newS3Client(client, config),
+	}
+}
+
+func (sp *s3Provider) Open(id string) (Storage, error) {
+	if err := checkId(id); err != nil {
+		return nil, err
+	}
+	return newS3Storage(sp.client, path.Join(sp.client.config.Prefix, id))
+}
+
+func (sp *s3Provider) List() ([]string, error) {
+	prefix := sp.client.config.Prefix
+	if prefix != "" {
+		prefix = strings.TrimSuffix(prefix, "/") + "/"
+	}
+	_, prefixes, err := sp.client.listObjects(prefix, "/")
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, p := range prefixes {
+		id := strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/")
+		if id != "" && !strings.HasPrefix(id, ".") {
+			result = append(result, id)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 keeps the objects in memory and implements just enough of the S3
+// REST API for the s3Storage.
+type fakeS3 struct {
+	mux      sync.Mutex
+	bucket   string
+	maxKeys  int
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	requests []string
+	// failPart makes the upload of the part with this number fail
+	failPart   int
+	failCreate bool
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:  bucket,
+		maxKeys: 1000,
+		objects: map[string][]byte{},
+		uploads: map[string]map[int][]byte{},
+	}
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	keys := []string{}
+	seenPrefixes := map[string]bool{}
+	for k := range f.objects {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				p := k[:len(prefix)+i+len(delimiter)]
+				if !seenPrefixes[p] {
+					seenPrefixes[p] = true
+					keys = append(keys, p)
+				}
+				continue
+			}
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(query.Get("continuation-token"))
+	end := min(start+f.maxKeys, len(keys))
+	result := &s3ListResult{}
+	for _, k := range keys[start:end] {
+		if seenPrefixes[k] {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3Prefix{Prefix: k})
+		} else {
+			result.Contents = append(result.Contents, s3Object{Key: k, Size: int64(len(f.objects[k]))})
+		}
+	}
+	if end < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(end)
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	query := r.URL.Query()
+	f.requests = append(f.requests, r.Method+" "+r.URL.RawQuery)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		f.error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	switch {
+	case r.Method == http.MethodGet && key == "" && query.Get("list-type") == "2":
+		f.list(w, query)
+	case r.Method == http.MethodPost && query.Has("uploads") && f.failCreate:
+		f.error(w, http.StatusInternalServerError, "InternalError")
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		uploadId := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[uploadId] = map[int][]byte{}
+		xml.NewEncoder(w).Encode(&s3InitiateResult{UploadId: uploadId})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if number == f.failPart {
+			f.error(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		f.uploads[query.Get("uploadId")][number] = body
+		w.Header().Set("ETag", fmt.Sprintf("\"etag-%d\"", number))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		complete := &s3CompleteRequest{}
+		xml.Unmarshal(body, complete)
+		data := []byte{}
+		for _, part := range complete.Parts {
+			data = append(data, f.uploads[query.Get("uploadId")][part.PartNumber]...)
+		}
+		f.objects[key] = data
+		delete(f.uploads, query.Get("uploadId"))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		data, ok := f.objects[strings.TrimPrefix(source, "/"+f.bucket+"/")]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		f.objects[key] = data
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Write(data)
+	default:
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func newFakeS3Provider(t *testing.T, partSize int) (*fakeS3, Provider) {
+	fake := newFakeS3("bucket")
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, NewS3Provider(server.Client(), &S3Config{
+		Endpoint:  server.URL,
+		Bucket:    "bucket",
+		Prefix:    "archive",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PartSize:  partSize,
+	})
+}
+
+func TestS3Storage(t *testing.T) {
+	fake, provider := newFakeS3Provider(t, 0)
+	s, err := provider.Open("00000000-0000-4000-8000-000000000001")
+	if err != nil {
+		t.Fatalf("Cannot open s3 storage: %s", err)
+	}
+	for _, content := range []string{"first", "second", "third"} {
+		w, err := s.Put(&PutRequest{Url: "snapshot.json", SaveOnOverwrite: true})
+		if err != nil {
+			t.Fatalf("Cannot write to storage: %s", err)
+		}
+		w.Write([]byte(content))
+		w.Close()
+	}
+	if err := write(s, "http://some/file.jpg?a=b", []byte{1, 2, 3}); err != nil {
+		t.Errorf("Cannot write to storage: %s", err)
+	}
+
+	t.Run("same layout as local storage", func(t *testing.T) {
+		keys := []string{}
+		for k := range fake.objects {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		want := []string{
+			"archive/00000000-0000-4000-8000-000000000001/.metadata/mapping.json",
+			"archive/00000000-0000-4000-8000-000000000001/.snapshot/snapshot.json_0000",
+			"archive/00000000-0000-4000-8000-000000000001/.snapshot/snapshot.json_0001",
+			"archive/00000000-0000-4000-8000-000000000001/" + localName("http://some/file.jpg?a=b"),
+			"archive/00000000-0000-4000-8000-000000000001/snapshot.json",
+		}
+		if !reflect.DeepEqual(keys, want) {
+			t.Errorf("Expected keys to be %q, but got %q", want, keys)
+		}
+	})
+
+	t.Run("reopen and read", func(t *testing.T) {
+		reopened, err := provider.Open("00000000-0000-4000-8000-000000000001")
+		if err != nil {
+			t.Fatalf("Cannot reopen s3 storage: %s", err)
+		}
+		list, err := reopened.List(&ListRequest{WithSnapshots: true})
+		if err != nil {
+			t.Errorf("Cannot list storage: %s", err)
+		}
+		sort.Slice(list.Items, func(i, j int) bool {
+			return list.Items[i].Url < list.Items[j].Url
+		})
+		wantList := &ListResponse{Items: []StorageItem{
+			{Url: "http://some/file.jpg?a=b"},
+			{Url: "snapshot.json", Versions: []string{"0000", "0001"}},
+		}}
+		if !reflect.DeepEqual(list, wantList) {
+			t.Errorf("Expected list to be %v, but got %v", wantList, list)
+		}
+
+		got, err := (&BlockStorage{Storage: reopened}).GetBytes(&GetRequest{Url: "snapshot.json"})
+		if err != nil || string(got) != "third" {
+			t.Errorf("Expected to read \"third\", but got %q (%v)", got, err)
+		}
+		got, err = (&BlockStorage{Storage: reopened}).GetBytes(&GetRequest{Url: "snapshot.json", Version: "0000"})
+		if err != nil || string(got) != "first" {
+			t.Errorf("Expected to read \"first\" from version 0000, but got %q (%v)", got, err)
+		}
+	})
+
+	t.Run("non existing get", func(t *testing.T) {
+		if _, err := s.Get(&GetRequest{Url: "someurl"}); err == nil || !strings.Contains(err.Error(), "file does not exist") {
+			t.Errorf("Expected file does not exist error, but got %v", err)
+		}
+	})
+}
+
+func TestS3StorageMultipart(t *testing.T) {
+	fake, provider := newFakeS3Provider(t, 10)
+	s, err := provider.Open("00000000-0000-4000-8000-000000000021")
+	if err != nil {
+		t.Fatalf("Cannot open s3 storage: %s", err)
+	}
+	want := bytes.Repeat([]byte("0123456"), 5)
+	bs := &BlockStorage{Storage: s}
+	if _, err := bs.PutBytes(&PutRequest{Url: "big-file.mp4"}, want); err != nil {
+		t.Errorf("Cannot write to storage: %s", err)
+	}
+	got, err := bs.GetBytes(&GetRequest{Url: "big-file.mp4"})
+	if err != nil {
+		t.Errorf("Cannot read from storage: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Expected to read %q, but got %q", want, got)
+	}
+
+	parts := 0
+	for _, r := range fake.requests {
+		if strings.HasPrefix(r, "PUT partNumber=") {
+			parts++
+		}
+	}
+	if parts != 4 {
+		t.Errorf("Expected 4 parts to be uploaded, but got %d: %q", parts, fake.requests)
+	}
+}
+
+func TestS3StorageFailedUpload(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		failPart   int
+		failCreate bool
+	}{
+		{name: "first part", failPart: 1},
+		{name: "last part", failPart: 4},
+		{name: "create upload", failCreate: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake, provider := newFakeS3Provider(t, 10)
+			fake.failPart = tc.failPart
+			fake.failCreate = tc.failCreate
+			s, err := provider.Open("00000000-0000-4000-8000-000000000022")
+			if err != nil {
+				t.Fatalf("Cannot open s3 storage: %s", err)
+			}
+			bs := &BlockStorage{Storage: s}
+			if _, err := bs.PutBytes(&PutRequest{Url: "big-file.mp4"}, bytes.Repeat([]byte("0123456"), 5)); err == nil {
+				t.Errorf("Expected the failed upload to fail the write")
+			}
+			if len(fake.uploads) != 0 {
+				t.Errorf("Expected the upload to be aborted, but got %d uploads: %q", len(fake.uploads), fake.requests)
+			}
+			for key := range fake.objects {
+				if strings.HasSuffix(key, "/"+localName("big-file.mp4")) {
+					t.Errorf("Expected no object for the failed write, but got %q", key)
+				}
+			}
+			if list, err := s.List(&ListRequest{}); err != nil || len(list.Items) != 0 {
+				t.Errorf("Expected no mapping for the failed write, but got %v, %v", list, err)
+			}
+		})
+	}
+}
+
+func TestS3Provider(t *testing.T) {
+	fake, provider := newFakeS3Provider(t, 0)
+	fake.maxKeys = 1
+	for _, id := range []string{"00000000-0000-4000-8000-000000000013", "00000000-0000-4000-8000-000000000011", "00000000-0000-4000-8000-000000000012"} {
+		s, err := provider.Open(id)
+		if err != nil {
+			t.Fatalf("Cannot open s3 storage: %s", err)
+		}
+		write(s, "snapshot.json", []byte(id))
+	}
+	ids, err := provider.List()
+	if err != nil {
+		t.Errorf("Cannot list storages: %s", err)
+	}
+	if want := []string{"00000000-0000-4000-8000-000000000011", "00000000-0000-4000-8000-000000000012", "00000000-0000-4000-8000-000000000013"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("Expected ids to be %q, but got %q", want, ids)
+	}
+}
+
+func TestParseS3Url(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		url     string
+		want    *S3Config
+		wantErr bool
+	}{
+		{
+			name: "bucket and prefix",
+			url:  "https://s3.example.com:9000/bucket/some/prefix/",
+			want: &S3Config{Endpoint: "https://s3.example.com:9000", Bucket: "bucket", Prefix: "some/prefix"},
+		},
+		{
+			name: "bucket only",
+			url:  "http://localhost/bucket",
+			want: &S3Config{Endpoint: "http://localhost", Bucket: "bucket"},
+		},
+		{
+			name:    "no bucket",
+			url:     "http://localhost/",
+			wantErr: true,
+		},
+		{
+			name:    "not http",
+			url:     "s3://bucket/prefix",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("AWS_REGION", "")
+			t.Setenv("AWS_ACCESS_KEY_ID", "")
+			t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+			got, err := ParseS3Url(tc.url)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Expected error: %v, but got %v", tc.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected ParseS3Url(%q) to be %v, but got %v", tc.url, tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	opb "chronicler/proto"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+type SnapshotFormat int
+
+const (
+	FormatProtoJson SnapshotFormat = iota
+	FormatProtoBinary
+)
+
+const (
+	snapshotVersion = 1
+	snapshotMagic   = "#chronicler-snapshot"
+)
+
+var (
+	formatNames = map[SnapshotFormat]string{
+		FormatProtoJson:   "protojson",
+		FormatProtoBinary: "binary",
+	}
+)
+
+func (sf SnapshotFormat) String() string {
+	return formatNames[sf]
+}
+
+func ParseSnapshotFormat(name string) (SnapshotFormat, error) {
+	for format, formatName := range formatNames {
+		if formatName == name {
+			return format, nil
+		}
+	}
+	return FormatProtoJson, fmt.Errorf("unknown snapshot format %q", name)
+}
+
+// MarshalSnapshot writes a one line header with the format and version
+// followed by the snapshot itself: "#chronicler-snapshot 1 protojson\n{...}".
+func MarshalSnapshot(snapshot *opb.Snapshot, format SnapshotFormat) ([]byte, error) {
+	var data []byte
+	var err error
+	switch format {
+	case FormatProtoJson:
+		data, err = protojson.MarshalOptions{Multiline: true}.Marshal(snapshot)
+	case FormatProtoBinary:
+		data, err = proto.Marshal(snapshot)
+	default:
+		err = fmt.Errorf("unknown snapshot format %d", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	header := fmt.Sprintf("%s %d %s\n", snapshotMagic, snapshotVersion, format)
+	return append([]byte(header), data...), nil
+}
+
+// UnmarshalSnapshot reads snapshots written by MarshalSnapshot and the ones
+// written with encoding/json before the header was added.
+func UnmarshalSnapshot(data []byte) (*opb.Snapshot, error) {
+	snapshot := &opb.Snapshot{}
+	if !bytes.HasPrefix(data, []byte(snapshotMagic+" ")) {
+		if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, snapshot); err == nil {
+			return snapshot, nil
+		}
+		snapshot = &opb.Snapshot{}
+		if err := json.Unmarshal(data, snapshot); err != nil {
+			return nil, fmt.Errorf("cannot read legacy snapshot: %w", err)
+		}
+		return snapshot, nil
+	}
+
+	header, payload, _ := bytes.Cut(data, []byte("\n"))
+	version := 0
+	formatName := ""
+	if _, err := fmt.Sscanf(strings.TrimPrefix(string(header), snapshotMagic), " %d %s", &version, &formatName); err != nil {
+		return nil, fmt.Errorf("malformed snapshot header %q: %w", header, err)
+	}
+	if version > snapshotVersion {
+		return nil, fmt.Errorf("snapshot version %d is newer than supported %d", version, snapshotVersion)
+	}
+	format, err := ParseSnapshotFormat(formatName)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatProtoJson:
+		err = (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(payload, snapshot)
+	case FormatProtoBinary:
+		err = proto.Unmarshal(payload, snapshot)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func (bs *BlockStorage) PutSnapshot(put *PutRequest, snapshot *opb.Snapshot, format SnapshotFormat) (int64, error) {
+	data, err := MarshalSnapshot(snapshot, format)
+	if err != nil {
+		return -1, err
+	}
+	return bs.PutBytes(put, data)
+}
+
+func (bs *BlockStorage) GetSnapshot(get *GetRequest) (*opb.Snapshot, error) {
+	data, err := bs.GetBytes(get)
+	if err != nil {
+		return nil, err
+	}
+	return UnmarshalSnapshot(data)
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	opb "chronicler/proto"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+var (
+	testSnapshot = &opb.Snapshot{
+		FetchTime: &opb.Timestamp{Seconds: 1700000000},
+		Link:      &opb.Link{Href: "http://some/url"},
+		Objects: []*opb.Object{
+			{
+				Id:        "1",
+				CreatedAt: &opb.Timestamp{Seconds: 1600000000, Nanos: 100},
+				Generator: []*opb.Generator{{Id: "user", Name: "User"}},
+				Content:   []*opb.Content{{Text: "<p>Hello</p>", Mime: "text/html"}},
+				Stats:     []*opb.Stats{{Type: opb.Stats_UPVOTE, Counter: 10}},
+			},
+			{
+				Id:         "2",
+				Parent:     "1",
+				Attachment: []*opb.Attachment{{Url: "http://some/image.jpg", Mime: "image/jpeg"}},
+			},
+		},
+	}
+)
+
+func TestSnapshotFormat(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		format     SnapshotFormat
+		wantHeader string
+	}{
+		{
+			name:       "protojson",
+			format:     FormatProtoJson,
+			wantHeader: "#chronicler-snapshot 1 protojson\n",
+		},
+		{
+			name:       "binary",
+			format:     FormatProtoBinary,
+			wantHeader: "#chronicler-snapshot 1 binary\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := MarshalSnapshot(testSnapshot, tc.format)
+			if err != nil {
+				t.Errorf("Cannot marshal snapshot: %s", err)
+			}
+			if !bytes.HasPrefix(data, []byte(tc.wantHeader)) {
+				t.Errorf("Expected snapshot to start with %q, but got %q", tc.wantHeader, data)
+			}
+			got, err := UnmarshalSnapshot(data)
+			if err != nil {
+				t.Errorf("Cannot unmarshal snapshot: %s", err)
+			}
+			if diff := cmp.Diff(testSnapshot, got, protocmp.Transform()); diff != "" {
+				t.Errorf("Unexpected snapshot diff: %s", diff)
+			}
+		})
+	}
+
+	t.Run("enum names", func(t *testing.T) {
+		data, _ := MarshalSnapshot(testSnapshot, FormatProtoJson)
+		if !strings.Contains(string(data), "\"UPVOTE\"") {
+			t.Errorf("Expected enum to be written by name, but got %s", data)
+		}
+	})
+}
+
+func TestLegacySnapshot(t *testing.T) {
+	t.Run("encoding json", func(t *testing.T) {
+		data, err := json.Marshal(testSnapshot)
+		if err != nil {
+			t.Errorf("Cannot marshal snapshot: %s", err)
+		}
+		got, err := UnmarshalSnapshot(data)
+		if err != nil {
+			t.Errorf("Cannot unmarshal snapshot: %s", err)
+		}
+		if diff := cmp.Diff(testSnapshot, got, protocmp.Transform()); diff != "" {
+			t.Errorf("Unexpected snapshot diff: %s", diff)
+		}
+	})
+
+	t.Run("written by older version", func(t *testing.T) {
+		data := `{"fetch_time":{"seconds":1700000000},"link":{"href":"http://some/url"},` +
+			`"objects":[{"id":"1","createdAt":{"seconds":1600000000,"nanos":100},` +
+			`"generator":[{"id":"user","name":"User"}],"content":[{"text":"<p>Hello</p>","mime":"text/html"}],` +
+			`"stats":[{"type":2,"counter":10}]},` +
+			`{"id":"2","parent":"1","attachment":[{"url":"http://some/image.jpg","mime":"image/jpeg"}]}]}`
+		got, err := UnmarshalSnapshot([]byte(data))
+		if err != nil {
+			t.Errorf("Cannot unmarshal snapshot: %s", err)
+		}
+		if diff := cmp.Diff(testSnapshot, got, protocmp.Transform()); diff != "" {
+			t.Errorf("Unexpected snapshot diff: %s", diff)
+		}
+	})
+
+	t.Run("newer version", func(t *testing.T) {
+		if _, err := UnmarshalSnapshot([]byte("#chronicler-snapshot 100 protojson\n{}")); err == nil {
+			t.Errorf("Expected error for the newer snapshot version")
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		if _, err := UnmarshalSnapshot([]byte("#chronicler-snapshot 1 xml\n{}")); err == nil {
+			t.Errorf("Expected error for the unknown snapshot format")
+		}
+	})
+}
+
+func TestBlockStorageSnapshot(t *testing.T) {
+	s, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Cannot create temporary storage: %s", err)
+	}
+	bs := &BlockStorage{Storage: s}
+	if _, err := bs.PutSnapshot(&PutRequest{Url: "snapshot.json"}, testSnapshot, FormatProtoBinary); err != nil {
+		t.Errorf("Cannot write snapshot: %s", err)
+	}
+	got, err := bs.GetSnapshot(&GetRequest{Url: "snapshot.json"})
+	if err != nil {
+		t.Errorf("Cannot read snapshot: %s", err)
+	}
+	if diff := cmp.Diff(testSnapshot, got, protocmp.Transform()); diff != "" {
+		t.Errorf("Unexpected snapshot diff: %s", diff)
+	}
+}
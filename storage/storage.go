@@ -2,8 +2,34 @@ package storage
 
 import (
 	"io"
+	"regexp"
 )
 
+var (
+	// Versions are numbered from 0000 in the order they were saved
+	versionPattern = regexp.MustCompile(`^[0-9]{4}$`)
+)
+
+// validVersion is true for names of versions returned by List, anything else
+// cannot be joined into the file path.
+func validVersion(version string) bool {
+	return versionPattern.MatchString(version)
+}
+
+// errorCloser is implemented by writers which can drop the written data.
+type errorCloser interface {
+	CloseWithError(err error) error
+}
+
+// CloseWithError drops the data written so far, so a failed write is not kept
+// as a complete file. Writers which cannot drop the data are just closed.
+func CloseWithError(writer io.WriteCloser, err error) error {
+	if ec, ok := writer.(errorCloser); ok {
+		return ec.CloseWithError(err)
+	}
+	return writer.Close()
+}
+
 type PutRequest struct {
 	Url             string
 	SaveOnOverwrite bool
@@ -11,16 +37,23 @@ type PutRequest struct {
 
 type GetRequest struct {
 	Url string
+	// One of the versions from the ListResponse, the latest one if empty
+	Version string
 }
 
 type ListRequest struct {
 	WithSnapshots bool
-	Url           []string
+	// Items get the name and size of the stored file if the storage has them
+	WithFiles bool
+	Url       []string
 }
 
 type StorageItem struct {
 	Url      string
 	Versions []string
+	// Name of the stored file in the storage and its size in bytes
+	Name string
+	Size int64
 }
 
 type ListResponse struct {
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrNotVerifiable = errors.New("storage cannot verify its files")
+)
+
+type ProblemKind string
+
+const (
+	// Mapping points to the file which does not exist
+	ProblemMissing ProblemKind = "missing"
+	// File is shorter than it was when written
+	ProblemTruncated ProblemKind = "truncated"
+	// File size or checksum differs from the manifest
+	ProblemCorrupted ProblemKind = "corrupted"
+	// File is not in the mapping, so it cannot be read
+	ProblemOrphan ProblemKind = "orphan"
+	// File has no checksum, written before the manifest or never closed
+	ProblemUnverified ProblemKind = "unverified"
+)
+
+type Problem struct {
+	Kind    ProblemKind
+	Url     string
+	File    string
+	Details string
+}
+
+func (p *Problem) String() string {
+	name := p.Url
+	if name == "" {
+		name = p.File
+	}
+	if p.Details == "" {
+		return fmt.Sprintf("%s: %s", p.Kind, name)
+	}
+	return fmt.Sprintf("%s: %s (%s)", p.Kind, name, p.Details)
+}
+
+func fileChecksum(path string) (*fileInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{Size: size, Sha256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+func (ls *localStorage) checkFile(url string, name string) *Problem {
+	actual, err := fileChecksum(filepath.Join(ls.root, filepath.FromSlash(name)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Problem{Kind: ProblemMissing, Url: url, File: name}
+		}
+		return &Problem{Kind: ProblemCorrupted, Url: url, File: name, Details: err.Error()}
+	}
+	want, ok := ls.manifest[name]
+	if !ok {
+		return &Problem{Kind: ProblemUnverified, Url: url, File: name}
+	}
+	if actual.Size < want.Size {
+		return &Problem{Kind: ProblemTruncated, Url: url, File: name,
+			Details: fmt.Sprintf("%d of %d bytes", actual.Size, want.Size)}
+	}
+	if actual.Size != want.Size || actual.Sha256 != want.Sha256 {
+		return &Problem{Kind: ProblemCorrupted, Url: url, File: name, Details: "checksum mismatch"}
+	}
+	return nil
+}
+
+// versionOf returns the name of the file the version was saved from, the
+// versions are named {defaultSnapshot}/{name}_{version}.
+func versionOf(name string) (string, bool) {
+	rest, ok := strings.CutPrefix(name, defaultSnapshot+"/")
+	if !ok {
+		return "", false
+	}
+	i := strings.LastIndex(rest, "_")
+	if i < 0 || !validVersion(rest[i+1:]) {
+		return "", false
+	}
+	return rest[:i], true
+}
+
+func (ls *localStorage) verify() ([]*Problem, error) {
+	problems := []*Problem{}
+	known := map[string]bool{}
+	for url, name := range ls.localNames {
+		known[name] = true
+		if p := ls.checkFile(url, name); p != nil {
+			problems = append(problems, p)
+		}
+	}
+	for name := range ls.manifest {
+		if !strings.HasPrefix(name, defaultSnapshot+"/") {
+			continue
+		}
+		known[name] = true
+		if p := ls.checkFile("", name); p != nil {
+			problems = append(problems, p)
+		}
+	}
+
+	for _, dir := range []string{"", defaultSnapshot} {
+		entries, err := os.ReadDir(filepath.Join(ls.root, dir))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, e := range entries {
+			name := filepath.ToSlash(filepath.Join(dir, e.Name()))
+			if e.IsDir() || known[name] {
+				continue
+			}
+			// Versions written before the manifest
+			if latest, ok := versionOf(name); ok && known[latest] {
+				continue
+			}
+			problems = append(problems, &Problem{Kind: ProblemOrphan, File: name})
+		}
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].File < problems[j].File
+	})
+	return problems, nil
+}
+
+// Verifier is implemented by storages which can check their files against the
+// checksums recorded when the files were written.
+type Verifier interface {
+	// Verify checks the mapping against the files and the files against
+	// their checksums.
+	Verify() ([]*Problem, error)
+	// Repair removes mapping entries for the missing files, maps orphan files
+	// back when they belong to one of the urls and records checksums for the
+	// unverified and remapped files. Returns the list of changes.
+	Repair(urls []string) ([]string, error)
+}
+
+// verifier returns the storage as a Verifier, storages kept elsewhere than
+// the local disk cannot be checked.
+func verifier(s Storage) (Verifier, error) {
+	if v, ok := s.(Verifier); ok {
+		return v, nil
+	}
+	return nil, fmt.Errorf("%w: %T", ErrNotVerifiable, s)
+}
+
+func (ls *localStorage) Verify() ([]*Problem, error) {
+	ls.writeMux.Lock()
+	defer ls.writeMux.Unlock()
+	return ls.verify()
+}
+
+func (ls *localStorage) Repair(urls []string) ([]string, error) {
+	ls.writeMux.Lock()
+	defer ls.writeMux.Unlock()
+
+	problems, err := ls.verify()
+	if err != nil {
+		return nil, err
+	}
+	orphans := map[string]bool{}
+	changes := []string{}
+	for _, p := range problems {
+		switch p.Kind {
+		case ProblemMissing:
+			delete(ls.localNames, p.Url)
+			ls.usedNames.remove(p.File)
+			delete(ls.manifest, p.File)
+			changes = append(changes, fmt.Sprintf("removed mapping for missing %q", p.Url))
+		case ProblemOrphan:
+			orphans[p.File] = true
+		case ProblemUnverified:
+			info, err := fileChecksum(filepath.Join(ls.root, filepath.FromSlash(p.File)))
+			if err != nil {
+				return changes, err
+			}
+			ls.manifest[p.File] = info
+			changes = append(changes, fmt.Sprintf("recorded checksum for %q", p.File))
+		}
+	}
+	for _, url := range urls {
+		name := localName(url)
+		if !orphans[name] {
+			name = legacyName(url)
+		}
+		if _, ok := ls.localNames[url]; ok || !orphans[name] {
+			continue
+		}
+		delete(orphans, name)
+		info, err := fileChecksum(filepath.Join(ls.root, filepath.FromSlash(name)))
+		if err != nil {
+			return changes, err
+		}
+		ls.localNames[url] = name
+		ls.usedNames.add(name)
+		ls.manifest[name] = info
+		changes = append(changes, fmt.Sprintf("mapped %q to %q", url, name))
+	}
+	if err := ls.saveMapping(); err != nil {
+		return changes, err
+	}
+	return changes, ls.saveManifest()
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func problemKinds(problems []*Problem) map[string]ProblemKind {
+	result := map[string]ProblemKind{}
+	for _, p := range problems {
+		result[p.File] = p.Kind
+	}
+	return result
+}
+
+// verifyRoot opens the local storage at root and checks it, as fsck does.
+func verifyRoot(root string) ([]*Problem, error) {
+	s, err := NewLocalStorage(root)
+	if err != nil {
+		return nil, err
+	}
+	return s.(Verifier).Verify()
+}
+
+func repairRoot(root string, urls []string) ([]string, error) {
+	s, err := NewLocalStorage(root)
+	if err != nil {
+		return nil, err
+	}
+	return s.(Verifier).Repair(urls)
+}
+
+func TestVerifyLocal(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		damage func(root string)
+		want   map[string]ProblemKind
+	}{
+		{
+			name:   "intact",
+			damage: func(root string) {},
+			want:   map[string]ProblemKind{},
+		},
+		{
+			name:   "missing",
+			damage: func(root string) { os.Remove(filepath.Join(root, "file_1")) },
+			want:   map[string]ProblemKind{"file_1": ProblemMissing},
+		},
+		{
+			name:   "truncated",
+			damage: func(root string) { os.Truncate(filepath.Join(root, "file_1"), 2) },
+			want:   map[string]ProblemKind{"file_1": ProblemTruncated},
+		},
+		{
+			name:   "corrupted",
+			damage: func(root string) { os.WriteFile(filepath.Join(root, "file_2"), []byte("54321"), defaultPerms) },
+			want:   map[string]ProblemKind{"file_2": ProblemCorrupted},
+		},
+		{
+			name:   "orphan",
+			damage: func(root string) { os.WriteFile(filepath.Join(root, "file_3"), []byte("3"), defaultPerms) },
+			want:   map[string]ProblemKind{"file_3": ProblemOrphan},
+		},
+		{
+			name:   "unverified",
+			damage: func(root string) { os.Remove(filepath.Join(root, defaultManifest)) },
+			want: map[string]ProblemKind{
+				"file_1": ProblemUnverified,
+				"file_2": ProblemUnverified,
+			},
+		},
+		{
+			name:   "corrupted version",
+			damage: func(root string) { os.WriteFile(filepath.Join(root, ".snapshot/file_1_0000"), nil, defaultPerms) },
+			want:   map[string]ProblemKind{".snapshot/file_1_0000": ProblemTruncated},
+		},
+		{
+			name: "short names in versions",
+			damage: func(root string) {
+				for _, name := range []string{"a", "_", "file_2_", "file_2_x0000"} {
+					os.WriteFile(filepath.Join(root, defaultSnapshot, name), nil, defaultPerms)
+				}
+			},
+			want: map[string]ProblemKind{
+				".snapshot/a":            ProblemOrphan,
+				".snapshot/_":            ProblemOrphan,
+				".snapshot/file_2_":      ProblemOrphan,
+				".snapshot/file_2_x0000": ProblemOrphan,
+			},
+		},
+		{
+			name: "version without manifest",
+			damage: func(root string) {
+				os.WriteFile(filepath.Join(root, defaultSnapshot, "file_2_0000"), nil, defaultPerms)
+			},
+			want: map[string]ProblemKind{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			s, err := NewLocalStorage(root)
+			if err != nil {
+				t.Fatalf("Cannot create storage: %s", err)
+			}
+			bs := &BlockStorage{Storage: s}
+			bs.PutBytes(&PutRequest{Url: "file_1"}, []byte("old"))
+			bs.PutBytes(&PutRequest{Url: "file_1", SaveOnOverwrite: true}, []byte("12345"))
+			bs.PutBytes(&PutRequest{Url: "file_2"}, []byte("12345"))
+
+			tc.damage(root)
+			problems, err := verifyRoot(root)
+			if err != nil {
+				t.Errorf("Cannot verify storage: %s", err)
+			}
+			if got := problemKinds(problems); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected problems %v, but got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRepairLocal(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewLocalStorage(root)
+	if err != nil {
+		t.Fatalf("Cannot create storage: %s", err)
+	}
+	bs := &BlockStorage{Storage: s}
+	bs.PutBytes(&PutRequest{Url: "file_1"}, []byte("12345"))
+	bs.PutBytes(&PutRequest{Url: "file_2"}, []byte("12345"))
+	os.Remove(filepath.Join(root, "file_1"))
+	// Written before the names got hashes
+	os.WriteFile(filepath.Join(root, "file_3"), []byte("3"), defaultPerms)
+	os.WriteFile(filepath.Join(root, localName("file 4")), []byte("4"), defaultPerms)
+	os.WriteFile(filepath.Join(root, "unknown"), []byte("?"), defaultPerms)
+
+	if _, err := repairRoot(root, []string{"file 3", "file 4"}); err != nil {
+		t.Errorf("Cannot repair storage: %s", err)
+	}
+
+	problems, err := verifyRoot(root)
+	if err != nil {
+		t.Errorf("Cannot verify storage: %s", err)
+	}
+	want := map[string]ProblemKind{"unknown": ProblemOrphan}
+	if got := problemKinds(problems); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected problems %v after repair, but got %v", want, got)
+	}
+	reopened, _ := NewLocalStorage(root)
+	list, _ := reopened.List(&ListRequest{})
+	urls := []string{}
+	for _, item := range list.Items {
+		urls = append(urls, item.Url)
+	}
+	sort.Strings(urls)
+	if want := []string{"file 3", "file 4", "file_2"}; !reflect.DeepEqual(urls, want) {
+		t.Errorf("Expected %q in the mapping, but got %q", want, urls)
+	}
+}
@@ -0,0 +1,269 @@
+package viewer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	opb "chronicler/proto"
+)
+
+const (
+	activityStreamsContext = "https://www.w3.org/ns/activitystreams"
+	// Terms for the fields ActivityStreams has no properties for
+	chroniclerContext = "https://github.com/lanseg/chronicler/ns#"
+)
+
+type asActor struct {
+	Type              string `json:"type"`
+	Name              string `json:"name,omitempty"`
+	PreferredUsername string `json:"preferredUsername,omitempty"`
+}
+
+type asTag struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	Href string `json:"href,omitempty"`
+}
+
+type asCollection struct {
+	Type       string `json:"type"`
+	TotalItems int64  `json:"totalItems"`
+}
+
+type asStats struct {
+	Type    string `json:"type"`
+	Counter int64  `json:"counter"`
+}
+
+// asAttachment is either a file or a Note with additional content.
+type asAttachment struct {
+	Type      string `json:"type"`
+	Url       string `json:"url,omitempty"`
+	MediaType string `json:"mediaType,omitempty"`
+	Content   string `json:"content,omitempty"`
+	Size      uint32 `json:"size,omitempty"`
+	Checksum  string `json:"checksum,omitempty"`
+}
+
+type asObject struct {
+	Type         string          `json:"type"`
+	Id           string          `json:"id"`
+	InReplyTo    string          `json:"inReplyTo,omitempty"`
+	Published    string          `json:"published,omitempty"`
+	AttributedTo []*asActor      `json:"attributedTo,omitempty"`
+	Content      string          `json:"content,omitempty"`
+	MediaType    string          `json:"mediaType,omitempty"`
+	Attachment   []*asAttachment `json:"attachment,omitempty"`
+	Tag          []*asTag        `json:"tag,omitempty"`
+	Likes        *asCollection   `json:"likes,omitempty"`
+	Stats        []*asStats      `json:"stats,omitempty"`
+}
+
+// asSnapshot is the snapshot as an OrderedCollection of its objects.
+type asSnapshot struct {
+	Context      any         `json:"@context"`
+	Type         string      `json:"type"`
+	Id           string      `json:"id"`
+	Url          string      `json:"url,omitempty"`
+	MediaType    string      `json:"mediaType,omitempty"`
+	Published    string      `json:"published,omitempty"`
+	TotalItems   int         `json:"totalItems"`
+	OrderedItems []*asObject `json:"orderedItems"`
+}
+
+func asTime(t *opb.Timestamp) string {
+	if t == nil {
+		return ""
+	}
+	return time.Unix(t.Seconds, int64(t.Nanos)).UTC().Format(time.RFC3339Nano)
+}
+
+func parseAsTime(value string) (*opb.Timestamp, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return nil, err
+	}
+	return &opb.Timestamp{Seconds: t.Unix(), Nanos: int32(t.Nanosecond())}, nil
+}
+
+func asAttachmentType(mime string) string {
+	switch attachmentKind(mime) {
+	case "image":
+		return "Image"
+	case "video":
+		return "Video"
+	case "audio":
+		return "Audio"
+	}
+	return "Document"
+}
+
+func objectIri(base string, id string) string {
+	return base + "#" + url.PathEscape(id)
+}
+
+func toActivityStreams(id string, snapshot *opb.Snapshot) *asSnapshot {
+	base := "urn:uuid:" + id
+	result := &asSnapshot{
+		Context: []any{activityStreamsContext, map[string]string{
+			"chronicler": chroniclerContext,
+			"size":       "chronicler:size",
+			"checksum":   "chronicler:checksum",
+			"stats":      "chronicler:stats",
+			"counter":    "chronicler:counter",
+		}},
+		Type:         "OrderedCollection",
+		Id:           base,
+		Published:    asTime(snapshot.FetchTime),
+		TotalItems:   len(snapshot.Objects),
+		OrderedItems: []*asObject{},
+	}
+	if snapshot.Link != nil {
+		result.Url = snapshot.Link.Href
+		result.MediaType = snapshot.Link.MediaType
+	}
+	for _, obj := range snapshot.Objects {
+		item := &asObject{
+			Type:      "Note",
+			Id:        objectIri(base, obj.Id),
+			Published: asTime(obj.CreatedAt),
+		}
+		if obj.Parent == "" {
+			item.Type = "Article"
+		} else {
+			item.InReplyTo = objectIri(base, obj.Parent)
+		}
+		for _, g := range obj.Generator {
+			item.AttributedTo = append(item.AttributedTo, &asActor{Type: "Person", Name: g.Name, PreferredUsername: g.Id})
+		}
+		for i, c := range obj.Content {
+			if i == 0 {
+				item.Content = c.Text
+				item.MediaType = c.Mime
+				continue
+			}
+			item.Attachment = append(item.Attachment, &asAttachment{Type: "Note", Content: c.Text, MediaType: c.Mime})
+		}
+		for _, a := range obj.Attachment {
+			item.Attachment = append(item.Attachment, &asAttachment{
+				Type:      asAttachmentType(a.Mime),
+				Url:       a.Url,
+				MediaType: a.Mime,
+				Size:      a.Size,
+				Checksum:  a.Checksum,
+			})
+		}
+		for _, t := range obj.Tag {
+			item.Tag = append(item.Tag, &asTag{Type: "Hashtag", Name: "#" + t.Name, Href: t.Url})
+		}
+		for _, s := range obj.Stats {
+			item.Stats = append(item.Stats, &asStats{Type: s.Type.String(), Counter: s.Counter})
+			if s.Type == opb.Stats_UPVOTE {
+				item.Likes = &asCollection{Type: "Collection", TotalItems: s.Counter}
+			}
+		}
+		result.OrderedItems = append(result.OrderedItems, item)
+	}
+	return result
+}
+
+func objectId(base string, iri string) (string, error) {
+	escaped, ok := strings.CutPrefix(iri, base+"#")
+	if !ok {
+		return iri, nil
+	}
+	return url.PathUnescape(escaped)
+}
+
+// ReadActivityStreams reads the snapshot written by the "activitystreams"
+// export format.
+func ReadActivityStreams(r io.Reader) (*opb.Snapshot, error) {
+	collection := &asSnapshot{}
+	if err := json.NewDecoder(r).Decode(collection); err != nil {
+		return nil, err
+	}
+	if collection.Type != "OrderedCollection" && collection.Type != "Collection" {
+		return nil, fmt.Errorf("expected a collection, but got %q", collection.Type)
+	}
+	fetchTime, err := parseAsTime(collection.Published)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &opb.Snapshot{FetchTime: fetchTime, Objects: []*opb.Object{}}
+	if collection.Url != "" {
+		snapshot.Link = &opb.Link{Href: collection.Url, MediaType: collection.MediaType}
+	}
+	for _, item := range collection.OrderedItems {
+		obj := &opb.Object{}
+		if obj.Id, err = objectId(collection.Id, item.Id); err != nil {
+			return nil, err
+		}
+		if item.InReplyTo != "" {
+			if obj.Parent, err = objectId(collection.Id, item.InReplyTo); err != nil {
+				return nil, err
+			}
+		}
+		if obj.CreatedAt, err = parseAsTime(item.Published); err != nil {
+			return nil, err
+		}
+		for _, actor := range item.AttributedTo {
+			obj.Generator = append(obj.Generator, &opb.Generator{Id: actor.PreferredUsername, Name: actor.Name})
+		}
+		if item.Content != "" || item.MediaType != "" {
+			obj.Content = append(obj.Content, &opb.Content{Text: item.Content, Mime: item.MediaType})
+		}
+		for _, a := range item.Attachment {
+			if a.Type == "Note" {
+				obj.Content = append(obj.Content, &opb.Content{Text: a.Content, Mime: a.MediaType})
+				continue
+			}
+			obj.Attachment = append(obj.Attachment, &opb.Attachment{
+				Url:      a.Url,
+				Mime:     a.MediaType,
+				Size:     a.Size,
+				Checksum: a.Checksum,
+			})
+		}
+		for _, t := range item.Tag {
+			obj.Tag = append(obj.Tag, &opb.Tag{Name: strings.TrimPrefix(t.Name, "#"), Url: t.Href})
+		}
+		for _, s := range item.Stats {
+			obj.Stats = append(obj.Stats, &opb.Stats{Type: opb.Stats_StatsType(opb.Stats_StatsType_value[s.Type]), Counter: s.Counter})
+		}
+		if len(item.Stats) == 0 && item.Likes != nil {
+			obj.Stats = append(obj.Stats, &opb.Stats{Type: opb.Stats_UPVOTE, Counter: item.Likes.TotalItems})
+		}
+		snapshot.Objects = append(snapshot.Objects, obj)
+	}
+	return snapshot, nil
+}
+
+type activityStreamsFormat struct{}
+
+func newActivityStreamsFormat() format {
+	return &activityStreamsFormat{}
+}
+
+func (af *activityStreamsFormat) writeSnapshot(target string, s *exportedSnapshot) error {
+	data := strings.Builder{}
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(toActivityStreams(s.Id, s.Snapshot)); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(target, s.Id+".jsonld"), data.String())
+}
+
+// writeIndex does nothing, every snapshot is a separate collection.
+func (af *activityStreamsFormat) writeIndex(target string, exported []*exportedSnapshot) error {
+	return nil
+}
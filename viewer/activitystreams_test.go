@@ -0,0 +1,122 @@
+package viewer
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"chronicler/common"
+	opb "chronicler/proto"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestActivityStreams(t *testing.T) {
+	snapshot := proto.Clone(testSnapshot).(*opb.Snapshot)
+	snapshot.Objects = append(snapshot.Objects, &opb.Object{
+		Id:        "a b/#c",
+		Parent:    "2",
+		CreatedAt: &opb.Timestamp{Seconds: 1600000200, Nanos: 5000},
+		Tag:       []*opb.Tag{{Name: "news", Url: "http://some/tag/news"}, {Name: "#hash"}},
+		Generator: []*opb.Generator{{Id: "u1", Name: "First"}, {Name: "Second"}},
+		Content:   []*opb.Content{{Text: "Title", Mime: "text/plain"}, {Text: "<p>Body</p>", Mime: "text/html"}},
+		Attachment: []*opb.Attachment{
+			{Url: "http://some/doc.pdf", Mime: "application/pdf", Size: 123, Checksum: "abc"},
+		},
+		Stats: []*opb.Stats{{Type: opb.Stats_DOWNVOTE, Counter: 2}, {Type: opb.Stats_RATING, Counter: -1}},
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		id := common.UUID4For(testLink)
+		data, err := json.Marshal(toActivityStreams(id, snapshot))
+		if err != nil {
+			t.Fatalf("Cannot write collection: %s", err)
+		}
+		got, err := ReadActivityStreams(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Cannot read collection: %s", err)
+		}
+		if !proto.Equal(got, snapshot) {
+			t.Errorf("Expected %v, but got %v", snapshot, got)
+		}
+	})
+
+	t.Run("vocabulary", func(t *testing.T) {
+		collection := toActivityStreams("id", snapshot)
+		items := collection.OrderedItems
+		if collection.Type != "OrderedCollection" || collection.TotalItems != 3 || collection.Url != "http://some/url" {
+			t.Errorf("Unexpected collection %q of %d items at %q", collection.Type, collection.TotalItems, collection.Url)
+		}
+		types := []string{items[0].Type, items[1].Type, items[2].Type}
+		if strings.Join(types, " ") != "Article Note Note" {
+			t.Errorf("Unexpected object types %q", types)
+		}
+		if items[1].InReplyTo != items[0].Id || items[2].Id != "urn:uuid:id#a%20b%2F%23c" {
+			t.Errorf("Unexpected ids %q, %q replying to %q", items[0].Id, items[2].Id, items[1].InReplyTo)
+		}
+		if actor := items[0].AttributedTo[0]; actor.Type != "Person" || actor.Name != "Original Poster" {
+			t.Errorf("Unexpected actor %v", actor)
+		}
+		if a := items[0].Attachment; a[0].Type != "Image" || a[1].Type != "Video" {
+			t.Errorf("Unexpected attachment types %q, %q", a[0].Type, a[1].Type)
+		}
+		if items[0].Likes == nil || items[0].Likes.TotalItems != 10 {
+			t.Errorf("Expected 10 likes, but got %v", items[0].Likes)
+		}
+		if tag := items[2].Tag[0]; tag.Type != "Hashtag" || tag.Name != "#news" {
+			t.Errorf("Unexpected tag %v", tag)
+		}
+	})
+
+	t.Run("foreign collection", func(t *testing.T) {
+		got, err := ReadActivityStreams(strings.NewReader(`{
+			"@context": "https://www.w3.org/ns/activitystreams",
+			"type": "OrderedCollection",
+			"id": "https://social/outbox",
+			"orderedItems": [{
+				"type": "Note",
+				"id": "https://social/notes/1",
+				"inReplyTo": "https://social/notes/0",
+				"content": "Hi",
+				"likes": {"type": "Collection", "totalItems": 3}
+			}]
+		}`))
+		if err != nil {
+			t.Fatalf("Cannot read collection: %s", err)
+		}
+		want := &opb.Snapshot{Objects: []*opb.Object{{
+			Id:      "https://social/notes/1",
+			Parent:  "https://social/notes/0",
+			Content: []*opb.Content{{Text: "Hi"}},
+			Stats:   []*opb.Stats{{Type: opb.Stats_UPVOTE, Counter: 3}},
+		}}}
+		if !proto.Equal(got, want) {
+			t.Errorf("Expected %v, but got %v", want, got)
+		}
+	})
+
+	t.Run("not a collection", func(t *testing.T) {
+		if _, err := ReadActivityStreams(strings.NewReader(`{"type": "Note"}`)); err == nil {
+			t.Errorf("Expected error for a single note")
+		}
+	})
+
+	t.Run("export", func(t *testing.T) {
+		target := t.TempDir()
+		id := common.UUID4For(testLink)
+		exporter := NewExporter(newTestStorages(t), target)
+		exporter.Format = "activitystreams"
+		if err := exporter.Export(id); err != nil {
+			t.Fatalf("Cannot export: %s", err)
+		}
+		got, err := ReadActivityStreams(strings.NewReader(readFile(t, filepath.Join(target, id+".jsonld"))))
+		if err != nil {
+			t.Fatalf("Cannot read export: %s", err)
+		}
+		if !proto.Equal(got, testSnapshot) {
+			t.Errorf("Expected %v, but got %v", testSnapshot, got)
+		}
+	})
+}
@@ -0,0 +1,578 @@
+package viewer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"chronicler/catalog"
+	"chronicler/common"
+	opb "chronicler/proto"
+	"chronicler/storage"
+
+	"golang.org/x/term"
+)
+
+const (
+	catalogScreen = iota
+	threadScreen
+
+	selectedStyle = "\x1b[7m"
+	headerStyle   = "\x1b[1m"
+	resetStyle    = "\x1b[0m"
+
+	catalogHelp = "↑↓ move  Enter open  / search  n/N next/previous  q quit"
+	threadHelp  = "↑↓ move  ←→ fold  Space toggle  J/K scroll  / search  n/N next  1-9 open file  q back"
+)
+
+// threadState is the reply tree of the opened snapshot, only replies of
+// expanded objects are in rows.
+type threadState struct {
+	title        string
+	storage      storage.Storage
+	saved        map[string]bool
+	roots        []*Node
+	all          []*Node
+	parents      map[*Node]*Node
+	collapsed    map[*Node]bool
+	rows         []*Node
+	cursor       int
+	offset       int
+	detailOffset int
+}
+
+func newThreadState(title string, s storage.Storage, snapshot *opb.Snapshot) (*threadState, error) {
+	list, err := s.List(&storage.ListRequest{})
+	if err != nil {
+		return nil, err
+	}
+	ts := &threadState{
+		title:     title,
+		storage:   s,
+		saved:     map[string]bool{},
+		roots:     BuildThread(snapshot.Objects),
+		parents:   map[*Node]*Node{},
+		collapsed: map[*Node]bool{},
+	}
+	for _, item := range list.Items {
+		ts.saved[item.Url] = true
+	}
+	Walk(ts.roots, func(node *Node) {
+		ts.all = append(ts.all, node)
+		for _, child := range node.Children {
+			ts.parents[child] = node
+		}
+	})
+	ts.refresh()
+	return ts, nil
+}
+
+func (ts *threadState) selected() *Node {
+	if ts.cursor < 0 || ts.cursor >= len(ts.rows) {
+		return nil
+	}
+	return ts.rows[ts.cursor]
+}
+
+// refresh rebuilds visible rows keeping the selected object or its closest
+// visible parent selected.
+func (ts *threadState) refresh() {
+	selected := ts.selected()
+	ts.rows = []*Node{}
+	var visit func(nodes []*Node)
+	visit = func(nodes []*Node) {
+		for _, node := range nodes {
+			ts.rows = append(ts.rows, node)
+			if !ts.collapsed[node] {
+				visit(node.Children)
+			}
+		}
+	}
+	visit(ts.roots)
+	for node := selected; node != nil; node = ts.parents[node] {
+		for i, row := range ts.rows {
+			if row == node {
+				ts.cursor = i
+				return
+			}
+		}
+	}
+	ts.cursor = 0
+}
+
+func (ts *threadState) selectNode(node *Node) {
+	for parent := ts.parents[node]; parent != nil; parent = ts.parents[parent] {
+		ts.collapsed[parent] = false
+	}
+	ts.refresh()
+	for i, row := range ts.rows {
+		if row == node {
+			ts.cursor = i
+		}
+	}
+	ts.detailOffset = 0
+}
+
+func (ts *threadState) move(delta int) {
+	ts.cursor = max(0, min(len(ts.rows)-1, ts.cursor+delta))
+	ts.detailOffset = 0
+}
+
+func (ts *threadState) toggle() {
+	if node := ts.selected(); node != nil && len(node.Children) > 0 {
+		ts.collapsed[node] = !ts.collapsed[node]
+		ts.refresh()
+	}
+}
+
+// left folds the replies or goes to the parent if they are folded already.
+func (ts *threadState) left() {
+	node := ts.selected()
+	if node == nil {
+		return
+	}
+	if len(node.Children) > 0 && !ts.collapsed[node] {
+		ts.toggle()
+	} else if parent, ok := ts.parents[node]; ok {
+		ts.selectNode(parent)
+	}
+}
+
+// right unfolds the replies or goes to the first reply.
+func (ts *threadState) right() {
+	node := ts.selected()
+	if node == nil || len(node.Children) == 0 {
+		return
+	}
+	if ts.collapsed[node] {
+		ts.toggle()
+	} else {
+		ts.selectNode(node.Children[0])
+	}
+}
+
+func objectText(obj *opb.Object) string {
+	text := []string{}
+	for _, c := range obj.Content {
+		text = append(text, plainText(c))
+	}
+	return strings.Join(text, "\n")
+}
+
+// find selects the next object with the text, replies of folded objects are
+// searched too.
+func (ts *threadState) find(query string, forward bool) bool {
+	query = strings.ToLower(query)
+	start := 0
+	if node := ts.selected(); node != nil {
+		for i, n := range ts.all {
+			if n == node {
+				start = i
+			}
+		}
+	}
+	total := len(ts.all)
+	for i := 1; i <= total; i++ {
+		index := (start + i) % total
+		if !forward {
+			index = (start - i + total) % total
+		}
+		obj := ts.all[index].Object
+		if strings.Contains(strings.ToLower(authorName(obj)+" "+objectText(obj)), query) {
+			ts.selectNode(ts.all[index])
+			return true
+		}
+	}
+	return false
+}
+
+func (ts *threadState) treeLine(node *Node) string {
+	marker := "•"
+	if len(node.Children) > 0 {
+		marker = "▾"
+		if ts.collapsed[node] {
+			marker = fmt.Sprintf("▸ (%d)", len(node.Children))
+		}
+	}
+	text, _, _ := strings.Cut(objectText(node.Object), "\n")
+	return fmt.Sprintf("%s%s %s %s: %s", strings.Repeat("  ", node.Depth), marker,
+		authorName(node.Object), formatTime(node.Object.CreatedAt), text)
+}
+
+func (ts *threadState) detailLines(columns int) []string {
+	node := ts.selected()
+	if node == nil {
+		return []string{}
+	}
+	obj := node.Object
+	header := []string{authorName(obj)}
+	if t := formatTime(obj.CreatedAt); t != "" {
+		header = append(header, t)
+	}
+	header = append(header, formatStats(obj.Stats)...)
+	lines := []string{strings.Join(header, " · ")}
+	if len(obj.Tag) > 0 {
+		tags := []string{}
+		for _, tag := range obj.Tag {
+			tags = append(tags, "#"+tag.Name)
+		}
+		lines = append(lines, "Tags: "+strings.Join(tags, " "))
+	}
+	lines = append(lines, "")
+	for _, c := range obj.Content {
+		if text := plainText(c); text != "" {
+			lines = append(lines, strings.Split(common.WrapText(text, columns), "\n")...)
+			lines = append(lines, "")
+		}
+	}
+	for i, a := range obj.Attachment {
+		state := "not saved"
+		if ts.saved[a.Url] {
+			state = "saved"
+		}
+		lines = append(lines, fmt.Sprintf("[%d] %s (%s, %s)", i+1, a.Url, a.Mime, state))
+	}
+	return lines
+}
+
+// Browser is an interactive terminal view of the catalog and the threads.
+type Browser struct {
+	Storages storage.Provider
+	Entries  []*catalog.Entry
+
+	open      func(name string) error
+	screen    int
+	cursor    int
+	offset    int
+	height    int
+	thread    *threadState
+	searching bool
+	input     string
+	query     string
+	message   string
+	done      bool
+	tempDir   string
+}
+
+func NewBrowser(storages storage.Provider, entries []*catalog.Entry) *Browser {
+	return &Browser{
+		Storages: storages,
+		Entries:  entries,
+		open:     openFile,
+		height:   24,
+	}
+}
+
+func (b *Browser) pageSize() int {
+	return max(1, b.height/2-2)
+}
+
+func (b *Browser) openSnapshot() {
+	if b.cursor >= len(b.Entries) {
+		return
+	}
+	entry := b.Entries[b.cursor]
+	s, err := b.Storages.Open(entry.Id)
+	if err != nil {
+		b.message = err.Error()
+		return
+	}
+	snapshot, err := (&storage.BlockStorage{Storage: s}).GetSnapshot(&storage.GetRequest{Url: objectFileName})
+	if err != nil {
+		b.message = fmt.Sprintf("Cannot read %s: %s", entry.Link, err)
+		return
+	}
+	if b.thread, err = newThreadState(entry.Link, s, snapshot); err != nil {
+		b.message = err.Error()
+		return
+	}
+	b.screen = threadScreen
+}
+
+// openAttachment copies the saved file to a temporary directory and opens it
+// with the system handler, so it works for any storage.
+func (b *Browser) openAttachment(index int) {
+	node := b.thread.selected()
+	if node == nil || index >= len(node.Object.Attachment) {
+		return
+	}
+	a := node.Object.Attachment[index]
+	if !b.thread.saved[a.Url] {
+		b.message = fmt.Sprintf("%s is not saved", a.Url)
+		return
+	}
+	if b.tempDir == "" {
+		dir, err := os.MkdirTemp("", "chronicler-browse-")
+		if err != nil {
+			b.message = err.Error()
+			return
+		}
+		b.tempDir = dir
+	}
+	es := &exportedSnapshot{storage: b.thread.storage}
+	name := filepath.Join(b.tempDir, fileName(a.Url))
+	if err := es.copyFile(a.Url, name); err != nil {
+		b.message = fmt.Sprintf("Cannot copy %s: %s", a.Url, err)
+		return
+	}
+	if err := b.open(name); err != nil {
+		b.message = fmt.Sprintf("Cannot open %s: %s", name, err)
+		return
+	}
+	b.message = "Opened " + a.Url
+}
+
+func (b *Browser) find(forward bool) {
+	if b.query == "" {
+		return
+	}
+	found := false
+	if b.screen == threadScreen {
+		found = b.thread.find(b.query, forward)
+	} else {
+		total := len(b.Entries)
+		for i := 1; i <= total && !found; i++ {
+			index := (b.cursor + i) % total
+			if !forward {
+				index = (b.cursor - i + total) % total
+			}
+			if strings.Contains(strings.ToLower(b.Entries[index].Link), strings.ToLower(b.query)) {
+				b.cursor = index
+				found = true
+			}
+		}
+	}
+	if !found {
+		b.message = fmt.Sprintf("%q not found", b.query)
+	}
+}
+
+func (b *Browser) handleSearch(key Key) {
+	switch key.Code {
+	case KeyEnter:
+		b.searching = false
+		b.query = b.input
+		b.find(true)
+	case KeyEscape, KeyInterrupt:
+		b.searching = false
+	case KeyBackspace:
+		if runes := []rune(b.input); len(runes) > 0 {
+			b.input = string(runes[:len(runes)-1])
+		}
+	case KeyRune:
+		b.input += string(key.Rune)
+	}
+}
+
+func (b *Browser) handleCatalog(key Key) {
+	switch {
+	case key.Code == KeyUp || key.Rune == 'k':
+		b.cursor--
+	case key.Code == KeyDown || key.Rune == 'j':
+		b.cursor++
+	case key.Code == KeyPageUp:
+		b.cursor -= b.pageSize()
+	case key.Code == KeyPageDown:
+		b.cursor += b.pageSize()
+	case key.Code == KeyHome || key.Rune == 'g':
+		b.cursor = 0
+	case key.Code == KeyEnd || key.Rune == 'G':
+		b.cursor = len(b.Entries) - 1
+	case key.Code == KeyEnter || key.Code == KeyRight || key.Rune == 'l':
+		b.openSnapshot()
+	case key.Code == KeyEscape || key.Rune == 'q':
+		b.done = true
+	}
+	b.cursor = max(0, min(len(b.Entries)-1, b.cursor))
+}
+
+func (b *Browser) handleThread(key Key) {
+	ts := b.thread
+	switch {
+	case key.Code == KeyUp || key.Rune == 'k':
+		ts.move(-1)
+	case key.Code == KeyDown || key.Rune == 'j':
+		ts.move(1)
+	case key.Code == KeyPageUp:
+		ts.move(-b.pageSize())
+	case key.Code == KeyPageDown:
+		ts.move(b.pageSize())
+	case key.Code == KeyHome || key.Rune == 'g':
+		ts.move(-len(ts.rows))
+	case key.Code == KeyEnd || key.Rune == 'G':
+		ts.move(len(ts.rows))
+	case key.Code == KeyLeft || key.Rune == 'h':
+		ts.left()
+	case key.Code == KeyRight || key.Rune == 'l':
+		ts.right()
+	case key.Code == KeyEnter || key.Rune == ' ':
+		ts.toggle()
+	case key.Rune == 'J':
+		ts.detailOffset++
+	case key.Rune == 'K':
+		ts.detailOffset = max(0, ts.detailOffset-1)
+	case key.Rune >= '1' && key.Rune <= '9':
+		b.openAttachment(int(key.Rune - '1'))
+	case key.Code == KeyEscape || key.Code == KeyBackspace || key.Rune == 'q':
+		b.screen = catalogScreen
+		b.thread = nil
+	}
+}
+
+func (b *Browser) handle(key Key) {
+	b.message = ""
+	if b.searching {
+		b.handleSearch(key)
+		return
+	}
+	switch {
+	case key.Code == KeyInterrupt:
+		b.done = true
+	case key.Rune == '/':
+		b.searching = true
+		b.input = ""
+	case key.Rune == 'n':
+		b.find(true)
+	case key.Rune == 'N':
+		b.find(false)
+	case b.screen == threadScreen:
+		b.handleThread(key)
+	default:
+		b.handleCatalog(key)
+	}
+}
+
+// scroll returns the offset which keeps the cursor visible.
+func scroll(offset int, cursor int, height int) int {
+	if cursor < offset {
+		return cursor
+	}
+	if cursor >= offset+height {
+		return cursor - height + 1
+	}
+	return offset
+}
+
+func (b *Browser) statusLine() string {
+	if b.searching {
+		return "/" + b.input
+	}
+	if b.message != "" {
+		return b.message
+	}
+	if b.screen == threadScreen {
+		return threadHelp
+	}
+	return catalogHelp
+}
+
+func (b *Browser) renderCatalog(columns int, height int) []string {
+	lines := []string{headerStyle + fitLine(fmt.Sprintf("Chronicler: %d snapshots", len(b.Entries)), columns) + resetStyle}
+	listHeight := height - 2
+	b.offset = scroll(b.offset, b.cursor, listHeight)
+	for i := b.offset; i < b.offset+listHeight; i++ {
+		if i >= len(b.Entries) {
+			lines = append(lines, fitLine("", columns))
+			continue
+		}
+		e := b.Entries[i]
+		fetchTime := "?"
+		if e.FetchTime != 0 {
+			fetchTime = time.Unix(e.FetchTime, 0).Format("2006-01-02 15:04")
+		}
+		line := fitLine(fmt.Sprintf("%-16s %-8s %6d objects  %s", fetchTime, e.Adapter, e.Objects, e.Link), columns)
+		if i == b.cursor {
+			line = selectedStyle + line + resetStyle
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func (b *Browser) renderThread(columns int, height int) []string {
+	ts := b.thread
+	title := fmt.Sprintf("%s [%d/%d]", ts.title, ts.cursor+1, len(ts.rows))
+	lines := []string{headerStyle + fitLine(title, columns) + resetStyle}
+	treeHeight := max(1, (height-3)/2)
+	ts.offset = scroll(ts.offset, ts.cursor, treeHeight)
+	for i := ts.offset; i < ts.offset+treeHeight; i++ {
+		if i >= len(ts.rows) {
+			lines = append(lines, fitLine("", columns))
+			continue
+		}
+		line := fitLine(ts.treeLine(ts.rows[i]), columns)
+		if i == ts.cursor {
+			line = selectedStyle + line + resetStyle
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, strings.Repeat("─", columns))
+	detail := ts.detailLines(columns)
+	detailHeight := height - 3 - treeHeight
+	ts.detailOffset = max(0, min(ts.detailOffset, len(detail)-detailHeight))
+	for i := ts.detailOffset; i < ts.detailOffset+detailHeight; i++ {
+		line := ""
+		if i < len(detail) {
+			line = detail[i]
+		}
+		lines = append(lines, fitLine(line, columns))
+	}
+	return lines
+}
+
+// render returns exactly height lines of the given width.
+func (b *Browser) render(columns int, height int) []string {
+	b.height = height
+	var lines []string
+	if b.screen == threadScreen {
+		lines = b.renderThread(columns, height)
+	} else {
+		lines = b.renderCatalog(columns, height)
+	}
+	return append(lines, fitLine(b.statusLine(), columns))
+}
+
+// Run shows the browser in the terminal until it is closed, logs are
+// discarded meanwhile.
+func (b *Browser) Run() error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return fmt.Errorf("browser needs a terminal")
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+	previous := common.SetLogOutput(io.Discard)
+	defer common.SetLogOutput(previous)
+
+	out := bufio.NewWriter(os.Stdout)
+	out.WriteString("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		out.WriteString("\x1b[?25h\x1b[?1049l")
+		out.Flush()
+	}()
+	in := bufio.NewReader(os.Stdin)
+	for !b.done {
+		columns, height, err := term.GetSize(fd)
+		if err != nil || columns <= 0 || height <= 3 {
+			columns, height = 80, 24
+		}
+		out.WriteString("\x1b[H")
+		out.WriteString(strings.Join(b.render(columns, height), "\r\n"))
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		key, err := readKey(in)
+		if err != nil {
+			return err
+		}
+		b.handle(key)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package viewer
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"chronicler/catalog"
+	"chronicler/common"
+)
+
+func press(b *Browser, keys ...Key) {
+	for _, key := range keys {
+		b.handle(key)
+	}
+}
+
+func typeText(b *Browser, text string) {
+	for _, c := range text {
+		b.handle(Key{Code: KeyRune, Rune: c})
+	}
+}
+
+func screen(b *Browser) string {
+	return strings.Join(b.render(80, 14), "\n")
+}
+
+func TestBrowser(t *testing.T) {
+	opened := []string{}
+	b := NewBrowser(newTestStorages(t), []*catalog.Entry{
+		catalog.NewEntry(common.UUID4For(testLink), testSnapshot, "web", 0),
+		{Id: "missing", Link: "http://missing/snapshot"},
+	})
+	b.open = func(name string) error {
+		data, err := os.ReadFile(name)
+		opened = append(opened, string(data))
+		return err
+	}
+	defer func() {
+		if b.tempDir != "" {
+			os.RemoveAll(b.tempDir)
+		}
+	}()
+
+	for _, tc := range []struct {
+		name    string
+		action  func()
+		want    []string
+		notWant []string
+	}{
+		{
+			name:   "catalog",
+			action: func() {},
+			want:   []string{"Chronicler: 2 snapshots", "2 objects  http://some/url", catalogHelp},
+		},
+		{
+			name:   "broken snapshot",
+			action: func() { press(b, Key{Code: KeyDown}, Key{Code: KeyEnter}) },
+			want:   []string{"Cannot read http://missing/snapshot"},
+		},
+		{
+			name:   "search catalog",
+			action: func() { press(b, Key{Code: KeyRune, Rune: '/'}); typeText(b, "SOME"); press(b, Key{Code: KeyEnter}) },
+			want:   []string{selectedStyle + "2023-11-14"},
+		},
+		{
+			name:   "thread",
+			action: func() { press(b, Key{Code: KeyEnter}) },
+			want: []string{
+				"http://some/url [1/2]",
+				selectedStyle + "▾ Original Poster",
+				"  • ? 2020-09-13",
+				"Original Poster · 2020-09-13",
+				"upvote 10",
+				"Look here",
+				"[1] http://some/image.jpg (image/jpeg, saved)",
+				"[2] http://some/missing.mp4 (video/mp4, not saved)",
+			},
+		},
+		{
+			name:    "fold",
+			action:  func() { press(b, Key{Code: KeyLeft}) },
+			want:    []string{"▸ (1) Original Poster", "[1/1]"},
+			notWant: []string{"• ?"},
+		},
+		{
+			name:   "search folded",
+			action: func() { press(b, Key{Code: KeyRune, Rune: '/'}); typeText(b, "thanks"); press(b, Key{Code: KeyEnter}) },
+			want:   []string{"[2/2]", selectedStyle + "  • ?", "Reply & <thanks>"},
+		},
+		{
+			name:   "not found",
+			action: func() { press(b, Key{Code: KeyRune, Rune: '/'}); typeText(b, "nothing"); press(b, Key{Code: KeyEnter}) },
+			want:   []string{`"nothing" not found`},
+		},
+		{
+			name:   "parent",
+			action: func() { press(b, Key{Code: KeyRune, Rune: 'h'}) },
+			want:   []string{"[1/2]"},
+		},
+		{
+			name:   "open saved",
+			action: func() { press(b, Key{Code: KeyRune, Rune: '1'}) },
+			want:   []string{"Opened http://some/image.jpg"},
+		},
+		{
+			name:   "open missing",
+			action: func() { press(b, Key{Code: KeyRune, Rune: '2'}) },
+			want:   []string{"http://some/missing.mp4 is not saved"},
+		},
+		{
+			name:   "back",
+			action: func() { press(b, Key{Code: KeyRune, Rune: 'q'}) },
+			want:   []string{"Chronicler: 2 snapshots"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.action()
+			result := screen(b)
+			if lines := strings.Count(result, "\n") + 1; lines != 14 {
+				t.Errorf("Expected 14 lines, but got %d", lines)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(result, want) {
+					t.Errorf("Expected screen to contain %q, but got\n%s", want, result)
+				}
+			}
+			for _, notWant := range tc.notWant {
+				if strings.Contains(result, notWant) {
+					t.Errorf("Expected screen not to contain %q, but got\n%s", notWant, result)
+				}
+			}
+		})
+	}
+
+	if len(opened) != 1 || opened[0] != "image" {
+		t.Errorf("Expected the saved image to be opened, but got %q", opened)
+	}
+	press(b, Key{Code: KeyRune, Rune: 'q'})
+	if !b.done {
+		t.Errorf("Expected q to close the browser")
+	}
+}
@@ -0,0 +1,372 @@
+package viewer
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"chronicler/storage"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+<rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>
+`
+	epubStyle = `
+body { font-family: serif; }
+.header { font-size: 0.85em; color: #555; margin: 1em 0 0.3em 0; }
+.author { font-weight: bold; }
+.children { margin-left: 0.8em; padding-left: 0.6em; border-left: 1px solid #aaa; }
+img { max-width: 100%; }
+`
+)
+
+var (
+	// Core media types, readers are not required to show anything else
+	epubImages = map[string]bool{
+		"image/gif": true, "image/jpeg": true, "image/png": true, "image/svg+xml": true, "image/webp": true,
+	}
+	xmlName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.-]*$`)
+)
+
+func xmlEscape(text string) string {
+	result := strings.Builder{}
+	xml.EscapeText(&result, []byte(text))
+	return result.String()
+}
+
+// writeXhtml writes the parsed html as well-formed xml, dropping foreign
+// elements and attributes which are not valid xml names.
+func writeXhtml(w *strings.Builder, n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.WriteString(xmlEscape(n.Data))
+		return
+	case html.ElementNode:
+	default:
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			writeXhtml(w, c)
+		}
+		return
+	}
+	if n.Namespace != "" {
+		return
+	}
+	w.WriteString("<" + n.Data)
+	seen := map[string]bool{}
+	for _, attr := range n.Attr {
+		if attr.Namespace != "" || !xmlName.MatchString(attr.Key) || seen[attr.Key] {
+			continue
+		}
+		seen[attr.Key] = true
+		w.WriteString(" " + attr.Key + `="` + xmlEscape(attr.Val) + `"`)
+	}
+	if n.FirstChild == nil {
+		w.WriteString("/>")
+		return
+	}
+	w.WriteString(">")
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		writeXhtml(w, c)
+	}
+	w.WriteString("</" + n.Data + ">")
+}
+
+func toXhtml(text string) string {
+	body := &html.Node{Type: html.ElementNode, DataAtom: atom.Body, Data: "body"}
+	nodes, err := html.ParseFragment(strings.NewReader(text), body)
+	if err != nil {
+		return xmlEscape(text)
+	}
+	result := strings.Builder{}
+	for _, n := range nodes {
+		writeXhtml(&result, n)
+	}
+	return result.String()
+}
+
+// remoteResources is true when the document embeds files by http urls,
+// readers need the remote-resources property to show them.
+func remoteResources(text string) bool {
+	tokenizer := html.NewTokenizer(strings.NewReader(text))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			for _, attr := range tokenizer.Token().Attr {
+				if !imageUrlAttributes[attr.Key] {
+					continue
+				}
+				if u, err := url.Parse(attr.Val); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+					return true
+				}
+			}
+		}
+	}
+}
+
+func epubPage(title string, body string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><meta charset="utf-8"/><title>` + xmlEscape(title) + `</title><link rel="stylesheet" type="text/css" href="style.css"/></head>
+<body>
+` + body + `
+</body>
+</html>
+`
+}
+
+type epubItem struct {
+	Id         string `xml:"id,attr"`
+	Href       string `xml:"href,attr"`
+	MediaType  string `xml:"media-type,attr"`
+	Properties string `xml:"properties,attr,omitempty"`
+}
+
+type epubItemRef struct {
+	IdRef string `xml:"idref,attr"`
+}
+
+type epubMeta struct {
+	Property string `xml:"property,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type epubIdentifier struct {
+	Id    string `xml:"id,attr"`
+	Value string `xml:",chardata"`
+}
+
+type epubMetadata struct {
+	Identifier epubIdentifier `xml:"dc:identifier"`
+	Title      string         `xml:"dc:title"`
+	Language   string         `xml:"dc:language"`
+	Source     string         `xml:"dc:source,omitempty"`
+	Date       string         `xml:"dc:date,omitempty"`
+	Meta       *epubMeta      `xml:"meta"`
+}
+
+// epubPackage is the OEBPS/content.opf document.
+type epubPackage struct {
+	XMLName          xml.Name `xml:"http://www.idpf.org/2007/opf package"`
+	Version          string   `xml:"version,attr"`
+	UniqueIdentifier string   `xml:"unique-identifier,attr"`
+	Metadata         struct {
+		DC string `xml:"xmlns:dc,attr"`
+		epubMetadata
+	} `xml:"metadata"`
+	Items []*epubItem    `xml:"manifest>item"`
+	Spine []*epubItemRef `xml:"spine>itemref"`
+}
+
+type epubChapter struct {
+	name  string
+	title string
+}
+
+type epubFormat struct{}
+
+func newEpubFormat() format {
+	return &epubFormat{}
+}
+
+func (ef *epubFormat) object(node *Node, localUrl func(url string) string) string {
+	obj := node.Object
+	result := strings.Builder{}
+	result.WriteString(`<div class="object" id="` + xmlEscape("o"+obj.Id) + `">`)
+	result.WriteString(`<p class="header"><span class="author">` + xmlEscape(authorName(obj)) + `</span> ` + formatTime(obj.CreatedAt))
+	for _, stat := range formatStats(obj.Stats) {
+		result.WriteString(" · " + stat)
+	}
+	result.WriteString("</p>\n")
+	for _, c := range obj.Content {
+		result.WriteString(`<div class="content">` + toXhtml(string(formatContent(c, localUrl))) + "</div>\n")
+	}
+	for _, a := range obj.Attachment {
+		src := localUrl(a.Url)
+		if src != a.Url {
+			result.WriteString(`<p><img src="` + xmlEscape(src) + `" alt="` + xmlEscape(a.Url) + `"/></p>` + "\n")
+		} else {
+			result.WriteString(`<p><a href="` + xmlEscape(a.Url) + `">` + xmlEscape(a.Url) + "</a></p>\n")
+		}
+	}
+	if len(node.Children) > 0 {
+		result.WriteString(`<div class="children">` + "\n")
+		for _, child := range node.Children {
+			result.WriteString(ef.object(child, localUrl))
+		}
+		result.WriteString("</div>\n")
+	}
+	result.WriteString("</div>\n")
+	return result.String()
+}
+
+func (ef *epubFormat) nav(title string, chapters []*epubChapter) string {
+	result := strings.Builder{}
+	result.WriteString(`<nav epub:type="toc" id="toc"><h1>` + xmlEscape(title) + "</h1>\n<ol>\n")
+	for _, c := range chapters {
+		result.WriteString(`<li><a href="` + c.name + `">` + xmlEscape(c.title) + "</a></li>\n")
+	}
+	result.WriteString("</ol></nav>")
+	return epubPage(title, result.String())
+}
+
+func (ef *epubFormat) addImages(zw *zip.Writer, s *exportedSnapshot, pkg *epubPackage) (map[string]string, error) {
+	attachments, err := s.savedAttachments()
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]string{}
+	for i, a := range attachments {
+		if !epubImages[a.Mime] {
+			continue
+		}
+		name := path.Join("images", fileName(a.Url))
+		reader, err := s.storage.Get(&storage.GetRequest{Url: a.Url})
+		if err != nil {
+			return nil, err
+		}
+		writer, err := zw.Create("OEBPS/" + name)
+		if err == nil {
+			_, err = io.Copy(writer, reader)
+		}
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		files[a.Url] = name
+		pkg.Items = append(pkg.Items, &epubItem{Id: fmt.Sprintf("image%d", i), Href: name, MediaType: a.Mime})
+	}
+	return files, nil
+}
+
+func addZipFile(zw *zip.Writer, name string, text string) error {
+	writer, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(writer, text)
+	return err
+}
+
+// write makes a chapter from every top-level object with its replies.
+func (ef *epubFormat) write(w io.Writer, s *exportedSnapshot) error {
+	zw := zip.NewWriter(w)
+	// The mimetype must be the first file and must not be compressed
+	mimetype, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(mimetype, "application/epub+zip"); err != nil {
+		return err
+	}
+	if err := addZipFile(zw, "META-INF/container.xml", epubContainer); err != nil {
+		return err
+	}
+
+	title := s.Id
+	pkg := &epubPackage{Version: "3.0", UniqueIdentifier: "id"}
+	pkg.Metadata.DC = "http://purl.org/dc/elements/1.1/"
+	modified := time.Now()
+	if s.Snapshot.FetchTime != nil {
+		modified = time.Unix(s.Snapshot.FetchTime.Seconds, 0)
+		pkg.Metadata.Date = modified.UTC().Format(time.RFC3339)
+	}
+	if s.Snapshot.Link != nil && s.Snapshot.Link.Href != "" {
+		title = s.Snapshot.Link.Href
+		pkg.Metadata.Source = s.Snapshot.Link.Href
+	}
+	pkg.Metadata.Identifier = epubIdentifier{Id: pkg.UniqueIdentifier, Value: "urn:uuid:" + s.Id}
+	pkg.Metadata.Title = title
+	pkg.Metadata.Language = "und"
+	pkg.Metadata.Meta = &epubMeta{Property: "dcterms:modified", Value: modified.UTC().Format("2006-01-02T15:04:05Z")}
+	pkg.Items = []*epubItem{
+		{Id: "nav", Href: "nav.xhtml", MediaType: "application/xhtml+xml", Properties: "nav"},
+		{Id: "style", Href: "style.css", MediaType: "text/css"},
+	}
+
+	files, err := ef.addImages(zw, s, pkg)
+	if err != nil {
+		return err
+	}
+	localUrl := localUrls(files)
+	chapters := []*epubChapter{}
+	for i, node := range s.Thread {
+		chapter := &epubChapter{
+			name:  fmt.Sprintf("chapter%04d.xhtml", i+1),
+			title: strings.TrimSpace(authorName(node.Object) + " " + formatTime(node.Object.CreatedAt)),
+		}
+		body := ef.object(node, localUrl)
+		if err := addZipFile(zw, "OEBPS/"+chapter.name, epubPage(chapter.title, body)); err != nil {
+			return err
+		}
+		chapters = append(chapters, chapter)
+		id := fmt.Sprintf("chapter%d", i+1)
+		item := &epubItem{Id: id, Href: chapter.name, MediaType: "application/xhtml+xml"}
+		if remoteResources(body) {
+			item.Properties = "remote-resources"
+		}
+		pkg.Items = append(pkg.Items, item)
+		pkg.Spine = append(pkg.Spine, &epubItemRef{IdRef: id})
+	}
+	// The spine cannot be empty, a book without objects gets a title page
+	if len(chapters) == 0 {
+		chapter := &epubChapter{name: "title.xhtml", title: title}
+		body := "<h1>" + xmlEscape(title) + "</h1>\n<p>No objects</p>"
+		if err := addZipFile(zw, "OEBPS/"+chapter.name, epubPage(chapter.title, body)); err != nil {
+			return err
+		}
+		chapters = append(chapters, chapter)
+		pkg.Items = append(pkg.Items, &epubItem{Id: "title", Href: chapter.name, MediaType: "application/xhtml+xml"})
+		pkg.Spine = append(pkg.Spine, &epubItemRef{IdRef: "title"})
+	}
+	if err := addZipFile(zw, "OEBPS/nav.xhtml", ef.nav(title, chapters)); err != nil {
+		return err
+	}
+	if err := addZipFile(zw, "OEBPS/style.css", epubStyle); err != nil {
+		return err
+	}
+	opf, err := xml.MarshalIndent(pkg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := addZipFile(zw, "OEBPS/content.opf", xml.Header+string(opf)); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func (ef *epubFormat) writeSnapshot(target string, s *exportedSnapshot) error {
+	if err := os.MkdirAll(target, 0777); err != nil {
+		return err
+	}
+	file, err := os.Create(filepath.Join(target, s.Id+".epub"))
+	if err != nil {
+		return err
+	}
+	if err := ef.write(file, s); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeIndex does nothing, every snapshot is a separate book.
+func (ef *epubFormat) writeIndex(target string, exported []*exportedSnapshot) error {
+	return nil
+}
@@ -0,0 +1,256 @@
+package viewer
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"path"
+	"strings"
+	"testing"
+
+	"chronicler/common"
+	opb "chronicler/proto"
+	"chronicler/storage"
+)
+
+type testPackage struct {
+	UniqueIdentifier string `xml:"unique-identifier,attr"`
+	Identifiers      []struct {
+		Id    string `xml:"id,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"metadata>identifier"`
+	Title    string `xml:"metadata>title"`
+	Language string `xml:"metadata>language"`
+	Source   string `xml:"metadata>source"`
+	Meta     []struct {
+		Property string `xml:"property,attr"`
+		Value    string `xml:",chardata"`
+	} `xml:"metadata>meta"`
+	Items []struct {
+		Id         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+	Spine []struct {
+		IdRef string `xml:"idref,attr"`
+	} `xml:"spine>itemref"`
+}
+
+func readZipFile(t *testing.T, files map[string]*zip.File, name string) []byte {
+	file, ok := files[name]
+	if !ok {
+		t.Fatalf("Expected %q in the book", name)
+	}
+	reader, err := file.Open()
+	if err != nil {
+		t.Fatalf("Cannot open %q: %s", name, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Cannot read %q: %s", name, err)
+	}
+	return data
+}
+
+// checkXml parses the document and returns values of src attributes.
+func checkXml(t *testing.T, name string, data []byte) []string {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	sources := []string{}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return sources
+		}
+		if err != nil {
+			t.Fatalf("%q is not well-formed: %s", name, err)
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			for _, attr := range start.Attr {
+				if attr.Name.Local == "src" {
+					sources = append(sources, attr.Value)
+				}
+			}
+		}
+	}
+}
+
+func TestEpub(t *testing.T) {
+	id := common.UUID4For(testLink)
+	s, _ := newTestStorages(t).Open(id)
+	book := &bytes.Buffer{}
+	err := (&epubFormat{}).write(book, &exportedSnapshot{
+		Id:       id,
+		Snapshot: testSnapshot,
+		Thread:   BuildThread(testSnapshot.Objects),
+		storage:  s,
+	})
+	if err != nil {
+		t.Fatalf("Cannot write book: %s", err)
+	}
+	reader, err := zip.NewReader(bytes.NewReader(book.Bytes()), int64(book.Len()))
+	if err != nil {
+		t.Fatalf("Book is not a zip file: %s", err)
+	}
+
+	t.Run("mimetype", func(t *testing.T) {
+		first := reader.File[0]
+		if first.Name != "mimetype" || first.Method != zip.Store {
+			t.Fatalf("Expected uncompressed mimetype first, but got %q", first.Name)
+		}
+		files := map[string]*zip.File{"mimetype": first}
+		if data := readZipFile(t, files, "mimetype"); string(data) != "application/epub+zip" {
+			t.Errorf("Unexpected mimetype %q", data)
+		}
+	})
+
+	files := map[string]*zip.File{}
+	for _, file := range reader.File {
+		files[file.Name] = file
+	}
+	container := struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}{}
+	if err := xml.Unmarshal(readZipFile(t, files, "META-INF/container.xml"), &container); err != nil {
+		t.Fatalf("Cannot read container: %s", err)
+	}
+	if len(container.Rootfiles) != 1 {
+		t.Fatalf("Expected one rootfile, but got %d", len(container.Rootfiles))
+	}
+	opfPath := container.Rootfiles[0].FullPath
+	pkg := &testPackage{}
+	if err := xml.Unmarshal(readZipFile(t, files, opfPath), pkg); err != nil {
+		t.Fatalf("Cannot read package: %s", err)
+	}
+
+	t.Run("metadata", func(t *testing.T) {
+		if len(pkg.Identifiers) != 1 || pkg.Identifiers[0].Id != pkg.UniqueIdentifier || pkg.Identifiers[0].Value != "urn:uuid:"+id {
+			t.Errorf("Unexpected identifiers %v for %q", pkg.Identifiers, pkg.UniqueIdentifier)
+		}
+		if pkg.Title != testLink.Href || pkg.Source != testLink.Href || pkg.Language == "" {
+			t.Errorf("Unexpected title %q, source %q or language %q", pkg.Title, pkg.Source, pkg.Language)
+		}
+		if len(pkg.Meta) != 1 || pkg.Meta[0].Property != "dcterms:modified" || pkg.Meta[0].Value != "2023-11-14T22:13:20Z" {
+			t.Errorf("Unexpected meta %v", pkg.Meta)
+		}
+	})
+
+	t.Run("manifest", func(t *testing.T) {
+		dir := path.Dir(opfPath)
+		items := map[string]string{}
+		listed := map[string]bool{opfPath: true, "mimetype": true, "META-INF/container.xml": true}
+		navs := 0
+		for _, item := range pkg.Items {
+			name := path.Join(dir, item.Href)
+			items[item.Id] = item.MediaType
+			listed[name] = true
+			if item.Properties == "nav" {
+				navs++
+			}
+			if _, ok := files[name]; !ok {
+				t.Errorf("Manifest item %q is missing", name)
+				continue
+			}
+			if item.MediaType != "application/xhtml+xml" {
+				continue
+			}
+			for _, src := range checkXml(t, name, readZipFile(t, files, name)) {
+				if _, ok := files[path.Join(dir, src)]; !ok {
+					t.Errorf("Image %q in %q is missing", src, name)
+				}
+			}
+		}
+		if navs != 1 {
+			t.Errorf("Expected one navigation document, but got %d", navs)
+		}
+		for name := range files {
+			if !listed[name] {
+				t.Errorf("File %q is not in the manifest", name)
+			}
+		}
+		if len(pkg.Spine) != 1 {
+			t.Errorf("Expected one chapter for one top-level object, but got %d", len(pkg.Spine))
+		}
+		for _, ref := range pkg.Spine {
+			if items[ref.IdRef] != "application/xhtml+xml" {
+				t.Errorf("Spine item %q is not a document in the manifest", ref.IdRef)
+			}
+		}
+	})
+
+	t.Run("chapter", func(t *testing.T) {
+		chapter := string(readZipFile(t, files, path.Join(path.Dir(opfPath), pkg.Items[len(pkg.Items)-1].Href)))
+		for _, want := range []string{
+			"Original Poster",
+			`<img src="images/` + fileName("http://some/image.jpg") + `"`,
+			`<div class="children">`,
+			"Reply &amp; &lt;thanks&gt;",
+		} {
+			if !strings.Contains(chapter, want) {
+				t.Errorf("Expected chapter to contain %q, but got %s", want, chapter)
+			}
+		}
+		if strings.Contains(chapter, "alert") {
+			t.Errorf("Expected scripts to be removed")
+		}
+	})
+}
+
+func writeTestBook(t *testing.T, snapshot *opb.Snapshot) (*testPackage, map[string]*zip.File) {
+	book := &bytes.Buffer{}
+	err := (&epubFormat{}).write(book, &exportedSnapshot{
+		Id:       common.UUID4For(testLink),
+		Snapshot: snapshot,
+		Thread:   BuildThread(snapshot.Objects),
+		storage:  storage.NewMemoryStorage(nil),
+	})
+	if err != nil {
+		t.Fatalf("Cannot write book: %s", err)
+	}
+	reader, err := zip.NewReader(bytes.NewReader(book.Bytes()), int64(book.Len()))
+	if err != nil {
+		t.Fatalf("Book is not a zip file: %s", err)
+	}
+	files := map[string]*zip.File{}
+	for _, file := range reader.File {
+		files[file.Name] = file
+	}
+	pkg := &testPackage{}
+	if err := xml.Unmarshal(readZipFile(t, files, "OEBPS/content.opf"), pkg); err != nil {
+		t.Fatalf("Cannot read package: %s", err)
+	}
+	return pkg, files
+}
+
+func TestEpubWithoutObjects(t *testing.T) {
+	pkg, files := writeTestBook(t, &opb.Snapshot{Link: testLink})
+	if len(pkg.Spine) != 1 {
+		t.Fatalf("Expected a title page in the spine, but got %v", pkg.Spine)
+	}
+	for _, item := range pkg.Items {
+		if item.Id == pkg.Spine[0].IdRef {
+			page := string(readZipFile(t, files, path.Join("OEBPS", item.Href)))
+			if !strings.Contains(page, xmlEscape(testLink.Href)) {
+				t.Errorf("Expected the title page to show the link, but got %s", page)
+			}
+		}
+	}
+}
+
+func TestEpubRemoteResources(t *testing.T) {
+	pkg, _ := writeTestBook(t, &opb.Snapshot{Link: testLink, Objects: []*opb.Object{
+		{Id: "1", Content: []*opb.Content{{Mime: "text/html", Text: `<img src="http://remote/pic.png">`}}},
+		{Id: "2", Content: []*opb.Content{{Mime: "text/html", Text: `<a href="http://remote/page">page</a>`}}},
+	}})
+	properties := map[string]string{}
+	for _, item := range pkg.Items {
+		properties[item.Id] = item.Properties
+	}
+	if properties["chapter1"] != "remote-resources" || properties["chapter2"] != "" {
+		t.Errorf("Expected only the chapter with the remote image to have remote-resources, but got %v", properties)
+	}
+}
@@ -1,40 +1,216 @@
 package viewer
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
 	"chronicler/common"
-	"chronicler/iferr"
 	opb "chronicler/proto"
 	"chronicler/storage"
-	"path/filepath"
 )
 
+// format writes exported snapshots in one of the output formats
+type format interface {
+	writeSnapshot(target string, s *exportedSnapshot) error
+	// writeIndex is called once after all snapshots are written
+	writeIndex(target string, exported []*exportedSnapshot) error
+}
+
+var (
+	formats = map[string]func() format{
+		"activitystreams": newActivityStreamsFormat,
+		"csv":             newCsvFormat,
+		"epub":            newEpubFormat,
+		"html":            newHtmlFormat,
+		"html-single":     newSingleHtmlFormat,
+		"jsonl":           newJsonlFormat,
+		"markdown":        newMarkdownFormat,
+		"mbox":            newMboxFormat,
+	}
+)
+
+func Formats() []string {
+	result := []string{}
+	for name := range formats {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+type exportedSnapshot struct {
+	Id       string
+	Snapshot *opb.Snapshot
+	Thread   []*Node
+	storage  storage.Storage
+}
+
+// fileName is unique for the url and keeps the extension, so browsers and
+// players can guess the type.
+func fileName(fileUrl string) string {
+	sum := sha256.Sum256([]byte(fileUrl))
+	name := hex.EncodeToString(sum[:])[:16]
+	if u, err := url.Parse(fileUrl); err == nil {
+		if ext := path.Ext(u.Path); len(ext) <= 10 && common.SanitizeUrl(ext, 0) == ext {
+			name += ext
+		}
+	}
+	return name
+}
+
+// localUrls returns the local copy of the url if there is one.
+func localUrls(files map[string]string) func(url string) string {
+	return func(url string) string {
+		if local, ok := files[url]; ok {
+			return local
+		}
+		return url
+	}
+}
+
+// savedAttachments returns attachments of the snapshot saved in the storage,
+// each url once.
+func (es *exportedSnapshot) savedAttachments() ([]*opb.Attachment, error) {
+	saved := map[string]bool{}
+	list, err := es.storage.List(&storage.ListRequest{})
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range list.Items {
+		saved[item.Url] = true
+	}
+	result := []*opb.Attachment{}
+	for _, obj := range es.Snapshot.Objects {
+		for _, attachment := range obj.Attachment {
+			if saved[attachment.Url] {
+				result = append(result, attachment)
+				saved[attachment.Url] = false
+			}
+		}
+	}
+	return result, nil
+}
+
+// copyFiles copies attachments saved in the storage to {dir}/{subdir} and
+// returns their paths relative to dir by the original url.
+func (es *exportedSnapshot) copyFiles(dir string, subdir string) (map[string]string, error) {
+	attachments, err := es.savedAttachments()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]string{}
+	for _, attachment := range attachments {
+		local := path.Join(subdir, fileName(attachment.Url))
+		if err := es.copyFile(attachment.Url, filepath.Join(dir, filepath.FromSlash(local))); err != nil {
+			return nil, err
+		}
+		result[attachment.Url] = local
+	}
+	return result, nil
+}
+
+// readSmall returns the saved file if it is not larger than the limit.
+func (es *exportedSnapshot) readSmall(fileUrl string, limit int64) ([]byte, error) {
+	reader, err := es.storage.Get(&storage.GetRequest{Url: fileUrl})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil || int64(len(data)) > limit {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (es *exportedSnapshot) copyFile(fileUrl string, target string) error {
+	reader, err := es.storage.Get(&storage.GetRequest{Url: fileUrl})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		return err
+	}
+	file, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
 type Exporter struct {
-	Root   string
-	Target string
+	Storages storage.Provider
+	Target   string
+	// One of Formats(), "html" if empty
+	Format string
+	// Only the selected objects are exported
+	Query  ThreadQuery
 	logger *common.Logger
 }
 
-func NewExporter(root string, target string) *Exporter {
+func NewExporter(storages storage.Provider, target string) *Exporter {
 	return &Exporter{
-		Root:   root,
-		Target: target,
-		logger: common.NewLogger("export"),
+		Storages: storages,
+		Target:   target,
+		Format:   "html",
+		logger:   common.NewLogger("export"),
 	}
 }
 
-func (v *Exporter) Export(id string) error {
-	store := storage.BlockStorage{
-		Storage: iferr.Exit(storage.NewLocalStorage(filepath.Join(v.Root, id))),
+func (v *Exporter) Export(ids ...string) error {
+	name := v.Format
+	if name == "" {
+		name = "html"
 	}
-	v.logger.Infof("Loading objects from %q", objectFileName)
-	result := &opb.Snapshot{}
-	if err := store.GetObject(&storage.GetRequest{Url: objectFileName}, &result); err != nil {
-		return err
+	newFormat, ok := formats[name]
+	if !ok {
+		return fmt.Errorf("unknown export format %q, supported are %q", name, Formats())
 	}
-	total := len(result.Objects)
-	v.logger.Infof("Loaded objects: %d", total)
-	for i, obj := range result.Objects {
-		v.logger.Infof("[%06d of %06d] exporting %q to %q", i, total, obj.Id, v.Target)
+	f := newFormat()
+
+	exported := []*exportedSnapshot{}
+	for _, id := range ids {
+		s, err := v.Storages.Open(id)
+		if err != nil {
+			return err
+		}
+		store := storage.BlockStorage{Storage: s}
+		v.logger.Infof("Loading objects from %q", objectFileName)
+		snapshot, err := store.GetSnapshot(&storage.GetRequest{Url: objectFileName})
+		if err != nil {
+			return fmt.Errorf("cannot read snapshot %s: %w", id, err)
+		}
+		thread, err := v.Query.Select(BuildThread(snapshot.Objects))
+		if err != nil {
+			return fmt.Errorf("cannot select objects of %s: %w", id, err)
+		}
+		es := &exportedSnapshot{
+			Id: id,
+			Snapshot: &opb.Snapshot{
+				FetchTime: snapshot.FetchTime,
+				Link:      snapshot.Link,
+				Objects:   selectedObjects(snapshot, thread),
+			},
+			Thread:  thread,
+			storage: s,
+		}
+		v.logger.Infof("Exporting %d objects of %s to %q", len(es.Snapshot.Objects), id, v.Target)
+		if err := f.writeSnapshot(v.Target, es); err != nil {
+			return err
+		}
+		exported = append(exported, es)
 	}
-	return nil
+	return f.writeIndex(v.Target, exported)
 }
@@ -1,8 +1,137 @@
 package viewer
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"chronicler/common"
+	opb "chronicler/proto"
+	"chronicler/storage"
+)
+
+var (
+	testLink     = &opb.Link{Href: "http://some/url"}
+	testSnapshot = &opb.Snapshot{
+		Link:      testLink,
+		FetchTime: &opb.Timestamp{Seconds: 1700000000},
+		Objects: []*opb.Object{
+			{
+				Id:        "1",
+				CreatedAt: &opb.Timestamp{Seconds: 1600000000},
+				Generator: []*opb.Generator{{Id: "op", Name: "Original Poster"}},
+				Content: []*opb.Content{{
+					Text: `<p>Look <a href="http://some/image.jpg">here</a></p><script>alert(1)</script>`,
+					Mime: "text/html",
+				}},
+				Attachment: []*opb.Attachment{
+					{Url: "http://some/image.jpg", Mime: "image/jpeg"},
+					{Url: "http://some/missing.mp4", Mime: "video/mp4"},
+				},
+				Stats: []*opb.Stats{{Type: opb.Stats_UPVOTE, Counter: 10}},
+			},
+			{
+				Id:        "2",
+				Parent:    "1",
+				CreatedAt: &opb.Timestamp{Seconds: 1600000100},
+				Content:   []*opb.Content{{Text: "Reply & <thanks>"}},
+			},
+		},
+	}
 )
 
+func newTestStorages(t *testing.T) storage.Provider {
+	storages := storage.NewMemoryProvider(nil)
+	s, _ := storages.Open(common.UUID4For(testLink))
+	bs := &storage.BlockStorage{Storage: s}
+	if _, err := bs.PutSnapshot(&storage.PutRequest{Url: objectFileName}, testSnapshot, storage.FormatProtoJson); err != nil {
+		t.Fatalf("Cannot write snapshot: %s", err)
+	}
+	bs.PutBytes(&storage.PutRequest{Url: "http://some/image.jpg"}, []byte("image"))
+	return storages
+}
+
+func readFile(t *testing.T, name string) string {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Cannot read exported file: %s", err)
+	}
+	return string(data)
+}
+
 func TestExporter(t *testing.T) {
+	t.Run("html", func(t *testing.T) {
+		target := t.TempDir()
+		id := common.UUID4For(testLink)
+		if err := NewExporter(newTestStorages(t), target).Export(id); err != nil {
+			t.Fatalf("Cannot export: %s", err)
+		}
+
+		local := "files/" + fileName("http://some/image.jpg")
+		if got := readFile(t, filepath.Join(target, id, local)); got != "image" {
+			t.Errorf("Expected attachment to be copied, but got %q", got)
+		}
+		page := readFile(t, filepath.Join(target, id, "index.html"))
+		for _, want := range []string{
+			"Original Poster",
+			"2020-09-13",
+			"upvote 10",
+			`<a href="` + local + `">here</a>`,
+			`<img src="` + local + `"`,
+			`<video src="http://some/missing.mp4"`,
+			`Reply &amp; &lt;thanks&gt;`,
+			`<div class="children">`,
+		} {
+			if !strings.Contains(page, want) {
+				t.Errorf("Expected page to contain %q", want)
+			}
+		}
+		if strings.Contains(page, "alert") {
+			t.Errorf("Expected scripts to be removed")
+		}
+		if index := readFile(t, filepath.Join(target, "index.html")); !strings.Contains(index, id+"/index.html") {
+			t.Errorf("Expected index to link the snapshot, but got %s", index)
+		}
+	})
+
+	t.Run("markdown", func(t *testing.T) {
+		target := t.TempDir()
+		id := common.UUID4For(testLink)
+		exporter := NewExporter(newTestStorages(t), target)
+		exporter.Format = "markdown"
+		if err := exporter.Export(id); err != nil {
+			t.Fatalf("Cannot export: %s", err)
+		}
+
+		local := "files/" + fileName("http://some/image.jpg")
+		if got := readFile(t, filepath.Join(target, id, local)); got != "image" {
+			t.Errorf("Expected attachment to be copied, but got %q", got)
+		}
+		page := readFile(t, filepath.Join(target, id, "index.md"))
+		for _, want := range []string{
+			"**Original Poster** · 2020-09-13",
+			"upvote 10",
+			"Look [here](" + local + ")",
+			"![http://some/image.jpg](" + local + ")",
+			"[http://some/missing.mp4](http://some/missing.mp4)",
+			"> **?** · ",
+			`> Reply & \<thanks\>`,
+		} {
+			if !strings.Contains(page, want) {
+				t.Errorf("Expected page to contain %q", want)
+			}
+		}
+		if index := readFile(t, filepath.Join(target, "index.md")); !strings.Contains(index, id+"/index.md") {
+			t.Errorf("Expected index to link the snapshot, but got %s", index)
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		exporter := NewExporter(newTestStorages(t), t.TempDir())
+		exporter.Format = "doc"
+		if err := exporter.Export(common.UUID4For(testLink)); err == nil {
+			t.Errorf("Expected error for the unknown format")
+		}
+	})
 }
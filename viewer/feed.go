@@ -0,0 +1,226 @@
+package viewer
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"chronicler/catalog"
+	opb "chronicler/proto"
+	"chronicler/storage"
+)
+
+const (
+	atomNamespace     = "http://www.w3.org/2005/Atom"
+	feedSummaryLength = 200
+)
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Id      string    `xml:"id"`
+	Title   string    `xml:"title"`
+	Updated string    `xml:"updated"`
+	Link    *atomLink `xml:"link"`
+	Summary *atomText `xml:"summary"`
+	updated int64
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name     `xml:"feed"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Id      string       `xml:"id"`
+	Title   string       `xml:"title"`
+	Updated string       `xml:"updated"`
+	Author  *atomAuthor  `xml:"author"`
+	Entries []*atomEntry `xml:"entry"`
+}
+
+type FeedOptions struct {
+	Title string
+	// Entries in the feed, newest first, all if zero
+	Limit int
+	// Objects rendered in the summary
+	Objects int
+	// An entry for every version of the snapshot instead of the latest one
+	Versions bool
+}
+
+// Feed makes an Atom feed of the saved snapshots listed in the catalog.
+type Feed struct {
+	Storages storage.Provider
+	Options  *FeedOptions
+}
+
+func NewFeed(storages storage.Provider, options *FeedOptions) *Feed {
+	return &Feed{Storages: storages, Options: options}
+}
+
+func atomTime(seconds int64) string {
+	return time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+}
+
+func shorten(text string, length int) string {
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	if len(runes) > length {
+		return strings.TrimSpace(string(runes[:length])) + "…"
+	}
+	return string(runes)
+}
+
+// summary lists the first objects which were not in the previous version.
+func (f *Feed) summary(snapshot *opb.Snapshot, previous *opb.Snapshot) string {
+	known := map[string]bool{}
+	if previous != nil {
+		for _, obj := range previous.Objects {
+			known[obj.Id] = true
+		}
+	}
+	result := strings.Builder{}
+	result.WriteString(fmt.Sprintf("<p>Fetched %s, %d objects", formatTime(snapshot.FetchTime), len(snapshot.Objects)))
+	if previous != nil {
+		result.WriteString(fmt.Sprintf(", %d new", len(snapshot.Objects)-countKnown(snapshot, known)))
+	}
+	result.WriteString("</p>\n<ul>\n")
+	shown := 0
+	for _, obj := range snapshot.Objects {
+		if shown >= f.Options.Objects {
+			break
+		}
+		if known[obj.Id] {
+			continue
+		}
+		text := []string{}
+		for _, c := range obj.Content {
+			text = append(text, plainText(c))
+		}
+		header := "<b>" + template.HTMLEscapeString(authorName(obj)) + "</b>"
+		if t := formatTime(obj.CreatedAt); t != "" {
+			header += " " + t
+		}
+		result.WriteString(fmt.Sprintf("<li>%s: %s</li>\n", header,
+			template.HTMLEscapeString(shorten(strings.Join(text, " "), feedSummaryLength))))
+		shown++
+	}
+	result.WriteString("</ul>")
+	return result.String()
+}
+
+func countKnown(snapshot *opb.Snapshot, known map[string]bool) int {
+	count := 0
+	for _, obj := range snapshot.Objects {
+		if known[obj.Id] {
+			count++
+		}
+	}
+	return count
+}
+
+func (f *Feed) entry(e *catalog.Entry, id string, snapshot *opb.Snapshot, previous *opb.Snapshot) *atomEntry {
+	fetchTime := e.FetchTime
+	if snapshot.FetchTime != nil {
+		fetchTime = snapshot.FetchTime.Seconds
+	}
+	title := e.Link
+	if previous != nil {
+		title = "Update: " + title
+	}
+	return &atomEntry{
+		Id:      id,
+		Title:   title,
+		Updated: atomTime(fetchTime),
+		Link:    &atomLink{Href: e.Link, Rel: "alternate"},
+		Summary: &atomText{Type: "html", Text: f.summary(snapshot, previous)},
+		updated: fetchTime,
+	}
+}
+
+func (f *Feed) entries(e *catalog.Entry) ([]*atomEntry, error) {
+	s, err := f.Storages.Open(e.Id)
+	if err != nil {
+		return nil, err
+	}
+	bs := &storage.BlockStorage{Storage: s}
+	versions := []string{""}
+	if f.Options.Versions {
+		list, err := s.List(&storage.ListRequest{Url: []string{objectFileName}, WithSnapshots: true})
+		if err != nil {
+			return nil, err
+		}
+		if len(list.Items) > 0 {
+			versions = append([]string{}, list.Items[0].Versions...)
+			sort.Strings(versions)
+			versions = append(versions, "")
+		}
+	}
+	result := []*atomEntry{}
+	var previous *opb.Snapshot
+	for i, version := range versions {
+		snapshot, err := bs.GetSnapshot(&storage.GetRequest{Url: objectFileName, Version: version})
+		if err != nil {
+			return nil, err
+		}
+		id := fmt.Sprintf("urn:uuid:%s", e.Id)
+		if f.Options.Versions {
+			id = fmt.Sprintf("%s:%d", id, i)
+		}
+		result = append(result, f.entry(e, id, snapshot, previous))
+		previous = snapshot
+	}
+	return result, nil
+}
+
+// Write writes the feed with entries for the catalog entries.
+func (f *Feed) Write(w io.Writer, catalogEntries []*catalog.Entry) error {
+	feed := &atomFeed{
+		Xmlns:  atomNamespace,
+		Id:     "urn:chronicler:feed",
+		Title:  f.Options.Title,
+		Author: &atomAuthor{Name: "chronicler"},
+	}
+	for _, e := range catalogEntries {
+		entries, err := f.entries(e)
+		if err != nil {
+			return fmt.Errorf("cannot read snapshot %s: %w", e.Id, err)
+		}
+		feed.Entries = append(feed.Entries, entries...)
+	}
+	sort.SliceStable(feed.Entries, func(i, j int) bool {
+		return feed.Entries[i].updated > feed.Entries[j].updated
+	})
+	if f.Options.Limit > 0 && len(feed.Entries) > f.Options.Limit {
+		feed.Entries = feed.Entries[:f.Options.Limit]
+	}
+	updated := int64(0)
+	if len(feed.Entries) > 0 {
+		updated = feed.Entries[0].updated
+	}
+	feed.Updated = atomTime(updated)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(feed); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
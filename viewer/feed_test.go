@@ -0,0 +1,112 @@
+package viewer
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"chronicler/catalog"
+	"chronicler/common"
+	opb "chronicler/proto"
+	"chronicler/storage"
+)
+
+func TestFeed(t *testing.T) {
+	storages := newTestStorages(t)
+	watched := &opb.Link{Href: "http://watched/thread"}
+	s, _ := storages.Open(common.UUID4For(watched))
+	bs := &storage.BlockStorage{Storage: s}
+	first := &opb.Snapshot{
+		Link:      watched,
+		FetchTime: &opb.Timestamp{Seconds: 1700000100},
+		Objects:   []*opb.Object{{Id: "a", Content: []*opb.Content{{Text: "Old <news>"}}}},
+	}
+	second := &opb.Snapshot{
+		Link:      watched,
+		FetchTime: &opb.Timestamp{Seconds: 1700000200},
+		Objects: []*opb.Object{
+			first.Objects[0],
+			{Id: "b", Content: []*opb.Content{{Text: strings.Repeat("long ", 100)}}},
+		},
+	}
+	for _, snapshot := range []*opb.Snapshot{first, second} {
+		bs.PutSnapshot(&storage.PutRequest{Url: objectFileName, SaveOnOverwrite: true}, snapshot, storage.FormatProtoJson)
+	}
+	entries := []*catalog.Entry{
+		catalog.NewEntry(common.UUID4For(testLink), testSnapshot, "web", 0),
+		catalog.NewEntry(common.UUID4For(watched), second, "web", 0),
+	}
+
+	for _, tc := range []struct {
+		name    string
+		options *FeedOptions
+		titles  []string
+		updated []string
+	}{
+		{
+			name:    "snapshots",
+			options: &FeedOptions{Title: "Archive", Objects: 5},
+			titles:  []string{"http://watched/thread", "http://some/url"},
+			updated: []string{"2023-11-14T22:16:40Z", "2023-11-14T22:13:20Z"},
+		},
+		{
+			name:    "versions",
+			options: &FeedOptions{Title: "Archive", Objects: 5, Versions: true},
+			titles:  []string{"Update: http://watched/thread", "http://watched/thread", "http://some/url"},
+			updated: []string{"2023-11-14T22:16:40Z", "2023-11-14T22:15:00Z", "2023-11-14T22:13:20Z"},
+		},
+		{
+			name:    "limit",
+			options: &FeedOptions{Title: "Archive", Objects: 5, Versions: true, Limit: 1},
+			titles:  []string{"Update: http://watched/thread"},
+			updated: []string{"2023-11-14T22:16:40Z"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result := &bytes.Buffer{}
+			if err := NewFeed(storages, tc.options).Write(result, entries); err != nil {
+				t.Fatalf("Cannot write feed: %s", err)
+			}
+			feed := &atomFeed{}
+			if err := xml.Unmarshal(result.Bytes(), feed); err != nil {
+				t.Fatalf("Cannot parse feed: %s", err)
+			}
+			if feed.XMLName.Space != atomNamespace || feed.Title != "Archive" || feed.Updated != tc.updated[0] {
+				t.Errorf("Unexpected feed %v %q updated %q", feed.XMLName, feed.Title, feed.Updated)
+			}
+			titles := []string{}
+			updated := []string{}
+			for _, e := range feed.Entries {
+				titles = append(titles, e.Title)
+				updated = append(updated, e.Updated)
+			}
+			if strings.Join(titles, " ") != strings.Join(tc.titles, " ") || strings.Join(updated, " ") != strings.Join(tc.updated, " ") {
+				t.Errorf("Expected entries %q at %q, but got %q at %q", tc.titles, tc.updated, titles, updated)
+			}
+		})
+	}
+
+	t.Run("summary", func(t *testing.T) {
+		result := &bytes.Buffer{}
+		NewFeed(storages, &FeedOptions{Objects: 1, Versions: true}).Write(result, entries)
+		feed := &atomFeed{}
+		xml.Unmarshal(result.Bytes(), feed)
+		update := feed.Entries[0]
+		if update.Link.Href != "http://watched/thread" || update.Summary.Type != "html" {
+			t.Errorf("Unexpected link %v or summary type %q", update.Link, update.Summary.Type)
+		}
+		if !strings.Contains(update.Summary.Text, "2 objects, 1 new") || strings.Contains(update.Summary.Text, "Old") {
+			t.Errorf("Expected only new objects in the summary, but got %q", update.Summary.Text)
+		}
+		if !strings.HasSuffix(update.Summary.Text, "long…</li>\n</ul>") {
+			t.Errorf("Expected long text to be shortened, but got %q", update.Summary.Text)
+		}
+		if !strings.Contains(feed.Entries[1].Summary.Text, "Old &lt;news&gt;") {
+			t.Errorf("Expected escaped text, but got %q", feed.Entries[1].Summary.Text)
+		}
+		if !strings.Contains(feed.Entries[2].Summary.Text, "<b>Original Poster</b>") {
+			t.Errorf("Expected author in the summary, but got %q", feed.Entries[2].Summary.Text)
+		}
+	})
+}
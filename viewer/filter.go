@@ -0,0 +1,155 @@
+package viewer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	opb "chronicler/proto"
+)
+
+// ThreadQuery selects objects of the reply tree, replies of the hidden
+// objects move up to the closest shown parent.
+type ThreadQuery struct {
+	// Only the object with the id and its replies
+	Root string
+	// Replies nested deeper are hidden, 1 shows only the roots and 0 all
+	MaxDepth int
+	// Only objects of the author with the id or name
+	Author string
+	Since  time.Time
+	Until  time.Time
+	// Objects with lower score are hidden, see score
+	MinScore *int64
+	// Siblings are sorted by "time", "score" or "replies", the empty keeps
+	// the snapshot order for roots and sorts replies by time.
+	SortBy string
+}
+
+// score is the rating of the object if it has one, upvotes minus downvotes
+// otherwise.
+func score(obj *opb.Object) int64 {
+	result := int64(0)
+	for _, stat := range obj.Stats {
+		switch stat.Type {
+		case opb.Stats_RATING:
+			return stat.Counter
+		case opb.Stats_UPVOTE:
+			result += stat.Counter
+		case opb.Stats_DOWNVOTE:
+			result -= stat.Counter
+		}
+	}
+	return result
+}
+
+func countReplies(node *Node) int {
+	result := len(node.Children)
+	for _, child := range node.Children {
+		result += countReplies(child)
+	}
+	return result
+}
+
+func (q *ThreadQuery) matches(obj *opb.Object) bool {
+	if q.Author != "" {
+		found := false
+		for _, g := range obj.Generator {
+			found = found || g.Id == q.Author || strings.EqualFold(g.Name, q.Author)
+		}
+		if !found {
+			return false
+		}
+	}
+	created := time.Unix(createdAt(obj), 0)
+	if !q.Since.IsZero() && created.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !created.Before(q.Until) {
+		return false
+	}
+	return q.MinScore == nil || score(obj) >= *q.MinScore
+}
+
+func (q *ThreadQuery) less(a *Node, b *Node) bool {
+	switch q.SortBy {
+	case "score":
+		return score(a.Object) > score(b.Object)
+	case "replies":
+		return countReplies(a) > countReplies(b)
+	}
+	return createdAt(a.Object) < createdAt(b.Object)
+}
+
+// filter returns the shown nodes, with the replies of the hidden ones in
+// their place.
+func (q *ThreadQuery) filter(nodes []*Node, depth int) []*Node {
+	result := []*Node{}
+	for _, node := range nodes {
+		children := []*Node{}
+		if q.MaxDepth == 0 || depth+1 < q.MaxDepth {
+			children = q.filter(node.Children, depth+1)
+		}
+		if !q.matches(node.Object) {
+			result = append(result, children...)
+			continue
+		}
+		result = append(result, &Node{Object: node.Object, Children: children})
+	}
+	return result
+}
+
+func (q *ThreadQuery) arrange(nodes []*Node, depth int) {
+	if q.SortBy != "" {
+		sort.SliceStable(nodes, func(i, j int) bool {
+			return q.less(nodes[i], nodes[j])
+		})
+	}
+	for _, node := range nodes {
+		node.Depth = depth
+		q.arrange(node.Children, depth+1)
+	}
+}
+
+func findNode(nodes []*Node, id string) *Node {
+	for _, node := range nodes {
+		if node.Object.Id == id {
+			return node
+		}
+		if found := findNode(node.Children, id); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// Select returns a new tree with the objects matching the query, the nodes of
+// the original tree are not changed.
+func (q *ThreadQuery) Select(roots []*Node) ([]*Node, error) {
+	if q.Root != "" {
+		root := findNode(roots, q.Root)
+		if root == nil {
+			return nil, fmt.Errorf("object %q not found", q.Root)
+		}
+		roots = []*Node{root}
+	}
+	result := q.filter(roots, 0)
+	q.arrange(result, 0)
+	return result, nil
+}
+
+// selectedObjects returns the objects of the tree in the snapshot order.
+func selectedObjects(snapshot *opb.Snapshot, roots []*Node) []*opb.Object {
+	shown := map[*opb.Object]bool{}
+	Walk(roots, func(node *Node) {
+		shown[node.Object] = true
+	})
+	result := []*opb.Object{}
+	for _, obj := range snapshot.Objects {
+		if shown[obj] {
+			result = append(result, obj)
+		}
+	}
+	return result
+}
@@ -0,0 +1,147 @@
+package viewer
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"chronicler/common"
+	opb "chronicler/proto"
+)
+
+func TestThreadQuery(t *testing.T) {
+	stats := func(upvotes int64, downvotes int64) []*opb.Stats {
+		return []*opb.Stats{
+			{Type: opb.Stats_UPVOTE, Counter: upvotes},
+			{Type: opb.Stats_DOWNVOTE, Counter: downvotes},
+		}
+	}
+	objects := []*opb.Object{
+		{Id: "post", CreatedAt: &opb.Timestamp{Seconds: 100}, Generator: []*opb.Generator{{Id: "u1", Name: "Alice"}}},
+		{Id: "a", Parent: "post", CreatedAt: &opb.Timestamp{Seconds: 200}, Stats: stats(1, 5), Generator: []*opb.Generator{{Id: "u2", Name: "Bob"}}},
+		{Id: "a1", Parent: "a", CreatedAt: &opb.Timestamp{Seconds: 300}, Stats: stats(10, 0), Generator: []*opb.Generator{{Id: "u1", Name: "Alice"}}},
+		{Id: "a2", Parent: "a", CreatedAt: &opb.Timestamp{Seconds: 400}, Generator: []*opb.Generator{{Id: "u2", Name: "Bob"}}},
+		{Id: "b", Parent: "post", CreatedAt: &opb.Timestamp{Seconds: 250}, Stats: []*opb.Stats{{Type: opb.Stats_RATING, Counter: 7}}},
+		{Id: "b1", Parent: "b", CreatedAt: &opb.Timestamp{Seconds: 500}},
+		{Id: "other", CreatedAt: &opb.Timestamp{Seconds: 50}, Stats: stats(3, 0)},
+	}
+	minScore := int64(0)
+	for _, tc := range []struct {
+		name    string
+		query   ThreadQuery
+		want    []walked
+		wantErr bool
+	}{
+		{
+			name:  "everything",
+			query: ThreadQuery{},
+			want: []walked{
+				{"post", 0}, {"a", 1}, {"a1", 2}, {"a2", 2}, {"b", 1}, {"b1", 2}, {"other", 0},
+			},
+		},
+		{
+			name:  "subtree",
+			query: ThreadQuery{Root: "a"},
+			want:  []walked{{"a", 0}, {"a1", 1}, {"a2", 1}},
+		},
+		{
+			name:    "unknown root",
+			query:   ThreadQuery{Root: "missing"},
+			wantErr: true,
+		},
+		{
+			name:  "depth",
+			query: ThreadQuery{MaxDepth: 2},
+			want:  []walked{{"post", 0}, {"a", 1}, {"b", 1}, {"other", 0}},
+		},
+		{
+			name:  "subtree depth",
+			query: ThreadQuery{Root: "b", MaxDepth: 1},
+			want:  []walked{{"b", 0}},
+		},
+		{
+			name:  "author replies move up",
+			query: ThreadQuery{Author: "alice"},
+			want:  []walked{{"post", 0}, {"a1", 1}},
+		},
+		{
+			name:  "author id",
+			query: ThreadQuery{Author: "u2"},
+			want:  []walked{{"a", 0}, {"a2", 1}},
+		},
+		{
+			name:  "dates",
+			query: ThreadQuery{Since: time.Unix(200, 0), Until: time.Unix(400, 0)},
+			want:  []walked{{"a", 0}, {"a1", 1}, {"b", 0}},
+		},
+		{
+			name:  "score",
+			query: ThreadQuery{MinScore: &minScore},
+			want: []walked{
+				{"post", 0}, {"a1", 1}, {"a2", 1}, {"b", 1}, {"b1", 2}, {"other", 0},
+			},
+		},
+		{
+			name:  "sort by time",
+			query: ThreadQuery{SortBy: "time"},
+			want: []walked{
+				{"other", 0}, {"post", 0}, {"a", 1}, {"a1", 2}, {"a2", 2}, {"b", 1}, {"b1", 2},
+			},
+		},
+		{
+			name:  "sort by score",
+			query: ThreadQuery{SortBy: "score"},
+			want: []walked{
+				{"other", 0}, {"post", 0}, {"b", 1}, {"b1", 2}, {"a", 1}, {"a1", 2}, {"a2", 2},
+			},
+		},
+		{
+			name:  "sort by replies",
+			query: ThreadQuery{SortBy: "replies", Root: "post"},
+			want:  []walked{{"post", 0}, {"a", 1}, {"a1", 2}, {"a2", 2}, {"b", 1}, {"b1", 2}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			thread := BuildThread(objects)
+			selected, err := tc.query.Select(thread)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, but got %v", tc.wantErr, err)
+			}
+			if tc.wantErr {
+				return
+			}
+			got := []walked{}
+			Walk(selected, func(node *Node) {
+				got = append(got, walked{node.Object.Id, node.Depth})
+			})
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected %v, but got %v", tc.want, got)
+			}
+			if len(thread[0].Children) != 2 || thread[0].Depth != 0 {
+				t.Errorf("Expected original thread to be unchanged")
+			}
+		})
+	}
+}
+
+func TestExportQuery(t *testing.T) {
+	target := t.TempDir()
+	id := common.UUID4For(testLink)
+	exporter := NewExporter(newTestStorages(t), target)
+	exporter.Format = "jsonl"
+	exporter.Query = ThreadQuery{Root: "2"}
+	if err := exporter.Export(id); err != nil {
+		t.Fatalf("Cannot export: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(readFile(t, filepath.Join(target, "objects.jsonl"))), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"id":"2"`) {
+		t.Errorf("Expected only the selected object, but got %q", lines)
+	}
+
+	exporter.Query = ThreadQuery{Root: "missing"}
+	if err := exporter.Export(id); err == nil {
+		t.Errorf("Expected export of a missing object to fail")
+	}
+}
@@ -0,0 +1,227 @@
+package viewer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	opb "chronicler/proto"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	textBreaks = map[string]bool{
+		"br": true, "p": true, "div": true, "li": true, "blockquote": true, "pre": true, "tr": true,
+		"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	}
+)
+
+// plainText returns the text of the content without markup, block elements
+// are separated by new lines.
+func plainText(content *opb.Content) string {
+	if !strings.HasPrefix(content.Mime, "text/html") {
+		return strings.TrimSpace(content.Text)
+	}
+	result := strings.Builder{}
+	tokenizer := html.NewTokenizer(strings.NewReader(content.Text))
+	skipping := ""
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+		token := tokenizer.Token()
+		switch {
+		case skipping != "":
+			if tokenType == html.EndTagToken && token.Data == skipping {
+				skipping = ""
+			}
+		case tokenType == html.StartTagToken && droppedElements[token.Data]:
+			skipping = token.Data
+		case tokenType == html.TextToken:
+			result.WriteString(spaces.ReplaceAllString(token.Data, " "))
+		case textBreaks[token.Data]:
+			result.WriteString("\n")
+		}
+	}
+	lines := strings.Split(result.String(), "\n")
+	text := []string{}
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			text = append(text, line)
+		}
+	}
+	return strings.Join(text, "\n")
+}
+
+// flatRow is one object in the JSON Lines and CSV exports.
+type flatRow struct {
+	Snapshot    string           `json:"snapshot"`
+	Url         string           `json:"url"`
+	Id          string           `json:"id"`
+	Parent      string           `json:"parent"`
+	Depth       int              `json:"depth"`
+	Created     string           `json:"created"`
+	AuthorId    string           `json:"author_id"`
+	AuthorName  string           `json:"author_name"`
+	Text        string           `json:"text"`
+	Stats       map[string]int64 `json:"stats"`
+	Attachments int              `json:"attachments"`
+	Files       []string         `json:"files"`
+}
+
+func statsName(t opb.Stats_StatsType) string {
+	return strings.ToLower(t.String())
+}
+
+// statsColumns are names of all stats types in the enum order.
+func statsColumns() []string {
+	types := []int{}
+	for value := range opb.Stats_StatsType_name {
+		types = append(types, int(value))
+	}
+	sort.Ints(types)
+	result := []string{}
+	for _, value := range types {
+		result = append(result, statsName(opb.Stats_StatsType(value)))
+	}
+	return result
+}
+
+func flatRows(s *exportedSnapshot, files map[string]string) []*flatRow {
+	link := ""
+	if s.Snapshot.Link != nil {
+		link = s.Snapshot.Link.Href
+	}
+	rows := []*flatRow{}
+	Walk(s.Thread, func(node *Node) {
+		obj := node.Object
+		row := &flatRow{
+			Snapshot:    s.Id,
+			Url:         link,
+			Id:          obj.Id,
+			Parent:      obj.Parent,
+			Depth:       node.Depth,
+			Stats:       map[string]int64{},
+			Attachments: len(obj.Attachment),
+			Files:       []string{},
+		}
+		if obj.CreatedAt != nil {
+			row.Created = time.Unix(obj.CreatedAt.Seconds, int64(obj.CreatedAt.Nanos)).UTC().Format(time.RFC3339)
+		}
+		if len(obj.Generator) > 0 {
+			row.AuthorId = obj.Generator[0].Id
+			row.AuthorName = obj.Generator[0].Name
+		}
+		text := []string{}
+		for _, c := range obj.Content {
+			if t := plainText(c); t != "" {
+				text = append(text, t)
+			}
+		}
+		row.Text = strings.Join(text, "\n")
+		for _, stat := range obj.Stats {
+			row.Stats[statsName(stat.Type)] += stat.Counter
+		}
+		for _, a := range obj.Attachment {
+			if local, ok := files[a.Url]; ok {
+				row.Files = append(row.Files, local)
+			}
+		}
+		rows = append(rows, row)
+	})
+	return rows
+}
+
+// flatFormat collects rows of all snapshots into one file, attachments are
+// copied to {target}/{id}/files.
+type flatFormat struct {
+	rows  []*flatRow
+	write func(target string, rows []*flatRow) error
+}
+
+func newJsonlFormat() format {
+	return &flatFormat{write: writeJsonl}
+}
+
+func newCsvFormat() format {
+	return &flatFormat{write: writeCsv}
+}
+
+func (ff *flatFormat) writeSnapshot(target string, s *exportedSnapshot) error {
+	files, err := s.copyFiles(target, path.Join(s.Id, "files"))
+	if err != nil {
+		return err
+	}
+	ff.rows = append(ff.rows, flatRows(s, files)...)
+	return nil
+}
+
+func (ff *flatFormat) writeIndex(target string, exported []*exportedSnapshot) error {
+	if err := os.MkdirAll(target, 0777); err != nil {
+		return err
+	}
+	return ff.write(target, ff.rows)
+}
+
+func writeJsonl(target string, rows []*flatRow) error {
+	file, err := os.Create(filepath.Join(target, "objects.jsonl"))
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetEscapeHTML(false)
+	for _, row := range rows {
+		if err := encoder.Encode(row); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// csvText keeps spreadsheets from reading scraped text as formulas.
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func writeCsv(target string, rows []*flatRow) error {
+	file, err := os.Create(filepath.Join(target, "objects.csv"))
+	if err != nil {
+		return err
+	}
+	stats := statsColumns()
+	writer := csv.NewWriter(file)
+	header := []string{"snapshot", "url", "id", "parent", "depth", "created", "author_id", "author_name", "text"}
+	header = append(header, stats...)
+	writer.Write(append(header, "attachments", "files"))
+	for _, row := range rows {
+		record := []string{csvText(row.Snapshot), csvText(row.Url), csvText(row.Id), csvText(row.Parent), strconv.Itoa(row.Depth),
+			csvText(row.Created), csvText(row.AuthorId), csvText(row.AuthorName), csvText(row.Text)}
+		for _, name := range stats {
+			value := ""
+			if counter, ok := row.Stats[name]; ok {
+				value = strconv.FormatInt(counter, 10)
+			}
+			record = append(record, value)
+		}
+		record = append(record, strconv.Itoa(row.Attachments), csvText(strings.Join(row.Files, " ")))
+		writer.Write(record)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,139 @@
+package viewer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"chronicler/common"
+	opb "chronicler/proto"
+	"chronicler/storage"
+)
+
+func TestPlainText(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content *opb.Content
+		want    string
+	}{
+		{name: "plain", content: &opb.Content{Text: " a <b>c</b> \n", Mime: "text/plain"}, want: "a <b>c</b>"},
+		{name: "html", content: &opb.Content{Text: "<p>One\n two</p><p>Three<br>&gt; four</p>", Mime: "text/html"}, want: "One two\nThree\n> four"},
+		{name: "script", content: &opb.Content{Text: "Hi<script>alert(1)</script>", Mime: "text/html"}, want: "Hi"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := plainText(tc.content); got != tc.want {
+				t.Errorf("Expected %q, but got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCsvText(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  string
+	}{
+		{value: "plain", want: "plain"},
+		{value: "", want: ""},
+		{value: "=HYPERLINK(\"http://evil\")", want: "'=HYPERLINK(\"http://evil\")"},
+		{value: "+1", want: "'+1"},
+		{value: "-2+3", want: "'-2+3"},
+		{value: "@SUM(A1)", want: "'@SUM(A1)"},
+		{value: "\t=1", want: "'\t=1"},
+		{value: "a=1", want: "a=1"},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			if got := csvText(tc.value); got != tc.want {
+				t.Errorf("Expected %q, but got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func exportFlat(t *testing.T, format string) (string, string, string) {
+	storages := newTestStorages(t)
+	other := &opb.Link{Href: "http://other/url"}
+	s, _ := storages.Open(common.UUID4For(other))
+	bs := &storage.BlockStorage{Storage: s}
+	bs.PutSnapshot(&storage.PutRequest{Url: objectFileName}, &opb.Snapshot{
+		Link:    other,
+		Objects: []*opb.Object{{Id: "a", Content: []*opb.Content{{Text: "Other, \"quoted\"\nline"}}}},
+	}, storage.FormatProtoJson)
+
+	target := t.TempDir()
+	exporter := NewExporter(storages, target)
+	exporter.Format = format
+	if err := exporter.Export(common.UUID4For(testLink), common.UUID4For(other)); err != nil {
+		t.Fatalf("Cannot export: %s", err)
+	}
+	return target, common.UUID4For(testLink), common.UUID4For(other)
+}
+
+func TestFlatFormats(t *testing.T) {
+	t.Run("jsonl", func(t *testing.T) {
+		target, id, otherId := exportFlat(t, "jsonl")
+		lines := strings.Split(strings.TrimSpace(readFile(t, filepath.Join(target, "objects.jsonl"))), "\n")
+		rows := []*flatRow{}
+		for _, line := range lines {
+			row := &flatRow{}
+			if err := json.Unmarshal([]byte(line), row); err != nil {
+				t.Fatalf("Cannot parse %q: %s", line, err)
+			}
+			rows = append(rows, row)
+		}
+		local := filepath.ToSlash(filepath.Join(id, "files", fileName("http://some/image.jpg")))
+		want := []*flatRow{
+			{
+				Snapshot: id, Url: "http://some/url", Id: "1", Depth: 0, Created: "2020-09-13T12:26:40Z",
+				AuthorId: "op", AuthorName: "Original Poster", Text: "Look here",
+				Stats: map[string]int64{"upvote": 10}, Attachments: 2, Files: []string{local},
+			},
+			{
+				Snapshot: id, Url: "http://some/url", Id: "2", Parent: "1", Depth: 1, Created: "2020-09-13T12:28:20Z",
+				Text: "Reply & <thanks>", Stats: map[string]int64{}, Files: []string{},
+			},
+			{
+				Snapshot: otherId, Url: "http://other/url", Id: "a",
+				Text: "Other, \"quoted\"\nline", Stats: map[string]int64{}, Files: []string{},
+			},
+		}
+		if !reflect.DeepEqual(rows, want) {
+			got, _ := json.Marshal(rows)
+			t.Errorf("Unexpected rows %s", got)
+		}
+		if _, err := os.Stat(filepath.Join(target, local)); err != nil {
+			t.Errorf("Expected attachment to be copied: %s", err)
+		}
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		target, _, _ := exportFlat(t, "csv")
+		file, err := os.Open(filepath.Join(target, "objects.csv"))
+		if err != nil {
+			t.Fatalf("Cannot open export: %s", err)
+		}
+		defer file.Close()
+		records, err := csv.NewReader(file).ReadAll()
+		if err != nil {
+			t.Fatalf("Cannot parse csv: %s", err)
+		}
+		wantHeader := []string{"snapshot", "url", "id", "parent", "depth", "created", "author_id", "author_name", "text",
+			"unknown_reaction", "rating", "upvote", "downvote", "attachments", "files"}
+		if !reflect.DeepEqual(records[0], wantHeader) {
+			t.Errorf("Expected header %q, but got %q", wantHeader, records[0])
+		}
+		if len(records) != 4 {
+			t.Fatalf("Expected 3 rows, but got %d", len(records)-1)
+		}
+		if got := records[1][11]; got != "10" {
+			t.Errorf("Expected 10 upvotes, but got %q", got)
+		}
+		if got := records[3][8]; got != "Other, \"quoted\"\nline" {
+			t.Errorf("Unexpected text %q", got)
+		}
+	})
+}
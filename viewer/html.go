@@ -0,0 +1,466 @@
+package viewer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	opb "chronicler/proto"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	htmlIndex = "index.html"
+	// Images up to this size are embedded into single page exports
+	defaultEmbedLimit = 2 * 1024 * 1024
+	htmlStyle         = `
+body { font-family: sans-serif; max-width: 60em; margin: 0 auto; padding: 1em; color: #222; }
+header { border-bottom: 1px solid #ccc; margin-bottom: 1em; }
+details.object { margin: 0.5em 0; }
+details.object > summary { cursor: pointer; color: #555; font-size: 0.9em; }
+.author { font-weight: bold; color: #222; }
+.stats span { margin-left: 0.5em; }
+.children { margin-left: 1em; padding-left: 0.8em; border-left: 2px solid #ddd; }
+.content { margin: 0.3em 0; overflow-wrap: anywhere; }
+.attachments img, .attachments video { max-width: 100%; max-height: 40em; display: block; margin: 0.3em 0; }
+table { border-collapse: collapse; }
+td { padding: 0.2em 0.5em; border-bottom: 1px solid #eee; }
+`
+)
+
+var (
+	htmlTemplates = template.Must(template.New("html").Parse(`
+{{define "objects"}}{{range .}}
+<details open class="object" id="{{.Id}}">
+<summary><span class="author">{{.Author}}</span> <time>{{.Time}}</time><span class="stats">{{range .Stats}}<span>{{.}}</span>{{end}}</span></summary>
+{{range .Content}}<div class="content">{{.}}</div>{{end}}
+{{if .Attachments}}<div class="attachments">{{range .Attachments}}
+{{if eq .Kind "image"}}<a href="{{.Src}}"><img src="{{.Src}}" alt="{{.Url}}" loading="lazy"></a>
+{{else if eq .Kind "video"}}<video src="{{.Src}}" controls preload="metadata"></video>
+{{else if eq .Kind "audio"}}<audio src="{{.Src}}" controls preload="metadata"></audio>
+{{else}}<a href="{{.Src}}">{{.Url}}</a>
+{{end}}{{end}}</div>{{end}}
+{{if .Children}}<div class="children">{{template "objects" .Children}}</div>{{end}}
+</details>{{end}}{{end}}
+
+{{define "snapshot"}}<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Link}}</title><style>{{.Style}}</style></head>
+<body>
+<header>
+{{if .Index}}<p><a href="{{.Index}}">All snapshots</a></p>{{end}}
+<h1><a href="{{.Link}}">{{.Link}}</a></h1>
+<p>Fetched {{.FetchTime}}, {{.Count}} objects</p>
+{{if .Versions}}<p>Versions:{{range .Versions}} <a href="{{.Href}}">{{.Name}}</a>{{end}}</p>{{end}}
+</header>
+<main>{{template "objects" .Objects}}</main>
+</body>
+</html>{{end}}
+
+{{define "index"}}<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Snapshots</title><style>{{.Style}}</style></head>
+<body>
+<h1>Snapshots</h1>
+<table>{{range .Snapshots}}
+<tr><td>{{.FetchTime}}</td><td>{{.Count}} objects</td><td><a href="{{.Href}}">{{.Link}}</a></td></tr>{{end}}
+</table>
+</body>
+</html>{{end}}
+`))
+)
+
+type htmlAttachment struct {
+	Kind string
+	// string or template.URL for the embedded data
+	Src any
+	Url string
+}
+
+type htmlObject struct {
+	Id          string
+	Author      string
+	Time        string
+	Stats       []string
+	Content     []template.HTML
+	Attachments []*htmlAttachment
+	Children    []*htmlObject
+}
+
+type htmlSnapshot struct {
+	Id string
+	// Page of the snapshot and the index relative to the snapshot page
+	Href      string
+	Index     string
+	Link      string
+	FetchTime string
+	Count     int
+	Style     template.CSS
+	Versions  []*HtmlLink
+	Objects   []*htmlObject
+}
+
+type HtmlLink struct {
+	Name string
+	Href string
+}
+
+// HtmlPage is the page of the html export served by something else.
+type HtmlPage struct {
+	Id       string
+	Snapshot *opb.Snapshot
+	// Urls of the saved attachments by their original urls
+	Files map[string]string
+	// Link to the list of all snapshots
+	Index    string
+	Versions []*HtmlLink
+}
+
+func (hp *HtmlPage) Write(w io.Writer) error {
+	es := &exportedSnapshot{
+		Id:       hp.Id,
+		Snapshot: hp.Snapshot,
+		Thread:   BuildThread(hp.Snapshot.Objects),
+	}
+	files := hp.Files
+	if files == nil {
+		files = map[string]string{}
+	}
+	page := (&htmlFormat{}).snapshot(es, files)
+	page.Index = hp.Index
+	page.Versions = hp.Versions
+	return htmlTemplates.ExecuteTemplate(w, "snapshot", page)
+}
+
+func formatTime(t *opb.Timestamp) string {
+	if t == nil || (t.Seconds == 0 && t.Nanos == 0) {
+		return ""
+	}
+	return time.Unix(t.Seconds, int64(t.Nanos)).Format("2006-01-02 15:04")
+}
+
+func authorName(obj *opb.Object) string {
+	for _, g := range obj.Generator {
+		if g.Name != "" {
+			return g.Name
+		}
+		if g.Id != "" {
+			return g.Id
+		}
+	}
+	return "?"
+}
+
+func formatStats(stats []*opb.Stats) []string {
+	result := []string{}
+	for _, s := range stats {
+		result = append(result, fmt.Sprintf("%s %d", strings.ToLower(s.Type.String()), s.Counter))
+	}
+	return result
+}
+
+func attachmentKind(mime string) string {
+	kind, _, _ := strings.Cut(mime, "/")
+	switch kind {
+	case "image", "video", "audio":
+		return kind
+	}
+	return "link"
+}
+
+var (
+	// Elements removed with everything inside them
+	droppedElements = map[string]bool{
+		"script": true, "style": true, "iframe": true, "object": true, "embed": true,
+		"form": true, "link": true, "meta": true, "base": true, "noscript": true,
+		"head": true, "title": true, "svg": true, "math": true, "template": true,
+		"textarea": true, "select": true,
+	}
+	// Attributes kept on every allowed element
+	commonAttributes = map[string]bool{"title": true, "lang": true, "dir": true}
+	// Elements kept in the cleaned html with their allowed attributes, other
+	// elements are removed, but their content is kept
+	allowedElements = map[string]map[string]bool{
+		"a": {"href": true}, "abbr": {}, "article": {}, "audio": {"src": true, "controls": true},
+		"b": {}, "blockquote": {"cite": true}, "br": {}, "caption": {}, "cite": {}, "code": {},
+		"dd": {}, "del": {}, "details": {"open": true}, "div": {}, "dl": {}, "dt": {}, "em": {},
+		"figcaption": {}, "figure": {}, "footer": {}, "h1": {}, "h2": {}, "h3": {}, "h4": {},
+		"h5": {}, "h6": {}, "header": {}, "hr": {}, "i": {},
+		"img": {"src": true, "alt": true, "width": true, "height": true},
+		"ins": {}, "kbd": {}, "li": {}, "mark": {}, "ol": {"start": true}, "p": {}, "pre": {},
+		"q": {"cite": true}, "s": {}, "samp": {}, "section": {}, "small": {},
+		"source": {"src": true, "type": true}, "span": {}, "strike": {}, "strong": {}, "sub": {},
+		"summary": {}, "sup": {}, "table": {}, "tbody": {}, "td": {"colspan": true, "rowspan": true},
+		"tfoot": {}, "th": {"colspan": true, "rowspan": true}, "thead": {}, "time": {"datetime": true},
+		"tr": {}, "u": {}, "ul": {},
+		"video": {"src": true, "poster": true, "controls": true, "width": true, "height": true},
+	}
+	urlAttributes = map[string]bool{"href": true, "src": true, "poster": true, "cite": true}
+	// Attributes which can embed images as data urls
+	imageUrlAttributes = map[string]bool{"src": true, "poster": true}
+)
+
+// safeUrl returns the url without whitespace and control characters if it is
+// relative, http, https or, for images, a data:image url.
+func safeUrl(value string, image bool) (string, bool) {
+	value = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, value)
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https":
+		return value, true
+	case "data":
+		return value, image && strings.HasPrefix(strings.ToLower(value), "data:image/")
+	}
+	return "", false
+}
+
+// cleanAttributes keeps only the allowed attributes of the element, unsafe urls
+// are removed and urls with local copies point to the copies.
+func cleanAttributes(token html.Token, localUrl func(url string) string) []html.Attribute {
+	allowed := allowedElements[token.Data]
+	result := []html.Attribute{}
+	for _, attr := range token.Attr {
+		if attr.Namespace != "" || !(allowed[attr.Key] || commonAttributes[attr.Key]) {
+			continue
+		}
+		if urlAttributes[attr.Key] {
+			value, ok := safeUrl(attr.Val, imageUrlAttributes[attr.Key])
+			if !ok {
+				continue
+			}
+			attr.Val = localUrl(value)
+		}
+		result = append(result, attr)
+	}
+	// Lazy loaded images, e.g. on pikabu, keep the url in data attributes
+	if token.Data == "img" && attributeValue(result, "src") == "" {
+		for _, key := range imageAttributes {
+			if value, ok := safeUrl(attributeValue(token.Attr, key), true); ok && value != "" {
+				result = append(result, html.Attribute{Key: "src", Val: localUrl(value)})
+				break
+			}
+		}
+	}
+	return result
+}
+
+// cleanHtml keeps only the allowed elements and attributes of the saved
+// html, so scripts, event handlers and other active content are removed, and
+// points urls with local copies to the copies.
+func cleanHtml(text string, localUrl func(url string) string) string {
+	result := strings.Builder{}
+	tokenizer := html.NewTokenizer(strings.NewReader(text))
+	skipping := ""
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+		token := tokenizer.Token()
+		if skipping != "" {
+			if tokenType == html.EndTagToken && token.Data == skipping {
+				skipping = ""
+			}
+			continue
+		}
+		switch tokenType {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if droppedElements[token.Data] {
+				if tokenType == html.StartTagToken {
+					skipping = token.Data
+				}
+				continue
+			}
+			if _, ok := allowedElements[token.Data]; !ok {
+				continue
+			}
+			token.Attr = cleanAttributes(token, localUrl)
+		case html.EndTagToken:
+			if _, ok := allowedElements[token.Data]; !ok {
+				continue
+			}
+		case html.CommentToken, html.DoctypeToken:
+			continue
+		}
+		result.WriteString(token.String())
+	}
+	return result.String()
+}
+
+func formatContent(content *opb.Content, localUrl func(url string) string) template.HTML {
+	if strings.HasPrefix(content.Mime, "text/html") {
+		return template.HTML(cleanHtml(content.Text, localUrl))
+	}
+	escaped := template.HTMLEscapeString(content.Text)
+	return template.HTML(strings.ReplaceAll(escaped, "\n", "<br>"))
+}
+
+// htmlFormat writes a page with files copied next to it or, if embedLimit is
+// set, a single page with images up to the limit embedded as data urls.
+type htmlFormat struct {
+	embedLimit int64
+}
+
+func newHtmlFormat() format {
+	return &htmlFormat{}
+}
+
+func newSingleHtmlFormat() format {
+	return &htmlFormat{embedLimit: defaultEmbedLimit}
+}
+
+// resolveUrls resolves relative urls of saved pages against the page url, so
+// they match the saved attachments.
+func resolveUrls(base string, localUrl func(url string) string) func(url string) string {
+	baseUrl, err := url.Parse(base)
+	if err != nil || !baseUrl.IsAbs() {
+		return localUrl
+	}
+	return func(value string) string {
+		ref, err := url.Parse(value)
+		if err != nil || strings.HasPrefix(value, "#") {
+			return localUrl(value)
+		}
+		return localUrl(baseUrl.ResolveReference(ref).String())
+	}
+}
+
+func (hf *htmlFormat) toHtml(nodes []*Node, files map[string]string, link string) []*htmlObject {
+	localUrl := localUrls(files)
+	result := []*htmlObject{}
+	for _, node := range nodes {
+		obj := node.Object
+		converted := &htmlObject{
+			Id:       obj.Id,
+			Author:   authorName(obj),
+			Time:     formatTime(obj.CreatedAt),
+			Stats:    formatStats(obj.Stats),
+			Children: hf.toHtml(node.Children, files, link),
+		}
+		// Objects of the web snapshots are pages with their urls as ids
+		base := link
+		if u, err := url.Parse(obj.Id); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			base = obj.Id
+		}
+		for _, c := range obj.Content {
+			converted.Content = append(converted.Content, formatContent(c, resolveUrls(base, localUrl)))
+		}
+		for _, a := range obj.Attachment {
+			local := localUrl(a.Url)
+			attachment := &htmlAttachment{Kind: attachmentKind(a.Mime), Src: local, Url: a.Url}
+			if strings.HasPrefix(local, "data:") {
+				attachment.Src = template.URL(local)
+			} else if hf.embedLimit > 0 {
+				// Not embedded media is too large for a single page
+				attachment.Kind = "link"
+			}
+			converted.Attachments = append(converted.Attachments, attachment)
+		}
+		result = append(result, converted)
+	}
+	return result
+}
+
+func (hf *htmlFormat) snapshot(s *exportedSnapshot, files map[string]string) *htmlSnapshot {
+	result := &htmlSnapshot{
+		Id:        s.Id,
+		Href:      path.Join(s.Id, htmlIndex),
+		Index:     "../" + htmlIndex,
+		FetchTime: formatTime(s.Snapshot.FetchTime),
+		Count:     len(s.Snapshot.Objects),
+		Style:     template.CSS(htmlStyle),
+	}
+	if hf.embedLimit > 0 {
+		result.Href = s.Id + ".html"
+		result.Index = ""
+	}
+	if s.Snapshot.Link != nil {
+		result.Link = s.Snapshot.Link.Href
+	}
+	if files != nil {
+		result.Objects = hf.toHtml(s.Thread, files, result.Link)
+	}
+	return result
+}
+
+// embedFiles returns data urls of the saved images which are not larger
+// than the limit.
+func (hf *htmlFormat) embedFiles(s *exportedSnapshot) (map[string]string, error) {
+	attachments, err := s.savedAttachments()
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]string{}
+	for _, a := range attachments {
+		if attachmentKind(a.Mime) != "image" {
+			continue
+		}
+		data, err := s.readSmall(a.Url, hf.embedLimit)
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			files[a.Url] = "data:" + a.Mime + ";base64," + base64.StdEncoding.EncodeToString(data)
+		}
+	}
+	return files, nil
+}
+
+func (hf *htmlFormat) writeSnapshot(target string, s *exportedSnapshot) error {
+	if hf.embedLimit > 0 {
+		files, err := hf.embedFiles(s)
+		if err != nil {
+			return err
+		}
+		return writeTemplate(filepath.Join(target, s.Id+".html"), "snapshot", hf.snapshot(s, files))
+	}
+	dir := filepath.Join(target, s.Id)
+	files, err := s.copyFiles(dir, "files")
+	if err != nil {
+		return err
+	}
+	return writeTemplate(filepath.Join(dir, htmlIndex), "snapshot", hf.snapshot(s, files))
+}
+
+func (hf *htmlFormat) writeIndex(target string, exported []*exportedSnapshot) error {
+	index := struct {
+		Style     template.CSS
+		Snapshots []*htmlSnapshot
+	}{Style: template.CSS(htmlStyle)}
+	for _, s := range exported {
+		index.Snapshots = append(index.Snapshots, hf.snapshot(s, nil))
+	}
+	return writeTemplate(filepath.Join(target, htmlIndex), "index", index)
+}
+
+func writeTemplate(name string, templateName string, data any) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		return err
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := htmlTemplates.ExecuteTemplate(file, templateName, data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,147 @@
+package viewer
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"chronicler/common"
+	"chronicler/iferr"
+	opb "chronicler/proto"
+	"chronicler/storage"
+)
+
+func TestCleanHtml(t *testing.T) {
+	local := func(url string) string {
+		if url == "http://some/image.jpg" {
+			return "files/image.jpg"
+		}
+		return url
+	}
+	for _, tc := range []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "plain", text: "<p>Hello <b>there</b></p>", want: "<p>Hello <b>there</b></p>"},
+		{name: "script", text: "<p>Hi</p><script>alert('<p>')</script>", want: "<p>Hi</p>"},
+		{name: "event handler", text: `<img src="x.png" onerror="alert(1)">`, want: `<img src="x.png">`},
+		{name: "javascript url", text: `<a href=" javascript:alert(1)">link</a>`, want: `<a>link</a>`},
+		{name: "local copy", text: `<img src="http://some/image.jpg">`, want: `<img src="files/image.jpg">`},
+		{name: "comment", text: `a<!-- hidden -->b`, want: `ab`},
+		{name: "tab in scheme", text: `<a href="java&#x09;script:alert(1)">link</a>`, want: `<a>link</a>`},
+		{name: "newline in scheme", text: "<a href=\"java\nscript:alert(1)\">link</a>", want: `<a>link</a>`},
+		{name: "control character in scheme", text: `<a href="&#x01;javascript:alert(1)">link</a>`, want: `<a>link</a>`},
+		{name: "uppercase scheme", text: `<a href="JaVaScRiPt:alert(1)">link</a>`, want: `<a>link</a>`},
+		{name: "vbscript", text: `<a href="vbscript:msgbox(1)">link</a>`, want: `<a>link</a>`},
+		{
+			name: "svg xlink href",
+			text: `<svg><a xlink:href="javascript:alert(1)"><text>svg</text></a></svg>after`,
+			want: `after`,
+		},
+		{
+			name: "animate href",
+			text: `<a><animate attributeName="href" values="javascript:alert(1)"/>link</a>`,
+			want: `<a>link</a>`,
+		},
+		{name: "namespaced attribute", text: `<a xlink:href="javascript:alert(1)">link</a>`, want: `<a>link</a>`},
+		{name: "unknown elements unwrapped", text: `<font color="red"><p>text</p></font>`, want: `<p>text</p>`},
+		{name: "unknown attributes", text: `<p style="x" id="y" class="z" title="t">text</p>`, want: `<p title="t">text</p>`},
+		{name: "http and relative urls", text: `<a href="https://a/b">a</a><a href="../c?d#e">c</a>`, want: `<a href="https://a/b">a</a><a href="../c?d#e">c</a>`},
+		{name: "data image", text: `<img src="data:image/png;base64,AAAA">`, want: `<img src="data:image/png;base64,AAAA">`},
+		{name: "data html", text: `<img src="data:text/html,<script>alert(1)</script>">`, want: `<img>`},
+		{name: "data image link", text: `<a href="data:image/svg+xml,<svg onload=alert(1)>">x</a>`, want: `<a>x</a>`},
+		{name: "lazy image", text: `<img data-src="http://some/image.jpg">`, want: `<img src="files/image.jpg">`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := cleanHtml(tc.text, local); got != tc.want {
+				t.Errorf("Expected %q, but got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestSingleHtml(t *testing.T) {
+	storages := newTestStorages(t)
+	page := &opb.Link{Href: "http://site/page/"}
+	s, _ := storages.Open(common.UUID4For(page))
+	bs := &storage.BlockStorage{Storage: s}
+	bs.PutSnapshot(&storage.PutRequest{Url: objectFileName}, &opb.Snapshot{
+		Link: page,
+		Objects: []*opb.Object{{
+			Id: "http://site/page/a.html",
+			Content: []*opb.Content{{
+				Text: `<html><head><title>A</title></head><body><img src="img/b.png"><a href="other.html">Other</a><a href="#top">Top</a></body></html>`,
+				Mime: "text/html",
+			}},
+			Attachment: []*opb.Attachment{{Url: "http://site/page/img/b.png", Mime: "image/png"}},
+		}},
+	}, storage.FormatProtoJson)
+	bs.PutBytes(&storage.PutRequest{Url: "http://site/page/img/b.png"}, []byte("png"))
+
+	for _, tc := range []struct {
+		name       string
+		link       *opb.Link
+		embedLimit int64
+		want       []string
+		notWant    []string
+	}{
+		{
+			name:       "embedded",
+			link:       testLink,
+			embedLimit: defaultEmbedLimit,
+			want: []string{
+				`<img src="data:image/jpeg;base64,aW1hZ2U="`,
+				`<a href="data:image/jpeg;base64,aW1hZ2U=">here</a>`,
+				`<a href="http://some/missing.mp4">http://some/missing.mp4</a>`,
+				"<style>",
+			},
+			notWant: []string{"files/", "All snapshots", "<video"},
+		},
+		{
+			name:       "too large",
+			link:       testLink,
+			embedLimit: 3,
+			want:       []string{`<a href="http://some/image.jpg">http://some/image.jpg</a>`},
+			notWant:    []string{"data:", "<img"},
+		},
+		{
+			name:       "web page",
+			link:       page,
+			embedLimit: defaultEmbedLimit,
+			want: []string{
+				`<img src="data:image/png;base64,cG5n">`,
+				`<a href="http://site/page/other.html">Other</a>`,
+				`<a href="#top">Top</a>`,
+			},
+			notWant: []string{"<title>A</title>"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target := t.TempDir()
+			id := common.UUID4For(tc.link)
+			s := iferr.Exit(storages.Open(id))
+			snapshot, _ := (&storage.BlockStorage{Storage: s}).GetSnapshot(&storage.GetRequest{Url: objectFileName})
+			err := (&htmlFormat{embedLimit: tc.embedLimit}).writeSnapshot(target, &exportedSnapshot{
+				Id:       id,
+				Snapshot: snapshot,
+				Thread:   BuildThread(snapshot.Objects),
+				storage:  s,
+			})
+			if err != nil {
+				t.Fatalf("Cannot write page: %s", err)
+			}
+			result := readFile(t, filepath.Join(target, id+".html"))
+			for _, want := range tc.want {
+				if !strings.Contains(result, want) {
+					t.Errorf("Expected page to contain %q", want)
+				}
+			}
+			for _, notWant := range tc.notWant {
+				if strings.Contains(result, notWant) {
+					t.Errorf("Expected page not to contain %q", notWant)
+				}
+			}
+		})
+	}
+}
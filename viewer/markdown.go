@@ -0,0 +1,321 @@
+package viewer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	opb "chronicler/proto"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	markdownIndex = "index.md"
+)
+
+var (
+	markdownEscaper = strings.NewReplacer(
+		`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`",
+		"[", `\[`, "]", `\]`, "<", `\<`, ">", `\>`, "#", `\#`)
+	markdownUrlEscaper = strings.NewReplacer(
+		" ", "%20", "(", "%28", ")", "%29", "<", "%3C", ">", "%3E")
+	// List markers and setext underlines are special only at the line start
+	lineStart  = regexp.MustCompile(`(?m)^[ \t]*([-+=]|\d+[.)])`)
+	spaces     = regexp.MustCompile(`\s+`)
+	blankLines = regexp.MustCompile(`\n[ \t]*(\n[ \t]*)+`)
+)
+
+func escapeMarkdown(text string) string {
+	return markdownEscaper.Replace(text)
+}
+
+// escapeLineStart escapes the last character of the markers at the start of
+// the lines, the text is expected to be escaped already.
+func escapeLineStart(text string) string {
+	return lineStart.ReplaceAllStringFunc(text, func(marker string) string {
+		return marker[:len(marker)-1] + `\` + marker[len(marker)-1:]
+	})
+}
+
+// markdownUrl returns the safe url, or its local copy, to be used as a link
+// destination, or an empty string for unsafe urls.
+func markdownUrl(value string, image bool, localUrl func(url string) string) string {
+	value, ok := safeUrl(value, image)
+	if !ok || value == "" {
+		return ""
+	}
+	return markdownUrlEscaper.Replace(localUrl(value))
+}
+
+// indent prefixes every line but the first one.
+func indent(text string, prefix string) string {
+	return strings.ReplaceAll(text, "\n", "\n"+prefix)
+}
+
+func quote(text string, prefix string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			lines[i] = strings.TrimRight(prefix, " ")
+		} else {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func rawText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	result := strings.Builder{}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		result.WriteString(rawText(c))
+	}
+	return result.String()
+}
+
+func codeSpan(text string) string {
+	fence := "`"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	if strings.HasPrefix(text, "`") || strings.HasSuffix(text, "`") {
+		text = " " + text + " "
+	}
+	return fence + text + fence
+}
+
+type markdownWriter struct {
+	localUrl func(url string) string
+}
+
+func (mw *markdownWriter) children(n *html.Node) string {
+	result := strings.Builder{}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		result.WriteString(mw.node(c))
+	}
+	return result.String()
+}
+
+func (mw *markdownWriter) block(text string) string {
+	return "\n\n" + strings.TrimSpace(text) + "\n\n"
+}
+
+func (mw *markdownWriter) url(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return markdownUrl(attr.Val, n.DataAtom == atom.Img, mw.localUrl)
+		}
+	}
+	return ""
+}
+
+func (mw *markdownWriter) list(n *html.Node) string {
+	result := strings.Builder{}
+	i := 1
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.DataAtom != atom.Li {
+			continue
+		}
+		marker := "- "
+		if n.DataAtom == atom.Ol {
+			marker = fmt.Sprintf("%d. ", i)
+		}
+		item := strings.TrimSpace(blankLines.ReplaceAllString(mw.children(c), "\n\n"))
+		result.WriteString(marker + indent(item, strings.Repeat(" ", len(marker))) + "\n")
+		i++
+	}
+	return mw.block(result.String())
+}
+
+func (mw *markdownWriter) node(n *html.Node) string {
+	switch n.Type {
+	case html.TextNode:
+		return escapeLineStart(escapeMarkdown(spaces.ReplaceAllString(n.Data, " ")))
+	case html.ElementNode:
+	default:
+		return mw.children(n)
+	}
+	if droppedElements[n.Data] {
+		return ""
+	}
+	switch n.DataAtom {
+	case atom.A:
+		text := strings.TrimSpace(mw.children(n))
+		href := mw.url(n, "href")
+		if href == "" {
+			return text
+		}
+		if text == "" {
+			text = escapeMarkdown(href)
+		}
+		return "[" + text + "](" + href + ")"
+	case atom.Img:
+		src := mw.url(n, "src")
+		if src == "" {
+			return ""
+		}
+		alt := ""
+		for _, attr := range n.Attr {
+			if attr.Key == "alt" {
+				alt = escapeMarkdown(attr.Val)
+			}
+		}
+		return "![" + alt + "](" + src + ")"
+	case atom.Br:
+		return "  \n"
+	case atom.Hr:
+		return "\n\n---\n\n"
+	case atom.B, atom.Strong:
+		if text := strings.TrimSpace(mw.children(n)); text != "" {
+			return "**" + text + "**"
+		}
+		return ""
+	case atom.I, atom.Em:
+		if text := strings.TrimSpace(mw.children(n)); text != "" {
+			return "*" + text + "*"
+		}
+		return ""
+	case atom.S, atom.Del, atom.Strike:
+		if text := strings.TrimSpace(mw.children(n)); text != "" {
+			return "~~" + text + "~~"
+		}
+		return ""
+	case atom.Code:
+		return codeSpan(rawText(n))
+	case atom.Pre:
+		text := strings.Trim(rawText(n), "\n")
+		fence := "```"
+		for strings.Contains(text, fence) {
+			fence += "`"
+		}
+		return "\n\n" + fence + "\n" + text + "\n" + fence + "\n\n"
+	case atom.Blockquote:
+		text := strings.TrimSpace(blankLines.ReplaceAllString(mw.children(n), "\n\n"))
+		return mw.block(quote(text, "> "))
+	case atom.Ul, atom.Ol:
+		return mw.list(n)
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level := int(n.Data[1] - '0')
+		return mw.block(strings.Repeat("#", level) + " " + strings.TrimSpace(mw.children(n)))
+	case atom.P, atom.Div, atom.Li, atom.Table, atom.Tr, atom.Section, atom.Article:
+		return mw.block(mw.children(n))
+	}
+	return mw.children(n)
+}
+
+// htmlToMarkdown converts the saved html to markdown, urls with local copies
+// point to the copies.
+func htmlToMarkdown(text string, localUrl func(url string) string) string {
+	body := &html.Node{Type: html.ElementNode, DataAtom: atom.Body, Data: "body"}
+	nodes, err := html.ParseFragment(strings.NewReader(text), body)
+	if err != nil {
+		return escapeMarkdown(text)
+	}
+	mw := &markdownWriter{localUrl: localUrl}
+	result := strings.Builder{}
+	for _, n := range nodes {
+		result.WriteString(mw.node(n))
+	}
+	return strings.TrimSpace(blankLines.ReplaceAllString(result.String(), "\n\n"))
+}
+
+func formatMarkdownContent(content *opb.Content, localUrl func(url string) string) string {
+	if strings.HasPrefix(content.Mime, "text/html") {
+		return htmlToMarkdown(content.Text, localUrl)
+	}
+	return strings.ReplaceAll(escapeLineStart(escapeMarkdown(strings.TrimSpace(content.Text))), "\n", "  \n")
+}
+
+type markdownFormat struct{}
+
+func newMarkdownFormat() format {
+	return &markdownFormat{}
+}
+
+func (mf *markdownFormat) object(obj *opb.Object, localUrl func(url string) string) string {
+	header := []string{"**" + escapeMarkdown(authorName(obj)) + "**"}
+	if t := formatTime(obj.CreatedAt); t != "" {
+		header = append(header, t)
+	}
+	header = append(header, formatStats(obj.Stats)...)
+	parts := []string{strings.Join(header, " · ")}
+	for _, c := range obj.Content {
+		if text := formatMarkdownContent(c, localUrl); text != "" {
+			parts = append(parts, text)
+		}
+	}
+	for _, a := range obj.Attachment {
+		src := markdownUrl(a.Url, attachmentKind(a.Mime) == "image", localUrl)
+		if src == "" {
+			parts = append(parts, escapeMarkdown(a.Url))
+		} else if attachmentKind(a.Mime) == "image" {
+			parts = append(parts, "!["+escapeMarkdown(a.Url)+"]("+src+")")
+		} else {
+			parts = append(parts, "["+escapeMarkdown(a.Url)+"]("+src+")")
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// snapshot writes replies as block quotes nested by depth.
+func (mf *markdownFormat) snapshot(s *exportedSnapshot, files map[string]string) string {
+	localUrl := localUrls(files)
+	link := ""
+	if s.Snapshot.Link != nil {
+		link = s.Snapshot.Link.Href
+	}
+	result := strings.Builder{}
+	if href, ok := safeUrl(link, false); ok && href != "" {
+		result.WriteString(fmt.Sprintf("# [%s](%s)\n\n", escapeMarkdown(link), markdownUrlEscaper.Replace(href)))
+	} else {
+		result.WriteString(fmt.Sprintf("# %s\n\n", escapeMarkdown(link)))
+	}
+	result.WriteString(fmt.Sprintf("Fetched %s, %d objects\n", formatTime(s.Snapshot.FetchTime), len(s.Snapshot.Objects)))
+	previous := 0
+	Walk(s.Thread, func(node *Node) {
+		separator := strings.TrimSpace(strings.Repeat("> ", min(previous, node.Depth)))
+		if node.Depth == 0 {
+			separator = "\n---\n"
+		}
+		result.WriteString(separator + "\n")
+		result.WriteString(quote(mf.object(node.Object, localUrl), strings.Repeat("> ", node.Depth)) + "\n")
+		previous = node.Depth
+	})
+	return result.String()
+}
+
+func (mf *markdownFormat) writeSnapshot(target string, s *exportedSnapshot) error {
+	dir := filepath.Join(target, s.Id)
+	files, err := s.copyFiles(dir, "files")
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, markdownIndex), mf.snapshot(s, files))
+}
+
+func (mf *markdownFormat) writeIndex(target string, exported []*exportedSnapshot) error {
+	result := strings.Builder{}
+	result.WriteString("# Snapshots\n\n")
+	for _, s := range exported {
+		link := ""
+		if s.Snapshot.Link != nil {
+			link = s.Snapshot.Link.Href
+		}
+		result.WriteString(fmt.Sprintf("- [%s](%s/%s) %s, %d objects\n",
+			escapeMarkdown(link), s.Id, markdownIndex, formatTime(s.Snapshot.FetchTime), len(s.Snapshot.Objects)))
+	}
+	return writeFile(filepath.Join(target, markdownIndex), result.String())
+}
+
+func writeFile(name string, text string) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		return err
+	}
+	return os.WriteFile(name, []byte(text), 0666)
+}
@@ -0,0 +1,85 @@
+package viewer
+
+import (
+	"strings"
+	"testing"
+
+	opb "chronicler/proto"
+)
+
+func TestHtmlToMarkdown(t *testing.T) {
+	local := func(url string) string {
+		if url == "http://some/image.jpg" {
+			return "files/image.jpg"
+		}
+		return url
+	}
+	for _, tc := range []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "plain", text: "Hello <b>there</b>, <i>you</i>", want: "Hello **there**, *you*"},
+		{name: "escaped", text: "2 * 3 = [six]", want: `2 \* 3 = \[six\]`},
+		{name: "paragraphs", text: "<p>One\n  line</p><p>Two<br>lines</p>", want: "One line\n\nTwo  \nlines"},
+		{name: "link", text: `<a href="http://some/url">some url</a>`, want: "[some url](http://some/url)"},
+		{name: "local image", text: `<img src="http://some/image.jpg" alt="pic">`, want: "![pic](files/image.jpg)"},
+		{name: "script", text: "<p>Hi</p><script>alert(1)</script>", want: "Hi"},
+		{name: "quote", text: "<blockquote><p>One</p><p>Two</p></blockquote>After", want: "> One\n>\n> Two\n\nAfter"},
+		{name: "code", text: "Run <code>a*b</code><pre>if a {\n  b()\n}</pre>", want: "Run `a*b`\n\n```\nif a {\n  b()\n}\n```"},
+		{name: "line start", text: "<p>- one</p><p>+ two</p><p>3. three</p><p># four</p><p>> five</p><p>===</p>",
+			want: "\\- one\n\n\\+ two\n\n3\\. three\n\n\\# four\n\n\\> five\n\n\\==="},
+		{name: "url", text: `<a href="http://some/a (b)<c>">x</a>`, want: "[x](http://some/a%28b%29%3Cc%3E)"},
+		{name: "unsafe url", text: `<a href="java\tscript:alert(1)">x</a><img src="data:text/html,x">`, want: "x"},
+		{name: "data image", text: `<img src="data:image/png;base64,AA==">`, want: "![](data:image/png;base64,AA==)"},
+		{name: "lists", text: "<ul><li>One</li><li>Two</li></ul><ol><li>First</li><li>Second</li></ol>", want: "- One\n- Two\n\n1. First\n2. Second"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := htmlToMarkdown(tc.text, local); got != tc.want {
+				t.Errorf("Expected %q, but got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestMarkdownSnapshot(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		link   string
+		text   string
+		header string
+		want   string
+	}{
+		{
+			name:   "markdown in link",
+			link:   "http://some/url_(1)",
+			text:   "- not a list\n1. not a number\n# not a header\n> not a quote",
+			header: `# [http://some/url\_(1)](http://some/url_%281%29)`,
+			want:   "\\- not a list  \n1\\. not a number  \n\\# not a header  \n\\> not a quote",
+		},
+		{
+			name:   "unsafe link",
+			link:   "javascript:alert(1)",
+			text:   "text",
+			header: "# javascript:alert(1)\n",
+			want:   "text",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			snapshot := &opb.Snapshot{
+				Link:    &opb.Link{Href: tc.link},
+				Objects: []*opb.Object{{Id: "1", Content: []*opb.Content{{Text: tc.text}}}},
+			}
+			got := (&markdownFormat{}).snapshot(&exportedSnapshot{
+				Snapshot: snapshot,
+				Thread:   BuildThread(snapshot.Objects),
+			}, map[string]string{})
+			if !strings.HasPrefix(got, tc.header) {
+				t.Errorf("Expected header %q, but got %q", tc.header, got)
+			}
+			if !strings.Contains(got, tc.want) {
+				t.Errorf("Expected text %q, but got %q", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package viewer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"chronicler/common"
+	opb "chronicler/proto"
+)
+
+const (
+	// Saved attachments up to this size are added to the messages
+	mboxAttachmentLimit = 1024 * 1024
+	mboxSubjectLength   = 60
+)
+
+var (
+	fromLine     = regexp.MustCompile(`(?m)^(>*From )`)
+	addressChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+)
+
+func messageId(s *exportedSnapshot, obj *opb.Object) string {
+	return fmt.Sprintf("<%s.%s@chronicler>", addressChars.ReplaceAllString(obj.Id, "_"), s.Id)
+}
+
+func sender(obj *opb.Object, host string) string {
+	address := &mail.Address{Address: "unknown@" + host}
+	if len(obj.Generator) > 0 {
+		g := obj.Generator[0]
+		address.Name = g.Name
+		if local := addressChars.ReplaceAllString(g.Id, "_"); local != "" {
+			address.Address = local + "@" + host
+		}
+	}
+	return address.String()
+}
+
+func subject(obj *opb.Object, fallback string) string {
+	for _, c := range obj.Content {
+		if text := shorten(plainText(c), mboxSubjectLength); text != "" {
+			return text
+		}
+	}
+	return fallback
+}
+
+func writeQuotedPrintable(part io.Writer, text string) error {
+	writer := quotedprintable.NewWriter(part)
+	if _, err := io.WriteString(writer, strings.ReplaceAll(text, "\n", "\r\n")); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+func writeBase64(part io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(part, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err := io.WriteString(part, encoded+"\r\n")
+	return err
+}
+
+type mboxFormat struct{}
+
+func newMboxFormat() format {
+	return &mboxFormat{}
+}
+
+func (mf *mboxFormat) body(w io.Writer, obj *opb.Object, boundary string) error {
+	writer := multipart.NewWriter(w)
+	if err := writer.SetBoundary(boundary); err != nil {
+		return err
+	}
+	text := []string{}
+	htmlText := []string{}
+	for _, c := range obj.Content {
+		text = append(text, plainText(c))
+		htmlText = append(htmlText, "<div>"+string(formatContent(c, localUrls(nil)))+"</div>")
+	}
+	for _, a := range obj.Attachment {
+		text = append(text, a.Url)
+		htmlText = append(htmlText, `<p><a href="`+template.HTMLEscapeString(a.Url)+`">`+template.HTMLEscapeString(a.Url)+"</a></p>")
+	}
+	for _, p := range []struct {
+		mime string
+		text string
+	}{
+		{"text/plain; charset=utf-8", strings.Join(text, "\n\n") + "\n"},
+		{"text/html; charset=utf-8", "<html><body>\n" + strings.Join(htmlText, "\n") + "\n</body></html>\n"},
+	} {
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.mime},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return err
+		}
+		if err := writeQuotedPrintable(part, p.text); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+func (mf *mboxFormat) message(s *exportedSnapshot, node *Node, ancestors []*Node, saved map[string]bool) ([]byte, error) {
+	obj := node.Object
+	host := "localhost"
+	title := s.Id
+	if s.Snapshot.Link != nil {
+		title = s.Snapshot.Link.Href
+		if u, err := url.Parse(s.Snapshot.Link.Href); err == nil && u.Hostname() != "" {
+			host = u.Hostname()
+		}
+	}
+	date := time.Unix(0, 0)
+	if obj.CreatedAt != nil {
+		date = time.Unix(obj.CreatedAt.Seconds, int64(obj.CreatedAt.Nanos))
+	} else if s.Snapshot.FetchTime != nil {
+		date = time.Unix(s.Snapshot.FetchTime.Seconds, 0)
+	}
+	root := obj
+	if len(ancestors) > 0 {
+		root = ancestors[0].Object
+	}
+	subjectText := subject(root, title)
+	if len(ancestors) > 0 {
+		subjectText = "Re: " + subjectText
+	}
+
+	header := &bytes.Buffer{}
+	header.WriteString(fmt.Sprintf("From chronicler %s\n", date.UTC().Format(time.ANSIC)))
+	header.WriteString("Message-ID: " + messageId(s, obj) + "\n")
+	if len(ancestors) > 0 {
+		references := []string{}
+		for _, a := range ancestors {
+			references = append(references, messageId(s, a.Object))
+		}
+		header.WriteString("In-Reply-To: " + references[len(references)-1] + "\n")
+		header.WriteString("References: " + strings.Join(references, "\n ") + "\n")
+	}
+	header.WriteString("From: " + sender(obj, host) + "\n")
+	header.WriteString("Date: " + date.Format(time.RFC1123Z) + "\n")
+	header.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subjectText) + "\n")
+	header.WriteString("X-Chronicler-Source: " + title + "\n")
+	header.WriteString("MIME-Version: 1.0\n")
+
+	attachments := map[string][]byte{}
+	for _, a := range obj.Attachment {
+		if !saved[a.Url] {
+			continue
+		}
+		data, err := s.readSmall(a.Url, mboxAttachmentLimit)
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			attachments[a.Url] = data
+		}
+	}
+	alternative := "alt-" + common.UUID4()
+	body := &bytes.Buffer{}
+	if len(attachments) == 0 {
+		header.WriteString(fmt.Sprintf("Content-Type: multipart/alternative; boundary=%q\n\n", alternative))
+		if err := mf.body(body, obj, alternative); err != nil {
+			return nil, err
+		}
+	} else {
+		writer := multipart.NewWriter(body)
+		header.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=%q\n\n", writer.Boundary()))
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {fmt.Sprintf("multipart/alternative; boundary=%q", alternative)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := mf.body(part, obj, alternative); err != nil {
+			return nil, err
+		}
+		for _, a := range obj.Attachment {
+			data, ok := attachments[a.Url]
+			if !ok {
+				continue
+			}
+			delete(attachments, a.Url)
+			mimeType := a.Mime
+			if mimeType == "" {
+				mimeType = "application/octet-stream"
+			}
+			part, err := writer.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {mimeType},
+				"Content-Transfer-Encoding": {"base64"},
+				"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": fileName(a.Url)})},
+				"Content-Location":          {a.Url},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if err := writeBase64(part, data); err != nil {
+				return nil, err
+			}
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+	}
+	// mboxrd: body lines starting with "From " are quoted, lines ending with
+	// \r\n from the multipart writer are stored with \n like the header.
+	text := strings.ReplaceAll(body.String(), "\r\n", "\n")
+	header.WriteString(fromLine.ReplaceAllString(text, ">$1"))
+	header.WriteString("\n")
+	return header.Bytes(), nil
+}
+
+// write adds every object as a message, replies refer to their parents.
+func (mf *mboxFormat) write(w io.Writer, s *exportedSnapshot) error {
+	attachments, err := s.savedAttachments()
+	if err != nil {
+		return err
+	}
+	saved := map[string]bool{}
+	for _, a := range attachments {
+		saved[a.Url] = true
+	}
+	writer := bufio.NewWriter(w)
+	path := []*Node{}
+	Walk(s.Thread, func(node *Node) {
+		path = append(path[:node.Depth], node)
+		if err != nil {
+			return
+		}
+		var message []byte
+		if message, err = mf.message(s, node, path[:node.Depth], saved); err == nil {
+			_, err = writer.Write(message)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+func (mf *mboxFormat) writeSnapshot(target string, s *exportedSnapshot) error {
+	if err := os.MkdirAll(target, 0777); err != nil {
+		return err
+	}
+	file, err := os.Create(filepath.Join(target, s.Id+".mbox"))
+	if err != nil {
+		return err
+	}
+	if err := mf.write(file, s); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeIndex does nothing, every snapshot is a separate mailbox.
+func (mf *mboxFormat) writeIndex(target string, exported []*exportedSnapshot) error {
+	return nil
+}
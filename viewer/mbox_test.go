@@ -0,0 +1,129 @@
+package viewer
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+
+	"chronicler/common"
+	opb "chronicler/proto"
+
+	"google.golang.org/protobuf/proto"
+)
+
+type testPart struct {
+	mime string
+	data string
+}
+
+func readParts(t *testing.T, contentType string, body io.Reader) []*testPart {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("Cannot parse content type %q: %s", contentType, err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		data, _ := io.ReadAll(body)
+		return []*testPart{{mime: mediaType, data: string(data)}}
+	}
+	result := []*testPart{}
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return result
+		}
+		if err != nil {
+			t.Fatalf("Cannot read part: %s", err)
+		}
+		result = append(result, readParts(t, part.Header.Get("Content-Type"), part)...)
+	}
+}
+
+func TestMbox(t *testing.T) {
+	id := common.UUID4For(testLink)
+	s, _ := newTestStorages(t).Open(id)
+	snapshot := proto.Clone(testSnapshot).(*opb.Snapshot)
+	snapshot.Objects = append(snapshot.Objects, &opb.Object{
+		Id:      "3",
+		Parent:  "2",
+		Content: []*opb.Content{{Text: "First line\nFrom the second line"}},
+	})
+	mbox := &bytes.Buffer{}
+	err := (&mboxFormat{}).write(mbox, &exportedSnapshot{
+		Id:       id,
+		Snapshot: snapshot,
+		Thread:   BuildThread(snapshot.Objects),
+		storage:  s,
+	})
+	if err != nil {
+		t.Fatalf("Cannot write mbox: %s", err)
+	}
+
+	messages := strings.Split(mbox.String(), "\nFrom ")
+	if len(messages) != 3 || !strings.HasPrefix(messages[0], "From ") {
+		t.Fatalf("Expected 3 messages, but got %d", len(messages))
+	}
+	parsed := []*mail.Message{}
+	for _, message := range messages {
+		_, message, _ = strings.Cut(message, "\n")
+		m, err := mail.ReadMessage(strings.NewReader(message))
+		if err != nil {
+			t.Fatalf("Cannot parse message: %s", err)
+		}
+		parsed = append(parsed, m)
+	}
+
+	t.Run("headers", func(t *testing.T) {
+		ids := []string{"<1." + id + "@chronicler>", "<2." + id + "@chronicler>", "<3." + id + "@chronicler>"}
+		for i, m := range parsed {
+			if got := m.Header.Get("Message-ID"); got != ids[i] {
+				t.Errorf("Expected message id %q, but got %q", ids[i], got)
+			}
+		}
+		if got := parsed[2].Header.Get("In-Reply-To"); got != ids[1] {
+			t.Errorf("Expected reply to %q, but got %q", ids[1], got)
+		}
+		if got := strings.Fields(parsed[2].Header.Get("References")); !reflect.DeepEqual(got, ids[:2]) {
+			t.Errorf("Expected references %q, but got %q", ids[:2], got)
+		}
+		if got := parsed[0].Header.Get("In-Reply-To"); got != "" {
+			t.Errorf("Expected no parent for the first message, but got %q", got)
+		}
+		from, err := parsed[0].Header.AddressList("From")
+		if err != nil || from[0].Name != "Original Poster" || from[0].Address != "op@some" {
+			t.Errorf("Unexpected sender %v: %v", from, err)
+		}
+		if date, err := parsed[0].Header.Date(); err != nil || date.Unix() != 1600000000 {
+			t.Errorf("Unexpected date %s: %v", date, err)
+		}
+		subject, _ := (&mime.WordDecoder{}).DecodeHeader(parsed[1].Header.Get("Subject"))
+		if subject != "Re: Look here" {
+			t.Errorf("Unexpected subject %q", subject)
+		}
+	})
+
+	t.Run("parts", func(t *testing.T) {
+		parts := readParts(t, parsed[0].Header.Get("Content-Type"), parsed[0].Body)
+		if len(parts) != 3 {
+			t.Fatalf("Expected text, html and image parts, but got %d", len(parts))
+		}
+		if parts[0].mime != "text/plain" || !strings.Contains(parts[0].data, "Look here") {
+			t.Errorf("Unexpected text part %v", parts[0])
+		}
+		if parts[1].mime != "text/html" || strings.Contains(parts[1].data, "alert") {
+			t.Errorf("Unexpected html part %v", parts[1])
+		}
+		if parts[2].mime != "image/jpeg" || strings.TrimSpace(parts[2].data) != "aW1hZ2U=" {
+			t.Errorf("Unexpected attachment %v", parts[2])
+		}
+		reply := readParts(t, parsed[2].Header.Get("Content-Type"), parsed[2].Body)
+		if !strings.Contains(reply[0].data, "\n>From the second line") {
+			t.Errorf("Expected From line to be quoted, but got %q", reply[0].data)
+		}
+	})
+}
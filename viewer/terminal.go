@@ -0,0 +1,134 @@
+package viewer
+
+import (
+	"bufio"
+	"os/exec"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/width"
+)
+
+type KeyCode int
+
+const (
+	KeyRune KeyCode = iota
+	KeyUp
+	KeyDown
+	KeyLeft
+	KeyRight
+	KeyPageUp
+	KeyPageDown
+	KeyHome
+	KeyEnd
+	KeyEnter
+	KeyEscape
+	KeyBackspace
+	KeyTab
+	KeyInterrupt
+	KeyUnknown
+)
+
+type Key struct {
+	Code KeyCode
+	Rune rune
+}
+
+var (
+	escapeSequences = map[string]KeyCode{
+		"A": KeyUp, "B": KeyDown, "C": KeyRight, "D": KeyLeft, "H": KeyHome, "F": KeyEnd,
+		"1~": KeyHome, "7~": KeyHome, "4~": KeyEnd, "8~": KeyEnd, "5~": KeyPageUp, "6~": KeyPageDown,
+	}
+)
+
+// readKey reads one key press from the terminal in the raw mode, escape
+// sequences come in one read, a lone escape is the escape key.
+func readKey(r *bufio.Reader) (Key, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return Key{}, err
+	}
+	switch b {
+	case 0x1b:
+		if r.Buffered() == 0 {
+			return Key{Code: KeyEscape}, nil
+		}
+		next, _ := r.ReadByte()
+		if next != '[' && next != 'O' {
+			return Key{Code: KeyEscape}, nil
+		}
+		sequence := []byte{}
+		for r.Buffered() > 0 {
+			c, _ := r.ReadByte()
+			sequence = append(sequence, c)
+			if c >= 0x40 && c <= 0x7e {
+				break
+			}
+		}
+		if code, ok := escapeSequences[string(sequence)]; ok {
+			return Key{Code: code}, nil
+		}
+		return Key{Code: KeyUnknown}, nil
+	case '\r', '\n':
+		return Key{Code: KeyEnter}, nil
+	case 0x7f, 0x08:
+		return Key{Code: KeyBackspace}, nil
+	case '\t':
+		return Key{Code: KeyTab}, nil
+	case 0x03:
+		return Key{Code: KeyInterrupt}, nil
+	}
+	if b < utf8.RuneSelf {
+		return Key{Code: KeyRune, Rune: rune(b)}, nil
+	}
+	r.UnreadByte()
+	c, _, err := r.ReadRune()
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{Code: KeyRune, Rune: c}, nil
+}
+
+func runeWidth(c rune) int {
+	switch width.LookupRune(c).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	}
+	return 1
+}
+
+// fitLine cuts or pads the text to fill exactly the given number of columns.
+func fitLine(text string, columns int) string {
+	result := strings.Builder{}
+	used := 0
+	for _, c := range text {
+		if c == '\t' || c == '\n' || c == '\r' {
+			c = ' '
+		}
+		if c < ' ' {
+			continue
+		}
+		w := runeWidth(c)
+		if used+w > columns {
+			break
+		}
+		result.WriteRune(c)
+		used += w
+	}
+	return result.String() + strings.Repeat(" ", columns-used)
+}
+
+// openFile opens the file with the default application of the system.
+func openFile(name string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", name)
+	case "windows":
+		cmd = exec.Command("cmd", "/c", "start", "", name)
+	default:
+		cmd = exec.Command("xdg-open", name)
+	}
+	return cmd.Start()
+}
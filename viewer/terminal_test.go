@@ -0,0 +1,78 @@
+package viewer
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadKey(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  []Key
+	}{
+		{name: "letters", input: "jké", want: []Key{{Code: KeyRune, Rune: 'j'}, {Code: KeyRune, Rune: 'k'}, {Code: KeyRune, Rune: 'é'}}},
+		{name: "arrows", input: "\x1b[A\x1b[B\x1bOC\x1b[D", want: []Key{{Code: KeyUp}, {Code: KeyDown}, {Code: KeyRight}, {Code: KeyLeft}}},
+		{name: "pages", input: "\x1b[5~\x1b[6~\x1b[1~\x1b[F", want: []Key{{Code: KeyPageUp}, {Code: KeyPageDown}, {Code: KeyHome}, {Code: KeyEnd}}},
+		{name: "control", input: "\r\x7f\t\x03", want: []Key{{Code: KeyEnter}, {Code: KeyBackspace}, {Code: KeyTab}, {Code: KeyInterrupt}}},
+		{name: "unknown sequence", input: "\x1b[15~q", want: []Key{{Code: KeyUnknown}, {Code: KeyRune, Rune: 'q'}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tc.input))
+			got := []Key{}
+			for {
+				key, err := readKey(reader)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Cannot read key: %s", err)
+				}
+				got = append(got, key)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected %v, but got %v", tc.want, got)
+			}
+		})
+	}
+
+	t.Run("escape", func(t *testing.T) {
+		reader := bufio.NewReaderSize(&oneByteReader{data: "\x1b"}, 16)
+		if key, _ := readKey(reader); key.Code != KeyEscape {
+			t.Errorf("Expected escape, but got %v", key)
+		}
+	})
+}
+
+type oneByteReader struct {
+	data string
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, io.EOF
+	}
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func TestFitLine(t *testing.T) {
+	for _, tc := range []struct {
+		text    string
+		columns int
+		want    string
+	}{
+		{text: "abc", columns: 5, want: "abc  "},
+		{text: "abcdef", columns: 4, want: "abcd"},
+		{text: "a\tb\x1b", columns: 4, want: "a b "},
+		{text: "日本語", columns: 5, want: "日本 "},
+	} {
+		if got := fitLine(tc.text, tc.columns); got != tc.want {
+			t.Errorf("Expected %q for %q, but got %q", tc.want, tc.text, got)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package viewer
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"chronicler/common"
+	opb "chronicler/proto"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	textWidth = 80
+	// Reddit sends body_html escaped, so the markup is decoded twice.
+	redditMarkup      = "&lt;div class=\"md\"&gt;"
+	redditSelfMarkup  = "&lt;!-- SC_OFF --&gt;"
+	textQuotePrefix   = "> "
+	textCodePrefix    = "    "
+	textMinimumColumn = 20
+)
+
+var (
+	textBlocks = map[atom.Atom]bool{
+		atom.P: true, atom.Div: true, atom.Li: true, atom.Blockquote: true, atom.Pre: true,
+		atom.Ul: true, atom.Ol: true, atom.Table: true, atom.Hr: true, atom.Figure: true,
+		atom.Section: true, atom.Article: true, atom.Header: true, atom.Footer: true,
+		atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+		atom.Dl: true, atom.Dt: true, atom.Dd: true,
+	}
+	// Attributes with the image url, pikabu keeps the full size image in
+	// data-large-image and loads the preview lazily from data-src.
+	imageAttributes = []string{"data-large-image", "data-src", "src"}
+	// Collapses empty lines, unlike blankLines keeps the indentation after them.
+	emptyLines = regexp.MustCompile(`\n([ \t]*\n)+`)
+)
+
+func attributeValue(attrs []html.Attribute, key string) string {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return strings.TrimSpace(attr.Val)
+		}
+	}
+	return ""
+}
+
+func attribute(n *html.Node, key string) string {
+	return attributeValue(n.Attr, key)
+}
+
+func hasClass(n *html.Node, class string) bool {
+	for _, c := range strings.Fields(attribute(n, "class")) {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func isTextBlock(n *html.Node) bool {
+	return n.Type == html.ElementNode && textBlocks[n.DataAtom]
+}
+
+// wrap wraps every line of the text and drops the spaces around them.
+func wrap(text string, width int) string {
+	lines := strings.Split(common.WrapText(text, max(width, textMinimumColumn)), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	return strings.Join(lines, "\n")
+}
+
+// textWriter renders html as plain text for the terminal, links are replaced
+// with numbered references to the footnotes.
+type textWriter struct {
+	links []string
+}
+
+func (tw *textWriter) footnote(link string) string {
+	for i, l := range tw.links {
+		if l == link {
+			return fmt.Sprintf("[%d]", i+1)
+		}
+	}
+	tw.links = append(tw.links, link)
+	return fmt.Sprintf("[%d]", len(tw.links))
+}
+
+func (tw *textWriter) href(n *html.Node) string {
+	href := attribute(n, "href")
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+		return ""
+	}
+	// Pikabu sends external links through a redirect with the target in "u".
+	if parsed, err := url.Parse(href); err == nil && parsed.Query().Has("u") {
+		if target, err := url.QueryUnescape(parsed.Query().Get("u")); err == nil {
+			return target
+		}
+	}
+	return href
+}
+
+func (tw *textWriter) inlineChildren(n *html.Node) string {
+	result := strings.Builder{}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		result.WriteString(tw.inline(c))
+	}
+	return result.String()
+}
+
+func (tw *textWriter) media(kind string, src string, alt string) string {
+	text := "[" + kind + "]"
+	if alt != "" {
+		text = "[" + kind + ": " + alt + "]"
+	}
+	if src == "" {
+		return text
+	}
+	return text + tw.footnote(src)
+}
+
+func (tw *textWriter) inline(n *html.Node) string {
+	switch n.Type {
+	case html.TextNode:
+		return spaces.ReplaceAllString(n.Data, " ")
+	case html.ElementNode:
+	default:
+		return tw.inlineChildren(n)
+	}
+	if droppedElements[n.Data] {
+		return ""
+	}
+	switch n.DataAtom {
+	case atom.Br:
+		return "\n"
+	case atom.A:
+		text := strings.TrimSpace(tw.inlineChildren(n))
+		href := tw.href(n)
+		// 4chan links to other posts as ">>123", the reply tree shows them.
+		if href == "" || hasClass(n, "quotelink") || text == href {
+			return text
+		}
+		if text == "" {
+			return href
+		}
+		return text + tw.footnote(href)
+	case atom.Img:
+		src := ""
+		for _, key := range imageAttributes {
+			if src = attribute(n, key); src != "" {
+				break
+			}
+		}
+		return tw.media("image", src, attribute(n, "alt"))
+	case atom.Video, atom.Audio:
+		src := attribute(n, "src")
+		for c := n.FirstChild; c != nil && src == ""; c = c.NextSibling {
+			if c.Type == html.ElementNode && c.DataAtom == atom.Source {
+				src = attribute(c, "src")
+			}
+		}
+		return tw.media(n.Data, src, "")
+	case atom.Code:
+		return "`" + rawText(n) + "`"
+	case atom.S:
+		// 4chan marks spoilers with <s>.
+		return "[spoiler: " + strings.TrimSpace(tw.inlineChildren(n)) + "]"
+	case atom.Del, atom.Strike:
+		return "~" + strings.TrimSpace(tw.inlineChildren(n)) + "~"
+	case atom.Span:
+		if hasClass(n, "md-spoiler-text") {
+			return "[spoiler: " + strings.TrimSpace(tw.inlineChildren(n)) + "]"
+		}
+	case atom.Td, atom.Th:
+		return strings.TrimSpace(tw.inlineChildren(n)) + " | "
+	}
+	if isTextBlock(n) {
+		return "\n" + tw.inlineChildren(n) + "\n"
+	}
+	return tw.inlineChildren(n)
+}
+
+func (tw *textWriter) list(n *html.Node, width int) string {
+	items := []string{}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.DataAtom != atom.Li {
+			continue
+		}
+		marker := "- "
+		if n.DataAtom == atom.Ol {
+			marker = fmt.Sprintf("%d. ", len(items)+1)
+		}
+		item := tw.blocks(c, width-len(marker))
+		items = append(items, marker+indent(item, strings.Repeat(" ", len(marker))))
+	}
+	return strings.Join(items, "\n")
+}
+
+func (tw *textWriter) table(n *html.Node) string {
+	rows := []string{}
+	var visit func(n *html.Node)
+	visit = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode && c.DataAtom == atom.Tr {
+				rows = append(rows, strings.TrimSuffix(strings.TrimSpace(tw.inlineChildren(c)), " |"))
+			} else {
+				visit(c)
+			}
+		}
+	}
+	visit(n)
+	return strings.Join(rows, "\n")
+}
+
+func (tw *textWriter) block(n *html.Node, width int) string {
+	switch n.DataAtom {
+	case atom.Pre:
+		return quote(strings.Trim(rawText(n), "\n"), textCodePrefix)
+	case atom.Blockquote:
+		return quote(tw.blocks(n, width-len(textQuotePrefix)), textQuotePrefix)
+	case atom.Ul, atom.Ol:
+		return tw.list(n, width)
+	case atom.Table:
+		return tw.table(n)
+	case atom.Hr:
+		return "* * *"
+	}
+	return tw.blocks(n, width)
+}
+
+// blocks renders the children of the node, inline elements are joined into
+// wrapped paragraphs and the blocks are separated by empty lines.
+func (tw *textWriter) blocks(n *html.Node, width int) string {
+	result := []string{}
+	paragraph := strings.Builder{}
+	flush := func() {
+		lines := strings.Split(paragraph.String(), "\n")
+		for i := range lines {
+			lines[i] = strings.TrimSpace(lines[i])
+		}
+		if text := strings.Trim(strings.Join(lines, "\n"), "\n"); text != "" {
+			result = append(result, wrap(text, width))
+		}
+		paragraph.Reset()
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if !isTextBlock(c) {
+			paragraph.WriteString(tw.inline(c))
+			continue
+		}
+		flush()
+		if text := tw.block(c, width); strings.TrimSpace(text) != "" {
+			result = append(result, text)
+		}
+	}
+	flush()
+	return emptyLines.ReplaceAllString(strings.Join(result, "\n\n"), "\n\n")
+}
+
+// htmlToText renders the saved html as text wrapped to the width, the targets
+// of the links are listed after the text.
+func htmlToText(text string, width int) string {
+	if trimmed := strings.TrimSpace(text); strings.HasPrefix(trimmed, redditMarkup) || strings.HasPrefix(trimmed, redditSelfMarkup) {
+		text = html.UnescapeString(trimmed)
+	}
+	body := &html.Node{Type: html.ElementNode, DataAtom: atom.Body, Data: "body"}
+	nodes, err := html.ParseFragment(strings.NewReader(text), body)
+	if err != nil {
+		return wrap(strings.TrimSpace(text), width)
+	}
+	for _, n := range nodes {
+		body.AppendChild(n)
+	}
+	tw := &textWriter{}
+	result := strings.Builder{}
+	result.WriteString(tw.blocks(body, width))
+	if len(tw.links) > 0 {
+		result.WriteString("\n")
+	}
+	for i, link := range tw.links {
+		result.WriteString(fmt.Sprintf("\n[%d] %s", i+1, link))
+	}
+	return strings.TrimSpace(result.String())
+}
+
+// formatText renders the content for the terminal.
+func formatText(content *opb.Content, width int) string {
+	if strings.HasPrefix(content.Mime, "text/html") {
+		return htmlToText(content.Text, width)
+	}
+	return wrap(strings.TrimSpace(content.Text), width)
+}
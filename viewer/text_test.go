@@ -0,0 +1,114 @@
+package viewer
+
+import (
+	"testing"
+
+	opb "chronicler/proto"
+)
+
+func TestHtmlToText(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		text  string
+		width int
+		want  string
+	}{
+		{
+			name:  "entities",
+			text:  "Tom &amp; Jerry &lt;3 &quot;cheese&quot;",
+			width: 80,
+			want:  `Tom & Jerry <3 "cheese"`,
+		},
+		{
+			name:  "links as footnotes",
+			text:  `<p>See <a href="https://a.com/x">this</a> and <a href="https://b.com">that</a>, <a href="https://a.com/x">again</a></p><p><a href="https://c.com">https://c.com</a></p>`,
+			width: 80,
+			want:  "See this[1] and that[2], again[1]\n\nhttps://c.com\n\n[1] https://a.com/x\n[2] https://b.com",
+		},
+		{
+			name:  "wrapped paragraphs",
+			text:  "<p>one two three four five six seven eight nine ten eleven twelve</p><p>next</p>",
+			width: 25,
+			want:  "one two three four five\nsix seven eight nine\nten eleven twelve\n\nnext",
+		},
+		{
+			name:  "quotes",
+			text:  "<blockquote><p>quoted</p><blockquote>nested</blockquote></blockquote><p>answer</p>",
+			width: 80,
+			want:  "> quoted\n>\n> > nested\n\nanswer",
+		},
+		{
+			name:  "lists",
+			text:  "<ul><li>first</li><li>second<ol><li>inner</li><li>other</li></ol></li></ul>",
+			width: 80,
+			want:  "- first\n- second\n\n  1. inner\n  2. other",
+		},
+		{
+			name:  "code",
+			text:  "<p>run <code>make</code>:</p><pre><code>if x {\n\treturn &lt;-ch\n}</code></pre>",
+			width: 80,
+			want:  "run `make`:\n\n    if x {\n    \treturn <-ch\n    }",
+		},
+		{
+			name:  "scripts dropped",
+			text:  "<script>alert(1)</script><style>p {}</style>text",
+			width: 80,
+			want:  "text",
+		},
+		{
+			name:  "4chan greentext and post links",
+			text:  `<a href="#p123" class="quotelink">&gt;&gt;123</a><br><span class="quote">&gt;be me</span><br><span class="quote">&gt;mfw</span><br><br>text <s>secret</s>`,
+			width: 80,
+			want:  ">>123\n>be me\n>mfw\n\ntext [spoiler: secret]",
+		},
+		{
+			name:  "reddit escaped markup",
+			text:  `&lt;div class="md"&gt;&lt;p&gt;Hello &lt;a href="https://r.com"&gt;link&lt;/a&gt; &lt;span class="md-spoiler-text"&gt;hidden&lt;/span&gt;&lt;/p&gt;&lt;/div&gt;`,
+			width: 80,
+			want:  "Hello link[1] [spoiler: hidden]\n\n[1] https://r.com",
+		},
+		{
+			name:  "pikabu story blocks",
+			text:  `<div class="story-block story-block_type_text"><p>Story <a href="https://pikabu.ru/away?u=https%3A%2F%2Fsite.com%2Fpage">site</a></p></div><div class="story-block story-block_type_image"><figure><img data-src="https://cs.pikabu.ru/small.jpg" data-large-image="https://cs.pikabu.ru/large.jpg" alt="cat"></figure></div>`,
+			width: 80,
+			want:  "Story site[1]\n\n[image: cat][2]\n\n[1] https://site.com/page\n[2] https://cs.pikabu.ru/large.jpg",
+		},
+		{
+			name:  "tables",
+			text:  "<table><tr><th>a</th><th>b</th></tr><tr><td>1</td><td>2</td></tr></table>",
+			width: 80,
+			want:  "a | b\n1 | 2",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := htmlToText(tc.text, tc.width); got != tc.want {
+				t.Errorf("Expected text to be:\n%s\nbut got:\n%s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFormatText(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content *opb.Content
+		want    string
+	}{
+		{
+			name:    "plain text kept",
+			content: &opb.Content{Text: " a <b>not html</b> &amp; \n", Mime: "text/plain"},
+			want:    "a <b>not html</b> &amp;",
+		},
+		{
+			name:    "html rendered",
+			content: &opb.Content{Text: "a <b>bold</b> &amp;", Mime: "text/html; charset=utf-8"},
+			want:    "a bold &",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := formatText(tc.content, textWidth); got != tc.want {
+				t.Errorf("Expected %q, but got %q", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package viewer
+
+import (
+	"sort"
+
+	opb "chronicler/proto"
+)
+
+// Node is an object in the reply tree built from Object.Parent.
+type Node struct {
+	Object   *opb.Object
+	Depth    int
+	Children []*Node
+}
+
+func createdAt(obj *opb.Object) int64 {
+	if obj.CreatedAt == nil {
+		return 0
+	}
+	return obj.CreatedAt.Seconds
+}
+
+// BuildThread arranges objects into the reply tree, objects with unknown
+// parents become roots. Roots keep the snapshot order, replies are sorted
+// by creation time.
+func BuildThread(objects []*opb.Object) []*Node {
+	nodes := []*Node{}
+	byId := map[string]*Node{}
+	for _, obj := range objects {
+		node := &Node{Object: obj}
+		nodes = append(nodes, node)
+		if _, ok := byId[obj.Id]; !ok {
+			byId[obj.Id] = node
+		}
+	}
+	roots := []*Node{}
+	for _, node := range nodes {
+		parent, ok := byId[node.Object.Parent]
+		if node.Object.Parent == "" || !ok || parent == node {
+			roots = append(roots, node)
+			continue
+		}
+		parent.Children = append(parent.Children, node)
+	}
+
+	visited := map[*Node]bool{}
+	var setDepth func(nodes []*Node, depth int)
+	setDepth = func(nodes []*Node, depth int) {
+		for _, node := range nodes {
+			visited[node] = true
+			node.Depth = depth
+			sort.SliceStable(node.Children, func(i, j int) bool {
+				return createdAt(node.Children[i].Object) < createdAt(node.Children[j].Object)
+			})
+			setDepth(node.Children, depth+1)
+		}
+	}
+	setDepth(roots, 0)
+	// Objects replying to each other in a loop are not reachable from roots
+	for _, node := range nodes {
+		if !visited[node] {
+			for _, parent := range nodes {
+				parent.Children = removeNode(parent.Children, node)
+			}
+			roots = append(roots, node)
+			setDepth([]*Node{node}, 0)
+		}
+	}
+	return roots
+}
+
+func removeNode(nodes []*Node, node *Node) []*Node {
+	for i, n := range nodes {
+		if n == node {
+			return append(nodes[:i], nodes[i+1:]...)
+		}
+	}
+	return nodes
+}
+
+// Walk visits nodes depth-first, parents before their replies.
+func Walk(nodes []*Node, visit func(node *Node)) {
+	for _, node := range nodes {
+		visit(node)
+		Walk(node.Children, visit)
+	}
+}
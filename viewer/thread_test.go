@@ -0,0 +1,68 @@
+package viewer
+
+import (
+	"reflect"
+	"testing"
+
+	opb "chronicler/proto"
+)
+
+type walked struct {
+	Id    string
+	Depth int
+}
+
+func walkThread(objects []*opb.Object) []walked {
+	result := []walked{}
+	Walk(BuildThread(objects), func(node *Node) {
+		result = append(result, walked{node.Object.Id, node.Depth})
+	})
+	return result
+}
+
+func TestBuildThread(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		objects []*opb.Object
+		want    []walked
+	}{
+		{
+			name:    "empty",
+			objects: []*opb.Object{},
+			want:    []walked{},
+		},
+		{
+			name: "replies sorted by time",
+			objects: []*opb.Object{
+				{Id: "post"},
+				{Id: "late", Parent: "post", CreatedAt: &opb.Timestamp{Seconds: 20}},
+				{Id: "early", Parent: "post", CreatedAt: &opb.Timestamp{Seconds: 10}},
+				{Id: "reply", Parent: "early"},
+			},
+			want: []walked{{"post", 0}, {"early", 1}, {"reply", 2}, {"late", 1}},
+		},
+		{
+			name: "unknown parent",
+			objects: []*opb.Object{
+				{Id: "1"},
+				{Id: "2", Parent: "deleted"},
+			},
+			want: []walked{{"1", 0}, {"2", 0}},
+		},
+		{
+			name: "loop",
+			objects: []*opb.Object{
+				{Id: "1", Parent: "2"},
+				{Id: "2", Parent: "1"},
+				{Id: "3", Parent: "3"},
+			},
+			want: []walked{{"3", 0}, {"1", 0}, {"2", 1}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := walkThread(tc.objects); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected %v, but got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -6,11 +6,7 @@ import (
 	opb "chronicler/proto"
 	"chronicler/storage"
 	"fmt"
-	"path/filepath"
-	"regexp"
-	"sort"
 	"strings"
-	"time"
 )
 
 const (
@@ -18,88 +14,101 @@ const (
 )
 
 type Viewer struct {
-	Root string
+	Storages storage.Provider
+	// Only the selected objects are shown
+	Query ThreadQuery
 
 	logger *common.Logger
 }
 
-func NewViewer(root string) *Viewer {
+func NewViewer(storages storage.Provider) *Viewer {
 	return &Viewer{
-		Root:   root,
-		logger: common.NewLogger("viewer"),
+		Storages: storages,
+		logger:   common.NewLogger("viewer"),
 	}
 }
 
-func formatObject(obj *opb.Object, prefix int) string {
-	result := strings.Builder{}
-	t := time.Unix(obj.CreatedAt.Seconds, int64(obj.CreatedAt.Nanos))
-	result.WriteString(fmt.Sprintf("‣ [%s] %s: ", t.Format("2006-01-02 15:04"), obj.Generator[0].Name))
-	for _, c := range obj.Content {
-		txt := regexp.MustCompilePOSIX("[\n\t]*").ReplaceAllString(c.Text, "")
-		txt = regexp.MustCompilePOSIX("(<br>|</p>)+").ReplaceAllString(txt, "\n")
-		txt = regexp.MustCompilePOSIX("<[^>]*>").ReplaceAllString(txt, " ")
-		result.WriteString(strings.TrimSpace(txt) + "\n")
+// objectHeader has the time, author and stats of the object, which ones
+// are known.
+func objectHeader(obj *opb.Object) string {
+	header := []string{}
+	if t := formatTime(obj.CreatedAt); t != "" {
+		header = append(header, "["+t+"]")
 	}
-	prefixStr := ""
-	for range prefix {
-		prefixStr += "    "
+	if len(obj.Generator) > 0 {
+		header = append(header, authorName(obj))
 	}
-	lines := strings.Split(common.WrapText(result.String(), 80), "\n")
-	for i := range lines {
-		lines[i] = prefixStr + "   " + strings.TrimSpace(lines[i])
+	if len(header) == 0 && obj.Id != "" {
+		header = append(header, obj.Id)
+	}
+	result := "‣ " + strings.Join(header, " ")
+	if stats := formatStats(obj.Stats); len(stats) > 0 {
+		result += " · " + strings.Join(stats, " · ")
+	}
+	return result
+}
+
+// formatObject renders the object for the terminal, files are the stored
+// attachments by url.
+func formatObject(obj *opb.Object, prefix int, files map[string]storage.StorageItem) string {
+	lines := []string{objectHeader(obj)}
+	for _, c := range obj.Content {
+		if text := formatText(c, textWidth); text != "" {
+			lines = append(lines, strings.Split(text, "\n")...)
+		}
+	}
+	if len(obj.Tag) > 0 {
+		tags := []string{}
+		for _, tag := range obj.Tag {
+			tags = append(tags, "#"+tag.Name)
+		}
+		lines = append(lines, "Tags: "+strings.Join(tags, " "))
 	}
-	from := 0
-	to := 0
-	total := len(lines)
-	for i := 0; i < total/2; i++ {
-		if lines[i] == "" && (i == 0 || i == from+1) {
-			from = i
+	for i, a := range obj.Attachment {
+		line := fmt.Sprintf("Attachment %d: %s", i+1, a.Url)
+		if a.Mime != "" {
+			line += " (" + a.Mime + ")"
 		}
-		if lines[total-i-1] == "" && (i == 0 || i == to+1) {
-			to = i
+		if file, ok := files[a.Url]; !ok {
+			line += ", not saved"
+		} else if file.Name != "" {
+			line += fmt.Sprintf(", saved as %s, %d bytes", file.Name, file.Size)
+		} else {
+			line += fmt.Sprintf(", saved, %d bytes", file.Size)
 		}
+		lines = append(lines, line)
 	}
-	return strings.Join(lines[from:total-to-1], "\n")
+	prefixStr := strings.Repeat("    ", prefix)
+	for i := range lines {
+		lines[i] = strings.TrimRight(prefixStr+"   "+lines[i], " ")
+	}
+	return strings.Join(lines, "\n")
 }
 
 func (v *Viewer) View(id string) error {
 	store := storage.BlockStorage{
-		Storage: iferr.Exit(storage.NewLocalStorage(filepath.Join(v.Root, id))),
+		Storage: iferr.Exit(v.Storages.Open(id)),
 	}
 
-	result := &opb.Snapshot{}
-	if err := store.GetObject(&storage.GetRequest{Url: objectFileName}, &result); err != nil {
+	result, err := store.GetSnapshot(&storage.GetRequest{Url: objectFileName})
+	if err != nil {
 		return err
 	}
 
-	objByParent := map[string]([]*opb.Object){}
-	objById := map[string]*opb.Object{}
-	for _, obj := range result.Objects {
-		if _, ok := objByParent[obj.Parent]; !ok {
-			objByParent[obj.Parent] = []*opb.Object{}
-		}
-		objByParent[obj.Parent] = append(objByParent[obj.Parent], obj)
-		objById[obj.Id] = obj
+	thread, err := v.Query.Select(BuildThread(result.Objects))
+	if err != nil {
+		return err
 	}
-	toVisit := append([]*opb.Object{}, objByParent[""]...)
-	for len(toVisit) > 0 {
-		obj := toVisit[0]
-		toVisit = toVisit[1:]
-		prefix := 0
-
-		p := obj.Parent
-		for ; p != ""; prefix++ {
-			p = objById[p].Parent
-		}
-		fmt.Println(formatObject(obj, prefix))
-		children := objByParent[obj.Id]
-		if len(children) == 0 {
-			continue
-		}
-		sort.Slice(children, func(i, j int) bool {
-			return children[i].CreatedAt.Seconds < children[j].CreatedAt.Seconds
-		})
-		toVisit = append(children, toVisit...)
+	list, err := store.List(&storage.ListRequest{WithFiles: true})
+	if err != nil {
+		return err
+	}
+	files := map[string]storage.StorageItem{}
+	for _, item := range list.Items {
+		files[item.Url] = item
 	}
+	Walk(thread, func(node *Node) {
+		fmt.Println(formatObject(node.Object, node.Depth, files))
+	})
 	return nil
 }
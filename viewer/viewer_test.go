@@ -2,7 +2,99 @@ package viewer
 
 import (
 	"testing"
+	"time"
+
+	opb "chronicler/proto"
+	"chronicler/storage"
 )
 
 func TestViewer(t *testing.T) {
 }
+
+func TestFormatObject(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 0, 0, time.Local)
+	createdAt := &opb.Timestamp{Seconds: created.Unix()}
+	for _, tc := range []struct {
+		name   string
+		obj    *opb.Object
+		prefix int
+		files  map[string]storage.StorageItem
+		want   string
+	}{
+		{
+			name: "html content",
+			obj: &opb.Object{
+				CreatedAt: createdAt,
+				Generator: []*opb.Generator{{Name: "anon"}},
+				Content: []*opb.Content{{
+					Text: `<span class="quote">&gt;greentext</span><br>see <a href="https://a.com">here</a>`,
+					Mime: "text/html",
+				}},
+			},
+			want: "   ‣ [2024-01-02 03:04] anon\n" +
+				"   >greentext\n   see here[1]\n\n   [1] https://a.com",
+		},
+		{
+			name: "reply indented",
+			obj: &opb.Object{
+				CreatedAt: createdAt,
+				Generator: []*opb.Generator{{Name: "someone"}},
+				Content:   []*opb.Content{{Text: "plain\ntext", Mime: "text/plain"}},
+			},
+			prefix: 1,
+			want: "       ‣ [2024-01-02 03:04] someone\n" +
+				"       plain\n       text",
+		},
+		{
+			name: "stats, tags and attachments",
+			obj: &opb.Object{
+				CreatedAt: createdAt,
+				Generator: []*opb.Generator{{Id: "u1"}},
+				Content:   []*opb.Content{{Text: "text"}},
+				Stats: []*opb.Stats{
+					{Type: opb.Stats_UPVOTE, Counter: 10},
+					{Type: opb.Stats_DOWNVOTE, Counter: 2},
+					{Type: opb.Stats_RATING, Counter: 8},
+				},
+				Tag: []*opb.Tag{{Name: "news"}, {Name: "go"}},
+				Attachment: []*opb.Attachment{
+					{Url: "http://some/image.jpg", Mime: "image/jpeg"},
+					{Url: "http://some/video.mp4"},
+					{Url: "http://some/memory.png"},
+				},
+			},
+			files: map[string]storage.StorageItem{
+				"http://some/image.jpg":  {Url: "http://some/image.jpg", Name: "http___some_image.jpg_0123456789abcdef.jpg", Size: 1234},
+				"http://some/memory.png": {Url: "http://some/memory.png", Size: 5},
+			},
+			want: "   ‣ [2024-01-02 03:04] u1 · upvote 10 · downvote 2 · rating 8\n" +
+				"   text\n" +
+				"   Tags: #news #go\n" +
+				"   Attachment 1: http://some/image.jpg (image/jpeg), saved as http___some_image.jpg_0123456789abcdef.jpg, 1234 bytes\n" +
+				"   Attachment 2: http://some/video.mp4, not saved\n" +
+				"   Attachment 3: http://some/memory.png, saved, 5 bytes",
+		},
+		{
+			name: "web page without author and time",
+			obj: &opb.Object{
+				Id:      "http://some/page",
+				Content: []*opb.Content{{Text: "<p>page</p>", Mime: "text/html"}},
+			},
+			want: "   ‣ http://some/page\n   page",
+		},
+		{
+			name: "empty generator",
+			obj: &opb.Object{
+				CreatedAt: &opb.Timestamp{},
+				Generator: []*opb.Generator{{}},
+			},
+			want: "   ‣ ?",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := formatObject(tc.obj, tc.prefix, tc.files); got != tc.want {
+				t.Errorf("Expected object to be:\n%s\nbut got:\n%s", tc.want, got)
+			}
+		})
+	}
+}